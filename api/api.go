@@ -17,10 +17,18 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/onitake/restreamer/auth"
+	"github.com/onitake/restreamer/configuration"
 	"github.com/onitake/restreamer/metrics"
+	"github.com/onitake/restreamer/streaming"
+	"html/template"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // connectChecker represents a type that can report its "connected" status.
@@ -28,29 +36,148 @@ type connectChecker interface {
 	Connected() bool
 }
 
+// demandChecker is an optional extension of connectChecker for on-demand streams.
+type demandChecker interface {
+	// OnDemandState returns "standby" if the stream is on-demand and disconnected
+	// because nobody is watching, or something else otherwise.
+	OnDemandState() string
+}
+
+// deadChecker is an optional extension of connectChecker for streams that can give up reconnecting.
+type deadChecker interface {
+	// Dead returns true if the stream has given up reconnecting.
+	Dead() bool
+}
+
+// bufferingChecker is an optional extension of connectChecker for streams with a pre-roll.
+type bufferingChecker interface {
+	// Buffering returns true while a new connection is filling its pre-roll.
+	Buffering() bool
+}
+
+// breakerChecker is an optional extension of connectChecker for streams with a circuit breaker.
+type breakerChecker interface {
+	// BreakerState returns closed, open or half-open, or the empty string if there is no breaker.
+	BreakerState() string
+}
+
+// apiError is the body of an API error response.
+type apiError struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// apiStatus is the body of an API response that carries no data.
+type apiStatus struct {
+	Status string `json:"status"`
+	Code   int    `json:"code"`
+}
+
+// writeResponse serializes a response body to JSON and sends it with the given status code.
+func writeResponse(writer http.ResponseWriter, status int, body interface{}) {
+	response, err := json.Marshal(body)
+	if err != nil {
+		logger.Logkv(
+			"event", eventApiError,
+			"error", errorApiJsonEncode,
+			"message", err.Error(),
+		)
+		// this can't fail
+		status = http.StatusInternalServerError
+		response, _ = json.Marshal(&apiError{
+			Error: strings.ToLower(http.StatusText(status)),
+			Code:  status,
+		})
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if _, err := writer.Write(response); err != nil {
+		logger.Logkv(
+			"event", eventApiError,
+			"error", errorApiWrite,
+			"message", err.Error(),
+		)
+	}
+}
+
+// writeError sends a JSON error response with the standard description of the status code.
+func writeError(writer http.ResponseWriter, status int) {
+	writeResponse(writer, status, &apiError{
+		Error: strings.ToLower(http.StatusText(status)),
+		Code:  status,
+	})
+}
+
+// writeStatus sends a JSON status response with the standard description of the status code.
+func writeStatus(writer http.ResponseWriter, status int) {
+	writeResponse(writer, status, &apiStatus{
+		Status: strings.ToLower(http.StatusText(status)),
+		Code:   status,
+	})
+}
+
+// writeText sends a plain text response like "404 not found".
+func writeText(writer http.ResponseWriter, status int) {
+	writeTextMessage(writer, status, strings.ToLower(http.StatusText(status)))
+}
+
+// writeTextMessage sends a plain text response with a custom message, like "200 standby".
+func writeTextMessage(writer http.ResponseWriter, status int, message string) {
+	writer.Header().Set("Content-Type", "text/plain")
+	writer.WriteHeader(status)
+	if _, err := writer.Write([]byte(fmt.Sprintf("%d %s", status, message))); err != nil {
+		logger.Logkv(
+			"event", eventApiError,
+			"error", errorApiWrite,
+			"message", err.Error(),
+		)
+	}
+}
+
 // healthApi encapsulates a system status object and
 // provides an HTTP/JSON handler for reporting system health.
 type healthApi struct {
 	stats metrics.Statistics
+	// full is the number of global connections at which the status is reported as full, 0 to disable
+	full uint
+	// fullPercent is the connection usage in percent of the limits at which the status is reported as full,
+	// 0 to disable
+	fullPercent uint
 	// auth is an authentication verifier for client requests
 	auth auth.Authenticator
 }
 
 // NewHealthApi creates a new health API object,
 // serving data from a system Statistics object.
-func NewHealthApi(stats metrics.Statistics, auth auth.Authenticator) http.Handler {
+//
+// In addition to the connection limits, the status is reported as full when the
+// total number of connections reaches full, or when a stream or the whole server
+// uses fullPercent percent of its hard limit (or its soft limit, if there is no hard limit).
+// These thresholds only affect the health status, not admission. 0 disables them.
+func NewHealthApi(stats metrics.Statistics, full uint, fullPercent uint, auth auth.Authenticator) http.Handler {
 	return &healthApi{
-		stats: stats,
-		auth:  auth,
+		stats:       stats,
+		full:        full,
+		fullPercent: fullPercent,
+		auth:        auth,
 	}
 }
 
+// thresholdReached tells if the connections of stats have reached the percentage threshold.
+func (api *healthApi) thresholdReached(stats *metrics.StreamStatistics) bool {
+	if api.fullPercent == 0 {
+		return false
+	}
+	limit := stats.MaxConnections
+	if limit <= 0 {
+		limit = stats.FullConnections
+	}
+	return limit > 0 && stats.Connections*100 >= limit*int64(api.fullPercent)
+}
+
 // ServeHTTP is the http handler method.
 // It sends back information about system health.
 func (api *healthApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	// set the content type for all responses
-	writer.Header().Add("Content-Type", "application/json")
-
 	// fail-fast: verify that this user can access this resource first
 	if !auth.HandleHttpAuthentication(api.auth, request, writer) {
 		return
@@ -65,43 +192,26 @@ func (api *healthApi) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 		Bandwidth int    `json:"bandwidth"`
 	}
 	// report for both hard and soft, respecting disabled limits
-	if global.MaxConnections != 0 && global.Connections >= global.MaxConnections {
+	stats.Status = "ok"
+	if limitReached(global) || api.thresholdReached(global) {
 		stats.Status = "full"
-	} else if global.FullConnections != 0 && global.Connections >= global.FullConnections {
+	}
+	// drain before the limits are reached, if configured
+	if api.full > 0 && global.Connections >= int64(api.full) {
 		stats.Status = "full"
-	} else {
-		stats.Status = "ok"
+	}
+	// streams with their own limits make the server full as well
+	for _, stream := range api.stats.GetAllStreamStatistics() {
+		if limitReached(stream) || api.thresholdReached(stream) {
+			stats.Status = "full"
+		}
 	}
 	stats.Viewer = int(global.Connections)
 	stats.Limit = int(global.FullConnections)
 	stats.Max = int(global.MaxConnections)
 	stats.Bandwidth = int(global.BytesPerSecondSent * 8 / 1024) // kbit/s
 
-	response, err := json.Marshal(&stats)
-	if err == nil {
-		writer.WriteHeader(http.StatusOK)
-		if _, err := writer.Write(response); err != nil {
-			logger.Logkv(
-				"event", eventApiError,
-				"error", errorApiWrite,
-				"message", err.Error(),
-			)
-		}
-	} else {
-		writer.WriteHeader(http.StatusInternalServerError)
-		if _, err := writer.Write([]byte(http.StatusText(http.StatusInternalServerError))); err != nil {
-			logger.Logkv(
-				"event", eventApiError,
-				"error", errorApiWrite,
-				"message", err.Error(),
-			)
-		}
-		logger.Logkv(
-			"event", eventApiError,
-			"error", errorApiJsonEncode,
-			"message", err.Error(),
-		)
-	}
+	writeResponse(writer, http.StatusOK, &stats)
 }
 
 // statisticsApi encapsulates a system status object and
@@ -121,87 +231,300 @@ func NewStatisticsApi(stats metrics.Statistics, auth auth.Authenticator) http.Ha
 	}
 }
 
+// statisticsObject is the JSON representation of a StreamStatistics object.
+type statisticsObject struct {
+	Status                   string `json:"status,omitempty"`
+	Connected                bool   `json:"connected"`
+	Connections              int    `json:"connections"`
+	PeakConnections          int    `json:"peak_connections"`
+	MaxConnections           int    `json:"max_connections"`
+	FullConnections          int    `json:"full_connections"`
+	TotalPacketsReceived     uint64 `json:"total_packets_received"`
+	TotalPacketsSent         uint64 `json:"total_packets_sent"`
+	TotalPacketsDropped      uint64 `json:"total_packets_dropped"`
+	TotalBytesReceived       uint64 `json:"total_bytes_received"`
+	TotalBytesSent           uint64 `json:"total_bytes_sent"`
+	TotalBytesDropped        uint64 `json:"total_bytes_dropped"`
+	TotalStreamTime          int64  `json:"total_stream_time_ns"`
+	PacketsPerSecondReceived uint64 `json:"packets_per_second_received"`
+	PacketsPerSecondSent     uint64 `json:"packets_per_second_sent"`
+	PacketsPerSecondDropped  uint64 `json:"packets_per_second_dropped"`
+	BytesPerSecondReceived   uint64 `json:"bytes_per_second_received"`
+	BytesPerSecondSent       uint64 `json:"bytes_per_second_sent"`
+	BytesPerSecondDropped    uint64 `json:"bytes_per_second_dropped"`
+	// Pids is keyed by the decimal PID
+	Pids map[uint16]*pidObject `json:"pids,omitempty"`
+}
+
+// pidObject is the JSON representation of a PidStatistics object.
+type pidObject struct {
+	Packets        uint64 `json:"packets"`
+	Bytes          uint64 `json:"bytes"`
+	BytesPerSecond uint64 `json:"bytes_per_second"`
+}
+
+// limitStatus reports "overload" if the hard connection limit is reached,
+// "full" if the soft limit is reached and "ok" otherwise.
+// Returns an empty string if neither limit is set.
+func limitStatus(stats *metrics.StreamStatistics) string {
+	switch {
+	case stats.MaxConnections != 0 && stats.Connections >= stats.MaxConnections:
+		return "overload"
+	case stats.FullConnections != 0 && stats.Connections >= stats.FullConnections:
+		return "full"
+	case stats.MaxConnections == 0 && stats.FullConnections == 0:
+		return ""
+	default:
+		return "ok"
+	}
+}
+
+// limitReached tells if the soft or the hard connection limit is reached.
+func limitReached(stats *metrics.StreamStatistics) bool {
+	status := limitStatus(stats)
+	return status == "full" || status == "overload"
+}
+
+// newStatisticsObject converts statistics into their JSON representation.
+// The status is omitted if it is empty.
+// Averaged rates are added with dynamic names, like bytes_per_second_sent_1m.
+func newStatisticsObject(status string, global *metrics.StreamStatistics) mergedObject {
+	stats := &statisticsObject{
+		Status:                   status,
+		Connected:                global.Connected,
+		Connections:              int(global.Connections),
+		PeakConnections:          int(global.PeakConnections),
+		MaxConnections:           int(global.MaxConnections),
+		FullConnections:          int(global.FullConnections),
+		TotalPacketsReceived:     global.TotalPacketsReceived,
+		TotalPacketsSent:         global.TotalPacketsSent,
+		TotalPacketsDropped:      global.TotalPacketsDropped,
+		TotalBytesReceived:       global.TotalBytesReceived,
+		TotalBytesSent:           global.TotalBytesSent,
+		TotalBytesDropped:        global.TotalBytesDropped,
+		TotalStreamTime:          global.TotalStreamTime,
+		PacketsPerSecondReceived: global.PacketsPerSecondReceived,
+		PacketsPerSecondSent:     global.PacketsPerSecondSent,
+		PacketsPerSecondDropped:  global.PacketsPerSecondDropped,
+		BytesPerSecondReceived:   global.BytesPerSecondReceived,
+		BytesPerSecondSent:       global.BytesPerSecondSent,
+		BytesPerSecondDropped:    global.BytesPerSecondDropped,
+	}
+	if len(global.Pids) > 0 {
+		stats.Pids = make(map[uint16]*pidObject, len(global.Pids))
+		for pid, traffic := range global.Pids {
+			stats.Pids[pid] = &pidObject{
+				Packets:        traffic.Packets,
+				Bytes:          traffic.Bytes,
+				BytesPerSecond: traffic.BytesPerSecond,
+			}
+		}
+	}
+
+	windows := make(map[string]uint64, len(global.Windows)*6)
+	for name, rate := range global.Windows {
+		windows["packets_per_second_received_"+name] = rate.PacketsPerSecondReceived
+		windows["packets_per_second_sent_"+name] = rate.PacketsPerSecondSent
+		windows["packets_per_second_dropped_"+name] = rate.PacketsPerSecondDropped
+		windows["bytes_per_second_received_"+name] = rate.BytesPerSecondReceived
+		windows["bytes_per_second_sent_"+name] = rate.BytesPerSecondSent
+		windows["bytes_per_second_dropped_"+name] = rate.BytesPerSecondDropped
+	}
+
+	return mergedObject{stats, windows}
+}
+
 // ServeHTTP is the http handler method.
 // It sends back information about system health.
+//
+// The query parameter fields can be used to select a comma-separated list of fields.
+// Unknown field names are ignored.
+// If the streams parameter is given, the statistics of the listed streams are added
+// as an object under the key "streams". The same field selection applies.
+// Unknown streams are ignored.
 func (api *statisticsApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	// set the content type for all responses
-	writer.Header().Add("Content-Type", "application/json")
-
 	// fail-fast: verify that this user can access this resource first
 	if !auth.HandleHttpAuthentication(api.auth, request, writer) {
 		return
 	}
 
+	query := request.URL.Query()
+	var fields []string
+	if query.Has("fields") {
+		fields = splitList(query.Get("fields"))
+	}
+
 	global := api.stats.GetGlobalStatistics()
-	var stats struct {
-		Status                   string `json:"status"`
-		Connections              int    `json:"connections"`
-		MaxConnections           int    `json:"max_connections"`
-		FullConnections          int    `json:"full_connections"`
-		TotalPacketsReceived     uint64 `json:"total_packets_received"`
-		TotalPacketsSent         uint64 `json:"total_packets_sent"`
-		TotalPacketsDropped      uint64 `json:"total_packets_dropped"`
-		TotalBytesReceived       uint64 `json:"total_bytes_received"`
-		TotalBytesSent           uint64 `json:"total_bytes_sent"`
-		TotalBytesDropped        uint64 `json:"total_bytes_dropped"`
-		TotalStreamTime          int64  `json:"total_stream_time_ns"`
-		PacketsPerSecondReceived uint64 `json:"packets_per_second_received"`
-		PacketsPerSecondSent     uint64 `json:"packets_per_second_sent"`
-		PacketsPerSecondDropped  uint64 `json:"packets_per_second_dropped"`
-		BytesPerSecondReceived   uint64 `json:"bytes_per_second_received"`
-		BytesPerSecondSent       uint64 `json:"bytes_per_second_sent"`
-		BytesPerSecondDropped    uint64 `json:"bytes_per_second_dropped"`
+	status := limitStatus(global)
+	if status == "" {
+		status = "ok"
 	}
-	// report for both hard and soft, respecting disabled limits
-	if global.MaxConnections != 0 && global.Connections >= global.MaxConnections {
-		stats.Status = "overload"
-	} else if global.FullConnections != 0 && global.Connections >= global.FullConnections {
-		stats.Status = "full"
-	} else {
-		stats.Status = "ok"
-	}
-	stats.Connections = int(global.Connections)
-	stats.MaxConnections = int(global.MaxConnections)
-	stats.FullConnections = int(global.FullConnections)
-	stats.TotalPacketsReceived = global.TotalPacketsReceived
-	stats.TotalPacketsSent = global.TotalPacketsSent
-	stats.TotalPacketsDropped = global.TotalPacketsDropped
-	stats.TotalBytesReceived = global.TotalBytesReceived
-	stats.TotalBytesSent = global.TotalBytesSent
-	stats.TotalBytesDropped = global.TotalBytesDropped
-	stats.TotalStreamTime = global.TotalStreamTime
-	stats.PacketsPerSecondReceived = global.PacketsPerSecondReceived
-	stats.PacketsPerSecondSent = global.PacketsPerSecondSent
-	stats.PacketsPerSecondDropped = global.PacketsPerSecondDropped
-	stats.BytesPerSecondReceived = global.BytesPerSecondReceived
-	stats.BytesPerSecondSent = global.BytesPerSecondSent
-	stats.BytesPerSecondDropped = global.BytesPerSecondDropped
-
-	response, err := json.Marshal(&stats)
-	if err == nil {
-		writer.WriteHeader(http.StatusOK)
-		if _, err := writer.Write(response); err != nil {
-			logger.Logkv(
-				"event", eventApiError,
-				"error", errorApiWrite,
-				"message", err.Error(),
-			)
+
+	response := filteredObject{newStatisticsObject(status, global), fields}
+	if query.Has("streams") {
+		all := api.stats.GetAllStreamStatistics()
+		streams := make(map[string]filteredObject)
+		for _, name := range splitList(query.Get("streams")) {
+			if stream, ok := all[name]; ok {
+				streams[name] = filteredObject{newStatisticsObject(limitStatus(stream), stream), fields}
+			}
+		}
+		var list struct {
+			Streams map[string]filteredObject `json:"streams"`
+		}
+		list.Streams = streams
+		// the stream list is always included when requested
+		response = filteredObject{mergedObject{response, &list}, nil}
+	}
+
+	writeResponse(writer, http.StatusOK, &response)
+}
+
+// splitList splits a comma-separated list and removes empty elements.
+func splitList(list string) []string {
+	var elements []string
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+// filteredObject is a value that encodes to a JSON object,
+// restricted to a list of keys.
+type filteredObject struct {
+	// value is the object to encode
+	value interface{}
+	// fields is the list of keys to retain. If it is nil, all keys are kept.
+	fields []string
+}
+
+// MarshalJSON encodes the object and removes all keys not in the field list.
+func (filtered filteredObject) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(filtered.value)
+	if err != nil || filtered.fields == nil {
+		return data, err
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]json.RawMessage, len(filtered.fields))
+	for _, field := range filtered.fields {
+		if value, ok := object[field]; ok {
+			selected[field] = value
+		}
+	}
+	return json.Marshal(selected)
+}
+
+// mergedObject is a list of values that are serialized into a single JSON object.
+// Each value must encode to a JSON object. Duplicate keys are not detected.
+type mergedObject []interface{}
+
+// MarshalJSON concatenates the members of all objects.
+func (merged mergedObject) MarshalJSON() ([]byte, error) {
+	result := []byte{'{'}
+	for _, value := range merged {
+		object, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(object) < 2 || object[0] != '{' || object[len(object)-1] != '}' {
+			return nil, fmt.Errorf("api: cannot merge non-object %s", object)
+		}
+		members := object[1 : len(object)-1]
+		if len(members) == 0 {
+			continue
 		}
+		if len(result) > 1 {
+			result = append(result, ',')
+		}
+		result = append(result, members...)
+	}
+	return append(result, '}'), nil
+}
+
+// peakResetApi allows clearing the connection high-water marks.
+type peakResetApi struct {
+	stats metrics.Statistics
+	// auth is an authentication verifier for client requests
+	auth auth.Authenticator
+}
+
+// NewPeakResetApi creates a new API object that resets the peak connection
+// counters of a system Statistics object.
+func NewPeakResetApi(stats metrics.Statistics, auth auth.Authenticator) http.Handler {
+	return &peakResetApi{
+		stats: stats,
+		auth:  auth,
+	}
+}
+
+// ServeHTTP is the http handler method.
+// It resets the peak connection counters to the current number of connections.
+func (api *peakResetApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// fail-fast: verify that this user can access this resource first
+	if !auth.HandleHttpAuthentication(api.auth, request, writer) {
+		return
+	}
+
+	api.stats.ResetPeakConnections()
+	writeStatus(writer, http.StatusAccepted)
+}
+
+// statisticsResetApi allows clearing the totals of some or all streams.
+type statisticsResetApi struct {
+	stats metrics.Statistics
+	// auth is an authentication verifier for client requests
+	auth auth.Authenticator
+}
+
+// NewStatisticsResetApi creates a new API object that resets the packet, byte
+// and duration totals of a system Statistics object.
+func NewStatisticsResetApi(stats metrics.Statistics, auth auth.Authenticator) http.Handler {
+	return &statisticsResetApi{
+		stats: stats,
+		auth:  auth,
+	}
+}
+
+// ServeHTTP is the http handler method.
+// It resets the statistics of the streams listed in the query parameter streams=/a,/b,
+// or of all streams if it isn't given. Connection counts are not affected.
+// If any of the streams doesn't exist, nothing is reset and 404 is returned.
+func (api *statisticsResetApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// fail-fast: verify that this user can access this resource first
+	if !auth.HandleHttpAuthentication(api.auth, request, writer) {
+		return
+	}
+
+	// the user name is only available with basic authentication
+	user, _, _ := request.BasicAuth()
+	streams := splitList(request.URL.Query().Get("streams"))
+	if len(streams) == 0 {
+		api.stats.ResetAllStatistics()
 	} else {
-		writer.WriteHeader(http.StatusInternalServerError)
-		if _, err := writer.Write([]byte(http.StatusText(http.StatusInternalServerError))); err != nil {
-			logger.Logkv(
-				"event", eventApiError,
-				"error", errorApiWrite,
-				"message", err.Error(),
-			)
+		all := api.stats.GetAllStreamStatistics()
+		for _, name := range streams {
+			if _, ok := all[name]; !ok {
+				writeError(writer, http.StatusNotFound)
+				return
+			}
+		}
+		for _, name := range streams {
+			api.stats.ResetStreamStatistics(name)
 		}
-		logger.Logkv(
-			"event", eventApiError,
-			"error", errorApiJsonEncode,
-			"message", err.Error(),
-		)
 	}
+	logger.Logkv(
+		"event", eventApiStatsReset,
+		"remote", request.RemoteAddr,
+		"user", user,
+		"streams", streams,
+		"message", fmt.Sprintf("Statistics of %v reset by %s (user %q)", streams, request.RemoteAddr, user),
+	)
+	writeStatus(writer, http.StatusAccepted)
 }
 
 // streamStatApi provides an API for checking stream availability.
@@ -225,34 +548,86 @@ func NewStreamStateApi(client connectChecker, auth auth.Authenticator) http.Hand
 // ServeHTTP is the http handler method.
 // It sends back "200 ok" if the stream is connected and "404 not found" if not,
 // along with the corresponding HTTP status code.
+// On-demand streams that are disconnected because nobody is watching report "200 standby".
+// Streams that have given up reconnecting report "410 dead".
+// Streams that are connected, but still filling their pre-roll, report "503 buffering".
+// If the stream has a circuit breaker, its state is added to JSON responses under the key breaker.
+// The response is JSON encoded, unless the query parameter format=text is given.
 func (api *streamStateApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	// set the content type for all responses
-	writer.Header().Add("Content-Type", "text/plain")
-
 	// fail-fast: verify that this user can access this resource first
 	if !auth.HandleHttpAuthentication(api.auth, request, writer) {
 		return
 	}
 
+	status := http.StatusNotFound
 	if api.client.Connected() {
-		writer.WriteHeader(http.StatusOK)
-		if _, err := writer.Write([]byte("200 ok")); err != nil {
-			logger.Logkv(
-				"event", eventApiError,
-				"error", errorApiWrite,
-				"message", err.Error(),
-			)
+		status = http.StatusOK
+	}
+	// viewers don't receive anything until the pre-roll is complete
+	if buffering, ok := api.client.(bufferingChecker); ok && status == http.StatusOK && buffering.Buffering() {
+		if request.URL.Query().Get("format") == "text" {
+			writeTextMessage(writer, http.StatusServiceUnavailable, "buffering")
+		} else {
+			writeResponse(writer, http.StatusServiceUnavailable, api.withBreaker(&apiStatus{
+				Status: "buffering",
+				Code:   http.StatusServiceUnavailable,
+			}))
+		}
+		return
+	}
+	// a dead stream stays offline until it is revived
+	if dead, ok := api.client.(deadChecker); ok && status != http.StatusOK && dead.Dead() {
+		if request.URL.Query().Get("format") == "text" {
+			writeTextMessage(writer, http.StatusGone, "dead")
+		} else {
+			writeResponse(writer, http.StatusGone, api.withBreaker(&apiStatus{
+				Status: "dead",
+				Code:   http.StatusGone,
+			}))
+		}
+		return
+	}
+	// an on-demand stream without viewers is available, it just isn't connected
+	if demand, ok := api.client.(demandChecker); ok && status != http.StatusOK && demand.OnDemandState() == "standby" {
+		if request.URL.Query().Get("format") == "text" {
+			writeTextMessage(writer, http.StatusOK, "standby")
+		} else {
+			writeResponse(writer, http.StatusOK, api.withBreaker(&apiStatus{
+				Status: "standby",
+				Code:   http.StatusOK,
+			}))
 		}
+		return
+	}
+	if request.URL.Query().Get("format") == "text" {
+		// legacy format for monitors
+		writeText(writer, status)
+	} else if status == http.StatusOK {
+		writeResponse(writer, status, api.withBreaker(&apiStatus{
+			Status: strings.ToLower(http.StatusText(status)),
+			Code:   status,
+		}))
 	} else {
-		writer.WriteHeader(http.StatusNotFound)
-		if _, err := writer.Write([]byte("404 not found")); err != nil {
-			logger.Logkv(
-				"event", eventApiError,
-				"error", errorApiWrite,
-				"message", err.Error(),
-			)
+		writeResponse(writer, status, api.withBreaker(&apiError{
+			Error: strings.ToLower(http.StatusText(status)),
+			Code:  status,
+		}))
+	}
+}
+
+// breakerObject is the circuit breaker state in a stream state response.
+type breakerObject struct {
+	Breaker string `json:"breaker"`
+}
+
+// withBreaker adds the circuit breaker state to a response body, if the stream has a breaker.
+func (api *streamStateApi) withBreaker(body interface{}) interface{} {
+	if checker, ok := api.client.(breakerChecker); ok {
+		if state := checker.BreakerState(); state != "" {
+			return mergedObject{body, &breakerObject{Breaker: state}}
 		}
 	}
+	return body
 }
 
 // inhibitor represents a type that can prevent or allow new connections.
@@ -260,11 +635,43 @@ type inhibitor interface {
 	SetInhibit(inhibit bool)
 }
 
+// recordSwitch is a stream recorder that can be started and stopped.
+type recordSwitch interface {
+	SetRecording(recording bool)
+}
+
+// sampleSwitch is a stream that can log periodic packet summaries for debugging.
+type sampleSwitch interface {
+	SetSampling(sampling bool)
+}
+
+// pidStatisticsSwitch is a stream that can count its packets per PID.
+type pidStatisticsSwitch interface {
+	SetPidStatistics(enable bool)
+}
+
+// reviveSwitch is a stream that can resume reconnecting after it has given up.
+type reviveSwitch interface {
+	Revive() bool
+}
+
+// lossSwitch is a stream that can simulate packet loss for testing.
+type lossSwitch interface {
+	SetLossSimulation(drop float64, delay float64, jitter time.Duration) error
+}
+
+// arrivalSwitch is a stream that can record packet arrival times.
+type arrivalSwitch interface {
+	ArmArrivalLog(window time.Duration) error
+}
+
 // streamControlApi allows manipulation of a stream's state.
 // If this API is enabled for a stream, requests to start and stop it externally
 // can be sent. Useful for testing or as an emergency kill switch.
 type streamControlApi struct {
 	inhibit inhibitor
+	// record is the stream recorder, nil if the stream isn't recorded
+	record recordSwitch
 	// auth is an authentication verifier for client requests
 	auth auth.Authenticator
 }
@@ -278,51 +685,260 @@ func NewStreamControlApi(inhibit inhibitor, auth auth.Authenticator) http.Handle
 	}
 }
 
+// NewStreamRecordControlApi creates a stream control API object like NewStreamControlApi,
+// that can also start and stop recording.
+func NewStreamRecordControlApi(inhibit inhibitor, record recordSwitch, auth auth.Authenticator) http.Handler {
+	return &streamControlApi{
+		inhibit: inhibit,
+		record:  record,
+		auth:    auth,
+	}
+}
+
 // ServeHTTP is the http handler method.
 // It parses the query string and prohibits or allows new connections depending
 // on the existence of the "offline" or "online" parameter.
 // When the "offline" parameter is present, all existing downstream connections
 // are closed immediately. If both are present, the query is treated like
 // if there was only "offline".
+//
+// If the stream is recorded, the "record" and "stoprecord" parameters start and stop
+// the recording. They can be combined with "offline" or "online".
+//
+// If the stream supports it, the "sample" and "stopsample" parameters enable and disable
+// the debug packet summary log.
+//
+// If the stream allows it, "loss", "lossdelay" and "lossjitter" set the drop probability,
+// the delay probability and the maximum delay in milliseconds of the packet loss simulation.
+// Omitted values are set to 0. "stoploss" disables the simulation.
+// If the simulation is not allowed, 403 Forbidden is returned.
+//
+// If the stream has an arrival log, "arrivals" starts recording packet arrival times.
+// Its value is the recording time in seconds, 10 if empty.
+// If there is no arrival log, 403 Forbidden is returned.
 func (api *streamControlApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	// set the content type for all responses
-	writer.Header().Add("Content-Type", "text/plain")
-
 	// fail-fast: verify that this user can access this resource first
 	if !auth.HandleHttpAuthentication(api.auth, request, writer) {
 		return
 	}
 
 	query := request.URL.Query()
+	handled := false
 	if len(query["offline"]) > 0 {
 		api.inhibit.SetInhibit(true)
-		writer.WriteHeader(http.StatusAccepted)
-		if _, err := writer.Write([]byte("202 accepted")); err != nil {
-			logger.Logkv(
-				"event", eventApiError,
-				"error", errorApiWrite,
-				"message", err.Error(),
-			)
-		}
+		handled = true
 	} else if len(query["online"]) > 0 {
 		api.inhibit.SetInhibit(false)
-		writer.WriteHeader(http.StatusAccepted)
-		if _, err := writer.Write([]byte("202 accepted")); err != nil {
-			logger.Logkv(
-				"event", eventApiError,
-				"error", errorApiWrite,
-				"message", err.Error(),
-			)
+		handled = true
+	}
+	if api.record != nil {
+		if len(query["stoprecord"]) > 0 {
+			api.record.SetRecording(false)
+			handled = true
+		} else if len(query["record"]) > 0 {
+			api.record.SetRecording(true)
+			handled = true
+		}
+	}
+	if sampler, ok := api.inhibit.(sampleSwitch); ok {
+		if len(query["stopsample"]) > 0 {
+			sampler.SetSampling(false)
+			handled = true
+		} else if len(query["sample"]) > 0 {
+			sampler.SetSampling(true)
+			handled = true
 		}
+	}
+	if counter, ok := api.inhibit.(pidStatisticsSwitch); ok {
+		if len(query["stoppidstats"]) > 0 {
+			counter.SetPidStatistics(false)
+			handled = true
+		} else if len(query["pidstats"]) > 0 {
+			counter.SetPidStatistics(true)
+			handled = true
+		}
+	}
+	if reviver, ok := api.inhibit.(reviveSwitch); ok && len(query["revive"]) > 0 {
+		// reviving a live stream does nothing
+		reviver.Revive()
+		handled = true
+	}
+	if simulator, ok := api.inhibit.(lossSwitch); ok {
+		var err error
+		if len(query["stoploss"]) > 0 {
+			err = simulator.SetLossSimulation(0, 0, 0)
+			handled = true
+		} else if len(query["loss"]) > 0 || len(query["lossdelay"]) > 0 || len(query["lossjitter"]) > 0 {
+			drop, derr := parseOptionalFloat(query.Get("loss"))
+			delay, lerr := parseOptionalFloat(query.Get("lossdelay"))
+			jitter, jerr := parseOptionalFloat(query.Get("lossjitter"))
+			if derr != nil || lerr != nil || jerr != nil || jitter < 0 {
+				writeError(writer, http.StatusBadRequest)
+				return
+			}
+			err = simulator.SetLossSimulation(drop, delay, time.Duration(jitter*float64(time.Millisecond)))
+			handled = true
+		}
+		if err != nil {
+			writeError(writer, http.StatusForbidden)
+			return
+		}
+	}
+	if arrivals, ok := api.inhibit.(arrivalSwitch); ok && len(query["arrivals"]) > 0 {
+		seconds, err := parseOptionalFloat(query.Get("arrivals"))
+		if err != nil || seconds < 0 {
+			writeError(writer, http.StatusBadRequest)
+			return
+		}
+		if err := arrivals.ArmArrivalLog(time.Duration(seconds * float64(time.Second))); err != nil {
+			writeError(writer, http.StatusForbidden)
+			return
+		}
+		handled = true
+	}
+	if handled {
+		writeStatus(writer, http.StatusAccepted)
 	} else {
-		writer.WriteHeader(http.StatusBadRequest)
-		if _, err := writer.Write([]byte("400 bad request")); err != nil {
-			logger.Logkv(
-				"event", eventApiError,
-				"error", errorApiWrite,
-				"message", err.Error(),
-			)
+		writeError(writer, http.StatusBadRequest)
+	}
+}
+
+// parseOptionalFloat parses a query value as a floating point number, an empty value is 0.
+func parseOptionalFloat(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// prober represents a type that can check an upstream.
+type prober interface {
+	Probe(ctx context.Context, uri string) (*streaming.ProbeReport, error)
+}
+
+// probeApi checks an upstream on request and reports what it delivers.
+type probeApi struct {
+	prober prober
+	// auth is an authentication verifier for client requests
+	auth auth.Authenticator
+}
+
+// NewProbeApi creates a new API object that probes upstream URLs.
+func NewProbeApi(prober prober, auth auth.Authenticator) http.Handler {
+	return &probeApi{
+		prober: prober,
+		auth:   auth,
+	}
+}
+
+// ServeHTTP is the http handler method.
+// It connects to the upstream passed in the "url" query parameter, reads from it
+// for a few seconds and sends back a JSON report.
+// The request is held until the probe has finished.
+func (api *probeApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// fail-fast: verify that this user can access this resource first
+	if !auth.HandleHttpAuthentication(api.auth, request, writer) {
+		return
+	}
+
+	uri := request.URL.Query().Get("url")
+	if uri == "" {
+		writeError(writer, http.StatusBadRequest)
+		return
+	}
+	report, err := api.prober.Probe(request.Context(), uri)
+	if err != nil {
+		writeResponse(writer, http.StatusBadRequest, &apiError{
+			Error: err.Error(),
+			Code:  http.StatusBadRequest,
+		})
+		return
+	}
+	writeResponse(writer, http.StatusOK, report)
+}
+
+// indexEntry is a single stream in the index listing.
+type indexEntry struct {
+	Serve       string `json:"serve"`
+	Connected   bool   `json:"connected"`
+	Connections int64  `json:"connections"`
+}
+
+// indexTemplate renders the HTML index page.
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Streams</title></head>
+<body>
+<ul>
+{{- range .}}
+<li><a href="{{.Serve}}">{{.Serve}}</a> {{if .Connected}}online{{else}}offline{{end}} ({{.Connections}} connected)</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+// indexApi lists the configured streams with links and their current state.
+type indexApi struct {
+	// path is the path the index is served on, all other paths are answered with 404
+	path string
+	// streams is the list of stream serve paths, in configuration order
+	streams []string
+	stats   metrics.Statistics
+	// auth is an authentication verifier for client requests
+	auth auth.Authenticator
+}
+
+// NewIndexApi creates a new index page that lists the streams by serve path.
+// The connected state is taken from the stream statistics.
+// Since the index is typically served on /, it only handles requests for path itself.
+func NewIndexApi(path string, streams []string, stats metrics.Statistics, auth auth.Authenticator) http.Handler {
+	return &indexApi{
+		path:    path,
+		streams: streams,
+		stats:   stats,
+		auth:    auth,
+	}
+}
+
+// ServeHTTP is the http handler method.
+// It sends back an HTML page with a link for each stream,
+// or a JSON list if the query parameter format=json is given.
+func (api *indexApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// the mux forwards unknown paths below a subtree to us, don't list the index for those
+	if request.URL.Path != api.path {
+		writeError(writer, http.StatusNotFound)
+		return
+	}
+	// fail-fast: verify that this user can access this resource first
+	if !auth.HandleHttpAuthentication(api.auth, request, writer) {
+		return
+	}
+
+	entries := make([]indexEntry, 0, len(api.streams))
+	for _, serve := range api.streams {
+		entry := indexEntry{
+			Serve: serve,
 		}
+		if stats := api.stats.GetStreamStatistics(serve); stats != nil {
+			entry.Connected = stats.Connected
+			entry.Connections = stats.Connections
+		}
+		entries = append(entries, entry)
+	}
+
+	if request.URL.Query().Get("format") == "json" {
+		writeResponse(writer, http.StatusOK, entries)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	if err := indexTemplate.Execute(writer, entries); err != nil {
+		logger.Logkv(
+			"event", eventApiError,
+			"error", errorApiWrite,
+			"message", err.Error(),
+		)
 	}
 }
 
@@ -353,3 +969,96 @@ func (api *prometheusApi) ServeHTTP(writer http.ResponseWriter, request *http.Re
 	// authentication successful, forward the request to the promhttp handler
 	api.handler.ServeHTTP(writer, request)
 }
+
+// limitedApi is a wrapper that enforces request restrictions before passing requests on to an API handler.
+type limitedApi struct {
+	// handler is the wrapped API handler
+	handler http.Handler
+	// maxBody is the maximum size of a request body, in bytes. 0 means unlimited.
+	maxBody int64
+	// methods is the list of accepted request methods
+	methods []string
+}
+
+// NewLimitedApi wraps an API handler and rejects requests that use any method
+// not in methods with "405 method not allowed".
+// Request bodies are limited to maxBody bytes, larger requests are answered with
+// "413 request entity too large". If maxBody is 0, the body size is not limited.
+func NewLimitedApi(handler http.Handler, maxBody int64, methods ...string) http.Handler {
+	return &limitedApi{
+		handler: handler,
+		maxBody: maxBody,
+		methods: methods,
+	}
+}
+
+// ServeHTTP is the http handler method.
+func (api *limitedApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	allowed := false
+	for _, method := range api.methods {
+		if request.Method == method {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		logger.Logkv(
+			"event", eventApiError,
+			"error", errorApiMethod,
+			"method", request.Method,
+			"remote", request.RemoteAddr,
+			"message", fmt.Sprintf("Rejecting %s request from %s", request.Method, request.RemoteAddr),
+		)
+		writer.Header().Set("Allow", strings.Join(api.methods, ", "))
+		writeError(writer, http.StatusMethodNotAllowed)
+		return
+	}
+
+	if api.maxBody > 0 {
+		if request.ContentLength > api.maxBody {
+			logger.Logkv(
+				"event", eventApiError,
+				"error", errorApiBodyTooLarge,
+				"remote", request.RemoteAddr,
+				"message", fmt.Sprintf("Rejecting request from %s, body size %d exceeds limit", request.RemoteAddr, request.ContentLength),
+			)
+			writeError(writer, http.StatusRequestEntityTooLarge)
+			return
+		}
+		// also guards against chunked bodies without a content length
+		request.Body = http.MaxBytesReader(writer, request.Body, api.maxBody)
+	}
+
+	api.handler.ServeHTTP(writer, request)
+}
+
+// configApi reports the configuration the server was started with.
+type configApi struct {
+	// config is the sanitized configuration
+	config *configuration.Configuration
+	// auth is an authentication verifier for client requests
+	auth auth.Authenticator
+}
+
+// NewConfigApi creates an API that returns the active configuration as JSON.
+// Passwords and other secrets are redacted, see configuration.Configuration.Sanitized.
+func NewConfigApi(config *configuration.Configuration, auth auth.Authenticator) http.Handler {
+	return &configApi{
+		config: config.Sanitized(),
+		auth:   auth,
+	}
+}
+
+// ServeHTTP is the http handler method.
+// It sends back the sanitized configuration.
+func (api *configApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// fail-fast: verify that this user can access this resource first
+	if !auth.HandleHttpAuthentication(api.auth, request, writer) {
+		return
+	}
+	if api.config == nil {
+		writeError(writer, http.StatusInternalServerError)
+		return
+	}
+	writeResponse(writer, http.StatusOK, api.config)
+}
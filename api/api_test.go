@@ -19,13 +19,19 @@ package api
 import (
 	//"encoding/hex"
 	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/onitake/restreamer/auth"
 	"github.com/onitake/restreamer/configuration"
 	"github.com/onitake/restreamer/metrics"
+	"github.com/onitake/restreamer/streaming"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 type Logger interface {
@@ -68,6 +74,7 @@ func (*mockStatistics) RegisterStream(name string) metrics.Collector {
 	return nil
 }
 func (*mockStatistics) RemoveStream(name string) {}
+func (*mockStatistics) SetStreamLimits(name string, maxconns uint, fullconns uint) {}
 func (stats *mockStatistics) GetStreamStatistics(name string) *metrics.StreamStatistics {
 	return stats.Streams[name]
 }
@@ -77,6 +84,22 @@ func (stats *mockStatistics) GetAllStreamStatistics() map[string]*metrics.Stream
 func (stats *mockStatistics) GetGlobalStatistics() *metrics.StreamStatistics {
 	return &stats.Global
 }
+func (stats *mockStatistics) ResetPeakConnections() {
+	stats.Global.PeakConnections = stats.Global.Connections
+}
+func (stats *mockStatistics) ResetStreamStatistics(name string) bool {
+	stream, ok := stats.Streams[name]
+	if ok {
+		stream.TotalPacketsSent = 0
+	}
+	return ok
+}
+func (stats *mockStatistics) ResetAllStatistics() {
+	for _, stream := range stats.Streams {
+		stream.TotalPacketsSent = 0
+	}
+	stats.Global.TotalPacketsSent = 0
+}
 
 func testStatisticsConnections(t *testing.T, connections, full, max int64, status string) {
 	stats := &mockStatistics{
@@ -136,6 +159,27 @@ func testHealthConnections(t *testing.T, connections, full, max int64, status st
 	}
 }
 
+func TestStatisticsApiWindows(t *testing.T) {
+	stats := &mockStatistics{
+		Global: metrics.StreamStatistics{
+			BytesPerSecondSent: 188,
+			Windows: map[string]*metrics.RateStatistics{
+				"1m": {BytesPerSecondSent: 376},
+			},
+		},
+	}
+	api := NewStatisticsApi(stats, auth.NewAuthenticator(configuration.Authentication{}, nil))
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/statistics", nil))
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("Error decoding JSON: %s", err.Error())
+	}
+	if decoded["bytes_per_second_sent"] != 188.0 || decoded["bytes_per_second_sent_1m"] != 376.0 {
+		t.Errorf("Invalid rates returned: %v", decoded)
+	}
+}
+
 func TestStatisticsApi(t *testing.T) {
 	testStatisticsConnections(t, 0, 0, 0, "ok")
 	testStatisticsConnections(t, 1, 0, 0, "ok")
@@ -157,3 +201,578 @@ func TestHealthApi(t *testing.T) {
 	testHealthConnections(t, 2, 1, 0, "full")
 	testHealthConnections(t, 2, 0, 2, "full")
 }
+
+func TestHealthApiThreshold(t *testing.T) {
+	stats := &mockStatistics{
+		Global: metrics.StreamStatistics{
+			Connections:     8,
+			MaxConnections:  10,
+			FullConnections: 9,
+		},
+	}
+	tests := []struct {
+		full        uint
+		fullPercent uint
+		status      string
+	}{
+		{0, 0, "ok"},
+		{9, 0, "ok"},
+		{8, 0, "full"},
+		{0, 90, "ok"},
+		{0, 80, "full"},
+	}
+	for _, test := range tests {
+		api := NewHealthApi(stats, test.full, test.fullPercent, auth.NewAuthenticator(configuration.Authentication{}, nil))
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+		var decoded map[string]interface{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &decoded); err != nil {
+			t.Fatalf("Error decoding JSON: %s", err.Error())
+		}
+		if decoded["status"] != test.status {
+			t.Errorf("Invalid status with threshold %d/%d%%: expected %s, got %v", test.full, test.fullPercent, test.status, decoded["status"])
+		}
+	}
+}
+
+func TestLimitedApi(t *testing.T) {
+	handler := NewLimitedApi(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if _, err := io.ReadAll(request.Body); err != nil {
+			writer.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+	}), 10, http.MethodPost)
+
+	tests := []struct {
+		method string
+		body   io.Reader
+		length int64
+		status int
+	}{
+		{http.MethodPost, strings.NewReader("short"), 5, http.StatusOK},
+		{http.MethodGet, nil, 0, http.StatusMethodNotAllowed},
+		{http.MethodPost, strings.NewReader("much too long"), 13, http.StatusRequestEntityTooLarge},
+		// unknown length, must be caught by the body reader
+		{http.MethodPost, strings.NewReader("much too long"), -1, http.StatusRequestEntityTooLarge},
+	}
+	for i, test := range tests {
+		request := httptest.NewRequest(test.method, "/control", test.body)
+		request.ContentLength = test.length
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.status, recorder.Code)
+		}
+	}
+	request := httptest.NewRequest(http.MethodGet, "/control", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if allow := recorder.Header().Get("Allow"); allow != http.MethodPost {
+		t.Errorf("Invalid Allow header: %s", allow)
+	}
+}
+
+type mockChecker bool
+
+func (checker mockChecker) Connected() bool {
+	return bool(checker)
+}
+
+type mockDemandChecker string
+
+func (checker mockDemandChecker) Connected() bool {
+	return false
+}
+
+func (checker mockDemandChecker) OnDemandState() string {
+	return string(checker)
+}
+
+func TestStreamStateApiOnDemand(t *testing.T) {
+	tests := []struct {
+		state  string
+		query  string
+		status int
+		body   string
+	}{
+		{"standby", "", http.StatusOK, `{"status":"standby","code":200}`},
+		{"standby", "?format=text", http.StatusOK, "200 standby"},
+		{"active", "", http.StatusNotFound, `{"error":"not found","code":404}`},
+	}
+	for i, test := range tests {
+		api := NewStreamStateApi(mockDemandChecker(test.state), auth.NewAuthenticator(configuration.Authentication{}, nil))
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/check"+test.query, nil))
+		if recorder.Code != test.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.status, recorder.Code)
+		}
+		if body := recorder.Body.String(); body != test.body {
+			t.Errorf("Test %d: expected body %s, got %s", i, test.body, body)
+		}
+	}
+}
+
+type mockDeadChecker struct {
+	dead    bool
+	revived bool
+}
+
+func (checker *mockDeadChecker) Connected() bool {
+	return false
+}
+
+func (checker *mockDeadChecker) Dead() bool {
+	return checker.dead
+}
+
+func (checker *mockDeadChecker) SetInhibit(inhibit bool) {}
+
+func (checker *mockDeadChecker) Revive() bool {
+	revived := checker.dead
+	checker.dead = false
+	checker.revived = true
+	return revived
+}
+
+func TestStreamStateApiDead(t *testing.T) {
+	checker := &mockDeadChecker{dead: true}
+	state := NewStreamStateApi(checker, auth.NewAuthenticator(configuration.Authentication{}, nil))
+	recorder := httptest.NewRecorder()
+	state.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/check", nil))
+	if recorder.Code != http.StatusGone || recorder.Body.String() != `{"status":"dead","code":410}` {
+		t.Errorf("Invalid dead stream state: %d %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	state.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/check?format=text", nil))
+	if recorder.Body.String() != "410 dead" {
+		t.Errorf("Invalid dead stream text state: %s", recorder.Body.String())
+	}
+
+	control := NewStreamControlApi(checker, auth.NewAuthenticator(configuration.Authentication{}, nil))
+	recorder = httptest.NewRecorder()
+	control.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/control?revive", nil))
+	if recorder.Code != http.StatusAccepted || !checker.revived {
+		t.Errorf("Stream not revived: %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	state.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/check", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 after revive, got %d", recorder.Code)
+	}
+}
+
+type mockBufferingChecker bool
+
+func (checker mockBufferingChecker) Connected() bool {
+	return true
+}
+
+func (checker mockBufferingChecker) Buffering() bool {
+	return bool(checker)
+}
+
+func TestStreamStateApiBuffering(t *testing.T) {
+	state := NewStreamStateApi(mockBufferingChecker(true), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	recorder := httptest.NewRecorder()
+	state.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/check", nil))
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Body.String() != `{"status":"buffering","code":503}` {
+		t.Errorf("Invalid buffering stream state: %d %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	state.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/check?format=text", nil))
+	if recorder.Body.String() != "503 buffering" {
+		t.Errorf("Invalid buffering stream text state: %s", recorder.Body.String())
+	}
+	state = NewStreamStateApi(mockBufferingChecker(false), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	recorder = httptest.NewRecorder()
+	state.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/check", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200 after the pre-roll, got %d", recorder.Code)
+	}
+}
+
+type mockBreakerChecker string
+
+func (checker mockBreakerChecker) Connected() bool {
+	return checker == "closed"
+}
+
+func (checker mockBreakerChecker) BreakerState() string {
+	return string(checker)
+}
+
+func TestStreamStateApiBreaker(t *testing.T) {
+	tests := []struct {
+		state  string
+		query  string
+		status int
+		body   string
+	}{
+		{"closed", "", http.StatusOK, `{"status":"ok","code":200,"breaker":"closed"}`},
+		{"open", "", http.StatusNotFound, `{"error":"not found","code":404,"breaker":"open"}`},
+		{"open", "?format=text", http.StatusNotFound, "404 not found"},
+		{"", "", http.StatusNotFound, `{"error":"not found","code":404}`},
+	}
+	for i, test := range tests {
+		api := NewStreamStateApi(mockBreakerChecker(test.state), auth.NewAuthenticator(configuration.Authentication{}, nil))
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/check"+test.query, nil))
+		if recorder.Code != test.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.status, recorder.Code)
+		}
+		if body := recorder.Body.String(); body != test.body {
+			t.Errorf("Test %d: expected body %s, got %s", i, test.body, body)
+		}
+	}
+}
+
+func TestStreamStateApi(t *testing.T) {
+	tests := []struct {
+		connected bool
+		query     string
+		status    int
+		mime      string
+		body      string
+	}{
+		{true, "", http.StatusOK, "application/json", `{"status":"ok","code":200}`},
+		{false, "", http.StatusNotFound, "application/json", `{"error":"not found","code":404}`},
+		{true, "?format=text", http.StatusOK, "text/plain", "200 ok"},
+		{false, "?format=text", http.StatusNotFound, "text/plain", "404 not found"},
+	}
+	for i, test := range tests {
+		api := NewStreamStateApi(mockChecker(test.connected), auth.NewAuthenticator(configuration.Authentication{}, nil))
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/check"+test.query, nil))
+		if recorder.Code != test.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.status, recorder.Code)
+		}
+		if mime := recorder.Header().Get("Content-Type"); mime != test.mime {
+			t.Errorf("Test %d: expected content type %s, got %s", i, test.mime, mime)
+		}
+		if body := recorder.Body.String(); body != test.body {
+			t.Errorf("Test %d: expected body %s, got %s", i, test.body, body)
+		}
+	}
+}
+
+func TestPeakResetApi(t *testing.T) {
+	stats := &mockStatistics{
+		Global: metrics.StreamStatistics{
+			Connections:     1,
+			PeakConnections: 10,
+		},
+	}
+	api := NewPeakResetApi(stats, auth.NewAuthenticator(configuration.Authentication{}, nil))
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/resetpeak", nil))
+	if recorder.Code != http.StatusAccepted {
+		t.Errorf("Invalid status code: %d", recorder.Code)
+	}
+	if stats.Global.PeakConnections != 1 {
+		t.Errorf("Peak connections were not reset: %d", stats.Global.PeakConnections)
+	}
+}
+
+func TestStatisticsApiFilter(t *testing.T) {
+	stats := &mockStatistics{
+		Streams: map[string]*metrics.StreamStatistics{
+			"/a": {Connections: 1, BytesPerSecondSent: 188},
+			"/b": {Connections: 2, Pids: map[uint16]*metrics.PidStatistics{256: {Packets: 1, Bytes: 188, BytesPerSecond: 188}}},
+		},
+		Global: metrics.StreamStatistics{
+			Connections:        3,
+			BytesPerSecondSent: 188,
+		},
+	}
+	api := NewStatisticsApi(stats, auth.NewAuthenticator(configuration.Authentication{}, nil))
+	tests := []struct {
+		query string
+		body  string
+	}{
+		{"?fields=connections,invalid", `{"connections":3}`},
+		{"?fields=connections&streams=/a,/c", `{"connections":3,"streams":{"/a":{"connections":1}}}`},
+		{"?fields=unknown&streams=/b", `{"streams":{"/b":{}}}`},
+		{"?fields=pids&streams=/a,/b", `{"streams":{"/a":{},"/b":{"pids":{"256":{"packets":1,"bytes":188,"bytes_per_second":188}}}}}`},
+	}
+	for i, test := range tests {
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/statistics"+test.query, nil))
+		if body := recorder.Body.String(); body != test.body {
+			t.Errorf("Test %d: expected %s, got %s", i, test.body, body)
+		}
+	}
+}
+
+type mockProber struct{}
+
+func (prober mockProber) Probe(ctx context.Context, uri string) (*streaming.ProbeReport, error) {
+	if !strings.HasPrefix(uri, "udp://") {
+		return nil, streaming.ErrInvalidProtocol
+	}
+	return &streaming.ProbeReport{Url: uri, Valid: true, Packets: 1, Pat: true, Pmt: true}, nil
+}
+
+func TestProbeApi(t *testing.T) {
+	api := NewProbeApi(mockProber{}, auth.NewAuthenticator(configuration.Authentication{}, nil))
+	tests := []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"", http.StatusBadRequest, `{"error":"bad request","code":400}`},
+		{"?url=fork://ls", http.StatusBadRequest, `{"error":"restreamer: unsupported protocol","code":400}`},
+		{"?url=" + url.QueryEscape("udp://239.0.0.1:5000"), http.StatusOK, `{"url":"udp://239.0.0.1:5000","valid":true,"duration":0,"packets":1,"sync_errors":0,"bitrate":0,"pat":true,"pmt":true,"pids":null,"streams":null}`},
+	}
+	for i, test := range tests {
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/probe"+test.query, nil))
+		if recorder.Code != test.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.status, recorder.Code)
+		}
+		if body := recorder.Body.String(); body != test.body {
+			t.Errorf("Test %d: expected %s, got %s", i, test.body, body)
+		}
+	}
+}
+
+func TestStatisticsResetApi(t *testing.T) {
+	stats := &mockStatistics{
+		Streams: map[string]*metrics.StreamStatistics{
+			"/a": {TotalPacketsSent: 1},
+			"/b": {TotalPacketsSent: 2},
+		},
+		Global: metrics.StreamStatistics{TotalPacketsSent: 3},
+	}
+	api := NewStatisticsResetApi(stats, auth.NewAuthenticator(configuration.Authentication{}, nil))
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/resetstats?streams=/a,/c", nil))
+	if recorder.Code != http.StatusNotFound || stats.Streams["/a"].TotalPacketsSent != 1 {
+		t.Errorf("Reset with unknown stream: got status %d, /a=%d", recorder.Code, stats.Streams["/a"].TotalPacketsSent)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/resetstats?streams=/a", nil))
+	if recorder.Code != http.StatusAccepted || stats.Streams["/a"].TotalPacketsSent != 0 || stats.Streams["/b"].TotalPacketsSent != 2 {
+		t.Errorf("Reset of /a: got status %d, /a=%d /b=%d", recorder.Code, stats.Streams["/a"].TotalPacketsSent, stats.Streams["/b"].TotalPacketsSent)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/resetstats", nil))
+	if recorder.Code != http.StatusAccepted || stats.Streams["/b"].TotalPacketsSent != 0 || stats.Global.TotalPacketsSent != 0 {
+		t.Errorf("Full reset: got status %d, /b=%d global=%d", recorder.Code, stats.Streams["/b"].TotalPacketsSent, stats.Global.TotalPacketsSent)
+	}
+}
+
+func TestIndexApi(t *testing.T) {
+	stats := &mockStatistics{
+		Streams: map[string]*metrics.StreamStatistics{
+			"/a.ts": {Connected: true, Connections: 3},
+		},
+	}
+	api := NewIndexApi("/", []string{"/a.ts", "/b.ts"}, stats, auth.NewAuthenticator(configuration.Authentication{}, nil))
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/?format=json", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", recorder.Code)
+	}
+	expected := `[{"serve":"/a.ts","connected":true,"connections":3},{"serve":"/b.ts","connected":false,"connections":0}]`
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("Expected body %s, got %s", expected, body)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if mime := recorder.Header().Get("Content-Type"); !strings.HasPrefix(mime, "text/html") {
+		t.Errorf("Expected HTML content type, got %s", mime)
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, `<a href="/b.ts">/b.ts</a> offline`) {
+		t.Errorf("Stream link missing from index: %s", body)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/unknown.ts", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown path, got %d", recorder.Code)
+	}
+}
+
+func TestConfigApi(t *testing.T) {
+	config := configuration.DefaultConfiguration()
+	config.UserList = map[string]configuration.UserCredentials{"user": {Password: "secret"}}
+	api := NewConfigApi(config, auth.NewAuthenticator(configuration.Authentication{}, nil))
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", recorder.Code)
+	}
+	body := recorder.Body.String()
+	if strings.Contains(body, "secret") || !strings.Contains(body, `"user":{"password":"***"}`) {
+		t.Errorf("Password not redacted: %s", body)
+	}
+	if !strings.Contains(body, `"listen":"localhost:http"`) {
+		t.Errorf("Configuration missing from response: %s", body)
+	}
+}
+
+type mockLossSwitch struct {
+	allowed bool
+	drop    float64
+	delay   float64
+	jitter  time.Duration
+}
+
+func (sw *mockLossSwitch) SetInhibit(inhibit bool) {}
+
+func (sw *mockLossSwitch) SetLossSimulation(drop float64, delay float64, jitter time.Duration) error {
+	if !sw.allowed {
+		return streaming.ErrLossSimulationDisabled
+	}
+	sw.drop, sw.delay, sw.jitter = drop, delay, jitter
+	return nil
+}
+
+func TestStreamControlApiLoss(t *testing.T) {
+	sw := &mockLossSwitch{allowed: true}
+	api := NewStreamControlApi(sw, auth.NewAuthenticator(configuration.Authentication{}, nil))
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/control?loss=0.1&lossdelay=0.5&lossjitter=200", nil))
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", recorder.Code)
+	}
+	if sw.drop != 0.1 || sw.delay != 0.5 || sw.jitter != 200*time.Millisecond {
+		t.Errorf("Invalid loss simulation settings: %v %v %v", sw.drop, sw.delay, sw.jitter)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/control?stoploss", nil))
+	if recorder.Code != http.StatusAccepted || sw.drop != 0 || sw.delay != 0 || sw.jitter != 0 {
+		t.Errorf("Loss simulation not stopped: %d %v %v %v", recorder.Code, sw.drop, sw.delay, sw.jitter)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/control?loss=lots", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid loss, got %d", recorder.Code)
+	}
+
+	sw.allowed = false
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/control?loss=0.1", nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 with disabled loss simulation, got %d", recorder.Code)
+	}
+}
+
+type mockArrivalSwitch struct {
+	mockLossSwitch
+	window time.Duration
+}
+
+func (sw *mockArrivalSwitch) ArmArrivalLog(window time.Duration) error {
+	if !sw.allowed {
+		return streaming.ErrNoArrivalLog
+	}
+	sw.window = window
+	return nil
+}
+
+func TestStreamControlApiArrivals(t *testing.T) {
+	sw := &mockArrivalSwitch{mockLossSwitch: mockLossSwitch{allowed: true}}
+	api := NewStreamControlApi(sw, auth.NewAuthenticator(configuration.Authentication{}, nil))
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/control?arrivals=30", nil))
+	if recorder.Code != http.StatusAccepted || sw.window != 30*time.Second {
+		t.Errorf("Arrival log not armed: %d %v", recorder.Code, sw.window)
+	}
+
+	sw.allowed = false
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/control?arrivals", nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 without arrival log, got %d", recorder.Code)
+	}
+}
+
+func TestMiddlewareChainOrder(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(handler http.Handler) http.Handler {
+			return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				order = append(order, name)
+				handler.ServeHTTP(writer, request)
+			})
+		}
+	}
+	handler := Chain(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		order = append(order, "handler")
+	}), mark("first"), mark("second"))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if strings.Join(order, ",") != "first,second,handler" {
+		t.Errorf("Invalid middleware order: %v", order)
+	}
+}
+
+func TestMiddlewareCors(t *testing.T) {
+	called := false
+	handler := NewMiddleware(nil, nil, nil, []string{"https://example.com"}, nil)(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		called = true
+	}))
+
+	request := httptest.NewRequest(http.MethodOptions, "/stream.ts", nil)
+	request.Header.Set("Origin", "https://example.com")
+	request.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent || called {
+		t.Errorf("Preflight request not answered: %d", recorder.Code)
+	}
+	if recorder.Header().Get("Access-Control-Allow-Origin") != "https://example.com" || recorder.Header().Get("Access-Control-Allow-Methods") == "" {
+		t.Errorf("Invalid preflight headers: %v", recorder.Header())
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/stream.ts", nil)
+	request.Header.Set("Origin", "https://example.org")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if !called || recorder.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Request from a foreign origin got CORS headers: %v", recorder.Header())
+	}
+}
+
+func TestMiddlewareRateLimitAuth(t *testing.T) {
+	limiter := streaming.NewRateLimiter(0.001, 2, nil)
+	authenticator := auth.NewAuthenticator(configuration.Authentication{
+		Type:  "bearer",
+		Users: []string{"user"},
+	}, map[string]configuration.UserCredentials{
+		"user": {Password: "pass"},
+	})
+	handler := NewMiddleware(nil, limiter, authenticator, nil, nil)(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	get := func(user string) int {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		if user != "" {
+			request.Header.Set("Authorization", authenticator.GetLogin(user))
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	if code := get(""); code != http.StatusForbidden {
+		t.Errorf("Unauthenticated request got %d", code)
+	}
+	if code := get("user"); code != http.StatusNoContent {
+		t.Errorf("Authenticated request got %d", code)
+	}
+	// the rate limit comes before authentication
+	if code := get("user"); code != http.StatusTooManyRequests {
+		t.Errorf("Rate limited request got %d", code)
+	}
+}
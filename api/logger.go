@@ -23,10 +23,13 @@ import (
 const (
 	moduleApi = "api"
 	//
-	eventApiError = "error"
+	eventApiError      = "error"
+	eventApiStatsReset = "stats_reset"
 	//
-	errorApiJsonEncode = "json_encode"
-	errorApiWrite      = "write"
+	errorApiJsonEncode   = "json_encode"
+	errorApiWrite        = "write"
+	errorApiMethod       = "method"
+	errorApiBodyTooLarge = "body_too_large"
 )
 
 var logger = util.NewGlobalModuleLogger(moduleApi, nil)
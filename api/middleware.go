@@ -0,0 +1,155 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"github.com/onitake/restreamer/auth"
+	"github.com/onitake/restreamer/streaming"
+	"github.com/onitake/restreamer/util"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// corsMethods are the methods that cross-origin requests may use
+	corsMethods = "GET, HEAD, POST"
+	// corsMaxAge is the number of seconds browsers may cache a preflight response
+	corsMaxAge = 600
+)
+
+// Middleware adds cross-cutting request handling, like rate limiting or logging, to a handler.
+type Middleware func(handler http.Handler) http.Handler
+
+// Chain wraps handler in middlewares.
+// The first middleware sees a request first, the handler last.
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// NewMiddleware combines the standard middlewares in their canonical order:
+// client address extraction, rate limiting, authentication, CORS and access logging.
+// Disabled parts (nil or empty arguments) are left out.
+//
+// Note that CORS preflight requests must pass the rate limit and authentication as well.
+func NewMiddleware(proxies util.ProxyList, limiter *streaming.RateLimiter, authenticator auth.Authenticator, origins []string, log *util.AccessLogger) Middleware {
+	return func(handler http.Handler) http.Handler {
+		return Chain(
+			handler,
+			ClientAddressMiddleware(proxies),
+			RateLimitMiddleware(limiter),
+			AuthMiddleware(authenticator),
+			CorsMiddleware(origins),
+			AccessLogMiddleware(log, proxies),
+		)
+	}
+}
+
+// ClientAddressMiddleware replaces the remote address of requests from trusted proxies
+// with the forwarded client address. See util.ProxyList.Handler.
+func ClientAddressMiddleware(proxies util.ProxyList) Middleware {
+	return proxies.Handler
+}
+
+// RateLimitMiddleware answers requests that exceed the rate limit of their client
+// with "429 too many requests". A nil limiter allows all requests.
+func RateLimitMiddleware(limiter *streaming.RateLimiter) Middleware {
+	return func(handler http.Handler) http.Handler {
+		if limiter == nil {
+			return handler
+		}
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if streaming.HandleHttpRateLimit(limiter, request, writer) {
+				handler.ServeHTTP(writer, request)
+			}
+		})
+	}
+}
+
+// AuthMiddleware refuses requests that don't pass authenticator.
+// A nil authenticator leaves authentication to the handler.
+func AuthMiddleware(authenticator auth.Authenticator) Middleware {
+	return func(handler http.Handler) http.Handler {
+		if authenticator == nil {
+			return handler
+		}
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if auth.HandleHttpAuthentication(authenticator, request, writer) {
+				handler.ServeHTTP(writer, request)
+			}
+		})
+	}
+}
+
+// CorsMiddleware allows browsers to access resources from other origins (CORS).
+// origins is the list of allowed origins, like https://example.com, or * to allow all.
+// Preflight requests are answered directly, other requests get the CORS response headers.
+// Requests from origins that are not allowed are passed on without CORS headers,
+// so browsers block them. If origins is empty, CORS is disabled.
+func CorsMiddleware(origins []string) Middleware {
+	return func(handler http.Handler) http.Handler {
+		if len(origins) == 0 {
+			return handler
+		}
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			origin := request.Header.Get("Origin")
+			if origin == "" {
+				handler.ServeHTTP(writer, request)
+				return
+			}
+			writer.Header().Add("Vary", "Origin")
+			allowed := ""
+			for _, entry := range origins {
+				if entry == "*" {
+					allowed = "*"
+					break
+				}
+				if strings.EqualFold(entry, origin) {
+					allowed = origin
+					break
+				}
+			}
+			if allowed == "" {
+				handler.ServeHTTP(writer, request)
+				return
+			}
+			writer.Header().Set("Access-Control-Allow-Origin", allowed)
+			if request.Method == http.MethodOptions && request.Header.Get("Access-Control-Request-Method") != "" {
+				writer.Header().Set("Access-Control-Allow-Methods", corsMethods)
+				if headers := request.Header.Get("Access-Control-Request-Headers"); headers != "" {
+					writer.Header().Set("Access-Control-Allow-Headers", headers)
+				}
+				writer.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+				writer.WriteHeader(http.StatusNoContent)
+				return
+			}
+			writer.Header().Set("Access-Control-Expose-Headers", util.RequestIdHeader)
+			handler.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// AccessLogMiddleware writes a line to log for each completed request.
+// The client address is determined with proxies. A nil log disables access logging.
+func AccessLogMiddleware(log *util.AccessLogger, proxies util.ProxyList) Middleware {
+	return func(handler http.Handler) http.Handler {
+		return streaming.AccessLogHandler(handler, log, proxies)
+	}
+}
@@ -18,6 +18,7 @@ package auth
 
 import (
 	"encoding/base64"
+	"net/http"
 	"strings"
 	// 	"crypto/md5"
 	"github.com/onitake/restreamer/configuration"
@@ -49,17 +50,32 @@ type Authenticator interface {
 // all requests is returned.
 //
 // Note: Empty whitelists allow no users at all!
+//
+// If the challenge or failure response is customized, the authenticator is wrapped
+// to provide these to HandleHttpAuthentication.
 func NewAuthenticator(auth configuration.Authentication, credentials map[string]configuration.UserCredentials) Authenticator {
+	var authenticator Authenticator
 	switch auth.Type {
 	case "":
-		return newPassAuthenticator()
+		authenticator = newPassAuthenticator()
 	case "basic":
-		return newBasicAuthenticator(auth.Users, credentials, auth.Realm)
+		authenticator = newBasicAuthenticator(auth.Users, credentials, auth.Realm)
 	case "bearer":
-		return newTokenAuthenticator(auth.Users, credentials)
+		authenticator = newTokenAuthenticator(auth.Users, credentials, auth.Realm)
+	case "signed":
+		authenticator = newSignedAuthenticator(auth.Users, credentials)
 	default:
-		return newDenyAuthenticator()
+		authenticator = newDenyAuthenticator()
+	}
+	if auth.NoChallenge || auth.FailureBody != "" || auth.FailureRedirect != "" {
+		return &challengeAuthenticator{
+			Authenticator: authenticator,
+			noChallenge:   auth.NoChallenge,
+			body:          auth.FailureBody,
+			redirect:      auth.FailureRedirect,
+		}
 	}
+	return authenticator
 }
 
 type passAuthenticator struct{}
@@ -179,14 +195,17 @@ type tokenAuthenticator struct {
 	tokens map[string]bool
 	// users maps user names to valid authentication tokens
 	users map[string]string
+	// the authentication realm, no challenge is sent if empty
+	realm string
 }
 
 // newTokenAuthenticator creates a new Authenticator that supports bearer token authentication.
 // The user name is only used as a unique identifier for the token list
-func newTokenAuthenticator(whitelist []string, credentials map[string]configuration.UserCredentials) *tokenAuthenticator {
+func newTokenAuthenticator(whitelist []string, credentials map[string]configuration.UserCredentials, realm string) *tokenAuthenticator {
 	auth := &tokenAuthenticator{
 		tokens: make(map[string]bool),
 		users:  make(map[string]string),
+		realm:  realm,
 	}
 	for _, user := range whitelist {
 		cred, ok := credentials[user]
@@ -237,9 +256,42 @@ func (auth *tokenAuthenticator) GetLogin(user string) string {
 }
 
 func (auth *tokenAuthenticator) GetAuthenticateRequest() string {
-	// token-based auth doesn't support challenge-response or similar, as token are generated externally
-	// just send back a 403.
-	return ""
+	// tokens are generated externally, so there is nothing to negotiate.
+	// without a realm, just send back a 403.
+	if auth.realm == "" {
+		return ""
+	}
+	return "Bearer realm=\"" + auth.realm + "\""
+}
+
+// challengeAuthenticator customizes the response to failed authentication requests.
+type challengeAuthenticator struct {
+	Authenticator
+	// noChallenge suppresses the WWW-Authenticate header
+	noChallenge bool
+	// body is the response body sent on failure
+	body string
+	// redirect is the location clients are redirected to on failure
+	redirect string
+}
+
+func (auth *challengeAuthenticator) GetAuthenticateRequest() string {
+	if auth.noChallenge {
+		return ""
+	}
+	return auth.Authenticator.GetAuthenticateRequest()
+}
+
+// AuthenticateRequest passes the request on to the wrapped authenticator.
+func (auth *challengeAuthenticator) AuthenticateRequest(request *http.Request) bool {
+	if reqauth, ok := auth.Authenticator.(RequestAuthenticator); ok {
+		return reqauth.AuthenticateRequest(request)
+	}
+	return auth.Authenticate(request.Header.Get("Authorization"))
+}
+
+func (auth *challengeAuthenticator) GetFailureResponse() (body, redirect string) {
+	return auth.body, auth.redirect
 }
 
 // UserAuthenticator is an authenticator that is bound to a single user.
@@ -19,8 +19,12 @@ package auth
 import (
 	"encoding/base64"
 	"github.com/onitake/restreamer/configuration"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"math/rand"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 )
 
 const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-+.:,;$!#@%&/()=?'[]{}_<>"
@@ -85,3 +89,107 @@ func TestBasicAuthenticator02(t *testing.T) {
 		t.Errorf("Basic authenticator allowed non-whitelisted user")
 	}
 }
+
+func TestSignedAuthenticator01(t *testing.T) {
+	user := "user"
+	secret := randStringBytes(16)
+	cred := map[string]configuration.UserCredentials{
+		user: {
+			Password: secret,
+		},
+	}
+	auth := newSignedAuthenticator([]string{user}, cred)
+	base, _ := url.Parse("http://localhost/stream.ts")
+
+	valid := SignUrl(base, secret, time.Now().Add(time.Minute))
+	if !HandleHttpAuthentication(auth, httptest.NewRequest("GET", valid.String(), nil), httptest.NewRecorder()) {
+		t.Errorf("Signed authenticator didn't allow valid URL")
+	}
+
+	expired := SignUrl(base, secret, time.Now().Add(-time.Minute))
+	if auth.AuthenticateRequest(httptest.NewRequest("GET", expired.String(), nil)) {
+		t.Errorf("Signed authenticator allowed expired URL")
+	}
+
+	wrong := SignUrl(base, "wrong", time.Now().Add(time.Minute))
+	if auth.AuthenticateRequest(httptest.NewRequest("GET", wrong.String(), nil)) {
+		t.Errorf("Signed authenticator allowed URL with invalid secret")
+	}
+
+	tampered := *valid
+	tampered.Path = "/other.ts"
+	if auth.AuthenticateRequest(httptest.NewRequest("GET", tampered.String(), nil)) {
+		t.Errorf("Signed authenticator allowed URL with modified path")
+	}
+
+	if auth.AuthenticateRequest(httptest.NewRequest("GET", base.String(), nil)) {
+		t.Errorf("Signed authenticator allowed unsigned URL")
+	}
+}
+
+func TestResourceAuthenticatorMetrics(t *testing.T) {
+	user := "user"
+	password := randStringBytes(16)
+	cred := map[string]configuration.UserCredentials{
+		user: {
+			Password: password,
+		},
+	}
+	auth := NewResourceAuthenticator("/metrics.ts", configuration.Authentication{Type: "bearer", Users: []string{user}}, cred)
+	failures := metricAuthFailures.WithLabelValues("/metrics.ts", "bearer")
+	successes := metricAuthSuccesses.WithLabelValues("/metrics.ts", "bearer")
+
+	failed := testutil.ToFloat64(failures)
+	succeeded := testutil.ToFloat64(successes)
+
+	request := httptest.NewRequest("GET", "/metrics.ts", nil)
+	HandleHttpAuthentication(auth, request, httptest.NewRecorder())
+	request.Header.Set("Authorization", "Bearer "+password)
+	HandleHttpAuthentication(auth, request, httptest.NewRecorder())
+	if testutil.ToFloat64(failures)-failed != 1 || testutil.ToFloat64(successes)-succeeded != 1 {
+		t.Errorf("Invalid authentication counters: failures=%v successes=%v", testutil.ToFloat64(failures)-failed, testutil.ToFloat64(successes)-succeeded)
+	}
+}
+
+func TestChallengeAuthenticator01(t *testing.T) {
+	cred := map[string]configuration.UserCredentials{
+		"user": {
+			Password: randStringBytes(16),
+		},
+	}
+	tests := []struct {
+		auth      configuration.Authentication
+		status    int
+		challenge string
+		body      string
+		location  string
+	}{
+		{configuration.Authentication{Type: "basic", Realm: "test"}, 401, "Basic realm=\"test\" charset=\"UTF-8\"", "", ""},
+		{configuration.Authentication{Type: "basic", Realm: "test", NoChallenge: true}, 403, "", "", ""},
+		{configuration.Authentication{Type: "bearer"}, 403, "", "", ""},
+		{configuration.Authentication{Type: "bearer", Realm: "test"}, 401, "Bearer realm=\"test\"", "", ""},
+		{configuration.Authentication{Type: "bearer", FailureBody: "go away"}, 403, "", "go away", ""},
+		{configuration.Authentication{Type: "basic", FailureRedirect: "http://example.com/login"}, 302, "", "", "http://example.com/login"},
+	}
+	for i, test := range tests {
+		test.auth.Users = []string{"user"}
+		auth := NewResourceAuthenticator("/stream.ts", test.auth, cred)
+		writer := httptest.NewRecorder()
+		if HandleHttpAuthentication(auth, httptest.NewRequest("GET", "/stream.ts", nil), writer) {
+			t.Errorf("Test %d: unauthenticated request was allowed", i)
+			continue
+		}
+		if writer.Code != test.status {
+			t.Errorf("Test %d: got status %d, expected %d", i, writer.Code, test.status)
+		}
+		if writer.Header().Get("WWW-Authenticate") != test.challenge {
+			t.Errorf("Test %d: got challenge %q, expected %q", i, writer.Header().Get("WWW-Authenticate"), test.challenge)
+		}
+		if test.body != "" && writer.Body.String() != test.body {
+			t.Errorf("Test %d: got body %q, expected %q", i, writer.Body.String(), test.body)
+		}
+		if writer.Header().Get("Location") != test.location {
+			t.Errorf("Test %d: got location %q, expected %q", i, writer.Header().Get("Location"), test.location)
+		}
+	}
+}
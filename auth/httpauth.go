@@ -20,13 +20,49 @@ import (
 	"net/http"
 )
 
+// FailureResponder is implemented by authenticators that send a custom response
+// when authentication fails.
+type FailureResponder interface {
+	// GetFailureResponse returns a response body and a redirect location.
+	// Either may be empty.
+	GetFailureResponse() (body, redirect string)
+}
+
 // HandleHttpAuthentication handles authentication headers and responses.
 // If it returns false, authenticaten has failed, an appropriate response was sent and the caller should immediately return.
 // A true return value indicates that authentication has succeeded and the caller should proceed with handling the request.
 func HandleHttpAuthentication(auth Authenticator, request *http.Request, writer http.ResponseWriter) bool {
 	// fail-fast: verify that this user can access this resource first
-	if !auth.Authenticate(request.Header.Get("Authorization")) {
+	var authenticated bool
+	if reqauth, ok := auth.(RequestAuthenticator); ok {
+		authenticated = reqauth.AuthenticateRequest(request)
+	} else {
+		authenticated = auth.Authenticate(request.Header.Get("Authorization"))
+	}
+	reportAuthentication(auth, authenticated)
+	if !authenticated {
+		var body, redirect string
+		if responder, ok := auth.(FailureResponder); ok {
+			body, redirect = responder.GetFailureResponse()
+		}
 		realm := auth.GetAuthenticateRequest()
+		if len(redirect) > 0 {
+			if logger != nil {
+				logger.Logkv(
+					"event", eventProtocolError,
+					"error", errorProtocolForbidden,
+					"statuscode", 302,
+					"message", "Redirecting unauthenticated user",
+					"url", request.URL.Path,
+					"client", request.RemoteAddr,
+				)
+			}
+			http.Redirect(writer, request, redirect, http.StatusFound)
+			return false
+		}
+		if len(body) > 0 {
+			writer.Header().Set("Content-Type", http.DetectContentType([]byte(body)))
+		}
 		if len(realm) > 0 {
 			if logger != nil {
 				logger.Logkv(
@@ -54,6 +90,9 @@ func HandleHttpAuthentication(auth Authenticator, request *http.Request, writer
 			// otherwise, just respond with a 403
 			writer.WriteHeader(http.StatusForbidden)
 		}
+		if len(body) > 0 {
+			writer.Write([]byte(body))
+		}
 		return false
 	}
 	if logger != nil {
@@ -0,0 +1,100 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"github.com/onitake/restreamer/configuration"
+	"github.com/onitake/restreamer/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+)
+
+var (
+	metricAuthFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "restreamer_auth_failures_total",
+			Help: "Total number of requests that were rejected by authentication.",
+		},
+		[]string{"resource", "scheme"},
+	)
+	metricAuthSuccesses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "restreamer_auth_successes_total",
+			Help: "Total number of requests that passed authentication.",
+		},
+		[]string{"resource", "scheme"},
+	)
+)
+
+func init() {
+	metrics.MustRegister(metricAuthFailures)
+	metrics.MustRegister(metricAuthSuccesses)
+}
+
+// resourceAuthenticator attaches a resource name and authentication scheme to an Authenticator,
+// so they can be reported in metrics.
+type resourceAuthenticator struct {
+	Authenticator
+	// resource is the name of the protected resource
+	resource string
+	// scheme is the authentication type
+	scheme string
+}
+
+// NewResourceAuthenticator creates an authentication service like NewAuthenticator,
+// but labels authentication metrics with the name of the resource it protects.
+func NewResourceAuthenticator(resource string, auth configuration.Authentication, credentials map[string]configuration.UserCredentials) Authenticator {
+	scheme := auth.Type
+	if scheme == "" {
+		scheme = "none"
+	}
+	return &resourceAuthenticator{
+		Authenticator: NewAuthenticator(auth, credentials),
+		resource:      resource,
+		scheme:        scheme,
+	}
+}
+
+// AuthenticateRequest passes the request on to the wrapped authenticator.
+func (auth *resourceAuthenticator) AuthenticateRequest(request *http.Request) bool {
+	if reqauth, ok := auth.Authenticator.(RequestAuthenticator); ok {
+		return reqauth.AuthenticateRequest(request)
+	}
+	return auth.Authenticate(request.Header.Get("Authorization"))
+}
+
+// GetFailureResponse passes on the failure response of the wrapped authenticator, if it has one.
+func (auth *resourceAuthenticator) GetFailureResponse() (body, redirect string) {
+	if responder, ok := auth.Authenticator.(FailureResponder); ok {
+		return responder.GetFailureResponse()
+	}
+	return "", ""
+}
+
+// reportAuthentication counts a successful or failed authentication.
+func reportAuthentication(auth Authenticator, success bool) {
+	labels := prometheus.Labels{"resource": "", "scheme": ""}
+	if resauth, ok := auth.(*resourceAuthenticator); ok {
+		labels["resource"] = resauth.resource
+		labels["scheme"] = resauth.scheme
+	}
+	if success {
+		metricAuthSuccesses.With(labels).Inc()
+	} else {
+		metricAuthFailures.With(labels).Inc()
+	}
+}
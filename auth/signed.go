@@ -0,0 +1,129 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/onitake/restreamer/configuration"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// SignedTokenParameter is the query parameter that contains the signature of a signed URL
+	SignedTokenParameter = "token"
+	// SignedExpiresParameter is the query parameter that contains the expiry time of a signed URL,
+	// in seconds since the Unix epoch
+	SignedExpiresParameter = "expires"
+)
+
+// RequestAuthenticator is an optional extension of Authenticator that
+// authenticates whole requests instead of the Authorization header only.
+// HandleHttpAuthentication prefers it if it is implemented.
+type RequestAuthenticator interface {
+	// AuthenticateRequest tries to authenticate a request.
+	// Returns true if the authentication succeeded, false otherwise.
+	AuthenticateRequest(request *http.Request) bool
+}
+
+// signUrlPath calculates the signature for a path and an expiry time.
+func signUrlPath(secret string, path string, expires string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(path))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignUrl returns a copy of urly that carries a token and expiry time in the query string,
+// suitable for resources with signed authentication.
+// The signature covers the path and the expiry time, other query parameters are not protected.
+func SignUrl(urly *url.URL, secret string, expires time.Time) *url.URL {
+	signed := *urly
+	query := signed.Query()
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	query.Set(SignedExpiresParameter, expiry)
+	query.Set(SignedTokenParameter, signUrlPath(secret, signed.Path, expiry))
+	signed.RawQuery = query.Encode()
+	return &signed
+}
+
+type signedAuthenticator struct {
+	// secrets maps user names to shared secrets
+	secrets map[string]string
+}
+
+// newSignedAuthenticator creates a new Authenticator that verifies signed URLs.
+// The passwords of the allowed users are used as the shared secrets, a URL signed with any of them is accepted.
+func newSignedAuthenticator(allowlist []string, credentials map[string]configuration.UserCredentials) *signedAuthenticator {
+	auth := &signedAuthenticator{
+		secrets: make(map[string]string),
+	}
+	for _, user := range allowlist {
+		cred, ok := credentials[user]
+		if ok {
+			auth.AddUser(user, cred.Password)
+		}
+	}
+	return auth
+}
+
+func (auth *signedAuthenticator) Authenticate(authorization string) bool {
+	// signed URLs can't be verified without the request
+	return false
+}
+
+func (auth *signedAuthenticator) AuthenticateRequest(request *http.Request) bool {
+	query := request.URL.Query()
+	token := query.Get(SignedTokenParameter)
+	expiry := query.Get(SignedExpiresParameter)
+	if token == "" || expiry == "" {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	for _, secret := range auth.secrets {
+		if hmac.Equal([]byte(token), []byte(signUrlPath(secret, request.URL.Path, expiry))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (auth *signedAuthenticator) AddUser(user, password string) {
+	auth.secrets[user] = password
+}
+
+func (auth *signedAuthenticator) RemoveUser(user string) {
+	delete(auth.secrets, user)
+}
+
+func (auth *signedAuthenticator) GetLogin(user string) string {
+	// there is no static login for signed URLs
+	return ""
+}
+
+func (auth *signedAuthenticator) GetAuthenticateRequest() string {
+	// clients need a new URL, there is no challenge
+	return ""
+}
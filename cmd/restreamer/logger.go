@@ -27,10 +27,13 @@ const (
 	eventMainConfig       = "config"
 	eventMainConfigStream = "stream"
 	eventMainConfigStatic = "static"
+	eventMainConfigAlias  = "alias"
 	eventMainConfigApi    = "api"
 	eventMainHandled      = "handled"
 	eventMainStartMonitor = "start_monitor"
 	eventMainStartServer  = "start_server"
+	eventMainStopServer   = "stop_server"
+	eventMainGeoIpReload  = "geoip_reload"
 	//
 	errorMainStreamNotFound          = "stream_notfound"
 	errorMainInvalidApi              = "invalid_api"
@@ -40,6 +43,24 @@ const (
 	errorMainMissingStreamUser       = "missing_stream_user"
 	errorMainInvalidAuthentication   = "invalid_authentication"
 	errorMainPreambleRead            = "preamble_read"
+	errorMainRefusedRead             = "refused_read"
+	errorMainInvalidListener         = "invalid_listener"
+	errorMainServer                  = "server"
+	errorMainTrustedProxies          = "trusted_proxies"
+	errorMainInvalidPacketSize       = "invalid_packet_size"
+	errorMainStreamSetup             = "stream_setup"
+	errorMainStreamFailed            = "stream_failed"
+	errorMainInvalidStatus           = "invalid_status"
+	errorMainInvalidOutputPolicy     = "invalid_output_policy"
+	errorMainInvalidFullPolicy       = "invalid_full_policy"
+	errorMainInvalidUrlLabels        = "invalid_url_labels"
+	errorMainInvalidSchedule         = "invalid_schedule"
+	errorMainInvalidAccessLog        = "invalid_access_log"
+	errorMainGeoIp                   = "geoip"
+	errorMainLossSimulation          = "loss_simulation"
+	errorMainInvalidTimeout          = "invalid_timeout"
+	errorMainInvalidFraming          = "invalid_framing"
+	errorMainInvalidHeaderRule       = "invalid_header_rule"
 )
 
 var logger = util.NewGlobalModuleLogger(moduleMain, nil)
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/onitake/restreamer/api"
@@ -24,6 +25,7 @@ import (
 	"github.com/onitake/restreamer/configuration"
 	"github.com/onitake/restreamer/event"
 	"github.com/onitake/restreamer/metrics"
+	"github.com/onitake/restreamer/protocol"
 	"github.com/onitake/restreamer/streaming"
 	"github.com/onitake/restreamer/util"
 	"io"
@@ -31,9 +33,47 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"regexp"
 	"time"
 )
 
+// maxDatagramSize is the largest possible UDP payload
+const maxDatagramSize = 65535
+
+// maxStreamTimeout is the largest per-stream timeout or reconnect delay, in seconds
+const maxStreamTimeout = 24 * 60 * 60
+
+// streamTimeout returns the per-stream override of a timeout setting,
+// or the global value if it is not set or out of range.
+func streamTimeout(serve string, name string, value *uint, global uint) uint {
+	if value == nil {
+		return global
+	}
+	if *value > maxStreamTimeout {
+		logger.Logkv(
+			"event", eventMainError,
+			"error", errorMainInvalidTimeout,
+			"serve", serve,
+			name, *value,
+			"message", fmt.Sprintf("Invalid %s %d for stream %s, must be at most %d, using %d", name, *value, serve, maxStreamTimeout, global),
+		)
+		return global
+	}
+	return *value
+}
+
+// defaultDemandWait is the time viewers wait for an on-demand stream without a connect timeout
+const defaultDemandWait = 10 * time.Second
+
+// failedStream stands in for a stream that could not be set up.
+// It is permanently offline.
+type failedStream struct{}
+
+// Connected always returns false.
+func (failedStream) Connected() bool {
+	return false
+}
+
 func main() {
 	logbackend := &util.ModuleLogger{
 		Logger:       &util.ConsoleLogger{},
@@ -61,34 +101,139 @@ func main() {
 		"timeout", config.Timeout,
 	)
 
+	if !config.NoProcessMetrics {
+		metrics.EnableProcessCollector()
+	}
+	// if profiling is enabled, we always want the Go runtime metrics collector
+	if !config.NoRuntimeMetrics || config.Profile {
+		metrics.EnableGoRuntimeCollector()
+	}
 	if config.Profile {
 		EnableProfiling()
-		// If profiling is enabled, we also want the Go runtime metrics collector
-		metrics.EnableGoRuntimeCollector()
 	}
 
 	if config.Log != "" {
-		flogger, err := util.NewFileLogger(config.Log, true)
+		var flogger *util.FileLogger
+		var err error
+		if config.LogCompress {
+			flogger, err = util.NewCompressedFileLogger(config.Log, true, time.Duration(config.LogFlushInterval)*time.Second)
+		} else {
+			flogger, err = util.NewFileLogger(config.Log, true)
+		}
 		if err != nil {
 			log.Fatal("Error opening log: ", err)
 		}
 		logbackend.Logger = flogger
 	}
 
+	if config.LogSampleWindow > 0 {
+		util.SetGlobalStandardLogger(util.NewSamplingLogger(logbackend, time.Duration(config.LogSampleWindow)*time.Second))
+	}
+
+	var accessLog *util.AccessLogger
+	if config.AccessLog != "" {
+		format, err := util.ParseAccessLogFormat(config.AccessLogFormat)
+		if err != nil {
+			logger.Logkv(
+				"event", eventMainError,
+				"error", errorMainInvalidAccessLog,
+				"message", fmt.Sprintf("Invalid access log format, using combined: %v", err),
+			)
+		}
+		alogger, err := util.NewFileLogger(config.AccessLog, true)
+		if err != nil {
+			log.Fatal("Error opening access log: ", err)
+		}
+		accessLog = util.NewAccessLogger(alogger, format)
+	}
+
 	clients := make(map[string]*streaming.Client)
+	// upstreams stops all clients on shutdown
+	upstreams, stopUpstreams := context.WithCancel(context.Background())
+	defer stopUpstreams()
+	recorders := make(map[string]*streaming.Recorder)
+	// streamers collects the stream outputs, so aliases can share them
+	streamers := make(map[string]*streaming.Streamer)
+	// failed collects the streams that could not be set up, so APIs can refer to them
+	failed := make(map[string]error)
 
 	var stats metrics.Statistics
 	if config.NoStats {
 		stats = &metrics.DummyStatistics{}
 	} else {
-		stats = metrics.NewStatistics(config.MaxConnections, config.FullConnections)
+		windows := metrics.DefaultRateWindows
+		if len(config.StatsWindows) > 0 {
+			windows = make([]time.Duration, len(config.StatsWindows))
+			for i, window := range config.StatsWindows {
+				windows[i] = time.Duration(window) * time.Second
+			}
+		}
+		stats = metrics.NewStatisticsWithWindows(config.MaxConnections, config.FullConnections, windows)
 	}
 
 	controller := streaming.NewAccessController(config.MaxConnections)
+	controller.SetWaitingRoom(config.WaitingRoom, time.Duration(config.WaitTimeout)*time.Second)
+	controller.SetMemoryBudget(config.MaxMemory)
+
+	proxies, err := util.ParseProxyList(config.TrustedProxies)
+	if err != nil {
+		logger.Logkv(
+			"event", eventMainError,
+			"error", errorMainTrustedProxies,
+			"message", fmt.Sprintf("Invalid trusted proxy list: %v", err),
+		)
+	}
+	egress := streaming.NewEgressLimiter(config.MaxEgressRate)
+	fetchLimiter := streaming.NewFetchLimiter(config.FetchConcurrency)
+	connectLimiter := streaming.NewConnectLimiter(config.StartupConcurrency, time.Duration(config.StartupDelay)*time.Millisecond)
+
+	var limiter *streaming.RateLimiter
+	if config.RateLimit.Rate > 0 {
+		limiter = streaming.NewRateLimiter(config.RateLimit.Rate, config.RateLimit.Burst, proxies)
+	}
+
+	// streams do their own rate limiting and access logging, static resources and APIs use the middleware.
+	// authentication is always left to the handlers, as it is configured per resource.
+	var resourceLimiter *streaming.RateLimiter
+	if config.ApiRateLimit.Rate > 0 {
+		resourceLimiter = streaming.NewRateLimiter(config.ApiRateLimit.Rate, config.ApiRateLimit.Burst, proxies)
+	}
+	var resourceLog *util.AccessLogger
+	if config.AccessLogResources {
+		resourceLog = accessLog
+	}
+	streamMiddleware := api.NewMiddleware(proxies, nil, nil, config.Cors, nil)
+	resourceMiddleware := api.NewMiddleware(proxies, resourceLimiter, nil, config.Cors, resourceLog)
 
 	enableheartbeat := false
 
 	queue := event.NewQueue(int(config.FullConnections))
+	if config.MissConnections > 0 {
+		queue.SetHysteresis(int(config.MissConnections))
+	}
+	queue.SetDebounce(time.Duration(config.LimitDebounce) * time.Second)
+	handlerTimeout := event.DefaultHandlerTimeout
+	if config.NotificationTimeout > 0 {
+		handlerTimeout = time.Duration(config.NotificationTimeout) * time.Second
+	}
+	drainTimeout := event.DefaultDrainTimeout
+	if config.NotificationDrainTimeout > 0 {
+		drainTimeout = time.Duration(config.NotificationDrainTimeout) * time.Second
+	}
+	queue.SetTimeouts(handlerTimeout, drainTimeout)
+	if config.NotificationShutdownTimeout > 0 {
+		queue.SetShutdownTimeout(time.Duration(config.NotificationShutdownTimeout) * time.Second)
+	}
+	queue.SetQueueSize(int(config.NotificationQueueSize))
+	for _, threshold := range config.Thresholds {
+		queue.AddThreshold(threshold.Name, threshold.Stream, int(threshold.Hit), int(threshold.Miss))
+	}
+	// streams with a soft limit notify when they are full
+	for _, resource := range config.Resources {
+		if resource.Type == "stream" && resource.FullConnections > 0 {
+			queue.AddThreshold("softlimit", resource.Serve, int(resource.FullConnections), 0)
+		}
+	}
 	for _, note := range config.Notifications {
 		var err error
 		var typ event.Type
@@ -99,6 +244,20 @@ func main() {
 			typ = event.TypeLimitMiss
 		case "heartbeat":
 			typ = event.TypeHeartbeat
+		case "threshold_hit":
+			typ = event.TypeThresholdHit
+		case "threshold_miss":
+			typ = event.TypeThresholdMiss
+		case "zero_viewers":
+			typ = event.TypeZeroViewers
+		case "shutdown":
+			typ = event.TypeShutdown
+		case "source_connected":
+			typ = event.TypeSourceConnected
+		case "source_disconnected":
+			typ = event.TypeSourceDisconnected
+		case "stream_dead":
+			typ = event.TypeStreamDead
 		default:
 			err = errors.New(fmt.Sprintf("Unknown event type: %s", note.Event))
 		}
@@ -115,14 +274,32 @@ func main() {
 			}
 			urlhandler, err := event.NewUrlHandler(note.Url, authenticator)
 			if err == nil {
+				urlhandler.SetHeaders(note.Headers)
+				urlhandler.SetQuery(note.Query)
 				handler = urlhandler
 			}
+		case "exec":
+			// don't overwrite an invalid event type error
+			exechandler, herr := event.NewExecHandler(note.Command, note.Args, time.Duration(note.Timeout)*time.Second)
+			if herr != nil {
+				err = herr
+			} else {
+				handler = exechandler
+			}
 		default:
 			err = errors.New(fmt.Sprintf("Unknown handler type: %s", note.Type))
 		}
 		if err == nil {
-			queue.RegisterEventHandler(typ, handler)
-			if typ == event.TypeHeartbeat {
+			if note.Threshold != "" || note.Stream != "" {
+				handler = event.NewFilterHandler(handler, note.Threshold, note.Stream)
+			}
+			if typ == event.TypeHeartbeat && note.Interval > 0 {
+				// this handler gets its own heartbeat
+				event.NewJitteredHeartbeat(time.Duration(note.Interval)*time.Second, time.Duration(config.HeartbeatJitter)*time.Second, config.HeartbeatImmediate, event.NewHandlerNotifier(handler))
+			} else {
+				queue.RegisterEventHandler(typ, handler)
+			}
+			if typ == event.TypeHeartbeat && note.Interval == 0 {
 				enableheartbeat = true
 				logger.Logkv(
 					"event", "enable_heartbeat",
@@ -140,28 +317,257 @@ func main() {
 	queue.Start()
 
 	if enableheartbeat {
-		event.NewHeartbeat(time.Duration(config.HeartbeatInterval)*time.Second, queue)
+		event.NewJitteredHeartbeat(time.Duration(config.HeartbeatInterval)*time.Second, time.Duration(config.HeartbeatJitter)*time.Second, config.HeartbeatImmediate, queue)
+	}
+
+	var geo *util.GeoDatabase
+	if config.GeoIpDatabase != "" {
+		geo, err = util.NewGeoDatabase(config.GeoIpDatabase)
+		if err != nil {
+			logger.Logkv(
+				"event", eventMainError,
+				"error", errorMainGeoIp,
+				"message", fmt.Sprintf("Cannot load GeoIP database, country restrictions are disabled: %v", err),
+			)
+		} else if config.GeoIpReload > 0 {
+			go geo.Watch(upstreams, time.Duration(config.GeoIpReload)*time.Second, func(loaded bool, err error) {
+				if err != nil {
+					logger.Logkv(
+						"event", eventMainError,
+						"error", errorMainGeoIp,
+						"message", fmt.Sprintf("Cannot reload GeoIP database, keeping the previous one: %v", err),
+					)
+				} else {
+					logger.Logkv(
+						"event", eventMainGeoIpReload,
+						"message", "Reloaded GeoIP database",
+					)
+				}
+			})
+		}
+	}
+
+	urlLabels, err := streaming.ParseUrlLabelScheme(config.UrlLabels)
+	if err != nil {
+		logger.Logkv(
+			"event", eventMainError,
+			"error", errorMainInvalidUrlLabels,
+			"message", fmt.Sprintf("%v, using sanitized URLs", err),
+		)
+	}
+
+	// the default listener has an empty name, all others are looked up by their name.
+	// a server is created for each accepted listener, so skipped ones are never served.
+	muxes := make(map[string]*http.ServeMux)
+	var servers []*http.Server
+	addListener := func(name string, address string) {
+		mux := http.NewServeMux()
+		muxes[name] = mux
+		servers = append(servers, &http.Server{Addr: address, Handler: mux, MaxHeaderBytes: config.MaxHeaderBytes})
+	}
+	if config.Listen != "" {
+		addListener("", config.Listen)
+	}
+	for _, listener := range config.Listeners {
+		if _, ok := muxes[listener.Name]; ok || listener.Name == "" {
+			logger.Logkv(
+				"event", eventMainError,
+				"error", errorMainInvalidListener,
+				"listener", listener.Name,
+				"message", fmt.Sprintf("Listener name is empty or not unique: %s", listener.Name),
+			)
+			continue
+		}
+		addListener(listener.Name, listener.Listen)
 	}
 
 	i := 0
-	mux := http.NewServeMux()
 	for _, streamdef := range config.Resources {
+		mux := muxes[streamdef.Listener]
+		if mux == nil {
+			logger.Logkv(
+				"event", eventMainError,
+				"error", errorMainInvalidListener,
+				"listener", streamdef.Listener,
+				"serve", streamdef.Serve,
+				"message", fmt.Sprintf("Listener not found for resource %s: %s", streamdef.Serve, streamdef.Listener),
+			)
+			continue
+		}
+
 		switch streamdef.Type {
 		case "stream":
+			timeout := streamTimeout(streamdef.Serve, "timeout", streamdef.Timeout, config.Timeout)
+			reconnect := streamTimeout(streamdef.Serve, "reconnect", streamdef.Reconnect, config.Reconnect)
+			readtimeout := streamTimeout(streamdef.Serve, "readtimeout", streamdef.ReadTimeout, config.ReadTimeout)
 			logger.Logkv(
 				"event", eventMainConfigStream,
 				"serve", streamdef.Serve,
 				"remote", streamdef.Remotes,
+				"timeout", timeout,
+				"reconnect", reconnect,
+				"readtimeout", readtimeout,
 				"message", fmt.Sprintf("Connecting stream %s to %v", streamdef.Serve, streamdef.Remotes),
 			)
 
+			// datagrams must hold at least one TS packet, and can't be larger than what UDP supports
+			if streamdef.Mru < protocol.MpegTsPacketSize || streamdef.Mru > maxDatagramSize {
+				logger.Logkv(
+					"event", eventMainError,
+					"error", errorMainInvalidPacketSize,
+					"serve", streamdef.Serve,
+					"mru", streamdef.Mru,
+					"message", fmt.Sprintf("Invalid packet size for stream %s: %d, must be between %d and %d", streamdef.Serve, streamdef.Mru, protocol.MpegTsPacketSize, maxDatagramSize),
+				)
+				failed[streamdef.Serve] = fmt.Errorf("invalid packet size %d", streamdef.Mru)
+				continue
+			}
+			readbuffer := streamdef.ReadBuffer
+			if readbuffer == 0 {
+				readbuffer = config.InputBuffer
+			}
+			logger.Logkv(
+				"event", eventMainConfigStream,
+				"serve", streamdef.Serve,
+				"readbuffer", readbuffer,
+				"mru", streamdef.Mru,
+				"message", fmt.Sprintf("Stream %s uses a read buffer of %d packets and a packet size of %d bytes", streamdef.Serve, readbuffer, streamdef.Mru),
+			)
+
 			reg := stats.RegisterStream(streamdef.Serve)
+			stats.SetStreamLimits(streamdef.Serve, streamdef.MaxConnections, streamdef.FullConnections)
 
-			authenticator := auth.NewAuthenticator(streamdef.Authentication, config.UserList)
+			authenticator := auth.NewResourceAuthenticator(streamdef.Serve, streamdef.Authentication, config.UserList)
 
 			streamer := streaming.NewStreamer(streamdef.Serve, config.OutputBuffer, controller, authenticator)
 			streamer.SetCollector(reg)
 			streamer.SetNotifier(queue)
+			streamer.SetEgressLimiter(egress)
+			streamer.SetEventStream(streamdef.EventStream)
+			streamer.SetDuplicateLimit(streamdef.MaxDuplicates, streamdef.RejectDuplicates, proxies)
+			overflow := streaming.OverflowDrop
+			switch streamdef.OutputPolicy {
+			case "", "drop":
+			case "disconnect":
+				overflow = streaming.OverflowDisconnect
+			default:
+				logger.Logkv(
+					"event", eventMainError,
+					"error", errorMainInvalidOutputPolicy,
+					"message", fmt.Sprintf("Invalid output policy %s for stream %s, dropping packets", streamdef.OutputPolicy, streamdef.Serve),
+				)
+			}
+			streamer.SetOutputBuffer(streamdef.OutputBytes, time.Duration(streamdef.OutputDuration)*time.Millisecond, overflow)
+			softPolicy := streaming.SoftLimitAdmit
+			switch streamdef.FullPolicy {
+			case "", "admit":
+			case "queue":
+				softPolicy = streaming.SoftLimitQueue
+			default:
+				logger.Logkv(
+					"event", eventMainError,
+					"error", errorMainInvalidFullPolicy,
+					"message", fmt.Sprintf("Invalid full policy %s for stream %s, admitting viewers", streamdef.FullPolicy, streamdef.Serve),
+				)
+			}
+			streamer.SetConnectionLimits(streamdef.MaxConnections, streamdef.FullConnections, softPolicy)
+			framing := streaming.FramingChunked
+			switch streamdef.Framing {
+			case "", "chunked":
+			case "close":
+				framing = streaming.FramingClose
+			case "length":
+				framing = streaming.FramingLength
+			default:
+				logger.Logkv(
+					"event", eventMainError,
+					"error", errorMainInvalidFraming,
+					"message", fmt.Sprintf("Invalid framing %s for stream %s, using chunked", streamdef.Framing, streamdef.Serve),
+				)
+			}
+			streamer.SetFraming(framing, streamdef.ContentLength)
+			streamer.SetWriteCoalescing(streamdef.WriteBuffer, time.Duration(streamdef.WriteDelay)*time.Millisecond)
+			if config.AcceptTimeout > 0 {
+				streamer.SetAcceptTimeout(time.Duration(config.AcceptTimeout) * time.Second)
+			}
+			if streamdef.RateLimit.Rate > 0 {
+				streamer.SetRateLimiter(streaming.NewRateLimiter(streamdef.RateLimit.Rate, streamdef.RateLimit.Burst, proxies))
+			} else {
+				streamer.SetRateLimiter(limiter)
+			}
+
+			if streamdef.Status != 0 && (streamdef.Status < 200 || streamdef.Status > 299) {
+				logger.Logkv(
+					"event", eventMainError,
+					"error", errorMainInvalidStatus,
+					"message", fmt.Sprintf("Invalid response status %d for stream %s, using 200", streamdef.Status, streamdef.Serve),
+				)
+				streamdef.Status = 0
+			}
+			streamer.SetResponse(streamdef.Status, streamdef.Headers)
+			if streamdef.RefusedStatus != 0 && (streamdef.RefusedStatus < 400 || streamdef.RefusedStatus > 599) {
+				logger.Logkv(
+					"event", eventMainError,
+					"error", errorMainInvalidStatus,
+					"message", fmt.Sprintf("Invalid refused status %d for stream %s, using 503", streamdef.RefusedStatus, streamdef.Serve),
+				)
+				streamdef.RefusedStatus = 0
+			}
+			streamer.SetRefusedResponse(streamdef.RefusedStatus, time.Duration(streamdef.RetryAfter)*time.Second)
+			if streamdef.RefusedFile != "" {
+				if body, err := os.ReadFile(streamdef.RefusedFile); err == nil {
+					streamer.SetRefusedContent(body, streamdef.RefusedType)
+				} else {
+					logger.Logkv(
+						"event", eventMainError,
+						"error", errorMainRefusedRead,
+						"stream", streamdef.Serve,
+						"message", fmt.Sprintf("Cannot read refused response file for stream %s: %v", streamdef.Serve, err),
+					)
+				}
+			}
+			streamer.SetRefusedRedirect(streamdef.RefusedRedirect)
+			streamer.SetMethods(streamdef.Methods)
+			streamer.SetGeoDatabase(geo, config.GeoIpMetrics)
+			streamer.SetCountries(streamdef.Countries, streamdef.BlockedCountries)
+			if geo == nil && (len(streamdef.Countries) > 0 || len(streamdef.BlockedCountries) > 0) {
+				logger.Logkv(
+					"event", eventMainError,
+					"error", errorMainGeoIp,
+					"stream", streamdef.Serve,
+					"message", fmt.Sprintf("No GeoIP database, country restrictions of %s are not enforced", streamdef.Serve),
+				)
+			}
+			var rules []streaming.HeaderRule
+			for _, required := range streamdef.RequireHeaders {
+				rule := streaming.HeaderRule{
+					Name:   required.Name,
+					Values: required.Values,
+				}
+				if required.Pattern != "" {
+					pattern, err := regexp.Compile(required.Pattern)
+					if err != nil {
+						// refuse everyone rather than letting hotlinkers through
+						logger.Logkv(
+							"event", eventMainError,
+							"error", errorMainInvalidHeaderRule,
+							"stream", streamdef.Serve,
+							"header", required.Name,
+							"message", fmt.Sprintf("Invalid pattern for header %s of stream %s, refusing all clients: %v", required.Name, streamdef.Serve, err),
+						)
+						// this pattern never matches
+						pattern = regexp.MustCompile(`$.^`)
+					}
+					rule.Pattern = pattern
+				}
+				rules = append(rules, rule)
+			}
+			streamer.SetRequiredHeaders(rules)
+			streamer.SetTableRepeat(time.Duration(streamdef.TableInterval)*time.Millisecond, streamdef.TablesOnJoin)
+			streamer.SetIdleResponse(streamdef.IdleResponse)
+			streamer.SetFlushInterval(time.Duration(streamdef.FlushInterval) * time.Millisecond)
+			streamer.SetIdleKeepAlive(time.Duration(streamdef.IdleKeepAlive) * time.Second)
+			streamer.SetAccessLog(accessLog)
 
 			if streamdef.Preamble != "" {
 				prein, err := os.Open(streamdef.Preamble)
@@ -187,12 +593,78 @@ func main() {
 			// should give a bit more randomness
 			remotes := util.ShuffleStrings(rnd, streamdef.Remotes)
 
-			client, err := streaming.NewClient(streamdef.Serve, remotes, streamer, config.Timeout, config.Reconnect, config.ReadTimeout, config.InputBuffer, streamdef.ClientInterface, config.InputBuffer, streamdef.Mru)
+			client, err := streaming.NewClient(streamdef.Serve, remotes, streamer, timeout, reconnect, readtimeout, config.InputBuffer, streamdef.ClientInterface, readbuffer, streamdef.Mru)
 			if err == nil {
 				client.SetCollector(reg)
-				client.Connect()
+				client.SetNotifier(queue)
+				client.SetConnectLimiter(connectLimiter)
+				client.SetKeepAlive(time.Duration(config.UpstreamKeepAlive) * time.Second)
+				client.SetDnsRefresh(time.Duration(config.DnsRefresh)*time.Second, config.DnsReconnect)
+				client.SetWatchdog(time.Duration(config.StreamWatchdog) * time.Second)
+				client.SetUrlLabels(urlLabels)
+				client.SetReadChunk(config.ReadChunk)
+				client.SetNullPacketFilter(streamdef.DropNullPackets, streamdef.NullPacketKeep)
+				client.SetBatchSize(streamdef.BatchSize)
+				client.SetUdpReaders(streamdef.UdpReaders)
+				client.SetSeamless(streamdef.Seamless)
+				client.SetSampleRate(streamdef.SamplePackets, time.Duration(streamdef.SampleInterval)*time.Second)
+				client.SetSampling(streamdef.Sample)
+				client.SetPidStatistics(streamdef.PidStatistics)
+				client.SetMaxAttempts(streamdef.MaxAttempts)
+				client.SetPreroll(streamdef.Preroll)
+				client.SetCircuitBreaker(streamdef.Breaker.Failures, time.Duration(streamdef.Breaker.Cooldown)*time.Second, time.Duration(streamdef.Breaker.MaxCooldown)*time.Second)
+				client.SetArrivalLog(streamdef.ArrivalLog.Path, streamdef.ArrivalLog.Size, streamdef.ArrivalLog.PcrOnly)
+				if config.AllowLossSimulation {
+					client.AllowLossSimulation()
+					sim := streamdef.LossSimulation
+					client.SetLossSimulation(sim.Drop, sim.Delay, time.Duration(sim.Jitter)*time.Millisecond)
+				} else if streamdef.LossSimulation != (configuration.LossSimulation{}) {
+					logger.Logkv(
+						"event", eventMainError,
+						"error", errorMainLossSimulation,
+						"stream", streamdef.Serve,
+						"message", fmt.Sprintf("Ignoring packet loss simulation of stream %s, allowlosssimulation is not set", streamdef.Serve),
+					)
+				}
+				if streamdef.OnDemand {
+					// viewers wait for the connect timeout, or a sensible default if there is none
+					wait := time.Duration(timeout) * time.Second
+					if wait == 0 {
+						wait = defaultDemandWait
+					}
+					client.SetOnDemand(time.Duration(streamdef.IdleTimeout)*time.Second, wait)
+					var windows []streaming.ScheduleWindow
+					for _, event := range streamdef.Schedule {
+						start, err := time.Parse(time.RFC3339, event.Start)
+						if err != nil {
+							logger.Logkv(
+								"event", eventMainError,
+								"error", errorMainInvalidSchedule,
+								"stream", streamdef.Serve,
+								"message", fmt.Sprintf("Ignoring invalid scheduled event start for stream %s: %v", streamdef.Serve, err),
+							)
+							continue
+						}
+						windows = append(windows, streaming.ScheduleWindow{
+							Start: start,
+							End:   start.Add(time.Duration(event.Duration) * time.Second),
+						})
+					}
+					client.SetSchedule(windows, time.Duration(streamdef.Warmup)*time.Second)
+				}
+				// the recorder and packager are sinks of the streamer, they must be added before the stream starts
+				if streamdef.Record.Path != "" {
+					recorders[streamdef.Serve] = streaming.NewRecorder(streamdef.Serve, streamdef.Record.Path, streamdef.Record.MaxSize, time.Duration(streamdef.Record.MaxDuration)*time.Second, !streamdef.Record.Manual, streamer)
+				}
+				if streamdef.Cmaf != "" {
+					packager := streaming.NewPackager(streamdef.Serve, streamdef.Cmaf, streamer, controller, authenticator)
+					packager.SetCollector(reg)
+					mux.Handle(streamdef.Cmaf, streamMiddleware(packager))
+				}
+				client.ConnectContext(upstreams)
 				clients[streamdef.Serve] = client
-				mux.Handle(streamdef.Serve, streamer)
+				streamers[streamdef.Serve] = streamer
+				mux.Handle(streamdef.Serve, streamMiddleware(streamer))
 
 				logger.Logkv(
 					"event", eventMainHandled,
@@ -201,30 +673,83 @@ func main() {
 				)
 				i++
 			} else {
-				log.Print(err)
+				logger.Logkv(
+					"event", eventMainError,
+					"error", errorMainStreamSetup,
+					"serve", streamdef.Serve,
+					"remote", streamdef.Remotes,
+					"message", fmt.Sprintf("Cannot set up stream %s: %v", streamdef.Serve, err),
+				)
+				failed[streamdef.Serve] = err
 			}
 
 		case "static":
 			logger.Logkv(
 				"event", eventMainConfigStatic,
 				"serve", streamdef.Serve,
-				"remote", streamdef.Remote,
-				"message", fmt.Sprintf("Configuring static resource %s on %s", streamdef.Serve, streamdef.Remote),
+				"remote", streamdef.Remotes,
+				"message", fmt.Sprintf("Configuring static resource %s on %v", streamdef.Serve, streamdef.Remotes),
 			)
-			authenticator := auth.NewAuthenticator(streamdef.Authentication, config.UserList)
-			proxy, err := streaming.NewProxy(streamdef.Remote, config.Timeout, streamdef.Cache, authenticator)
+			authenticator := auth.NewResourceAuthenticator(streamdef.Serve, streamdef.Authentication, config.UserList)
+			proxy, err := streaming.NewMirrorProxy(streamdef.Remotes, config.Timeout, streamdef.Cache, authenticator)
 			if err != nil {
 				log.Print(err)
 			} else {
 				proxy.SetStatistics(stats)
+				proxy.SetName(streamdef.Serve)
+				proxy.SetFetchQueue(streamdef.FetchQueue)
+				proxy.SetFetchLimiter(fetchLimiter)
+				proxy.SetMaxStale(time.Duration(streamdef.MaxStale) * time.Second)
+				proxy.SetErrorCache(time.Duration(streamdef.ErrorCache) * time.Second)
+				proxy.SetHeaders(streamdef.ForwardHeaders, streamdef.DropHeaders)
+				proxy.SetDefaultMime(streamdef.DefaultMime)
+				proxy.SetContentType(streamdef.ContentType)
 				proxy.Start()
-				mux.Handle(streamdef.Serve, proxy)
+				mux.Handle(streamdef.Serve, resourceMiddleware(proxy))
+			}
+
+		case "alias":
+			logger.Logkv(
+				"event", eventMainConfigAlias,
+				"serve", streamdef.Serve,
+				"remote", streamdef.Remote,
+				"message", fmt.Sprintf("Serving stream %s under %s", streamdef.Remote, streamdef.Serve),
+			)
+			// the alias shares the upstream connection and the streamer of the original stream
+			if streamer := streamers[streamdef.Remote]; streamer != nil {
+				mux.Handle(streamdef.Serve, streamMiddleware(streamer))
+			} else if err, ok := failed[streamdef.Remote]; ok {
+				logger.Logkv(
+					"event", eventMainError,
+					"error", errorMainStreamFailed,
+					"serve", streamdef.Serve,
+					"remote", streamdef.Remote,
+					"message", fmt.Sprintf("Stream %s could not be set up (%v), not registering alias %s", streamdef.Remote, err, streamdef.Serve),
+				)
+			} else {
+				logger.Logkv(
+					"event", eventMainError,
+					"error", errorMainStreamNotFound,
+					"serve", streamdef.Serve,
+					"remote", streamdef.Remote,
+					"message", fmt.Sprintf("Error, stream not found: %s", streamdef.Remote),
+				)
 			}
 
 		case "api":
-			authenticator := auth.NewAuthenticator(streamdef.Authentication, config.UserList)
+			authenticator := auth.NewResourceAuthenticator(streamdef.Serve, streamdef.Authentication, config.UserList)
+			// read-only APIs
+			readMethods := []string{http.MethodGet, http.MethodHead}
 
 			switch streamdef.Api {
+			case "config":
+				logger.Logkv(
+					"event", eventMainConfigApi,
+					"api", "config",
+					"serve", streamdef.Serve,
+					"message", fmt.Sprintf("Registering configuration API on %s", streamdef.Serve),
+				)
+				mux.Handle(streamdef.Serve, resourceMiddleware(api.NewLimitedApi(api.NewConfigApi(config, authenticator), config.ApiMaxBodySize, readMethods...)))
 			case "health":
 				logger.Logkv(
 					"event", eventMainConfigApi,
@@ -232,7 +757,7 @@ func main() {
 					"serve", streamdef.Serve,
 					"message", fmt.Sprintf("Registering global health API on %s", streamdef.Serve),
 				)
-				mux.Handle(streamdef.Serve, api.NewHealthApi(stats, authenticator))
+				mux.Handle(streamdef.Serve, resourceMiddleware(api.NewLimitedApi(api.NewHealthApi(stats, config.HealthFull, config.HealthFullPercent, authenticator), config.ApiMaxBodySize, readMethods...)))
 			case "statistics":
 				logger.Logkv(
 					"event", eventMainConfigApi,
@@ -240,7 +765,23 @@ func main() {
 					"serve", streamdef.Serve,
 					"message", fmt.Sprintf("Registering global statistics API on %s", streamdef.Serve),
 				)
-				mux.Handle(streamdef.Serve, api.NewStatisticsApi(stats, authenticator))
+				mux.Handle(streamdef.Serve, resourceMiddleware(api.NewLimitedApi(api.NewStatisticsApi(stats, authenticator), config.ApiMaxBodySize, readMethods...)))
+			case "resetpeak":
+				logger.Logkv(
+					"event", eventMainConfigApi,
+					"api", "resetpeak",
+					"serve", streamdef.Serve,
+					"message", fmt.Sprintf("Registering peak connection reset API on %s", streamdef.Serve),
+				)
+				mux.Handle(streamdef.Serve, resourceMiddleware(api.NewLimitedApi(api.NewPeakResetApi(stats, authenticator), config.ApiMaxBodySize, http.MethodPost)))
+			case "resetstats":
+				logger.Logkv(
+					"event", eventMainConfigApi,
+					"api", "resetstats",
+					"serve", streamdef.Serve,
+					"message", fmt.Sprintf("Registering statistics reset API on %s", streamdef.Serve),
+				)
+				mux.Handle(streamdef.Serve, resourceMiddleware(api.NewLimitedApi(api.NewStatisticsResetApi(stats, authenticator), config.ApiMaxBodySize, http.MethodPost)))
 			case "check":
 				logger.Logkv(
 					"event", eventMainConfigApi,
@@ -250,7 +791,16 @@ func main() {
 				)
 				client := clients[streamdef.Remote]
 				if client != nil {
-					mux.Handle(streamdef.Serve, api.NewStreamStateApi(client, authenticator))
+					mux.Handle(streamdef.Serve, resourceMiddleware(api.NewLimitedApi(api.NewStreamStateApi(client, authenticator), config.ApiMaxBodySize, readMethods...)))
+				} else if err, ok := failed[streamdef.Remote]; ok {
+					logger.Logkv(
+						"event", eventMainError,
+						"error", errorMainStreamFailed,
+						"api", "check",
+						"remote", streamdef.Remote,
+						"message", fmt.Sprintf("Stream %s could not be set up (%v), it will be reported as offline", streamdef.Remote, err),
+					)
+					mux.Handle(streamdef.Serve, resourceMiddleware(api.NewLimitedApi(api.NewStreamStateApi(failedStream{}, authenticator), config.ApiMaxBodySize, readMethods...)))
 				} else {
 					logger.Logkv(
 						"event", eventMainError,
@@ -269,7 +819,21 @@ func main() {
 				)
 				client := clients[streamdef.Remote]
 				if client != nil {
-					mux.Handle(streamdef.Serve, api.NewStreamControlApi(client, authenticator))
+					var control http.Handler
+					if recorder := recorders[streamdef.Remote]; recorder != nil {
+						control = api.NewStreamRecordControlApi(client, recorder, authenticator)
+					} else {
+						control = api.NewStreamControlApi(client, authenticator)
+					}
+					mux.Handle(streamdef.Serve, resourceMiddleware(api.NewLimitedApi(control, config.ApiMaxBodySize, http.MethodPost)))
+				} else if err, ok := failed[streamdef.Remote]; ok {
+					logger.Logkv(
+						"event", eventMainError,
+						"error", errorMainStreamFailed,
+						"api", "control",
+						"remote", streamdef.Remote,
+						"message", fmt.Sprintf("Stream %s could not be set up (%v), not registering its control API", streamdef.Remote, err),
+					)
 				} else {
 					logger.Logkv(
 						"event", eventMainError,
@@ -279,6 +843,30 @@ func main() {
 						"message", fmt.Sprintf("Error, stream not found: %s", streamdef.Remote),
 					)
 				}
+			case "probe":
+				logger.Logkv(
+					"event", eventMainConfigApi,
+					"api", "probe",
+					"serve", streamdef.Serve,
+					"message", fmt.Sprintf("Registering upstream probe API on %s", streamdef.Serve),
+				)
+				prober := streaming.NewProber(config.Timeout, time.Duration(config.ProbeDuration)*time.Second)
+				mux.Handle(streamdef.Serve, resourceMiddleware(api.NewLimitedApi(api.NewProbeApi(prober, authenticator), config.ApiMaxBodySize, http.MethodGet)))
+			case "index":
+				logger.Logkv(
+					"event", eventMainConfigApi,
+					"api", "index",
+					"serve", streamdef.Serve,
+					"message", fmt.Sprintf("Registering stream index on %s", streamdef.Serve),
+				)
+				// list all streams served on the same listener, including ones that are configured later
+				var streams []string
+				for _, resource := range config.Resources {
+					if resource.Type == "stream" && resource.Listener == streamdef.Listener {
+						streams = append(streams, resource.Serve)
+					}
+				}
+				mux.Handle(streamdef.Serve, resourceMiddleware(api.NewLimitedApi(api.NewIndexApi(streamdef.Serve, streams, stats, authenticator), config.ApiMaxBodySize, readMethods...)))
 			case "prometheus":
 				logger.Logkv(
 					"event", eventMainConfigApi,
@@ -286,7 +874,7 @@ func main() {
 					"serve", streamdef.Serve,
 					"message", fmt.Sprintf("Registering Prometheus API on %s", streamdef.Serve),
 				)
-				mux.Handle(streamdef.Serve, api.NewPrometheusApi(authenticator))
+				mux.Handle(streamdef.Serve, resourceMiddleware(api.NewLimitedApi(api.NewPrometheusApi(authenticator), config.ApiMaxBodySize, readMethods...)))
 			default:
 				logger.Logkv(
 					"event", eventMainError,
@@ -314,10 +902,61 @@ func main() {
 			"message", "Starting stats monitor",
 		)
 		stats.Start()
-		logger.Logkv(
-			"event", eventMainStartServer,
-			"message", "Starting server",
-		)
-		log.Fatal(http.ListenAndServe(config.Listen, mux))
+
+		if len(servers) == 0 {
+			log.Fatal("No listeners configured")
+		}
+
+		errs := make(chan error, len(servers))
+		for _, server := range servers {
+			logger.Logkv(
+				"event", eventMainStartServer,
+				"listen", server.Addr,
+				"message", fmt.Sprintf("Starting server on %s", server.Addr),
+			)
+			go func(server *http.Server) {
+				errs <- server.ListenAndServe()
+			}(server)
+		}
+
+		signals := make(chan os.Signal, 1)
+		util.RegisterShutdownSignalHandler(signals)
+
+		// wait until one of the servers fails or we're told to quit
+		var err error
+		select {
+		case err = <-errs:
+			logger.Logkv(
+				"event", eventMainError,
+				"error", errorMainServer,
+				"message", fmt.Sprintf("Server error: %v", err),
+			)
+		case sig := <-signals:
+			logger.Logkv(
+				"event", eventMainStopServer,
+				"signal", sig.String(),
+				"message", fmt.Sprintf("Received signal %v, shutting down", sig),
+			)
+		}
+
+		// streaming connections never become idle, so we close them forcibly
+		for _, server := range servers {
+			if err := server.Close(); err != nil {
+				logger.Logkv(
+					"event", eventMainError,
+					"error", errorMainServer,
+					"listen", server.Addr,
+					"message", fmt.Sprintf("Error closing server: %v", err),
+				)
+			}
+		}
+		stopUpstreams()
+		stats.Stop()
+		// sends the shutdown notifications
+		queue.Shutdown()
+
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 }
@@ -0,0 +1,50 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// signurl generates signed URLs for resources that use signed authentication.
+//
+// Usage: signurl [-validity seconds] secret url
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/onitake/restreamer/auth"
+	"log"
+	"net/url"
+	"os"
+	"time"
+)
+
+func main() {
+	validity := flag.Uint("validity", 3600, "number of seconds the URL stays valid")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-validity seconds] secret url\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	urly, err := url.Parse(flag.Arg(1))
+	if err != nil {
+		log.Fatal("Invalid URL: ", err)
+	}
+	expires := time.Now().Add(time.Duration(*validity) * time.Second)
+	fmt.Println(auth.SignUrl(urly, flag.Arg(0), expires))
+}
@@ -19,25 +19,40 @@ package configuration
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
 )
 
 // Authentication configures authentication for a resource.
 // The exact semantics depend on the resource.
 type Authentication struct {
 	// Type specifies the authentication type.
-	// Only the empty string, 'basic' and 'bearer' are currently supported.
+	// Only the empty string, 'basic', 'bearer' and 'signed' are currently supported.
 	// The interpretation of the type is as follows:
 	// '': Disable authentication and allow all requests to succeed.
 	// 'basic': compare the string after the 'Authorization: Basic' header with
 	// base64(md5sum(username + ':' + passwords[username])) and allow the request if they match.
 	// 'bearer': compare the string after 'Authentication: Bearer' with
 	// base64(passwords[username]) and allow the request if they match.
+	// 'signed': verify the token and expires query parameters of a signed URL,
+	// using passwords[username] as the shared secret.
 	Type string `json:"type"`
 	// Realm specifies the authentication realm that is sent
 	// back to the client if the authentication header was missing.
+	// For bearer authentication, a challenge is only sent if a realm is set.
 	Realm string `json:"realm"`
+	// NoChallenge suppresses the WWW-Authenticate header on failed requests.
+	// A 403 is sent instead of a 401, as some players retry endlessly when challenged.
+	NoChallenge bool `json:"nochallenge"`
+	// FailureBody is sent as the response body when authentication fails.
+	FailureBody string `json:"failurebody"`
+	// FailureRedirect redirects clients to this URL when authentication fails.
+	// Takes precedence over the challenge and FailureBody.
+	FailureRedirect string `json:"failureredirect"`
 	// User specifies a valid user who can access the resource.
 	// This is merged with Users.
 	User string `json:"user"`
@@ -46,6 +61,62 @@ type Authentication struct {
 	Users []string `json:"users"`
 }
 
+// Record configures recording of a stream to disk.
+type Record struct {
+	// Path is the file name template of the recording files. Recording is disabled if it is empty.
+	// The placeholder {stream} is replaced with the stream name, {time} with the time when the file was created.
+	Path string `json:"path"`
+	// MaxSize is the size in bytes after which a new file is started. 0 means no limit.
+	MaxSize uint64 `json:"maxsize"`
+	// MaxDuration is the time in seconds after which a new file is started. 0 means no limit.
+	MaxDuration uint `json:"maxduration"`
+	// Manual defers recording until it is started through the control API.
+	Manual bool `json:"manual"`
+}
+
+// RateLimit configures the connection rate limit per client.
+type RateLimit struct {
+	// Rate is the number of connections per second each client may open.
+	// If it is 0, rate limiting is disabled.
+	Rate float64 `json:"rate"`
+	// Burst is the number of connections a client may open at once before
+	// the rate limit applies.
+	Burst uint `json:"burst"`
+}
+
+// LossSimulation injects artificial packet loss and jitter into a stream's input, for testing.
+// It only takes effect if AllowLossSimulation is set in the global configuration.
+type LossSimulation struct {
+	// Drop is the probability (0..1) that an incoming packet is discarded.
+	Drop float64 `json:"drop"`
+	// Delay is the probability (0..1) that an incoming packet is held back.
+	Delay float64 `json:"delay"`
+	// Jitter is the maximum time in milliseconds a packet is held back.
+	Jitter uint `json:"jitter"`
+}
+
+// ArrivalLog records packet arrival times of a stream for latency analysis.
+// Recording is started through the control API.
+type ArrivalLog struct {
+	// Path is the file name template of the logs. {stream} is replaced with the stream name,
+	// {time} with the UTC time when recording started. Logs are written as JSON if the name
+	// ends in .json, and as CSV otherwise. The arrival log is disabled if it is empty.
+	Path string `json:"path"`
+	// Size is the number of packets that are kept, the most recent ones win. 100000 if 0.
+	Size uint `json:"size"`
+	// PcrOnly only logs packets with a PCR.
+	PcrOnly bool `json:"pcronly"`
+}
+
+// ScheduledEvent is a known time span during which viewers are expected.
+type ScheduledEvent struct {
+	// Start is the start time of the event, in RFC 3339 format.
+	Start string `json:"start"`
+	// Duration is the length of the event in seconds.
+	// The idle timeout of an on-demand stream only applies after the event has ended.
+	Duration uint `json:"duration"`
+}
+
 // Resource is a single HTTP endpoint.
 type Resource struct {
 	// Type is the resource type.
@@ -55,40 +126,314 @@ type Resource struct {
 	// Serve is the local URL to serve this stream under.
 	Serve string `json:"serve"`
 	// Remote is a single upstream URL or API argument;
+	// for aliases, it is the serve path of the stream to share.
 	// it will be added to Remotes during parsing.
 	Remote string `json:"remote"`
 	// Remotes is the upstream URLs.
+	// Streams connect to them in random order, static resources try them in the order given.
 	Remotes []string `json:"remotes"`
 	// ClientInterface denotes a specific network interface for the remote connection.
 	// This is currently only supported for multicast UDP.
 	// All interfaces will be used if this is not set.
 	ClientInterface string `json:"clientinterface"`
+	// Listener is the name of the listener that serves this resource.
+	// If it is empty, the resource is served on the default listener (see Configuration.Listen).
+	Listener string `json:"listener"`
 	// Cache the cache time in seconds.
 	Cache uint `json:"cache"`
+	// MaxStale is the time in seconds a static resource may still be served after its cache time has passed,
+	// while it is refreshed in the background (stale-while-revalidate). 0 refreshes before serving.
+	MaxStale uint `json:"maxstale"`
+	// ErrorCache is the time in seconds an upstream error response (non-2xx) of a static resource is cached.
+	// It is never longer than Cache. If 0, errors are cached for 5 seconds.
+	ErrorCache uint `json:"errorcache"`
+	// FetchQueue is the number of requests to a static resource that can be queued for its fetcher.
+	// If 0, 10 requests can be queued.
+	FetchQueue uint `json:"fetchqueue"`
+	// ForwardHeaders is the list of upstream headers that are passed through to clients for static resources.
+	// Entries ending with * match all headers starting with the name, a single * forwards everything.
+	// If empty, Content-Type, Content-Language and Content-Disposition are forwarded.
+	ForwardHeaders []string `json:"forwardheaders"`
+	// DropHeaders is a list of upstream headers that are never passed through, even if they match ForwardHeaders.
+	DropHeaders []string `json:"dropheaders"`
+	// ContentType overrides the content type of static resources, including parameters like the charset.
+	// If empty, the upstream content type or a type guessed from the file extension is used.
+	ContentType string `json:"contenttype"`
+	// DefaultMime is the content type of static resources whose type is unknown.
+	// If empty, application/octet-stream is used.
+	DefaultMime string `json:"defaultmime"`
 	// Authentication specifies credentials required to access this resource.
 	// If the authentication type is unset, no authentication is required.
 	Authentication Authentication `json:"authentication"`
 	// Mru (maximum receive unit) is the size of the datagram receive buffer.
 	// Only used for UDP and RTP protocols.
+	// Must be at least the size of one TS packet (188 bytes) and no larger than 65535 bytes.
 	Mru uint `json:"mru"`
+	// ReadBuffer is the socket receive buffer size, in packets.
+	// Only used for UDP and RTP protocols. If 0, InputBuffer from the global configuration is used.
+	ReadBuffer uint `json:"readbuffer"`
+	// Timeout overrides the global upstream connect timeout of this stream, in seconds.
+	// If it is not set, the global Timeout is used. Must not exceed one day.
+	Timeout *uint `json:"timeout"`
+	// Reconnect overrides the global reconnect delay of this stream, in seconds. 0 disables reconnecting.
+	// If it is not set, the global Reconnect delay is used. Must not exceed one day.
+	Reconnect *uint `json:"reconnect"`
+	// ReadTimeout overrides the global upstream read timeout of this stream, in seconds.
+	// If it is not set, the global ReadTimeout is used. Must not exceed one day.
+	ReadTimeout *uint `json:"readtimeout"`
+	// UdpReaders is the number of goroutines that receive from a UDP socket in parallel.
+	// Spreads the load of high-bitrate streams across CPU cores. RTP packets are put back in order
+	// by their sequence numbers, but bare TS packets may be slightly reordered.
+	// If 0 or 1, a single goroutine is used.
+	UdpReaders uint `json:"udpreaders"`
 	// Preamble specifies the name of a file containing a static preamble, that is sent to each client before
 	// actual data is streamed. It can be used to synchronize the decoder quickly, instead of needing to wait for
 	// the next PAT, PMT, SPS and PPS packets.
 	// Make sure that the format of the preamble content matches the stream, or you will end up with badly
 	// configured decoder!
 	Preamble string `json:"preamble"`
+	// Cmaf enables an additional HLS output with fragmented MP4 (CMAF) segments for a stream.
+	// It specifies the path prefix under which the playlist (index.m3u8) and the segments are served.
+	// Only H.264 video and AAC audio are supported. DASH and Low-Latency HLS are not available.
+	// Each player counts as one connection until it hasn't made a request for 30 seconds.
+	Cmaf string `json:"cmaf"`
+	// DropNullPackets filters null packets (PID 0x1FFF) from the input, to save bandwidth on
+	// constant-bitrate streams. Some players rely on the padding for timing, so this is off by default.
+	DropNullPackets bool `json:"dropnullpackets"`
+	// NullPacketKeep passes every n-th null packet through despite filtering. 0 drops all of them.
+	NullPacketKeep uint `json:"nullpacketkeep"`
+	// TableInterval repeats the most recent PAT and PMT of the stream to all clients every
+	// this many milliseconds, so players that joined in between tune in faster. 0 disables repetition.
+	// Only tables that fit into a single TS packet are repeated.
+	TableInterval uint `json:"tableinterval"`
+	// TablesOnJoin sends the most recent PAT and PMT to each new client before the stream data.
+	TablesOnJoin bool `json:"tablesonjoin"`
+	// WriteBuffer collects up to this many bytes for each client and sends them with a single
+	// write and flush, to save syscalls with many clients. 0 writes each packet separately.
+	WriteBuffer uint `json:"writebuffer"`
+	// WriteDelay is the maximum number of milliseconds data is held in the write buffer.
+	// If it is 0, data is held for up to 20ms.
+	WriteDelay uint `json:"writedelay"`
+	// EventStream allows clients to request the stream as base64 encoded Server-Sent Events,
+	// by sending Accept: text/event-stream. This is useful where only text/event-stream is let through.
+	EventStream bool `json:"eventstream"`
+	// BatchSize combines this many TS packets before they are passed on to the connections.
+	// This reduces the per-packet overhead at high bitrates, 7 packets fill one UDP datagram.
+	// Slow clients lose whole batches. 0 or 1 disables batching.
+	BatchSize uint `json:"batchsize"`
+	// Seamless keeps viewers connected when the upstream is lost, and joins the next
+	// upstream connection without timestamp or continuity jumps.
+	Seamless bool `json:"seamless"`
+	// Sample enables a periodic debug log of the incoming packets from the start.
+	// It can also be toggled through the control API.
+	Sample bool `json:"sample"`
+	// SamplePackets is the number of packets between two debug summaries, 0 for no limit.
+	SamplePackets uint `json:"samplepackets"`
+	// SampleInterval is the time between two debug summaries in seconds, 0 for no limit.
+	// If both are 0, a summary is logged every 10 seconds.
+	SampleInterval uint `json:"sampleinterval"`
+	// MaxAttempts gives up reconnecting after this many rounds through all remotes
+	// without receiving data, and marks the stream dead until it is revived through the control API.
+	// 0 retries forever. Only used if reconnecting is enabled.
+	MaxAttempts uint `json:"maxattempts"`
+	// Breaker holds back reconnects to an upstream that keeps failing to deliver data.
+	// It has no effect if reconnecting is disabled.
+	Breaker Breaker `json:"breaker"`
+	// Preroll is the number of packets (of 188 bytes each) that are buffered after connecting,
+	// before the source is reported connected and viewers receive data.
+	// The check API reports the stream as buffering in the meantime. 0 disables the pre-roll.
+	Preroll uint `json:"preroll"`
+	// PidStatistics adds the traffic of each PID to the stream statistics.
+	// This adds some work for every packet. It can also be toggled through the control API.
+	PidStatistics bool `json:"pidstatistics"`
+	// LossSimulation drops or delays incoming packets at random, to test players and stall detection.
+	// Requires AllowLossSimulation. It can also be changed through the control API.
+	LossSimulation LossSimulation `json:"losssimulation"`
+	// ArrivalLog records packet arrival times and PCRs for latency analysis, when requested through the control API.
+	ArrivalLog ArrivalLog `json:"arrivallog"`
+	// Record archives the stream to disk while it is being served.
+	Record Record `json:"record"`
+	// Status is the HTTP status sent when a client starts streaming. 200 if 0.
+	// Must be a 2xx code.
+	Status int `json:"status"`
+	// RefusedStatus is the HTTP status sent when a client is refused because the stream
+	// is offline or full. 503 if 0. Must be a 4xx or 5xx code.
+	RefusedStatus int `json:"refusedstatus"`
+	// RetryAfter is the number of seconds sent in the Retry-After header of refused
+	// connections with status 503. 10 if 0.
+	RetryAfter uint `json:"retryafter"`
+	// RefusedFile is the name of a file that is sent as the body of refused connections,
+	// like a short MPEG-TS clip announcing that the stream is offline.
+	// Clients that explicitly accept application/json get a JSON error instead.
+	RefusedFile string `json:"refusedfile"`
+	// RefusedType is the content type of RefusedFile. video/mpeg if empty.
+	RefusedType string `json:"refusedtype"`
+	// RefusedRedirect redirects refused connections to this URL, like a poster image.
+	// Takes precedence over RefusedStatus and RefusedFile.
+	RefusedRedirect string `json:"refusedredirect"`
+	// Methods is the list of accepted HTTP methods. Others are answered with 405 Method Not Allowed.
+	// HEAD requests only get the response headers and don't take up a connection slot.
+	// If empty, GET and HEAD are accepted.
+	Methods []string `json:"methods"`
+	// Countries restricts access to clients from these countries (ISO 3166-1 alpha-2 codes).
+	// Clients whose location is unknown are refused as well. All countries are allowed if empty.
+	// Requires a GeoIP database.
+	Countries []string `json:"countries"`
+	// BlockedCountries are countries (ISO 3166-1 alpha-2 codes) whose clients are refused.
+	// Requires a GeoIP database.
+	BlockedCountries []string `json:"blockedcountries"`
+	// RequireHeaders are request headers that clients must send, like a Referer from an allowed site.
+	// Clients that don't satisfy all rules are refused with 403 Forbidden.
+	// This is a crude measure against hotlinking and can be combined with authentication.
+	RequireHeaders []RequiredHeader `json:"requireheaders"`
+	// Headers are additional HTTP headers sent with stream responses.
+	// They override the default headers, like Content-Type.
+	Headers map[string]string `json:"headers"`
+	// FlushInterval is the maximum time in milliseconds that data is held in the response buffer.
+	// Without it, data is only sent when the server's buffer is full, which can add noticeable
+	// latency on low-bitrate streams, or behind reverse proxies that speak HTTP/2 to clients.
+	// 0 leaves flushing to the HTTP server.
+	FlushInterval uint `json:"flushinterval"`
+	// IdleKeepAlive sends a null packet to clients that haven't received any data for this many seconds,
+	// so proxies and load balancers don't close idle connections while the upstream stalls briefly.
+	// 0 disables keep-alive packets.
+	IdleKeepAlive uint `json:"idlekeepalive"`
+	// OnDemand connects the upstream only when the first viewer arrives.
+	OnDemand bool `json:"ondemand"`
+	// IdleTimeout is the number of seconds an on-demand upstream stays connected without viewers.
+	IdleTimeout uint `json:"idletimeout"`
+	// Schedule lists events during which an on-demand upstream is kept connected.
+	Schedule []ScheduledEvent `json:"schedule"`
+	// Warmup is the number of seconds before a scheduled event when the upstream is connected.
+	Warmup uint `json:"warmup"`
+	// IdleResponse answers requests with 204 No Content while the upstream is connected,
+	// but no packets have arrived yet, instead of holding the connection until data flows.
+	IdleResponse bool `json:"idleresponse"`
+	// RateLimit overrides the global connection rate limit for this stream.
+	// The bucket is not shared with other streams.
+	RateLimit RateLimit `json:"ratelimit"`
+	// MaxDuplicates is the number of concurrent connections a client may open to this stream
+	// before further connections are reported as duplicates. 0 disables duplicate detection.
+	MaxDuplicates uint `json:"maxduplicates"`
+	// RejectDuplicates refuses duplicate connections instead of only logging them.
+	RejectDuplicates bool `json:"rejectduplicates"`
+	// OutputBytes is the size of the output buffer per connection in bytes.
+	// It overrides the global OutputBuffer packet count if it is not 0.
+	OutputBytes uint `json:"outputbytes"`
+	// OutputDuration limits the output buffer per connection to the amount of data received
+	// in this many milliseconds, based on the measured bitrate. 0 disables the limit.
+	OutputDuration uint `json:"outputduration"`
+	// MaxConnections is the hard connection limit of this stream. Further connections are refused.
+	// The global limit still applies. 0 means no limit.
+	MaxConnections uint `json:"maxconnections"`
+	// FullConnections is the soft connection limit of this stream. When it is reached, the stream
+	// and the health API report "full", and a threshold named "softlimit" sends threshold_hit notifications.
+	// 0 disables the soft limit.
+	FullConnections uint `json:"fullconnections"`
+	// FullPolicy decides what happens to new viewers at the soft limit:
+	// "admit" (the default) accepts them, "queue" holds them in the waiting room until
+	// the stream drops below the soft limit. Without a waiting room, they are refused.
+	FullPolicy string `json:"fullpolicy"`
+	// OutputPolicy decides what happens when a client's output buffer is full:
+	// "drop" (the default) discards packets, "disconnect" closes the connection.
+	OutputPolicy string `json:"outputpolicy"`
+	// Framing decides how the length of the stream is announced to clients:
+	// "chunked" (the default) uses chunked transfer encoding, "close" sends the stream
+	// unchunked and ends it by closing the connection, "length" sends a large Content-Length.
+	// Only needed for legacy players that can't handle chunked responses.
+	Framing string `json:"framing"`
+	// ContentLength is the Content-Length sent with the "length" framing.
+	// The stream is cut off when it is reached. If it is 0, 2^63-1 is used.
+	ContentLength int64 `json:"contentlength"`
+}
+
+// RequiredHeader is a request header that clients must send.
+type RequiredHeader struct {
+	// Name is the name of the header.
+	Name string `json:"name"`
+	// Values are the accepted values of the header.
+	Values []string `json:"values"`
+	// Pattern is a regular expression that accepted values match, like ^https://example\.com/.
+	// If neither Values nor Pattern are set, any value is accepted.
+	Pattern string `json:"pattern"`
+}
+
+// Breaker configures the upstream circuit breaker of a stream.
+type Breaker struct {
+	// Failures is the number of connections in a row that end without delivering any data
+	// before the breaker opens. 0 disables the breaker.
+	Failures uint `json:"failures"`
+	// Cooldown is the number of seconds reconnecting is held back when the breaker opens.
+	// It doubles every time the attempt after a cooldown fails as well. 60 if 0.
+	Cooldown uint `json:"cooldown"`
+	// MaxCooldown is the upper limit of the cooldown in seconds.
+	MaxCooldown uint `json:"maxcooldown"`
+}
+
+// Listener is an additional network endpoint with its own set of resources.
+type Listener struct {
+	// Name is a unique identifier that resources can refer to.
+	Name string `json:"name"`
+	// Listen is the interface to listen on.
+	Listen string `json:"listen"`
 }
 
 // UserCredentials is a set of credentials for a single user
 type UserCredentials struct {
 	// Password is the key or password of this user.
+	// It may also reference an external secret, which is resolved when the configuration is loaded:
+	// 'file:/path/to/secret' reads the password from a file, with trailing line breaks removed.
+	// 'env:VARIABLE' takes the password from an environment variable.
 	Password string `json:"password"`
 }
 
+// resolveSecret looks up the actual value of a password that references an external source.
+// Passwords without a known prefix are returned as-is.
+func resolveSecret(password string) (string, error) {
+	switch {
+	case strings.HasPrefix(password, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(password, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(password, "env:"):
+		name := strings.TrimPrefix(password, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	default:
+		return password, nil
+	}
+}
+
+// Threshold is a named connection threshold, used for threshold_hit and threshold_miss notifications.
+type Threshold struct {
+	// Name identifies the threshold in notifications.
+	Name string `json:"name"`
+	// Stream is the stream (serve path) whose connections are counted.
+	// If it is empty, the connections of all streams are counted.
+	Stream string `json:"stream"`
+	// Hit is the number of connections when threshold_hit is sent.
+	Hit uint `json:"hit"`
+	// Miss is the number of connections below which threshold_miss is sent.
+	// If it is 0 or larger than Hit, Hit is used.
+	Miss uint `json:"miss"`
+}
+
 // Notification is a single notification definition.
 type Notification struct {
 	// Event is the event to watch for.
 	Event string `json:"event"`
+	// Threshold restricts threshold_hit and threshold_miss notifications to a single threshold.
+	// If it is empty, all thresholds are reported.
+	Threshold string `json:"threshold"`
+	// Stream restricts threshold, zero_viewers and source notifications to a single stream (serve path).
+	// Events for all streams combined have an empty stream name.
+	// If it is empty, all streams are reported.
+	Stream string `json:"stream"`
 	// Type is the kind of callback to send.
 	Type string `json:"type"`
 	// Url is the remote to access (if Type is http).
@@ -97,6 +442,25 @@ type Notification struct {
 	// If the authentication type is unset, no authentication is sent.
 	// Only the first user from the list (or the single 'User') is used, all others are ignored.
 	Authentication Authentication `json:"authentication"`
+	// Headers are additional HTTP headers sent with the notification, for APIs that expect
+	// a token in a custom header.
+	// Values can reference external secrets like user passwords.
+	Headers map[string]string `json:"headers"`
+	// Query are additional query parameters appended to the URL.
+	// Values can reference external secrets like user passwords.
+	Query map[string]string `json:"query"`
+	// Command is the executable to run (if Type is exec).
+	Command string `json:"command"`
+	// Args are the command line arguments.
+	// The placeholders {event}, {connections}, {new}, {limit}, {threshold}, {stream} and {time}
+	// are replaced with the event data.
+	Args []string `json:"args"`
+	// Interval gives a heartbeat notification its own interval in seconds.
+	// If it is 0, the global HeartbeatInterval is used.
+	Interval uint `json:"interval"`
+	// Timeout is the number of seconds after which the command is killed.
+	// If it is 0, the command is killed after 30 seconds.
+	Timeout uint `json:"timeout"`
 }
 
 // Configuration is a representation of the configurable settings.
@@ -104,7 +468,47 @@ type Notification struct {
 // the builtin marshaler.
 type Configuration struct {
 	// Listen is the interface to listen on.
+	// This is the default listener for all resources that don't specify one.
+	// If it is empty, the default listener is disabled.
 	Listen string `json:"listen"`
+	// Listeners is a list of additional named listeners.
+	// Resources are assigned to them with their Listener option.
+	Listeners []Listener `json:"listeners"`
+	// MaxHeaderBytes limits the size of HTTP request headers on all listeners.
+	// If it is 0, the Go default (1MiB) is used.
+	MaxHeaderBytes int `json:"maxheaderbytes"`
+	// ApiMaxBodySize limits the size of request bodies sent to API endpoints, in bytes.
+	// If it is 0, request bodies are not limited.
+	ApiMaxBodySize int64 `json:"apimaxbodysize"`
+	// ProbeDuration is the time in seconds the probe API reads from an upstream.
+	ProbeDuration uint `json:"probeduration"`
+	// FetchConcurrency limits the number of upstream fetches of static resources that can run at the same time.
+	// Simultaneous requests for the same resource always share a single fetch. 0 means no limit.
+	FetchConcurrency uint `json:"fetchconcurrency"`
+	// RateLimit is the global connection rate limit per client.
+	// All streams that don't define their own limit share it.
+	RateLimit RateLimit `json:"ratelimit"`
+	// TrustedProxies is a list of IP addresses or networks of trusted reverse proxies.
+	// For requests from these addresses, the client address is taken from the Forwarded,
+	// X-Forwarded-For or X-Real-IP header, and used for logs, limits and statistics.
+	// These headers are ignored for requests from other addresses.
+	TrustedProxies []string `json:"trustedproxies"`
+	// ApiRateLimit is the request rate limit per client for static resources and APIs.
+	// All of them share it. Streams use RateLimit instead.
+	ApiRateLimit RateLimit `json:"apiratelimit"`
+	// Cors is the list of origins that browsers may access resources from, like https://example.com.
+	// * allows all origins. If it is empty, no CORS headers are sent.
+	Cors []string `json:"cors"`
+	// GeoIpDatabase is the path of a MaxMind DB with country data, like GeoLite2-Country.mmdb.
+	// It is used for the country restrictions of streams.
+	// If it is empty or can't be loaded, country restrictions are disabled.
+	GeoIpDatabase string `json:"geoipdatabase"`
+	// GeoIpReload is the number of seconds between checks for an updated GeoIP database file.
+	// 0 disables reloading.
+	GeoIpReload uint `json:"geoipreload"`
+	// GeoIpMetrics counts client connections by country and stream.
+	// Each country adds a time series per stream, so use with care.
+	GeoIpMetrics bool `json:"geoipmetrics"`
 	// Timeout is the connection timeout
 	// (both input and output).
 	Timeout uint `json:"timeout"`
@@ -112,6 +516,29 @@ type Configuration struct {
 	Reconnect uint `json:"reconnect"`
 	// ReadTimeout is the upstream read timeout.
 	ReadTimeout uint `json:"readtimeout"`
+	// UpstreamKeepAlive is the TCP keepalive interval of upstream connections, in seconds.
+	// Dead connections are detected by the operating system, even if ReadTimeout is disabled.
+	// 0 uses the Go runtime default (15 seconds), a negative value disables keepalives.
+	UpstreamKeepAlive int `json:"upstreamkeepalive"`
+	// DnsRefresh is the interval in seconds at which the host names of connected upstreams
+	// are resolved again. Address changes are logged. 0 disables re-resolution.
+	DnsRefresh uint `json:"dnsrefresh"`
+	// DnsReconnect reconnects an upstream when the address it is connected to
+	// is no longer returned by DNS. Requires DnsRefresh.
+	DnsReconnect bool `json:"dnsreconnect"`
+	// StartupConcurrency limits the number of upstreams that connect at the same time on startup,
+	// so many streams don't overwhelm shared origins. Reconnects are not limited. 0 means no limit.
+	StartupConcurrency uint `json:"startupconcurrency"`
+	// StartupDelay is the minimum time in milliseconds between two upstream connection attempts on startup.
+	// 0 starts them without delay.
+	StartupDelay uint `json:"startupdelay"`
+	// StreamWatchdog is the time in seconds a stream may take to accept a packet from its upstream
+	// while its input buffer is full. If it takes longer, it is restarted and the upstream reconnected.
+	// 0 disables the watchdog.
+	StreamWatchdog uint `json:"streamwatchdog"`
+	// ReadChunk is the size in bytes of the read buffer for stream-oriented upstreams like HTTP, TCP and files.
+	// Saves syscalls at high bitrates. Datagram upstreams are not affected. 0 reads each packet separately.
+	ReadChunk uint `json:"readchunk"`
 	// InputBuffer is the maximum number of packets on the input buffer of each stream.
 	// It also determines the socket buffer size for datagram-oriented connections.
 	InputBuffer uint `json:"inputbuffer"`
@@ -123,16 +550,89 @@ type Configuration struct {
 	// MaxConnections is the maximum total number of concurrent connections.
 	// If it is 0, no hard limit will be imposed.
 	MaxConnections uint `json:"maxconnections"`
+	// MaxMemory is the memory budget for connection output buffers, in bytes.
+	// Each connection is estimated to hold OutputBuffer * (188 + 24) bytes, new connections
+	// that would exceed the budget are refused with 503 Service Unavailable.
+	// If it is 0, memory is not limited.
+	MaxMemory uint64 `json:"maxmemory"`
+	// MaxEgressRate is the total outgoing bandwidth limit over all stream connections, in bytes per second.
+	// If it is 0, bandwidth is not limited.
+	MaxEgressRate uint64 `json:"maxegressrate"`
+	// WaitingRoom is the maximum number of clients that are held while MaxConnections is reached.
+	WaitingRoom uint `json:"waitingroom"`
+	// WaitTimeout is the number of seconds a client is held in the waiting room before
+	// it is turned away with 503 Service Unavailable.
+	// If it is 0, the waiting room is disabled and clients are refused immediately.
+	WaitTimeout uint `json:"waittimeout"`
+	// AcceptTimeout is the number of seconds a new connection waits for a stream to take it.
+	// If a stream is stalled for longer, the client is turned away with 503 Service Unavailable.
+	// If it is 0, the timeout is 5 seconds.
+	AcceptTimeout uint `json:"accepttimeout"`
 	// FullConnections is the soft limit on the total number of concurrent connections.
 	// If it is 0, no soft limit will be imposed/reported.
 	FullConnections uint `json:"fullconnections"`
+	// MissConnections is the number of connections below which a limit_miss notification is sent,
+	// after limit_hit was reported.
+	// If it is 0 or larger than FullConnections, FullConnections is used.
+	MissConnections uint `json:"missconnections"`
+	// LimitDebounce is the number of seconds a limit hit or miss must persist before it is reported.
+	// If it is 0, changes are reported immediately.
+	LimitDebounce uint `json:"limitdebounce"`
+	// HealthFull is the total number of connections at which the health API reports the server as full,
+	// so load balancers can drain it before a limit is reached. It does not affect admission.
+	// If it is 0, only the connection limits are reported.
+	HealthFull uint `json:"healthfull"`
+	// HealthFullPercent is the connection usage, in percent of MaxConnections (or FullConnections
+	// if there is no hard limit), at which the health API reports the server as full.
+	// It applies to streams with their own limits as well and does not affect admission.
+	// If it is 0, only the connection limits are reported.
+	HealthFullPercent uint `json:"healthfullpercent"`
 	// NoStats disables statistics collection, if set.
 	NoStats bool `json:"nostats"`
+	// NoProcessMetrics disables the Prometheus process metrics (process_*), if set.
+	NoProcessMetrics bool `json:"noprocessmetrics"`
+	// NoRuntimeMetrics disables the Prometheus Go runtime metrics (go_*), if set.
+	// They are always enabled when profiling is on.
+	NoRuntimeMetrics bool `json:"noruntimemetrics"`
+	// UrlLabels is the scheme for the url label of upstream metrics:
+	// sanitized (the default) strips credentials, query and fragment, full keeps the whole URL,
+	// host only keeps the scheme, host and port, hash uses a hash of the sanitized URL and none leaves it empty.
+	UrlLabels string `json:"urllabels"`
+	// StatsWindows is a list of time windows in seconds, over which average rates are calculated.
+	// If it is empty, averages over 10 seconds, 1 minute and 5 minutes are reported.
+	StatsWindows []uint `json:"statswindows"`
 	// HeartbeatInterval defines the number of seconds between heartbeat notifications.
 	// This setting has not effect if no notifications were defined.
 	HeartbeatInterval uint `json:"heartbeatinterval"`
+	// HeartbeatJitter adds a random delay of up to this many seconds to each heartbeat interval,
+	// so heartbeats from many servers don't arrive at the same time.
+	HeartbeatJitter uint `json:"heartbeatjitter"`
+	// HeartbeatImmediate sends the first heartbeat on startup, instead of after the first interval.
+	HeartbeatImmediate bool `json:"heartbeatimmediate"`
 	// Log is the access log file name.
 	Log string `json:"log"`
+	// AccessLog is the name of a file that receives one line per completed stream request.
+	// If it is empty, no access log is written.
+	AccessLog string `json:"accesslog"`
+	// AccessLogFormat is the line format of the access log:
+	// "combined" (the default) for the Combined Log Format followed by the duration in seconds,
+	// "common" for the Common Log Format, or "json".
+	AccessLogFormat string `json:"accesslogformat"`
+	// AccessLogResources writes requests to static resources and APIs to the access log as well.
+	AccessLogResources bool `json:"accesslogresources"`
+	// LogSampleWindow is the number of seconds over which repeated error log lines are summarized.
+	// The first occurrence is logged immediately, the number of repetitions after each window.
+	// If it is 0, all lines are logged.
+	LogSampleWindow uint `json:"logsamplewindow"`
+	// LogCompress writes the access log with gzip compression.
+	// Compressed logs can't be followed line by line, use zcat or similar tools to read them.
+	LogCompress bool `json:"logcompress"`
+	// LogFlushInterval is the number of seconds after which compressed log lines are written out.
+	// If it is 0, they are flushed every 5 seconds.
+	LogFlushInterval uint `json:"logflushinterval"`
+	// AllowLossSimulation enables the packet loss simulation of streams, in their configuration
+	// and through the control API. It is a testing aid, never set it on production servers.
+	AllowLossSimulation bool `json:"allowlosssimulation"`
 	// Profile determines if profiling should be enabled.
 	// Set to true to turn on the pprof web server.
 	Profile bool `json:"profile"`
@@ -141,6 +641,21 @@ type Configuration struct {
 	UserList map[string]UserCredentials `json:"userlist"`
 	// Resources is the list of streams.
 	Resources []Resource `json:"resources"`
+	// NotificationQueueSize is the number of notifications that can be queued for the handlers.
+	// If the queue is full, connection changes are merged and heartbeats are dropped.
+	// If it is 0, up to 10 notifications are queued.
+	NotificationQueueSize uint `json:"notificationqueuesize"`
+	// NotificationTimeout is the number of seconds a notification handler may take
+	// before it is cancelled. If it is 0, handlers are cancelled after 10 seconds.
+	NotificationTimeout uint `json:"notificationtimeout"`
+	// NotificationDrainTimeout is the number of seconds to wait for pending notifications on shutdown.
+	// If it is 0, shutdown waits for up to 10 seconds.
+	NotificationDrainTimeout uint `json:"notificationdraintimeout"`
+	// NotificationShutdownTimeout is the number of seconds the shutdown notifications may take
+	// before the process exits. If it is 0, they are cancelled after 5 seconds.
+	NotificationShutdownTimeout uint `json:"notificationshutdowntimeout"`
+	// Thresholds defines additional connection thresholds for notifications.
+	Thresholds []Threshold `json:"thresholds"`
 	// Notifications defines event callbacks.
 	Notifications []Notification `json:"notifications"`
 }
@@ -150,6 +665,8 @@ type Configuration struct {
 func DefaultConfiguration() *Configuration {
 	return &Configuration{
 		Listen:            "localhost:http",
+		ApiMaxBodySize:    4096,
+		ProbeDuration:     5,
 		Timeout:           0,
 		Reconnect:         10,
 		InputBuffer:       1000,
@@ -183,8 +700,8 @@ func LoadConfiguration(reader io.Reader) (*Configuration, error) {
 
 	for i := range config.Resources {
 		resource := &config.Resources[i]
-		// add remote to remotes list, if given - but only if this is a stream
-		if resource.Type == "stream" && len(resource.Remote) > 0 {
+		// add remote to remotes list, if given - but only if this is a stream or static resource
+		if (resource.Type == "stream" || resource.Type == "static") && len(resource.Remote) > 0 {
 			length := len(resource.Remotes)
 			remotes := make([]string, length+1)
 			remotes[0] = resource.Remote
@@ -207,6 +724,10 @@ func LoadConfiguration(reader io.Reader) (*Configuration, error) {
 		if resource.Mru == 0 {
 			resource.Mru = 1500
 		}
+		// the CMAF prefix must be a subtree
+		if resource.Cmaf != "" && !strings.HasSuffix(resource.Cmaf, "/") {
+			resource.Cmaf += "/"
+		}
 	}
 	for i := range config.Notifications {
 		notification := &config.Notifications[i]
@@ -220,6 +741,25 @@ func LoadConfiguration(reader io.Reader) (*Configuration, error) {
 			// reset
 			notification.Authentication.User = ""
 		}
+		for name, value := range notification.Headers {
+			notification.Headers[name], err = resolveSecret(value)
+			if err != nil {
+				return nil, fmt.Errorf("cannot resolve notification header %s: %v", name, err)
+			}
+		}
+		for name, value := range notification.Query {
+			notification.Query[name], err = resolveSecret(value)
+			if err != nil {
+				return nil, fmt.Errorf("cannot resolve notification query parameter %s: %v", name, err)
+			}
+		}
+	}
+	for user, credentials := range config.UserList {
+		credentials.Password, err = resolveSecret(credentials.Password)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve password of user %s: %v", user, err)
+		}
+		config.UserList[user] = credentials
 	}
 
 	return config, err
@@ -229,3 +769,90 @@ func LoadConfiguration(reader io.Reader) (*Configuration, error) {
 func LoadConfigurationBytes(json []byte) (*Configuration, error) {
 	return LoadConfiguration(bytes.NewReader(json))
 }
+
+// Redacted replaces secrets in sanitized configurations.
+const Redacted = "***"
+
+// Sanitized returns a copy of the configuration with all secrets replaced by Redacted,
+// so it can be shown to operators. Passwords, required header values, notification headers,
+// query parameters and commands are redacted, as well as passwords and query parameter
+// values in URLs.
+func (config *Configuration) Sanitized() *Configuration {
+	// a JSON round trip makes a deep copy of everything that can be configured
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil
+	}
+	sanitized := &Configuration{}
+	if err := json.Unmarshal(data, sanitized); err != nil {
+		return nil
+	}
+	for user, credentials := range sanitized.UserList {
+		credentials.Password = Redacted
+		sanitized.UserList[user] = credentials
+	}
+	for i := range sanitized.Resources {
+		resource := &sanitized.Resources[i]
+		resource.Remote = sanitizeUrl(resource.Remote)
+		for j, remote := range resource.Remotes {
+			resource.Remotes[j] = sanitizeUrl(remote)
+		}
+		resource.RefusedRedirect = sanitizeUrl(resource.RefusedRedirect)
+		resource.Authentication.FailureRedirect = sanitizeUrl(resource.Authentication.FailureRedirect)
+		// required headers are often shared tokens
+		for j := range resource.RequireHeaders {
+			for k := range resource.RequireHeaders[j].Values {
+				resource.RequireHeaders[j].Values[k] = Redacted
+			}
+		}
+	}
+	for i := range sanitized.Notifications {
+		notification := &sanitized.Notifications[i]
+		notification.Url = sanitizeUrl(notification.Url)
+		for name := range notification.Headers {
+			notification.Headers[name] = Redacted
+		}
+		for name := range notification.Query {
+			notification.Query[name] = Redacted
+		}
+		notification.Authentication.FailureRedirect = sanitizeUrl(notification.Authentication.FailureRedirect)
+		// tokens are frequently passed on the command line
+		if notification.Command != "" {
+			notification.Command = Redacted
+		}
+		for j := range notification.Args {
+			notification.Args[j] = Redacted
+		}
+	}
+	return sanitized
+}
+
+// sanitizeUrl redacts the password and the query parameter values of a URL.
+// Strings that can't be parsed are redacted completely.
+func sanitizeUrl(raw string) string {
+	if raw == "" {
+		return raw
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return Redacted
+	}
+	if parsed.User != nil {
+		if _, ok := parsed.User.Password(); ok {
+			parsed.User = url.UserPassword(parsed.User.Username(), Redacted)
+		}
+	}
+	if parsed.RawQuery != "" {
+		// keep the parameter names, they help to tell URLs apart
+		var parameters []string
+		for name, values := range parsed.Query() {
+			for range values {
+				parameters = append(parameters, url.QueryEscape(name)+"="+Redacted)
+			}
+		}
+		sort.Strings(parameters)
+		parsed.RawQuery = strings.Join(parameters, "&")
+	}
+	// the user info is escaped more strictly than necessary, keep the marker readable
+	return strings.Replace(parsed.String(), ":"+url.PathEscape(Redacted)+"@", ":"+Redacted+"@", 1)
+}
@@ -0,0 +1,237 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package event
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultExecTimeout is the time a notification command may run if no timeout is configured
+	DefaultExecTimeout = 30 * time.Second
+	// execOutputLimit is the maximum number of bytes of command output that are logged
+	execOutputLimit = 64 * 1024
+	// execOutputDelay is the time to wait for the output after the command exited.
+	// Background processes started by the command may keep the output open.
+	execOutputDelay = time.Second
+)
+
+// ExecHandler is an event handler that runs a local command.
+//
+// The event data is passed in environment variables:
+//
+//	RESTREAMER_EVENT: the event type (limit_hit, limit_miss, threshold_hit, threshold_miss, zero_viewers,
+//	  heartbeat, shutdown, source_connected, source_disconnected or stream_dead)
+//	RESTREAMER_CONNECTIONS: the number of connections before the change (limit, threshold and zero viewers events)
+//	RESTREAMER_NEW_CONNECTIONS: the number of connections after the change (limit and threshold events)
+//	RESTREAMER_LIMIT: the connection limit (limit and threshold events)
+//	RESTREAMER_THRESHOLD: the threshold name (threshold events)
+//	RESTREAMER_STREAM: the stream name, empty for all streams (threshold, zero viewers, source and dead stream events)
+//	RESTREAMER_URL: the upstream URL, without credentials and query string (source events)
+//	RESTREAMER_TIME: the time of the event in RFC 3339 format (heartbeat and shutdown)
+//
+// The same values can also be used in the arguments, with the placeholders
+// {event}, {connections}, {new}, {limit}, {threshold}, {stream}, {url} and {time}.
+//
+// Commands are run in the background, so they can't block the event queue.
+// They are killed when they exceed the timeout.
+// Shutdown commands are the exception: the queue waits for them, so they can
+// finish before the process exits, but they are killed when the queue gives up.
+type ExecHandler struct {
+	// command is the executable to run
+	command string
+	// args are the command line arguments, with placeholders
+	args []string
+	// timeout is the maximum run time of the command
+	timeout time.Duration
+}
+
+// NewExecHandler creates an event handler that runs command with args.
+// If timeout is 0, DefaultExecTimeout is used.
+func NewExecHandler(command string, args []string, timeout time.Duration) (*ExecHandler, error) {
+	if command == "" {
+		return nil, errors.New("missing command")
+	}
+	if timeout == 0 {
+		timeout = DefaultExecTimeout
+	}
+	return &ExecHandler{
+		command: command,
+		args:    args,
+		timeout: timeout,
+	}, nil
+}
+
+// eventValues maps the placeholder names to the event data.
+func eventValues(typ Type, args ...interface{}) map[string]string {
+	values := map[string]string{
+		"event": typ.String(),
+	}
+	switch typ {
+	case TypeLimitHit, TypeLimitMiss:
+		argumentValues(values, []string{"connections", "new", "limit"}, args)
+	case TypeThresholdHit, TypeThresholdMiss:
+		argumentValues(values, []string{"threshold", "stream", "connections", "new", "limit"}, args)
+	case TypeZeroViewers:
+		argumentValues(values, []string{"stream", "connections"}, args)
+	case TypeStreamDead:
+		argumentValues(values, []string{"stream"}, args)
+	case TypeSourceConnected, TypeSourceDisconnected:
+		argumentValues(values, []string{"stream", "url"}, args)
+	case TypeHeartbeat, TypeShutdown:
+		if len(args) > 0 {
+			if when, ok := args[0].(time.Time); ok {
+				values["time"] = when.Format(time.RFC3339)
+			}
+		}
+	}
+	return values
+}
+
+// argumentValues stores string and integer event arguments under the given names.
+func argumentValues(values map[string]string, names []string, args []interface{}) {
+	for i, arg := range args {
+		if i < len(names) {
+			switch value := arg.(type) {
+			case int:
+				values[names[i]] = strconv.Itoa(value)
+			case string:
+				values[names[i]] = value
+			}
+		}
+	}
+}
+
+// HandleEvent starts the command and returns immediately.
+func (handler *ExecHandler) HandleEvent(typ Type, args ...interface{}) {
+	go handler.run(context.Background(), eventValues(typ, args...))
+}
+
+// HandleEventContext starts the command and returns immediately, except for the shutdown event.
+// Shutdown commands are waited for, and killed when ctx is cancelled.
+func (handler *ExecHandler) HandleEventContext(ctx context.Context, typ Type, args ...interface{}) {
+	if typ == TypeShutdown {
+		handler.run(ctx, eventValues(typ, args...))
+	} else {
+		handler.HandleEvent(typ, args...)
+	}
+}
+
+// run executes the command and logs its output.
+// It is killed when parent is cancelled or the timeout expires.
+func (handler *ExecHandler) run(parent context.Context, values map[string]string) {
+	replacements := make([]string, 0, len(values)*2)
+	env := os.Environ()
+	for name, value := range values {
+		replacements = append(replacements, "{"+name+"}", value)
+		variable := "RESTREAMER_" + strings.ToUpper(name)
+		if name == "new" {
+			variable = "RESTREAMER_NEW_CONNECTIONS"
+		}
+		env = append(env, variable+"="+value)
+	}
+	replacer := strings.NewReplacer(replacements...)
+	args := make([]string, len(handler.args))
+	for i, arg := range handler.args {
+		args[i] = replacer.Replace(arg)
+	}
+
+	ctx, cancel := context.WithTimeout(parent, handler.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, handler.command, args...)
+	cmd.Env = env
+
+	logger.Logkv(
+		"event", execHandlerEventRun,
+		"message", fmt.Sprintf("Event received, running %s", handler.command),
+		"command", handler.command,
+		"args", args,
+		"type", values["event"],
+	)
+	start := time.Now()
+	output, err := handler.execute(cmd)
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.Logkv(
+			"event", execHandlerEventError,
+			"error", execHandlerErrorTimeout,
+			"message", fmt.Sprintf("Command %s killed after %v", handler.command, handler.timeout),
+			"command", handler.command,
+			"output", string(output),
+			"type", values["event"],
+		)
+	} else if err != nil {
+		logger.Logkv(
+			"event", execHandlerEventError,
+			"error", execHandlerErrorRun,
+			"message", fmt.Sprintf("Error running %s: %v", handler.command, err),
+			"command", handler.command,
+			"output", string(output),
+			"type", values["event"],
+		)
+	} else {
+		logger.Logkv(
+			"event", execHandlerEventDone,
+			"message", fmt.Sprintf("Command %s finished", handler.command),
+			"command", handler.command,
+			"duration", time.Since(start).Seconds(),
+			"output", string(output),
+			"type", values["event"],
+		)
+	}
+}
+
+// execute runs the command and returns its combined output.
+//
+// Unlike exec.Cmd.CombinedOutput, it doesn't wait for processes that inherited
+// the output pipe and live on after the command was killed.
+func (handler *ExecHandler) execute(cmd *exec.Cmd) ([]byte, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	err = cmd.Start()
+	// the child has its own copy now
+	writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	output := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(io.LimitReader(reader, execOutputLimit))
+		output <- data
+	}()
+	err = cmd.Wait()
+	select {
+	case data := <-output:
+		return data, err
+	case <-time.After(execOutputDelay):
+		// unblock the reader
+		reader.Close()
+		return <-output, err
+	}
+}
@@ -0,0 +1,77 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package event
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecHandler(t *testing.T) {
+	logger = &mockLogger{t, "exechandler"}
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("No shell available")
+	}
+	output := filepath.Join(t.TempDir(), "output")
+	handler, err := NewExecHandler("/bin/sh", []string{"-c", `echo "$1 $RESTREAMER_EVENT $RESTREAMER_NEW_CONNECTIONS $RESTREAMER_LIMIT" > "$2"`, "sh", "{event}:{connections}", output}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// run synchronously, so the result can be checked
+	handler.run(context.Background(), eventValues(TypeLimitHit, 9, 10, 10))
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); got != "limit_hit:9 limit_hit 10 10" {
+		t.Errorf("Invalid command output: %s", got)
+	}
+}
+
+func TestExecHandlerTimeout(t *testing.T) {
+	logger = &mockLogger{t, "exechandlertimeout"}
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("No shell available")
+	}
+	handler, err := NewExecHandler("/bin/sh", []string{"-c", "sleep 10"}, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	handler.run(context.Background(), eventValues(TypeHeartbeat, time.Now()))
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Command was not killed after the timeout")
+	}
+}
+
+func TestExecHandlerSourceValues(t *testing.T) {
+	values := eventValues(TypeSourceDisconnected, "/stream.ts", "http://upstream/stream.ts")
+	if values["event"] != "source_disconnected" || values["stream"] != "/stream.ts" || values["url"] != "http://upstream/stream.ts" {
+		t.Errorf("Invalid source event values: %v", values)
+	}
+}
+
+func TestExecHandlerDeadValues(t *testing.T) {
+	values := eventValues(TypeStreamDead, "/stream.ts")
+	if values["event"] != "stream_dead" || values["stream"] != "/stream.ts" {
+		t.Errorf("Invalid dead stream event values: %v", values)
+	}
+}
@@ -16,14 +16,117 @@
 
 package event
 
+import "context"
+
 type Type int
 
 const (
 	TypeLimitHit Type = iota
 	TypeLimitMiss
 	TypeHeartbeat
+	TypeThresholdHit
+	TypeThresholdMiss
+	TypeZeroViewers
+	TypeShutdown
+	TypeSourceConnected
+	TypeSourceDisconnected
+	TypeStreamDead
 )
 
+// String returns the configuration name of an event type.
+func (typ Type) String() string {
+	switch typ {
+	case TypeLimitHit:
+		return "limit_hit"
+	case TypeLimitMiss:
+		return "limit_miss"
+	case TypeHeartbeat:
+		return "heartbeat"
+	case TypeThresholdHit:
+		return "threshold_hit"
+	case TypeThresholdMiss:
+		return "threshold_miss"
+	case TypeZeroViewers:
+		return "zero_viewers"
+	case TypeShutdown:
+		return "shutdown"
+	case TypeSourceConnected:
+		return "source_connected"
+	case TypeSourceDisconnected:
+		return "source_disconnected"
+	case TypeStreamDead:
+		return "stream_dead"
+	default:
+		return "unknown"
+	}
+}
+
 type Handler interface {
 	HandleEvent(Type, ...interface{})
 }
+
+// ContextHandler is an event handler that can be cancelled.
+// The queue prefers HandleEventContext over HandleEvent if a handler implements it.
+type ContextHandler interface {
+	HandleEventContext(context.Context, Type, ...interface{})
+}
+
+// FilterHandler passes threshold, zero viewer, source and dead stream events on to another handler,
+// but only if they belong to a specific threshold or stream.
+// All other events are passed unfiltered.
+type FilterHandler struct {
+	// handler receives the events that passed the filter
+	handler Handler
+	// threshold is the threshold name to match, or empty for all
+	threshold string
+	// stream is the stream name to match, or empty for all
+	stream string
+}
+
+// NewFilterHandler creates an event filter.
+// Empty names match everything.
+func NewFilterHandler(handler Handler, threshold string, stream string) *FilterHandler {
+	return &FilterHandler{
+		handler:   handler,
+		threshold: threshold,
+		stream:    stream,
+	}
+}
+
+func (filter *FilterHandler) HandleEvent(typ Type, args ...interface{}) {
+	if filter.match(typ, args...) {
+		filter.handler.HandleEvent(typ, args...)
+	}
+}
+
+func (filter *FilterHandler) HandleEventContext(ctx context.Context, typ Type, args ...interface{}) {
+	if filter.match(typ, args...) {
+		if contextHandler, ok := filter.handler.(ContextHandler); ok {
+			contextHandler.HandleEventContext(ctx, typ, args...)
+		} else {
+			filter.handler.HandleEvent(typ, args...)
+		}
+	}
+}
+
+// match returns true if an event passes the filter.
+func (filter *FilterHandler) match(typ Type, args ...interface{}) bool {
+	var threshold, stream interface{}
+	switch typ {
+	case TypeThresholdHit, TypeThresholdMiss:
+		if len(args) >= 2 {
+			threshold, stream = args[0], args[1]
+		}
+	case TypeZeroViewers, TypeSourceConnected, TypeSourceDisconnected, TypeStreamDead:
+		if len(args) >= 1 {
+			stream = args[0]
+		}
+	}
+	if filter.threshold != "" && threshold != nil && threshold != filter.threshold {
+		return false
+	}
+	if filter.stream != "" && stream != nil && stream != filter.stream {
+		return false
+	}
+	return true
+}
@@ -16,15 +16,24 @@
 
 package event
 
-import "time"
+import (
+	"math/rand"
+	"time"
+)
 
 type HeartbeatStopper interface {
 	Stop()
 }
 
 type Heartbeat struct {
-	// ticker fires a heartbeat at regular intervals.
-	ticker *time.Ticker
+	// interval is the time between heartbeats
+	interval time.Duration
+	// jitter is the maximum random delay added to each interval
+	jitter time.Duration
+	// immediate fires the first heartbeat right away
+	immediate bool
+	// stop ends the heartbeat loop when closed
+	stop chan struct{}
 	// target is the notification target.
 	// NotifyHeartbeat will be called on each tick.
 	target Notifiable
@@ -35,27 +44,63 @@ type Heartbeat struct {
 // On each heartbeat, target.NotifyHeartbeat will be called with the current timestamp.
 // Note that this happens asynchronously from a separate goroutine.
 func NewHeartbeat(interval time.Duration, target Notifiable) *Heartbeat {
+	return NewJitteredHeartbeat(interval, 0, false, target)
+}
+
+// NewJitteredHeartbeat creates a heartbeat ticker like NewHeartbeat,
+// with a random delay of up to jitter added to each interval.
+// This keeps a fleet of servers from sending their heartbeats at the same time.
+//
+// If immediate is true, the first heartbeat is sent right away, so monitoring
+// systems learn about a startup without waiting a full interval.
+func NewJitteredHeartbeat(interval time.Duration, jitter time.Duration, immediate bool, target Notifiable) *Heartbeat {
+	if interval <= 0 {
+		panic("heartbeat interval is out of range")
+	}
 	heartbeat := &Heartbeat{
-		ticker: time.NewTicker(interval),
-		target: target,
+		interval:  interval,
+		jitter:    jitter,
+		immediate: immediate,
+		stop:      make(chan struct{}),
+		target:    target,
 	}
 	go heartbeat.loop()
 	return heartbeat
 }
 
+// next returns the time until the next heartbeat.
+func (heartbeat *Heartbeat) next() time.Duration {
+	if heartbeat.jitter <= 0 {
+		return heartbeat.interval
+	}
+	return heartbeat.interval + time.Duration(rand.Int63n(int64(heartbeat.jitter)))
+}
+
 // loop is the ticker run loop
 func (heartbeat *Heartbeat) loop() {
 	logger.Logkv(
 		"event", queueEventHeartbeatStart,
 		"message", "Starting heartbeat goroutine",
 	)
-	// process events (also drains when the channel is closed)
-	for range heartbeat.ticker.C {
-		logger.Logkv(
-			"event", queueEventHeartbeatFire,
-			"message", "Firing heartbeat",
-		)
-		heartbeat.target.NotifyHeartbeat(time.Now())
+	var delay time.Duration
+	if !heartbeat.immediate {
+		delay = heartbeat.next()
+	}
+	timer := time.NewTimer(delay)
+	running := true
+	for running {
+		select {
+		case <-heartbeat.stop:
+			timer.Stop()
+			running = false
+		case <-timer.C:
+			logger.Logkv(
+				"event", queueEventHeartbeatFire,
+				"message", "Firing heartbeat",
+			)
+			heartbeat.target.NotifyHeartbeat(time.Now())
+			timer.Reset(heartbeat.next())
+		}
 	}
 	logger.Logkv(
 		"event", queueEventHeartbeatStop,
@@ -63,8 +108,39 @@ func (heartbeat *Heartbeat) loop() {
 	)
 }
 
+// Stop ends the heartbeat. It must only be called once.
 func (heartbeat *Heartbeat) Stop() {
-	heartbeat.ticker.Stop()
+	close(heartbeat.stop)
+}
+
+// handlerNotifier sends heartbeats directly to an event handler, bypassing the queue.
+type handlerNotifier struct {
+	handler Handler
+}
+
+// NewHandlerNotifier creates a heartbeat target that calls a single event handler.
+// Use it to give a handler its own heartbeat interval.
+// Connection, source and dead stream notifications are ignored.
+func NewHandlerNotifier(handler Handler) Notifiable {
+	return &handlerNotifier{
+		handler: handler,
+	}
+}
+
+func (notifier *handlerNotifier) NotifyConnect(stream string, connected int) {
+	// not interested
+}
+
+func (notifier *handlerNotifier) NotifySource(stream string, url string, connected bool) {
+	// not interested
+}
+
+func (notifier *handlerNotifier) NotifyDead(stream string) {
+	// not interested
+}
+
+func (notifier *handlerNotifier) NotifyHeartbeat(when time.Time) {
+	notifier.handler.HandleEvent(TypeHeartbeat, when)
 }
 
 type DummyHeartbeat struct{}
@@ -0,0 +1,49 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package event
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatImmediate(t *testing.T) {
+	logger = &mockLogger{t, "heartbeatimmediate"}
+	h := &recordingHandler{events: make(chan Type, 10)}
+	heartbeat := NewJitteredHeartbeat(time.Hour, 0, true, NewHandlerNotifier(h))
+	h.expect(t, TypeHeartbeat)
+	heartbeat.Stop()
+	h.expectNone(t, 50*time.Millisecond)
+}
+
+func TestHeartbeatJitter(t *testing.T) {
+	logger = &mockLogger{t, "heartbeatjitter"}
+	h := &recordingHandler{events: make(chan Type, 10)}
+	heartbeat := NewJitteredHeartbeat(10*time.Millisecond, 20*time.Millisecond, false, NewHandlerNotifier(h))
+	for i := 0; i < 3; i++ {
+		h.expect(t, TypeHeartbeat)
+	}
+	for i := 0; i < 100; i++ {
+		next := heartbeat.next()
+		if next < 10*time.Millisecond || next >= 30*time.Millisecond {
+			t.Errorf("Interval out of range: %v", next)
+		}
+	}
+	heartbeat.Stop()
+	// let the heartbeat goroutine log its shutdown
+	time.Sleep(50 * time.Millisecond)
+}
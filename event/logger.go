@@ -37,6 +37,11 @@ const (
 	queueEventHeartbeatStart = "heartbeat_start"
 	queueEventHeartbeatStop  = "heartbeat_stop"
 	queueEventHeartbeatFire  = "heartbeat_fire"
+	queueEventThreshold      = "threshold"
+	queueEventZero           = "zero"
+	queueEventShutdown       = "shutdown"
+	queueEventSource         = "source"
+	queueEventDead           = "dead"
 	//
 	queueErrorAlreadyRunning      = "already_running"
 	queueErrorInvalidNotification = "invalid_notification"
@@ -44,11 +49,22 @@ const (
 	queueErrorOverflow            = "overflow"
 	queueErrorRegister            = "register"
 	queueErrorNotRegistered       = "not_registered"
+	queueErrorHandlerTimeout      = "handler_timeout"
+	queueErrorDrainTimeout        = "drain_timeout"
+	queueErrorFull                = "full"
 	//
 	urlHandlerEventError  = "error"
 	urlHandlerEventNotify = "notify"
 	//
-	urlHandlerErrorGet = "get"
+	urlHandlerErrorGet    = "get"
+	urlHandlerErrorStatus = "status"
+	//
+	execHandlerEventError = "error"
+	execHandlerEventRun   = "exec"
+	execHandlerEventDone  = "exec_done"
+	//
+	execHandlerErrorRun     = "run"
+	execHandlerErrorTimeout = "timeout"
 )
 
 var logger = util.NewGlobalModuleLogger(moduleEvent, nil)
@@ -23,11 +23,16 @@ import "time"
 // Inidividual calls cause state changes, which may trigger events.
 type Notifiable interface {
 	// NotifyConnect reports new connections (if connected is positive) or
-	// disconnects (if connected is negative).
+	// disconnects (if connected is negative) on a stream.
 	//
 	// Connects and disconnects should be reported separately.
-	NotifyConnect(connected int)
+	NotifyConnect(stream string, connected int)
 	// NotifyHeartbeat is called periodically when enabled, to allow sending
 	// keepalive messages to a monitoring system
 	NotifyHeartbeat(when time.Time)
+	// NotifySource reports that the upstream of a stream has connected
+	// (if connected is true) or disconnected.
+	NotifySource(stream string, url string, connected bool)
+	// NotifyDead reports that a stream has given up reconnecting to its upstreams.
+	NotifyDead(stream string)
 }
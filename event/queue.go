@@ -17,15 +17,26 @@
 package event
 
 import (
+	"context"
 	"fmt"
+	"github.com/onitake/restreamer/metrics"
+	"github.com/onitake/restreamer/util"
+	"github.com/prometheus/client_golang/prometheus"
 	"math"
 	"sync"
 	"time"
 )
 
 const (
-	// queueSize is the maximum number of notifications to enqueue before we block
-	queueSize int = 10
+	// DefaultQueueSize is the maximum number of notifications to enqueue.
+	// Further notifications are merged or dropped, see NotifyConnect and NotifyHeartbeat.
+	DefaultQueueSize int = 10
+	// DefaultHandlerTimeout is the time an event handler may take before the queue moves on
+	DefaultHandlerTimeout = 10 * time.Second
+	// DefaultDrainTimeout is the time Shutdown waits for the queue to finish
+	DefaultDrainTimeout = 10 * time.Second
+	// DefaultShutdownTimeout is the time the handlers of the shutdown event may take
+	DefaultShutdownTimeout = 5 * time.Second
 )
 
 // changeType enumerates all possible state change notifications
@@ -34,12 +45,20 @@ type changeType int
 const (
 	changeConnect changeType = iota
 	changeHeartbeat
+	changeSource
+	changeDead
 )
 
 // stateChange encapsulates a state change notification
 type stateChange struct {
 	// typ contains the notification type
 	typ changeType
+	// stream is the name of the stream that had a connection change or died
+	stream string
+	// url is the upstream URL of a source change
+	url string
+	// source is true if the upstream connected, false if it disconnected
+	source bool
 	// connected contains the number of new connections.
 	// Can be negative if connections are dropped.
 	connected int
@@ -47,13 +66,61 @@ type stateChange struct {
 	when time.Time
 }
 
+var (
+	metricQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "event_queue_depth",
+			Help: "Number of notifications waiting in the event queue.",
+		},
+	)
+	metricQueueOverflows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "event_queue_overflows",
+			Help: "Number of notifications that didn't fit into the event queue.",
+		},
+		[]string{"type"},
+	)
+)
+
+func init() {
+	metrics.MustRegister(metricQueueDepth)
+	metrics.MustRegister(metricQueueOverflows)
+}
+
+// threshold is a named connection threshold with its own hit/miss events.
+type threshold struct {
+	// name identifies the threshold in events
+	name string
+	// stream is the stream whose connections are counted, or empty for all streams
+	stream string
+	// hit is the number of connections when a hit is reported
+	hit int
+	// miss is the number of connections below which a miss is reported
+	miss int
+	// state is true while the threshold is hit
+	state bool
+}
+
 // Queue encapsulates state for a connection load reporting callback.
 //
 // The hit/miss pairs define a hysteresis range to avoid "flapping" reports
 // when the number of connections changes quickly around a limit.
+// Additionally, reports can be delayed until the state has been stable for some time.
 type Queue struct {
 	// limit sets the number of connections when a hit is reported
 	limit int
+	// missLimit sets the number of connections below which a miss is reported
+	missLimit int
+	// debounce is the time a new state must persist before it is reported
+	debounce time.Duration
+	// hit is true while the reported state is over the limit.
+	// only accessed from the reporting thread
+	hit bool
+	// pending fires when a state change has been stable for the debounce time, nil if no change is pending.
+	// only accessed from the reporting thread
+	pending *time.Timer
+	// pendingFrom is the number of connections before the pending state change
+	pendingFrom int
 	// handlers contains all event handlers
 	handlers map[Type]map[Handler]bool
 	// internal notification channel for the reporting thread
@@ -61,12 +128,32 @@ type Queue struct {
 	// connections contains the number of active connections.
 	// only accessed from the reporting thread
 	connections int
+	// streams contains the number of active connections per stream.
+	// only accessed from the reporting thread
+	streams map[string]int
+	// thresholds are additional named thresholds, for all or individual streams
+	thresholds []*threshold
 	// shutdown is the internal shutdown notifier
 	shutdown chan struct{}
 	// running tells if the notifier is currently active
-	running bool
+	running util.AtomicBool
 	// waiter allows waiting for shutdown
 	waiter *sync.WaitGroup
+	// handlerTimeout is the time an event handler may take before the queue moves on
+	handlerTimeout time.Duration
+	// drainTimeout is the time Shutdown waits for the queue to finish
+	drainTimeout time.Duration
+	// shutdownTimeout is the time the handlers of the shutdown event may take
+	shutdownTimeout time.Duration
+	// queueSize is the capacity of the notification channel
+	queueSize int
+	// overflow contains connection changes per stream that didn't fit into the queue.
+	// Guarded by overflowLock.
+	overflow map[string]int
+	// overflowLock protects overflow
+	overflowLock sync.Mutex
+	// overflowed is signalled when overflow contains changes
+	overflowed chan struct{}
 }
 
 // NewQueue creates a new connection load report notifier.
@@ -77,10 +164,80 @@ func NewQueue(limit int) *Queue {
 		panic("limit is out of range")
 	}
 	return &Queue{
-		limit:    limit,
-		handlers: make(map[Type]map[Handler]bool),
-		waiter:   &sync.WaitGroup{},
+		limit:     limit,
+		missLimit: limit,
+		handlers:  make(map[Type]map[Handler]bool),
+		streams:   make(map[string]int),
+		waiter:    &sync.WaitGroup{},
+		queueSize: DefaultQueueSize,
+		overflow:  make(map[string]int),
+		// default timeouts, see SetTimeouts and SetShutdownTimeout
+		handlerTimeout:  DefaultHandlerTimeout,
+		drainTimeout:    DefaultDrainTimeout,
+		shutdownTimeout: DefaultShutdownTimeout,
+	}
+}
+
+// SetHysteresis sets the number of connections below which a miss is reported,
+// after a hit was reported.
+// It is clamped to the hit limit. By default, both are the same.
+// Must be called before Start.
+func (reporter *Queue) SetHysteresis(miss int) {
+	if miss > reporter.limit || miss < 0 {
+		miss = reporter.limit
+	}
+	reporter.missLimit = miss
+}
+
+// AddThreshold adds a named threshold that sends TypeThresholdHit when the number of
+// connections reaches hit, and TypeThresholdMiss when it drops below miss again.
+// If stream is empty, the connections of all streams are counted.
+// miss is clamped to hit.
+// Thresholds are not debounced.
+// Must be called before Start.
+func (reporter *Queue) AddThreshold(name string, stream string, hit int, miss int) {
+	if miss > hit || miss <= 0 {
+		miss = hit
 	}
+	reporter.thresholds = append(reporter.thresholds, &threshold{
+		name:   name,
+		stream: stream,
+		hit:    hit,
+		miss:   miss,
+	})
+}
+
+// SetQueueSize sets the number of notifications that can be queued.
+// Must be called before Start.
+func (reporter *Queue) SetQueueSize(size int) {
+	if size < 1 {
+		size = DefaultQueueSize
+	}
+	reporter.queueSize = size
+}
+
+// SetTimeouts sets the time an event handler may take before the queue moves on,
+// and the time Shutdown waits for the queue to finish.
+// Handlers that support it are cancelled through their context, all others are left running.
+// Must be called before Start.
+func (reporter *Queue) SetTimeouts(handler time.Duration, drain time.Duration) {
+	reporter.handlerTimeout = handler
+	reporter.drainTimeout = drain
+}
+
+// SetShutdownTimeout sets the time the handlers of the shutdown event may take.
+// They are run at the same time, so a slow handler doesn't hold up the others.
+// If there are any, Shutdown waits for up to this time in addition to the drain timeout.
+// Must be called before Start.
+func (reporter *Queue) SetShutdownTimeout(timeout time.Duration) {
+	reporter.shutdownTimeout = timeout
+}
+
+// SetDebounce delays hit and miss reports until the new state has persisted for delay.
+// Changes that are reverted within this time are not reported at all.
+// Must be called before Start.
+func (reporter *Queue) SetDebounce(delay time.Duration) {
+	reporter.debounce = delay
 }
 
 // Start launches the reporting goroutine.
@@ -92,16 +249,21 @@ func (reporter *Queue) Start() {
 		"message", "Checking if the handler can be started",
 	)
 	// check if we're running already
-	if !reporter.running {
+	if util.CompareAndSwapBool(&reporter.running, false, true) {
 		logger.Logkv(
 			"event", queueEventStarting,
 			"message", "Starting notification handler",
 		)
 		// initialise the channels
 		reporter.shutdown = make(chan struct{})
-		reporter.notifier = make(chan *stateChange, queueSize)
-		// set running state
-		reporter.running = true
+		reporter.notifier = make(chan *stateChange, reporter.queueSize)
+		reporter.overflowed = make(chan struct{}, 1)
+		// pick up changes that were reported before the queue was started
+		reporter.overflowLock.Lock()
+		if len(reporter.overflow) > 0 {
+			reporter.overflowed <- struct{}{}
+		}
+		reporter.overflowLock.Unlock()
 		reporter.waiter.Add(1)
 		// and start the handler
 		go reporter.run()
@@ -116,6 +278,9 @@ func (reporter *Queue) Start() {
 
 // Shutdown stops the load reporter and waits for completion.
 //
+// Before the queue stops, TypeShutdown is sent to the handlers that are registered for it,
+// with the time of the shutdown as argument. Pending notifications are discarded.
+//
 // You must not send any notifications after calling this method.
 func (reporter *Queue) Shutdown() {
 	logger.Logkv(
@@ -123,9 +288,26 @@ func (reporter *Queue) Shutdown() {
 		"message", "Stopping notification handler",
 	)
 	// signal shutdown
-	if reporter.running {
+	if util.LoadBool(&reporter.running) {
 		close(reporter.shutdown)
-		reporter.waiter.Wait()
+		done := make(chan struct{})
+		go func() {
+			reporter.waiter.Wait()
+			close(done)
+		}()
+		timeout := reporter.drainTimeout
+		if len(reporter.handlers[TypeShutdown]) > 0 {
+			timeout += reporter.shutdownTimeout
+		}
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			logger.Logkv(
+				"event", queueEventError,
+				"error", queueErrorDrainTimeout,
+				"message", fmt.Sprintf("Notification handler didn't stop within %v, giving up", timeout),
+			)
+		}
 	}
 }
 
@@ -141,9 +323,17 @@ func (reporter *Queue) run() {
 		case <-reporter.shutdown:
 			running = false
 		case message := <-reporter.notifier:
+			metricQueueDepth.Set(float64(len(reporter.notifier)))
 			reporter.handle(message)
+		case <-reporter.overflowed:
+			reporter.handleOverflow()
+		case <-reporter.pendingChannel():
+			reporter.pending = nil
+			reporter.report(!reporter.hit, reporter.pendingFrom)
 		}
 	}
+	reporter.cancelPending()
+	reporter.handleShutdown(time.Now())
 	logger.Logkv(
 		"event", queueEventDraining,
 		"message", "Draining notification queue",
@@ -157,7 +347,7 @@ func (reporter *Queue) run() {
 		"message", "Stopped notification handler",
 	)
 	// and we're done
-	reporter.running = false
+	util.StoreBool(&reporter.running, false)
 	reporter.waiter.Done()
 }
 
@@ -165,9 +355,13 @@ func (reporter *Queue) run() {
 func (reporter *Queue) handle(message *stateChange) {
 	switch message.typ {
 	case changeConnect:
-		reporter.handleConnect(message.connected)
+		reporter.handleConnect(message.stream, message.connected)
 	case changeHeartbeat:
 		reporter.handleHeartbeat(message.when)
+	case changeSource:
+		reporter.handleSource(message.stream, message.url, message.source)
+	case changeDead:
+		reporter.handleDead(message.stream)
 	default:
 		logger.Logkv(
 			"event", queueEventError,
@@ -177,6 +371,26 @@ func (reporter *Queue) handle(message *stateChange) {
 	}
 }
 
+// handleShutdown sends the shutdown event to all its handlers at the same time,
+// and waits until they have finished or the shutdown timeout has expired.
+func (reporter *Queue) handleShutdown(when time.Time) {
+	logger.Logkv(
+		"event", queueEventShutdown,
+		"message", "Sending shutdown notifications",
+	)
+	var wg sync.WaitGroup
+	for handler, ok := range reporter.handlers[TypeShutdown] {
+		if ok {
+			wg.Add(1)
+			go func(handler Handler) {
+				defer wg.Done()
+				reporter.call(handler, reporter.shutdownTimeout, TypeShutdown, when)
+			}(handler)
+		}
+	}
+	wg.Wait()
+}
+
 // handleHeartbeat handles a periodic heartbeat
 func (reporter *Queue) handleHeartbeat(when time.Time) {
 	logger.Logkv(
@@ -184,18 +398,39 @@ func (reporter *Queue) handleHeartbeat(when time.Time) {
 		"message", fmt.Sprintf("Periodic heartbeat at: %v", when),
 		"when", when,
 	)
-	for handler, ok := range reporter.handlers[TypeHeartbeat] {
-		if ok {
-			handler.HandleEvent(TypeHeartbeat, when)
-		}
+	reporter.dispatch(TypeHeartbeat, when)
+}
+
+// handleSource handles an upstream connection change
+func (reporter *Queue) handleSource(stream string, url string, connected bool) {
+	logger.Logkv(
+		"event", queueEventSource,
+		"stream", stream,
+		"url", url,
+		"connected", connected,
+	)
+	if connected {
+		reporter.dispatch(TypeSourceConnected, stream, url)
+	} else {
+		reporter.dispatch(TypeSourceDisconnected, stream, url)
 	}
 }
 
+// handleDead handles a stream that has given up on its upstreams
+func (reporter *Queue) handleDead(stream string) {
+	logger.Logkv(
+		"event", queueEventDead,
+		"stream", stream,
+	)
+	reporter.dispatch(TypeStreamDead, stream)
+}
+
 // handleConnect handles a connected clients state change
-func (reporter *Queue) handleConnect(connected int) {
+func (reporter *Queue) handleConnect(stream string, connected int) {
 	logger.Logkv(
 		"event", queueEventConnect,
 		"message", fmt.Sprintf("Number of connections changed by %d, current number %d, new number %d", connected, reporter.connections, reporter.connections+connected),
+		"stream", stream,
 		"connected", connected,
 		"current_connections", reporter.connections,
 		"new_connections", reporter.connections+connected,
@@ -223,49 +458,167 @@ func (reporter *Queue) handleConnect(connected int) {
 	} else {
 		newconn = reporter.connections + connected
 	}
+	// update the counter
+	previous := reporter.connections
+	reporter.connections = newconn
 	// check if the limit is enabled
 	if reporter.limit != 0 {
 		// handle state transitions
-		if reporter.connections >= reporter.limit {
-			if newconn < reporter.limit {
-				// hit -> miss
-				logger.Logkv(
-					"event", queueEventLimitMiss,
-					"message", "Limit missed",
-					"connections", reporter.connections,
-					"new", newconn,
-					"limit", reporter.limit,
-				)
-				for handler, ok := range reporter.handlers[TypeLimitMiss] {
-					if ok {
-						handler.HandleEvent(TypeLimitMiss, reporter.connections, newconn, reporter.limit)
-					}
-				}
-			}
+		var change bool
+		if reporter.hit {
+			// hit -> miss
+			change = newconn < reporter.missLimit
 		} else {
-			if newconn >= reporter.limit {
-				// miss -> hit
-				logger.Logkv(
-					"event", queueEventLimitHit,
-					"message", "Limit hit",
-					"connections", reporter.connections,
-					"new", newconn,
-					"limit", reporter.limit,
-				)
-				for handler, ok := range reporter.handlers[TypeLimitHit] {
-					if ok {
-						handler.HandleEvent(TypeLimitHit, reporter.connections, newconn, reporter.limit)
-					}
-				}
-			}
+			// miss -> hit
+			change = newconn >= reporter.limit
+		}
+		if !change {
+			// the state is back to what was reported last
+			reporter.cancelPending()
+		} else if reporter.debounce <= 0 {
+			reporter.report(!reporter.hit, previous)
+		} else if reporter.pending == nil {
+			reporter.pendingFrom = previous
+			reporter.pending = time.NewTimer(reporter.debounce)
 		}
 	}
-	// update the counter
-	reporter.connections = newconn
+	// update the stream counter, clamping it like the global one
+	streamPrevious := reporter.streams[stream]
+	streamNew := streamPrevious + connected
+	if streamNew <= 0 {
+		streamNew = 0
+		delete(reporter.streams, stream)
+	} else {
+		reporter.streams[stream] = streamNew
+	}
+	for _, threshold := range reporter.thresholds {
+		if threshold.stream == "" {
+			reporter.checkThreshold(threshold, previous, newconn)
+		} else if threshold.stream == stream {
+			reporter.checkThreshold(threshold, streamPrevious, streamNew)
+		}
+	}
+	if streamPrevious > 0 && streamNew == 0 {
+		reporter.reportZero(stream, streamPrevious)
+	}
+	if previous > 0 && newconn == 0 {
+		reporter.reportZero("", previous)
+	}
+}
+
+// checkThreshold sends a hit or miss event if a threshold was crossed.
+func (reporter *Queue) checkThreshold(threshold *threshold, previous int, connections int) {
+	var typ Type
+	if !threshold.state && connections >= threshold.hit {
+		typ = TypeThresholdHit
+	} else if threshold.state && connections < threshold.miss {
+		typ = TypeThresholdMiss
+	} else {
+		return
+	}
+	threshold.state = !threshold.state
+	logger.Logkv(
+		"event", queueEventThreshold,
+		"message", fmt.Sprintf("Threshold %s changed state", threshold.name),
+		"type", typ.String(),
+		"threshold", threshold.name,
+		"stream", threshold.stream,
+		"connections", previous,
+		"new", connections,
+	)
+	limit := threshold.hit
+	if typ == TypeThresholdMiss {
+		limit = threshold.miss
+	}
+	reporter.dispatch(typ, threshold.name, threshold.stream, previous, connections, limit)
+}
+
+// reportZero sends a zero viewers event for a stream, or for all streams if stream is empty.
+func (reporter *Queue) reportZero(stream string, previous int) {
+	logger.Logkv(
+		"event", queueEventZero,
+		"message", "No more viewers",
+		"stream", stream,
+		"connections", previous,
+	)
+	reporter.dispatch(TypeZeroViewers, stream, previous)
+}
+
+// report sends a hit or miss event to all registered handlers.
+func (reporter *Queue) report(hit bool, previous int) {
+	reporter.hit = hit
+	typ := TypeLimitMiss
+	event := queueEventLimitMiss
+	message := "Limit missed"
+	if hit {
+		typ = TypeLimitHit
+		event = queueEventLimitHit
+		message = "Limit hit"
+	}
+	logger.Logkv(
+		"event", event,
+		"message", message,
+		"connections", previous,
+		"new", reporter.connections,
+		"limit", reporter.limit,
+	)
+	reporter.dispatch(typ, previous, reporter.connections, reporter.limit)
+}
+
+// dispatch sends an event to all handlers registered for it, one after the other.
+func (reporter *Queue) dispatch(typ Type, args ...interface{}) {
+	for handler, ok := range reporter.handlers[typ] {
+		if ok {
+			reporter.call(handler, reporter.handlerTimeout, typ, args...)
+		}
+	}
+}
+
+// call runs a single event handler and waits for it until timeout expires.
+// A handler that takes longer is cancelled if it supports it, and left running otherwise.
+func (reporter *Queue) call(handler Handler, timeout time.Duration, typ Type, args ...interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if contextHandler, ok := handler.(ContextHandler); ok {
+			contextHandler.HandleEventContext(ctx, typ, args...)
+		} else {
+			handler.HandleEvent(typ, args...)
+		}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Logkv(
+			"event", queueEventError,
+			"error", queueErrorHandlerTimeout,
+			"message", fmt.Sprintf("Event handler %T didn't complete within %v", handler, timeout),
+			"type", typ.String(),
+		)
+	}
+}
+
+// pendingChannel returns the channel of the pending state change timer,
+// or nil if no change is pending.
+func (reporter *Queue) pendingChannel() <-chan time.Time {
+	if reporter.pending == nil {
+		return nil
+	}
+	return reporter.pending.C
+}
+
+// cancelPending stops the pending state change timer, if there is one.
+func (reporter *Queue) cancelPending() {
+	if reporter.pending != nil {
+		reporter.pending.Stop()
+		reporter.pending = nil
+	}
 }
 
 func (reporter *Queue) RegisterEventHandler(typ Type, handler Handler) {
-	if reporter.running {
+	if util.LoadBool(&reporter.running) {
 		logger.Logkv(
 			"event", queueEventError,
 			"error", queueErrorRegister,
@@ -280,7 +633,7 @@ func (reporter *Queue) RegisterEventHandler(typ Type, handler Handler) {
 }
 
 func (reporter *Queue) UnregisterEventHandler(typ Type, handler Handler) {
-	if reporter.running {
+	if util.LoadBool(&reporter.running) {
 		logger.Logkv(
 			"event", queueEventError,
 			"error", queueErrorRegister,
@@ -299,20 +652,106 @@ func (reporter *Queue) UnregisterEventHandler(typ Type, handler Handler) {
 	}
 }
 
-func (reporter *Queue) NotifyConnect(connected int) {
+// NotifyConnect queues a connection change.
+// It never blocks: if the queue is full, the change is merged with other
+// pending changes and handled as soon as the queue has caught up.
+func (reporter *Queue) NotifyConnect(stream string, connected int) {
 	// construct the notification message and pass it down the queue
 	message := &stateChange{
 		typ:       changeConnect,
+		stream:    stream,
 		connected: connected,
 	}
-	reporter.notifier <- message
+	select {
+	case reporter.notifier <- message:
+		metricQueueDepth.Set(float64(len(reporter.notifier)))
+	default:
+		metricQueueOverflows.With(prometheus.Labels{"type": "connect"}).Inc()
+		reporter.overflowLock.Lock()
+		reporter.overflow[stream] += connected
+		reporter.overflowLock.Unlock()
+		select {
+		case reporter.overflowed <- struct{}{}:
+		default:
+			// already signalled
+		}
+	}
+}
+
+// handleOverflow handles the connection changes that didn't fit into the queue.
+func (reporter *Queue) handleOverflow() {
+	reporter.overflowLock.Lock()
+	overflow := reporter.overflow
+	reporter.overflow = make(map[string]int)
+	reporter.overflowLock.Unlock()
+	for stream, connected := range overflow {
+		if connected != 0 {
+			reporter.handleConnect(stream, connected)
+		}
+	}
+}
+
+// NotifySource queues an upstream connection change.
+// It never blocks: if the queue is full, the change is dropped.
+func (reporter *Queue) NotifySource(stream string, url string, connected bool) {
+	message := &stateChange{
+		typ:    changeSource,
+		stream: stream,
+		url:    url,
+		source: connected,
+	}
+	select {
+	case reporter.notifier <- message:
+		metricQueueDepth.Set(float64(len(reporter.notifier)))
+	default:
+		metricQueueOverflows.With(prometheus.Labels{"type": "source"}).Inc()
+		logger.Logkv(
+			"event", queueEventError,
+			"error", queueErrorFull,
+			"stream", stream,
+			"message", "Notification queue is full, dropping source change",
+		)
+	}
+}
+
+// NotifyDead queues a dead stream notification.
+// It never blocks: if the queue is full, the notification is dropped.
+func (reporter *Queue) NotifyDead(stream string) {
+	message := &stateChange{
+		typ:    changeDead,
+		stream: stream,
+	}
+	select {
+	case reporter.notifier <- message:
+		metricQueueDepth.Set(float64(len(reporter.notifier)))
+	default:
+		metricQueueOverflows.With(prometheus.Labels{"type": "dead"}).Inc()
+		logger.Logkv(
+			"event", queueEventError,
+			"error", queueErrorFull,
+			"stream", stream,
+			"message", "Notification queue is full, dropping dead stream notification",
+		)
+	}
 }
 
+// NotifyHeartbeat queues a heartbeat.
+// It never blocks: if the queue is full, the heartbeat is dropped.
 func (reporter *Queue) NotifyHeartbeat(when time.Time) {
 	// construct the notification message and pass it down the queue
 	message := &stateChange{
 		typ:  changeHeartbeat,
 		when: when,
 	}
-	reporter.notifier <- message
+	select {
+	case reporter.notifier <- message:
+		metricQueueDepth.Set(float64(len(reporter.notifier)))
+	default:
+		metricQueueOverflows.With(prometheus.Labels{"type": "heartbeat"}).Inc()
+		logger.Logkv(
+			"event", queueEventError,
+			"error", queueErrorFull,
+			"message", "Notification queue is full, dropping heartbeat",
+		)
+	}
 }
@@ -17,9 +17,11 @@
 package event
 
 import (
+	"context"
 	"github.com/onitake/restreamer/util"
 	"sync"
 	"testing"
+	"time"
 )
 
 type mockLogger struct {
@@ -121,7 +123,7 @@ func TestCreateLoadReporter02(t *testing.T) {
 	logger = l02
 	c02.Start()
 	l02.Waiter.Add(1)
-	c02.NotifyConnect(1)
+	c02.NotifyConnect("", 1)
 	l02.Waiter.Wait()
 	c02.Shutdown()
 }
@@ -148,12 +150,12 @@ func TestCreateLoadReporter04(t *testing.T) {
 	logger = l04
 	c04.Start()
 	l04.Waiter.Add(1)
-	c04.NotifyConnect(1)
+	c04.NotifyConnect("", 1)
 	l04.Waiter.Wait()
 	c04.Shutdown()
 	c04.Start()
 	l04.Waiter.Add(1)
-	c04.NotifyConnect(1)
+	c04.NotifyConnect("", 1)
 	l04.Waiter.Wait()
 	c04.Shutdown()
 }
@@ -174,15 +176,284 @@ func TestCreateLoadReporter05(t *testing.T) {
 	c05.RegisterEventHandler(TypeLimitHit, h05)
 	c05.RegisterEventHandler(TypeLimitMiss, h05)
 	c05.Start()
-	c05.NotifyConnect(10)
-	c05.NotifyConnect(-1)
-	c05.NotifyConnect(-2)
-	c05.NotifyConnect(4)
-	c05.NotifyConnect(1)
-	c05.NotifyConnect(-2)
-	c05.NotifyConnect(-1)
-	c05.NotifyConnect(1)
+	c05.NotifyConnect("", 10)
+	c05.NotifyConnect("", -1)
+	c05.NotifyConnect("", -2)
+	c05.NotifyConnect("", 4)
+	c05.NotifyConnect("", 1)
+	c05.NotifyConnect("", -2)
+	c05.NotifyConnect("", -1)
+	c05.NotifyConnect("", 1)
 	h05.Hit.Wait()
 	h05.Miss.Wait()
 	c05.Shutdown()
 }
+
+type recordingHandler struct {
+	events chan Type
+}
+
+func (h *recordingHandler) HandleEvent(t Type, args ...interface{}) {
+	h.events <- t
+}
+
+func (h *recordingHandler) expect(t *testing.T, typ Type) {
+	t.Helper()
+	select {
+	case got := <-h.events:
+		if got != typ {
+			t.Errorf("Expected %v, got %v", typ, got)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected %v, got nothing", typ)
+	}
+}
+
+func (h *recordingHandler) expectNone(t *testing.T, wait time.Duration) {
+	t.Helper()
+	select {
+	case got := <-h.events:
+		t.Errorf("Expected no event, got %v", got)
+	case <-time.After(wait):
+	}
+}
+
+func TestLoadReporterHysteresis(t *testing.T) {
+	logger = &mockLogger{t, "loadreporterhysteresis"}
+	q := NewQueue(10)
+	q.SetHysteresis(5)
+	h := &recordingHandler{events: make(chan Type, 10)}
+	q.RegisterEventHandler(TypeLimitHit, h)
+	q.RegisterEventHandler(TypeLimitMiss, h)
+	q.Start()
+	defer q.Shutdown()
+
+	q.NotifyConnect("", 10)
+	h.expect(t, TypeLimitHit)
+	// inside the hysteresis band, nothing is reported
+	q.NotifyConnect("", -3)
+	q.NotifyConnect("", 3)
+	q.NotifyConnect("", -5)
+	h.expectNone(t, 50*time.Millisecond)
+	q.NotifyConnect("", -1)
+	h.expect(t, TypeLimitMiss)
+	q.NotifyConnect("", 5)
+	h.expectNone(t, 50*time.Millisecond)
+	q.NotifyConnect("", 1)
+	h.expect(t, TypeLimitHit)
+}
+
+func TestLoadReporterDebounce(t *testing.T) {
+	logger = &mockLogger{t, "loadreporterdebounce"}
+	q := NewQueue(10)
+	q.SetDebounce(100 * time.Millisecond)
+	h := &recordingHandler{events: make(chan Type, 10)}
+	q.RegisterEventHandler(TypeLimitHit, h)
+	q.RegisterEventHandler(TypeLimitMiss, h)
+	q.Start()
+	defer q.Shutdown()
+
+	// reverted changes are not reported
+	q.NotifyConnect("", 10)
+	q.NotifyConnect("", -1)
+	h.expectNone(t, 200*time.Millisecond)
+	// stable changes are
+	q.NotifyConnect("", 1)
+	h.expect(t, TypeLimitHit)
+	q.NotifyConnect("", -1)
+	h.expect(t, TypeLimitMiss)
+}
+
+func TestLoadReporterThresholds(t *testing.T) {
+	logger = &mockLogger{t, "thresholds"}
+	q := NewQueue(0)
+	q.AddThreshold("a", "/a", 3, 2)
+	q.AddThreshold("total", "", 4, 0)
+	h := &recordingHandler{events: make(chan Type, 10)}
+	q.RegisterEventHandler(TypeThresholdHit, h)
+	q.RegisterEventHandler(TypeThresholdMiss, h)
+	q.RegisterEventHandler(TypeZeroViewers, NewFilterHandler(h, "", "/a"))
+	q.Start()
+	defer q.Shutdown()
+
+	q.NotifyConnect("/b", 2)
+	h.expectNone(t, 50*time.Millisecond)
+	// total reaches 4
+	q.NotifyConnect("/a", 2)
+	h.expect(t, TypeThresholdHit)
+	// /a reaches 3
+	q.NotifyConnect("/a", 1)
+	h.expect(t, TypeThresholdHit)
+	// inside the hysteresis band of /a, total stays at its limit
+	q.NotifyConnect("/a", -1)
+	h.expectNone(t, 50*time.Millisecond)
+	// both drop below their miss values
+	q.NotifyConnect("/a", -1)
+	h.expect(t, TypeThresholdMiss)
+	h.expect(t, TypeThresholdMiss)
+	q.NotifyConnect("/a", -1)
+	h.expect(t, TypeZeroViewers)
+	// zero viewers on /b and on all streams don't pass the filter
+	q.NotifyConnect("/b", -2)
+	h.expectNone(t, 50*time.Millisecond)
+}
+
+func TestFilterHandler(t *testing.T) {
+	h := &recordingHandler{events: make(chan Type, 10)}
+	f := NewFilterHandler(h, "a", "")
+	f.HandleEvent(TypeThresholdHit, "b", "", 0, 1, 1)
+	f.HandleEvent(TypeThresholdHit, "a", "/s", 0, 1, 1)
+	f.HandleEvent(TypeLimitHit, 0, 1, 1)
+	h.expect(t, TypeThresholdHit)
+	h.expect(t, TypeLimitHit)
+	h.expectNone(t, 0)
+}
+
+type blockingHandler struct {
+	release chan struct{}
+}
+
+func (h *blockingHandler) HandleEvent(t Type, args ...interface{}) {
+	<-h.release
+}
+
+type cancellableHandler struct {
+	cancelled chan struct{}
+}
+
+func (h *cancellableHandler) HandleEvent(t Type, args ...interface{}) {}
+
+func (h *cancellableHandler) HandleEventContext(ctx context.Context, t Type, args ...interface{}) {
+	<-ctx.Done()
+	close(h.cancelled)
+}
+
+func TestLoadReporterHandlerTimeout(t *testing.T) {
+	logger = &mockLogger{t, "handlertimeout"}
+	q := NewQueue(1)
+	q.SetTimeouts(50*time.Millisecond, time.Second)
+	blocking := &blockingHandler{release: make(chan struct{})}
+	defer close(blocking.release)
+	cancellable := &cancellableHandler{cancelled: make(chan struct{})}
+	h := &recordingHandler{events: make(chan Type, 10)}
+	q.RegisterEventHandler(TypeLimitHit, blocking)
+	q.RegisterEventHandler(TypeLimitHit, cancellable)
+	q.RegisterEventHandler(TypeLimitHit, h)
+	q.Start()
+	q.NotifyConnect("", 1)
+	// the stuck handlers don't keep the others from being called
+	h.expect(t, TypeLimitHit)
+	select {
+	case <-cancellable.cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("Handler context was not cancelled")
+	}
+	q.Shutdown()
+}
+
+func TestLoadReporterDrainTimeout(t *testing.T) {
+	logger = &mockLogger{t, "draintimeout"}
+	q := NewQueue(1)
+	q.SetTimeouts(time.Hour, 50*time.Millisecond)
+	blocking := &blockingHandler{release: make(chan struct{})}
+	q.RegisterEventHandler(TypeLimitHit, blocking)
+	q.Start()
+	q.NotifyConnect("", 1)
+	start := time.Now()
+	q.Shutdown()
+	if time.Since(start) > time.Second {
+		t.Errorf("Shutdown was not bounded by the drain timeout")
+	}
+	// let the queue finish, so it doesn't log after the test
+	close(blocking.release)
+	q.waiter.Wait()
+}
+
+func TestLoadReporterOverflow(t *testing.T) {
+	logger = &mockLogger{t, "overflow"}
+	q := NewQueue(0)
+	q.SetQueueSize(1)
+	q.AddThreshold("first", "", 1, 0)
+	q.AddThreshold("last", "", 6, 0)
+	blocking := &blockingHandler{release: make(chan struct{})}
+	h := &recordingHandler{events: make(chan Type, 10)}
+	q.RegisterEventHandler(TypeThresholdHit, blocking)
+	q.RegisterEventHandler(TypeThresholdHit, NewFilterHandler(h, "last", ""))
+	q.Start()
+	defer q.Shutdown()
+
+	// the first connection stalls the queue in the blocking handler
+	q.NotifyConnect("/a", 1)
+	time.Sleep(50 * time.Millisecond)
+	// none of these may block
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			q.NotifyConnect("/a", 1)
+		}
+		q.NotifyHeartbeat(time.Now())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Notification blocked on a full queue")
+	}
+	close(blocking.release)
+	// the merged changes must still reach the threshold
+	h.expect(t, TypeThresholdHit)
+}
+
+func TestLoadReporterShutdown(t *testing.T) {
+	logger = &mockLogger{t, "shutdown"}
+	q := NewQueue(1)
+	q.SetShutdownTimeout(50 * time.Millisecond)
+	h := &recordingHandler{events: make(chan Type, 10)}
+	cancellable := &cancellableHandler{cancelled: make(chan struct{})}
+	q.RegisterEventHandler(TypeShutdown, h)
+	q.RegisterEventHandler(TypeShutdown, cancellable)
+	q.Start()
+	start := time.Now()
+	q.Shutdown()
+	if time.Since(start) > time.Second {
+		t.Errorf("Shutdown was not bounded by the shutdown timeout")
+	}
+	h.expect(t, TypeShutdown)
+	select {
+	case <-cancellable.cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("Shutdown handler context was not cancelled")
+	}
+}
+
+func TestLoadReporterSource(t *testing.T) {
+	logger = &mockLogger{t, "source"}
+	q := NewQueue(0)
+	h := &recordingHandler{events: make(chan Type, 10)}
+	q.RegisterEventHandler(TypeSourceConnected, h)
+	q.RegisterEventHandler(TypeSourceDisconnected, NewFilterHandler(h, "", "/b.ts"))
+	q.Start()
+	defer q.Shutdown()
+
+	q.NotifySource("/a.ts", "http://upstream/a.ts", true)
+	h.expect(t, TypeSourceConnected)
+	// filtered by stream
+	q.NotifySource("/a.ts", "http://upstream/a.ts", false)
+	h.expectNone(t, 50*time.Millisecond)
+	q.NotifySource("/b.ts", "http://upstream/b.ts", false)
+	h.expect(t, TypeSourceDisconnected)
+}
+
+func TestLoadReporterDead(t *testing.T) {
+	logger = &mockLogger{t, "dead"}
+	q := NewQueue(0)
+	h := &recordingHandler{events: make(chan Type, 10)}
+	q.RegisterEventHandler(TypeStreamDead, NewFilterHandler(h, "", "/b.ts"))
+	q.Start()
+	defer q.Shutdown()
+
+	q.NotifyDead("/a.ts")
+	h.expectNone(t, 50*time.Millisecond)
+	q.NotifyDead("/b.ts")
+	h.expect(t, TypeStreamDead)
+}
@@ -17,8 +17,10 @@
 package event
 
 import (
+	"context"
 	"fmt"
 	"github.com/onitake/restreamer/auth"
+	"io"
 	"net/http"
 	"net/url"
 )
@@ -29,6 +31,8 @@ type UrlHandler struct {
 	Url *url.URL
 	// userauth will be used to generate credentials for client requests
 	userauth *auth.UserAuthenticator
+	// headers are sent with every request, in addition to the Authorization header
+	headers http.Header
 }
 
 func NewUrlHandler(urly string, userauth *auth.UserAuthenticator) (*UrlHandler, error) {
@@ -43,7 +47,31 @@ func NewUrlHandler(urly string, userauth *auth.UserAuthenticator) (*UrlHandler,
 	}
 }
 
+// SetHeaders adds static headers to every request.
+// An Authorization header is replaced by the credentials of the user authenticator, if there is one.
+func (handler *UrlHandler) SetHeaders(headers map[string]string) {
+	handler.headers = make(http.Header)
+	for name, value := range headers {
+		handler.headers.Set(name, value)
+	}
+}
+
+// SetQuery adds static query parameters to the URL.
+// Parameters that are already part of the URL are replaced.
+func (handler *UrlHandler) SetQuery(query map[string]string) {
+	values := handler.Url.Query()
+	for name, value := range query {
+		values.Set(name, value)
+	}
+	handler.Url.RawQuery = values.Encode()
+}
+
 func (handler *UrlHandler) HandleEvent(typ Type, args ...interface{}) {
+	handler.HandleEventContext(context.Background(), typ, args...)
+}
+
+// HandleEventContext sends the request, aborting it when ctx is cancelled.
+func (handler *UrlHandler) HandleEventContext(ctx context.Context, typ Type, args ...interface{}) {
 	logger.Logkv(
 		"event", urlHandlerEventNotify,
 		"message", fmt.Sprintf("Event received, notifying %s", handler.Url),
@@ -54,12 +82,15 @@ func (handler *UrlHandler) HandleEvent(typ Type, args ...interface{}) {
 	req := &http.Request{
 		Method: "GET",
 		URL:    handler.Url,
-		Header: make(http.Header),
+		Header: handler.headers.Clone(),
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
 	}
 	if handler.userauth != nil {
-		req.Header.Add("Authorization", handler.userauth.GetLogin())
+		req.Header.Set("Authorization", handler.userauth.GetLogin())
 	}
-	_, err := http.DefaultClient.Do(req)
+	response, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
 		logger.Logkv(
 			"event", urlHandlerEventError,
@@ -68,5 +99,19 @@ func (handler *UrlHandler) HandleEvent(typ Type, args ...interface{}) {
 			"url", handler.Url.String(),
 			"type", typ,
 		)
+		return
+	}
+	// drain the body, so the connection can be reused
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		logger.Logkv(
+			"event", urlHandlerEventError,
+			"error", urlHandlerErrorStatus,
+			"message", fmt.Sprintf("Notification rejected with status %s", response.Status),
+			"url", handler.Url.String(),
+			"status", response.StatusCode,
+			"type", typ,
+		)
 	}
 }
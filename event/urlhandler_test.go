@@ -0,0 +1,68 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package event
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/onitake/restreamer/auth"
+	"github.com/onitake/restreamer/configuration"
+)
+
+func TestUrlHandlerHeaders(t *testing.T) {
+	logger = &mockLogger{t, "urlhandlerheaders"}
+	received := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		received <- request
+		writer.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	users := map[string]configuration.UserCredentials{
+		"user": {Password: "pass"},
+	}
+	cred := configuration.Authentication{
+		Type:  "bearer",
+		Users: []string{"user"},
+	}
+	handler, err := NewUrlHandler(server.URL+"/hook?a=1", auth.NewUserAuthenticator(cred, auth.NewAuthenticator(cred, users)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.SetHeaders(map[string]string{
+		"X-Api-Key":     "key",
+		"Authorization": "ignored",
+	})
+	handler.SetQuery(map[string]string{
+		"token": "abc",
+	})
+	handler.HandleEvent(TypeHeartbeat)
+
+	request := <-received
+	if request.Header.Get("X-Api-Key") != "key" {
+		t.Errorf("Invalid custom header: %s", request.Header.Get("X-Api-Key"))
+	}
+	if request.Header.Get("Authorization") != "Bearer pass" {
+		t.Errorf("Invalid Authorization header: %s", request.Header.Get("Authorization"))
+	}
+	query := request.URL.Query()
+	if query.Get("a") != "1" || query.Get("token") != "abc" {
+		t.Errorf("Invalid query string: %s", request.URL.RawQuery)
+	}
+}
@@ -1,10 +1,14 @@
 module github.com/onitake/restreamer
 
-require github.com/prometheus/client_golang v1.16.0
+require (
+	github.com/prometheus/client_golang v1.16.0
+	golang.org/x/time v0.3.0
+)
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
 	github.com/prometheus/client_model v0.3.0 // indirect
@@ -26,6 +26,7 @@ const (
 	eventMetricsError = "error"
 	//
 	errorMetricsPrometheus = "prometheus"
+	errorMetricsPanic      = "panic"
 )
 
 var logger = util.NewGlobalModuleLogger(moduleMetrics, nil)
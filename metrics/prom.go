@@ -22,6 +22,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
+	"sync"
 )
 
 var (
@@ -34,17 +35,27 @@ var (
 	DefaultGatherer prometheus.Gatherer = defaultRegistry
 )
 
-func init() {
-	// register the standard metrics
-	DefaultRegisterer.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
-	// the Go metrics are NOT enabled by default as they can have a serious performance impact.
-	// if you want them, you need to register with a call to EnableGoRuntimeCollector().
+var (
+	processOnce sync.Once
+	goOnce      sync.Once
+)
+
+// EnableProcessCollector enables the Prometheus process collector,
+// which reports CPU time, memory, file descriptors and the start time of the process.
+// Only supported on Linux. It is safe to call this more than once.
+func EnableProcessCollector() {
+	processOnce.Do(func() {
+		DefaultRegisterer.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	})
 }
 
-// EnableGoRuntimeCollector enables the Prometheus Go runtime collector.
-// Warning: This can have a serious impact on runtime performance. Enable at your own risk.
+// EnableGoRuntimeCollector enables the Prometheus Go runtime collector,
+// which reports goroutines, threads, garbage collection and memory allocator statistics.
+// The statistics are gathered on each scrape. It is safe to call this more than once.
 func EnableGoRuntimeCollector() {
-	DefaultRegisterer.MustRegister(collectors.NewGoCollector())
+	goOnce.Do(func() {
+		DefaultRegisterer.MustRegister(collectors.NewGoCollector())
+	})
 }
 
 // promErrorLogger is an internal error logger that prints to the kvl log.
@@ -0,0 +1,39 @@
+/* Copyright (c) 2019 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEnableCollectors(t *testing.T) {
+	// enabling twice must not panic on duplicate registration
+	EnableProcessCollector()
+	EnableProcessCollector()
+	EnableGoRuntimeCollector()
+	EnableGoRuntimeCollector()
+
+	recorder := httptest.NewRecorder()
+	PromHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), "go_goroutines") {
+		t.Errorf("Go runtime metrics are not exported")
+	}
+}
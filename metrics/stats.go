@@ -17,13 +17,68 @@
 package metrics
 
 import (
+	"fmt"
 	"github.com/onitake/restreamer/protocol"
 	"github.com/onitake/restreamer/util"
+	"github.com/prometheus/client_golang/prometheus"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	// statsInterval is the update interval of the statistics
+	statsInterval = 1 * time.Second
+	// statsMaxWindow is the longest supported rate averaging window.
+	// It bounds the size of the per-stream history.
+	statsMaxWindow = 1 * time.Hour
+)
+
+var (
+	metricPeakConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "streaming_peak_connections",
+			Help: "Highest number of concurrent client connections since startup or the last reset.",
+		},
+		[]string{"stream"},
+	)
+	metricStreamsConfigured = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "restreamer_streams_configured",
+			Help: "Number of configured streams.",
+		},
+	)
+	metricStreamsConnected = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "restreamer_streams_connected",
+			Help: "Number of streams with a live upstream connection.",
+		},
+	)
+	metricStreamsViewers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "restreamer_streams_total_viewers",
+			Help: "Number of client connections over all streams.",
+		},
+	)
+	metricStatsLastUpdate = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "restreamer_stats_last_update_timestamp",
+			Help: "Unix time of the last statistics update. Stops advancing if the updater is stuck.",
+		},
+	)
+)
+
+func init() {
+	MustRegister(metricPeakConnections)
+	MustRegister(metricStreamsConfigured)
+	MustRegister(metricStreamsConnected)
+	MustRegister(metricStreamsViewers)
+	MustRegister(metricStatsLastUpdate)
+}
+
+// DefaultRateWindows are the averaging windows used by NewStatistics.
+var DefaultRateWindows = []time.Duration{10 * time.Second, 1 * time.Minute, 5 * time.Minute}
+
 // Collector is the public face of a statistics collector.
 // It is implemented by the individual stream stats.
 type Collector interface {
@@ -48,6 +103,9 @@ type Collector interface {
 	IsUpstreamConnected() bool
 	// StreamDuration reports how long a downstream connection was up
 	StreamDuration(duration time.Duration)
+	// PidReceived notifies that a packet with a PID was received.
+	// This is only called when PID statistics are enabled.
+	PidReceived(pid uint16)
 }
 
 // realCollector represents per-stream state information
@@ -64,6 +122,12 @@ type realCollector struct {
 	packetsDropped uint64
 	// total streaming duration
 	duration int64
+	// highest number of concurrent connections
+	peak int64
+	// pidLock protects pids
+	pidLock sync.Mutex
+	// number of received packets per PID since the last update, nil if none were counted
+	pids map[uint16]uint64
 	// upstream connection state
 	// NOTE AtomicBool is a 32-bit type and must listed be after 64-bit fields
 	// to avoid crashes due to misalignment!
@@ -71,7 +135,14 @@ type realCollector struct {
 }
 
 func (stats *realCollector) ConnectionAdded() {
-	atomic.AddInt64(&stats.connections, 1)
+	connections := atomic.AddInt64(&stats.connections, 1)
+	// raise the high-water mark, unless another connection beat us to it
+	for {
+		peak := atomic.LoadInt64(&stats.peak)
+		if connections <= peak || atomic.CompareAndSwapInt64(&stats.peak, peak, connections) {
+			break
+		}
+	}
 }
 
 func (stats *realCollector) ConnectionRemoved() {
@@ -106,8 +177,27 @@ func (stats *realCollector) StreamDuration(duration time.Duration) {
 	atomic.AddInt64(&stats.duration, int64(duration))
 }
 
+func (stats *realCollector) PidReceived(pid uint16) {
+	stats.pidLock.Lock()
+	if stats.pids == nil {
+		stats.pids = make(map[uint16]uint64)
+	}
+	stats.pids[pid]++
+	stats.pidLock.Unlock()
+}
+
+// takePids returns the PID counters and starts counting from zero.
+func (stats *realCollector) takePids() map[uint16]uint64 {
+	stats.pidLock.Lock()
+	pids := stats.pids
+	stats.pids = nil
+	stats.pidLock.Unlock()
+	return pids
+}
+
 // clone creates a copy of the stats object - useful for
 // storing state temporarily.
+// The PID counters are moved to the copy, so they count from zero again.
 func (stats *realCollector) clone() *realCollector {
 	return &realCollector{
 		connections:     atomic.LoadInt64(&stats.connections),
@@ -116,13 +206,15 @@ func (stats *realCollector) clone() *realCollector {
 		packetsDropped:  atomic.LoadUint64(&stats.packetsDropped),
 		connected:       util.ToAtomicBool(util.LoadBool(&stats.connected)),
 		duration:        atomic.LoadInt64(&stats.duration),
+		peak:            atomic.LoadInt64(&stats.peak),
+		pids:            stats.takePids(),
 	}
 }
 
 // invsub subtracts this stats object from another and sets each
 // value to the difference. Note: Should not be used on atomic values
 // directly. clone() first.
-// "connected" is copied directly from "to".
+// "connected", "peak" and "pids" are copied directly from "to".
 // Useful if you want to calculate a delta, then replace the previous
 // value with the current one:
 // prev := realCollector{}
@@ -140,12 +232,15 @@ func (stats *realCollector) invsub(to *realCollector) {
 	stats.packetsDropped = to.packetsDropped - stats.packetsDropped
 	stats.connected = to.connected
 	stats.duration = to.duration - stats.duration
+	stats.peak = to.peak
+	stats.pids = to.pids
 }
 
 // StreamStatistics is the current state of a single stream
 // or all streams combined.
 type StreamStatistics struct {
 	Connections              int64
+	PeakConnections          int64
 	MaxConnections           int64
 	FullConnections          int64
 	TotalPacketsReceived     uint64
@@ -162,6 +257,100 @@ type StreamStatistics struct {
 	BytesPerSecondSent       uint64
 	BytesPerSecondDropped    uint64
 	Connected                bool
+	// Windows contains average rates over longer time windows, keyed by window name (like "1m").
+	// The map is replaced on every update and must not be modified.
+	Windows map[string]*RateStatistics
+	// Pids contains the traffic of each PID during the last update interval,
+	// nil if PID statistics are disabled. It is never set on the global statistics.
+	// The map is replaced on every update and must not be modified.
+	Pids map[uint16]*PidStatistics
+}
+
+// PidStatistics contains the traffic of a single PID during one update interval.
+type PidStatistics struct {
+	Packets        uint64
+	Bytes          uint64
+	BytesPerSecond uint64
+}
+
+// RateStatistics contains rates averaged over a time window.
+type RateStatistics struct {
+	PacketsPerSecondReceived uint64
+	PacketsPerSecondSent     uint64
+	PacketsPerSecondDropped  uint64
+	BytesPerSecondReceived   uint64
+	BytesPerSecondSent       uint64
+	BytesPerSecondDropped    uint64
+}
+
+// RateWindowName returns a short name for a window duration, like "10s", "5m" or "1h".
+func RateWindowName(window time.Duration) string {
+	switch {
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("%dm", window/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", window/time.Second)
+	}
+}
+
+// rateSample is the change of the packet counters during one update interval.
+type rateSample struct {
+	packetsReceived uint64
+	packetsSent     uint64
+	packetsDropped  uint64
+	duration        time.Duration
+}
+
+// rateHistory is a ring buffer of the most recent rate samples of a stream.
+type rateHistory struct {
+	samples []rateSample
+	// next is the index of the next sample to be written
+	next int
+	// count is the number of valid samples
+	count int
+}
+
+// newRateHistory creates a ring buffer with room for size samples.
+func newRateHistory(size int) *rateHistory {
+	return &rateHistory{
+		samples: make([]rateSample, size),
+	}
+}
+
+// push adds a sample, replacing the oldest one if the buffer is full.
+func (history *rateHistory) push(sample rateSample) {
+	if len(history.samples) == 0 {
+		return
+	}
+	history.samples[history.next] = sample
+	history.next = (history.next + 1) % len(history.samples)
+	if history.count < len(history.samples) {
+		history.count++
+	}
+}
+
+// average calculates the average rates over the most recent samples that fit into window.
+func (history *rateHistory) average(window time.Duration) *RateStatistics {
+	var sum rateSample
+	for i := 0; i < history.count && sum.duration < window; i++ {
+		sample := &history.samples[(history.next-1-i+len(history.samples))%len(history.samples)]
+		sum.packetsReceived += sample.packetsReceived
+		sum.packetsSent += sample.packetsSent
+		sum.packetsDropped += sample.packetsDropped
+		sum.duration += sample.duration
+	}
+	rate := &RateStatistics{}
+	if sum.duration > 0 {
+		rate.PacketsPerSecondReceived = uint64(float64(sum.packetsReceived) / sum.duration.Seconds())
+		rate.PacketsPerSecondSent = uint64(float64(sum.packetsSent) / sum.duration.Seconds())
+		rate.PacketsPerSecondDropped = uint64(float64(sum.packetsDropped) / sum.duration.Seconds())
+		rate.BytesPerSecondReceived = rate.PacketsPerSecondReceived * protocol.MpegTsPacketSize
+		rate.BytesPerSecondSent = rate.PacketsPerSecondSent * protocol.MpegTsPacketSize
+		rate.BytesPerSecondDropped = rate.PacketsPerSecondDropped * protocol.MpegTsPacketSize
+	}
+	return rate
 }
 
 // Statistics is the access interface for a stat tracker.
@@ -177,6 +366,9 @@ type Statistics interface {
 	RegisterStream(name string) Collector
 	// RemoveStream removes a stream from the map.
 	RemoveStream(name string)
+	// SetStreamLimits sets the hard (maxconns) and soft (fullconns) connection limits
+	// reported in the statistics of a stream. 0 means no limit.
+	SetStreamLimits(name string, maxconns uint, fullconns uint)
 	// GetStreamStatistics fetches the statistics for a stream.
 	// The returned object is a copy does not need to be handled with care.
 	GetStreamStatistics(name string) *StreamStatistics
@@ -186,16 +378,30 @@ type Statistics interface {
 	// GetGlobalStatistics fetches the global statistics.
 	// The returned object is a copy does not need to be handled with care.
 	GetGlobalStatistics() *StreamStatistics
+	// ResetPeakConnections sets the connection high-water marks of all streams
+	// and the global one to the current number of connections.
+	ResetPeakConnections()
+	// ResetStreamStatistics zeroes the packet, byte and duration totals and the average rates of a stream.
+	// Returns false if the stream doesn't exist.
+	ResetStreamStatistics(name string) bool
+	// ResetAllStatistics zeroes the totals and average rates of all streams, and the global totals with them.
+	ResetAllStatistics()
 }
 
 // realStatistics implements a full statistics collector and API endpoint generator.
 type realStatistics struct {
 	lock     sync.RWMutex
-	running  bool
+	running  util.AtomicBool
 	shutdown chan bool
 	internal map[string]*realCollector
 	streams  map[string]*StreamStatistics
 	global   *StreamStatistics
+	// windows are the rate averaging windows
+	windows []time.Duration
+	// history contains the recent rate samples of each stream
+	history map[string]*rateHistory
+	// historySize is the number of samples kept per stream
+	historySize int
 }
 
 // NewStatistics creates a new statistics container.
@@ -205,6 +411,13 @@ type realStatistics struct {
 // instead access them using the Add...() methods.
 // Snapshots of the aggregated statistics can then be fetched with the Get...() methods.
 func NewStatistics(maxconns uint, fullcons uint) Statistics {
+	return NewStatisticsWithWindows(maxconns, fullcons, DefaultRateWindows)
+}
+
+// NewStatisticsWithWindows creates a new statistics container that calculates
+// average rates over the given time windows, in addition to the instantaneous rates.
+// Windows longer than one hour are truncated.
+func NewStatisticsWithWindows(maxconns uint, fullcons uint, windows []time.Duration) Statistics {
 	stats := &realStatistics{
 		shutdown: make(chan bool),
 		internal: make(map[string]*realCollector),
@@ -213,6 +426,19 @@ func NewStatistics(maxconns uint, fullcons uint) Statistics {
 			MaxConnections:  int64(maxconns),
 			FullConnections: int64(fullcons),
 		},
+		history: make(map[string]*rateHistory),
+	}
+	for _, window := range windows {
+		if window > statsMaxWindow {
+			window = statsMaxWindow
+		}
+		if window < statsInterval {
+			continue
+		}
+		stats.windows = append(stats.windows, window)
+		if size := int(window / statsInterval); size > stats.historySize {
+			stats.historySize = size
+		}
 	}
 	return stats
 }
@@ -221,6 +447,8 @@ func NewStatistics(maxconns uint, fullcons uint) Statistics {
 func (stats *realStatistics) update(delta time.Duration, change map[string]*realCollector) {
 	// acquire the global write lock
 	stats.lock.Lock()
+	// released on panic as well, so a restarted updater doesn't deadlock
+	defer stats.lock.Unlock()
 
 	// reset the global counters
 	stats.global.Connections = 0
@@ -238,6 +466,10 @@ func (stats *realStatistics) update(delta time.Duration, change map[string]*real
 	stats.global.BytesPerSecondSent = 0
 	stats.global.BytesPerSecondDropped = 0
 	stats.global.Connected = false
+	globalWindows := make(map[string]*RateStatistics, len(stats.windows))
+	for _, window := range stats.windows {
+		globalWindows[RateWindowName(window)] = &RateStatistics{}
+	}
 
 	// loop over all streams
 	for name, stream := range stats.streams {
@@ -259,6 +491,42 @@ func (stats *realStatistics) update(delta time.Duration, change map[string]*real
 		stream.BytesPerSecondSent = stream.PacketsPerSecondSent * protocol.MpegTsPacketSize
 		stream.BytesPerSecondDropped = stream.PacketsPerSecondDropped * protocol.MpegTsPacketSize
 		stream.Connected = diff.connected != 0
+		stream.PeakConnections = diff.peak
+		stream.Pids = nil
+		if len(diff.pids) > 0 {
+			stream.Pids = make(map[uint16]*PidStatistics, len(diff.pids))
+			for pid, packets := range diff.pids {
+				stream.Pids[pid] = &PidStatistics{
+					Packets:        packets,
+					Bytes:          packets * protocol.MpegTsPacketSize,
+					BytesPerSecond: uint64(float64(packets*protocol.MpegTsPacketSize) / delta.Seconds()),
+				}
+			}
+		}
+		metricPeakConnections.With(prometheus.Labels{"stream": name}).Set(float64(stream.PeakConnections))
+
+		// update the averages
+		history := stats.history[name]
+		history.push(rateSample{
+			packetsReceived: diff.packetsReceived,
+			packetsSent:     diff.packetsSent,
+			packetsDropped:  diff.packetsDropped,
+			duration:        delta,
+		})
+		windows := make(map[string]*RateStatistics, len(stats.windows))
+		for _, window := range stats.windows {
+			key := RateWindowName(window)
+			rate := history.average(window)
+			windows[key] = rate
+			global := globalWindows[key]
+			global.PacketsPerSecondReceived += rate.PacketsPerSecondReceived
+			global.PacketsPerSecondSent += rate.PacketsPerSecondSent
+			global.PacketsPerSecondDropped += rate.PacketsPerSecondDropped
+			global.BytesPerSecondReceived += rate.BytesPerSecondReceived
+			global.BytesPerSecondSent += rate.BytesPerSecondSent
+			global.BytesPerSecondDropped += rate.BytesPerSecondDropped
+		}
+		stream.Windows = windows
 
 		// update the global counters as well
 		stats.global.Connections += stream.Connections
@@ -280,8 +548,22 @@ func (stats *realStatistics) update(delta time.Duration, change map[string]*real
 		}
 	}
 
-	// and done
-	stats.lock.Unlock()
+	stats.global.Windows = globalWindows
+
+	// node-level overview
+	connected := 0
+	for _, stream := range stats.streams {
+		if stream.Connected {
+			connected++
+		}
+	}
+	metricStreamsConfigured.Set(float64(len(stats.streams)))
+	metricStreamsConnected.Set(float64(connected))
+	metricStreamsViewers.Set(float64(stats.global.Connections))
+	// the global peak can only be sampled
+	if stats.global.Connections > stats.global.PeakConnections {
+		stats.global.PeakConnections = stats.global.Connections
+	}
 }
 
 // delta calculates the difference between a previous internal state
@@ -289,21 +571,33 @@ func (stats *realStatistics) update(delta time.Duration, change map[string]*real
 // The previous state (the argument) is replaced with the difference.
 func (stats *realStatistics) delta(previous map[string]*realCollector) map[string]*realCollector {
 	stats.lock.RLock()
+	defer stats.lock.RUnlock()
 	current := make(map[string]*realCollector)
 	for name, stream := range stats.internal {
 		update := stream.clone()
 		previous[name].invsub(update)
 		current[name] = update
 	}
-	stats.lock.RUnlock()
 	return current
 }
 
 // loop runs a ticker to update all statistics periodically.
+// If an update panics, the loop is restarted.
 func (stats *realStatistics) loop() {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Logkv(
+				"event", eventMetricsError,
+				"error", errorMetricsPanic,
+				"message", fmt.Sprintf("Statistics updater crashed, restarting: %v", err),
+			)
+			go stats.loop()
+		}
+	}()
 	running := true
 	// TODO make the interval configurable
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
 
 	// pre-init - store the current time and state
 	before := time.Now()
@@ -326,26 +620,24 @@ func (stats *realStatistics) loop() {
 			previous = stats.delta(previous)
 			// and update
 			stats.update(now.Sub(before), delta)
+			metricStatsLastUpdate.Set(float64(now.UnixNano()) / float64(time.Second))
 			// stash the current time
 			before = now
 		}
 	}
-	// this should close the channel as well
-	ticker.Stop()
-	stats.running = false
+	util.StoreBool(&stats.running, false)
 }
 
 // Start starts the updater thread.
 func (stats *realStatistics) Start() {
-	if !stats.running {
-		stats.running = true
+	if util.CompareAndSwapBool(&stats.running, false, true) {
 		go stats.loop()
 	}
 }
 
 // Stop stops the updater thread.
 func (stats *realStatistics) Stop() {
-	if stats.running {
+	if util.LoadBool(&stats.running) {
 		stats.shutdown <- true
 	}
 }
@@ -357,6 +649,7 @@ func (stats *realStatistics) RegisterStream(name string) Collector {
 	stats.lock.Lock()
 	stats.internal[name] = current
 	stats.streams[name] = &StreamStatistics{}
+	stats.history[name] = newRateHistory(stats.historySize)
 	stats.lock.Unlock()
 	return current
 }
@@ -366,6 +659,18 @@ func (stats *realStatistics) RemoveStream(name string) {
 	stats.lock.Lock()
 	delete(stats.internal, name)
 	delete(stats.streams, name)
+	delete(stats.history, name)
+	stats.lock.Unlock()
+	metricPeakConnections.DeleteLabelValues(name)
+}
+
+// SetStreamLimits sets the connection limits reported in the statistics of a stream.
+func (stats *realStatistics) SetStreamLimits(name string, maxconns uint, fullconns uint) {
+	stats.lock.Lock()
+	if stream, ok := stats.streams[name]; ok {
+		stream.MaxConnections = int64(maxconns)
+		stream.FullConnections = int64(fullconns)
+	}
 	stats.lock.Unlock()
 }
 
@@ -400,6 +705,64 @@ func (stats *realStatistics) GetGlobalStatistics() *StreamStatistics {
 	return &global
 }
 
+// ResetPeakConnections sets the connection high-water marks of all streams
+// and the global one to the current number of connections.
+func (stats *realStatistics) ResetPeakConnections() {
+	stats.lock.Lock()
+	for name, collector := range stats.internal {
+		connections := atomic.LoadInt64(&collector.connections)
+		atomic.StoreInt64(&collector.peak, connections)
+		stats.streams[name].PeakConnections = connections
+		metricPeakConnections.With(prometheus.Labels{"stream": name}).Set(float64(connections))
+	}
+	stats.global.PeakConnections = stats.global.Connections
+	stats.lock.Unlock()
+}
+
+// ResetStreamStatistics zeroes the totals and average rates of a stream.
+// The number of active connections and the upstream state are preserved.
+// The global totals are reduced accordingly.
+func (stats *realStatistics) ResetStreamStatistics(name string) bool {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	if _, ok := stats.streams[name]; !ok {
+		return false
+	}
+	stats.resetStream(name)
+	return true
+}
+
+// ResetAllStatistics zeroes the totals and average rates of all streams.
+func (stats *realStatistics) ResetAllStatistics() {
+	stats.lock.Lock()
+	for name := range stats.streams {
+		stats.resetStream(name)
+	}
+	stats.lock.Unlock()
+}
+
+// resetStream zeroes the totals of a stream and subtracts them from the global totals.
+// The updater only ever adds deltas to the totals, so this is safe while it is running.
+// Must be called with the write lock held.
+func (stats *realStatistics) resetStream(name string) {
+	stream := stats.streams[name]
+	stats.global.TotalPacketsReceived -= stream.TotalPacketsReceived
+	stats.global.TotalPacketsSent -= stream.TotalPacketsSent
+	stats.global.TotalPacketsDropped -= stream.TotalPacketsDropped
+	stats.global.TotalBytesReceived -= stream.TotalBytesReceived
+	stats.global.TotalBytesSent -= stream.TotalBytesSent
+	stats.global.TotalBytesDropped -= stream.TotalBytesDropped
+	stats.global.TotalStreamTime -= stream.TotalStreamTime
+	stream.TotalPacketsReceived = 0
+	stream.TotalPacketsSent = 0
+	stream.TotalPacketsDropped = 0
+	stream.TotalBytesReceived = 0
+	stream.TotalBytesSent = 0
+	stream.TotalBytesDropped = 0
+	stream.TotalStreamTime = 0
+	stats.history[name] = newRateHistory(stats.historySize)
+}
+
 // DummyStatistics is placeholder for a real stats handler.
 type DummyStatistics struct {
 }
@@ -417,6 +780,9 @@ func (stats *DummyStatistics) RegisterStream(name string) Collector {
 func (stats *DummyStatistics) RemoveStream(name string) {
 }
 
+func (stats *DummyStatistics) SetStreamLimits(name string, maxconns uint, fullconns uint) {
+}
+
 func (stats *DummyStatistics) GetStreamStatistics(name string) *StreamStatistics {
 	return &StreamStatistics{}
 }
@@ -429,6 +795,16 @@ func (stats *DummyStatistics) GetGlobalStatistics() *StreamStatistics {
 	return &StreamStatistics{}
 }
 
+func (stats *DummyStatistics) ResetStreamStatistics(name string) bool {
+	return false
+}
+
+func (stats *DummyStatistics) ResetAllStatistics() {
+}
+
+func (stats *DummyStatistics) ResetPeakConnections() {
+}
+
 // DummyCollector is placeholder for a real stats collector.
 type DummyCollector struct {
 }
@@ -460,3 +836,6 @@ func (stats *DummyCollector) IsUpstreamConnected() bool {
 
 func (stats *DummyCollector) StreamDuration(duration time.Duration) {
 }
+
+func (stats *DummyCollector) PidReceived(pid uint16) {
+}
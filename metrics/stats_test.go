@@ -17,6 +17,7 @@
 package metrics
 
 import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"testing"
 	"time"
 )
@@ -114,3 +115,134 @@ func TestRealStatistics(t *testing.T) {
 	testStatisticsLimits(t, NewStatistics(10, 20), 10, 20)
 	testStatisticsStateChange(t, NewStatistics(0, 0))
 }
+
+func TestRateHistory(t *testing.T) {
+	h := newRateHistory(3)
+	for i := uint64(1); i <= 4; i++ {
+		h.push(rateSample{packetsSent: i * 10, duration: time.Second})
+	}
+	// the oldest sample was overwritten: 20, 30, 40
+	if r := h.average(3 * time.Second); r.PacketsPerSecondSent != 30 {
+		t.Errorf("Invalid 3s average: %d", r.PacketsPerSecondSent)
+	}
+	if r := h.average(time.Second); r.PacketsPerSecondSent != 40 {
+		t.Errorf("Invalid 1s average: %d", r.PacketsPerSecondSent)
+	}
+	if r := h.average(time.Hour); r.BytesPerSecondSent != 30*188 {
+		t.Errorf("Invalid average over incomplete window: %d", r.BytesPerSecondSent)
+	}
+	for window, name := range map[time.Duration]string{10 * time.Second: "10s", 5 * time.Minute: "5m", 90 * time.Second: "90s", time.Hour: "1h"} {
+		if RateWindowName(window) != name {
+			t.Errorf("Invalid window name for %v: %s", window, RateWindowName(window))
+		}
+	}
+}
+
+func TestPeakConnections(t *testing.T) {
+	s := NewStatistics(0, 0)
+	c := s.RegisterStream("TestPeakConnections").(*realCollector)
+	c.ConnectionAdded()
+	c.ConnectionAdded()
+	c.ConnectionRemoved()
+	if c.peak != 2 {
+		t.Errorf("Invalid peak: %d", c.peak)
+	}
+	s.ResetPeakConnections()
+	if c.peak != 1 {
+		t.Errorf("Peak was not reset to the current connection count: %d", c.peak)
+	}
+	s.RemoveStream("TestPeakConnections")
+}
+
+func TestResetStatistics(t *testing.T) {
+	s := NewStatistics(0, 0).(*realStatistics)
+	s.RegisterStream("a")
+	s.RegisterStream("b")
+	change := map[string]*realCollector{
+		"a": {connections: 1, packetsSent: 10, duration: 100},
+		"b": {connections: 2, packetsSent: 20, duration: 200},
+	}
+	s.update(time.Second, change)
+	if s.GetGlobalStatistics().TotalPacketsSent != 30 {
+		t.Fatalf("Invalid global total: %d", s.GetGlobalStatistics().TotalPacketsSent)
+	}
+
+	if s.ResetStreamStatistics("c") {
+		t.Error("Reset of unknown stream succeeded")
+	}
+	if !s.ResetStreamStatistics("a") {
+		t.Error("Reset of stream a failed")
+	}
+	a := s.GetStreamStatistics("a")
+	if a.TotalPacketsSent != 0 || a.TotalBytesSent != 0 || a.TotalStreamTime != 0 {
+		t.Errorf("Totals of stream a not reset: %+v", a)
+	}
+	if a.Connections != 1 {
+		t.Errorf("Connections of stream a were reset: %d", a.Connections)
+	}
+	global := s.GetGlobalStatistics()
+	if global.TotalPacketsSent != 20 || global.TotalStreamTime != 200 || global.Connections != 3 {
+		t.Errorf("Invalid global statistics after stream reset: %+v", global)
+	}
+
+	// new traffic is counted from zero
+	s.update(time.Second, map[string]*realCollector{"a": {packetsSent: 5}, "b": {}})
+	if s.GetStreamStatistics("a").TotalPacketsSent != 5 {
+		t.Errorf("Invalid total after reset: %d", s.GetStreamStatistics("a").TotalPacketsSent)
+	}
+
+	s.ResetAllStatistics()
+	global = s.GetGlobalStatistics()
+	if global.TotalPacketsSent != 0 || global.TotalStreamTime != 0 || global.Connections != 3 {
+		t.Errorf("Invalid global statistics after full reset: %+v", global)
+	}
+	s.RemoveStream("a")
+	s.RemoveStream("b")
+}
+
+func TestStatisticsRestart(t *testing.T) {
+	s := NewStatistics(0, 0)
+	s.Start()
+	defer s.Stop()
+	// streams must be registered before the updater is running, so the next update panics
+	<-time.After(100 * time.Millisecond)
+	s.RegisterStream("TestStatisticsRestart")
+	<-time.After(1500 * time.Millisecond)
+	// the restarted updater keeps the timestamp going
+	start := testutil.ToFloat64(metricStatsLastUpdate)
+	<-time.After(1500 * time.Millisecond)
+	if last := testutil.ToFloat64(metricStatsLastUpdate); last <= start {
+		t.Errorf("Statistics updater was not restarted, last update at %v", last)
+	}
+	s.RemoveStream("TestStatisticsRestart")
+}
+
+func TestPidStatistics(t *testing.T) {
+	s := NewStatistics(0, 0).(*realStatistics)
+	c := s.RegisterStream("TestPidStatistics").(*realCollector)
+	previous := map[string]*realCollector{"TestPidStatistics": c.clone()}
+	for i := 0; i < 10; i++ {
+		c.PacketReceived()
+		c.PidReceived(0x100)
+	}
+	c.PidReceived(0x1fff)
+	delta := previous
+	previous = s.delta(previous)
+	s.update(time.Second, delta)
+	pids := s.GetStreamStatistics("TestPidStatistics").Pids
+	if len(pids) != 2 || pids[0x100].Packets != 10 || pids[0x100].BytesPerSecond != 1880 || pids[0x1fff].Bytes != 188 {
+		t.Errorf("Invalid PID statistics: %v", pids)
+	}
+	if s.GetGlobalStatistics().Pids != nil {
+		t.Error("PID statistics added to the global statistics")
+	}
+
+	// counters start from zero with every update
+	delta = previous
+	s.delta(previous)
+	s.update(time.Second, delta)
+	if pids := s.GetStreamStatistics("TestPidStatistics").Pids; pids != nil {
+		t.Errorf("PID statistics not cleared: %v", pids)
+	}
+	s.RemoveStream("TestPidStatistics")
+}
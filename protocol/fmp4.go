@@ -0,0 +1,524 @@
+/* Copyright (c) 2026 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// Fmp4VideoTimescale is the timescale of video tracks (same as MPEG-TS)
+	Fmp4VideoTimescale = 90000
+
+	// H.264 NAL unit types
+	h264NalIdr = 5
+	h264NalSps = 7
+	h264NalPps = 8
+	h264NalAud = 9
+
+	// sample flags for sync and non-sync samples
+	fmp4SampleSync    = 0x02000000
+	fmp4SampleNonSync = 0x01010000
+)
+
+var (
+	// ErrInvalidSps is returned when an H.264 sequence parameter set cannot be parsed
+	ErrInvalidSps = errors.New("restreamer: invalid H.264 SPS")
+	// ErrInvalidAdts is returned when an AAC frame has no valid ADTS header
+	ErrInvalidAdts = errors.New("restreamer: invalid ADTS header")
+)
+
+// aacSampleRates maps MPEG-4 sampling frequency indexes to sample rates.
+var aacSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// Fmp4Track describes a track in a fragmented MP4 file.
+type Fmp4Track struct {
+	// Id is the track ID, starting at 1
+	Id uint32
+	// Video is true for H.264 tracks, false for AAC tracks
+	Video bool
+	// Timescale is the number of time units per second
+	Timescale uint32
+	// Sps and Pps are the H.264 parameter sets (video only)
+	Sps []byte
+	Pps []byte
+	// Width and Height are the video resolution (video only)
+	Width  uint16
+	Height uint16
+	// AudioConfig is the MPEG-4 AudioSpecificConfig (audio only)
+	AudioConfig []byte
+	// Channels is the number of audio channels (audio only)
+	Channels uint16
+}
+
+// Fmp4Sample is a single sample (access unit or audio frame) in a fragment.
+type Fmp4Sample struct {
+	// Data is the sample payload, length-prefixed NAL units for video, raw AAC for audio
+	Data []byte
+	// Duration is the sample duration in track timescale units
+	Duration uint32
+	// CompositionOffset is PTS - DTS in track timescale units
+	CompositionOffset int32
+	// Sync is true for random access points
+	Sync bool
+}
+
+// Fmp4Fragment is the set of samples of one track in a media segment.
+type Fmp4Fragment struct {
+	// Track is the track the samples belong to
+	Track *Fmp4Track
+	// BaseDecodeTime is the decode time of the first sample, in track timescale units
+	BaseDecodeTime uint64
+	// Samples is the list of samples in decoding order
+	Samples []*Fmp4Sample
+}
+
+// box creates an ISO BMFF box from a type and payload parts.
+func box(typ string, parts ...[]byte) []byte {
+	size := 8
+	for _, part := range parts {
+		size += len(part)
+	}
+	data := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(data, uint32(size))
+	copy(data[4:], typ)
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	return data
+}
+
+// fullBox creates an ISO BMFF full box with version and flags.
+func fullBox(typ string, version byte, flags uint32, parts ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{header}, parts...)...)
+}
+
+// be creates a big endian byte sequence from a list of values.
+// Supported types are uint8, uint16, uint32, int32 and uint64.
+func be(values ...interface{}) []byte {
+	var data []byte
+	for _, value := range values {
+		switch v := value.(type) {
+		case uint8:
+			data = append(data, v)
+		case uint16:
+			data = binary.BigEndian.AppendUint16(data, v)
+		case uint32:
+			data = binary.BigEndian.AppendUint32(data, v)
+		case int32:
+			data = binary.BigEndian.AppendUint32(data, uint32(v))
+		case uint64:
+			data = binary.BigEndian.AppendUint64(data, v)
+		}
+	}
+	return data
+}
+
+// fmp4Matrix is the unity transformation matrix
+var fmp4Matrix = be(uint32(0x00010000), uint32(0), uint32(0), uint32(0), uint32(0x00010000), uint32(0), uint32(0), uint32(0), uint32(0x40000000))
+
+// Fmp4InitSegment creates an initialization segment (ftyp + moov) for a list of tracks.
+func Fmp4InitSegment(tracks []*Fmp4Track) []byte {
+	ftyp := box("ftyp", []byte("iso6"), be(uint32(0)), []byte("iso6cmfcmp41"))
+
+	mvhd := fullBox("mvhd", 0, 0,
+		be(uint32(0), uint32(0), uint32(1000), uint32(0), uint32(0x00010000), uint16(0x0100)),
+		make([]byte, 10),
+		fmp4Matrix,
+		make([]byte, 24),
+		be(uint32(len(tracks)+1)),
+	)
+	moov := [][]byte{mvhd}
+	var trexs [][]byte
+	for _, track := range tracks {
+		moov = append(moov, fmp4Trak(track))
+		trexs = append(trexs, fullBox("trex", 0, 0, be(track.Id, uint32(1), uint32(0), uint32(0), uint32(0))))
+	}
+	moov = append(moov, box("mvex", trexs...))
+	return append(ftyp, box("moov", moov...)...)
+}
+
+// fmp4Trak creates the trak box for a single track.
+func fmp4Trak(track *Fmp4Track) []byte {
+	var volume uint16
+	var width, height uint32
+	if track.Video {
+		width = uint32(track.Width) << 16
+		height = uint32(track.Height) << 16
+	} else {
+		volume = 0x0100
+	}
+	tkhd := fullBox("tkhd", 0, 0x000003,
+		be(uint32(0), uint32(0), track.Id, uint32(0), uint32(0)),
+		make([]byte, 8),
+		be(uint16(0), uint16(0), volume, uint16(0)),
+		fmp4Matrix,
+		be(width, height),
+	)
+	// language "und"
+	mdhd := fullBox("mdhd", 0, 0, be(uint32(0), uint32(0), track.Timescale, uint32(0), uint16(0x55c4), uint16(0)))
+
+	var hdlr, header, entry []byte
+	if track.Video {
+		hdlr = fullBox("hdlr", 0, 0, be(uint32(0)), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+		header = fullBox("vmhd", 0, 1, make([]byte, 8))
+		entry = fmp4Avc1(track)
+	} else {
+		hdlr = fullBox("hdlr", 0, 0, be(uint32(0)), []byte("soun"), make([]byte, 12), []byte("SoundHandler\x00"))
+		header = fullBox("smhd", 0, 0, make([]byte, 4))
+		entry = fmp4Mp4a(track)
+	}
+	dinf := box("dinf", fullBox("dref", 0, 0, be(uint32(1)), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, be(uint32(1)), entry),
+		fullBox("stts", 0, 0, be(uint32(0))),
+		fullBox("stsc", 0, 0, be(uint32(0))),
+		fullBox("stsz", 0, 0, be(uint32(0), uint32(0))),
+		fullBox("stco", 0, 0, be(uint32(0))),
+	)
+	minf := box("minf", header, dinf, stbl)
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, minf))
+}
+
+// fmp4Avc1 creates an H.264 sample entry.
+func fmp4Avc1(track *Fmp4Track) []byte {
+	var avcc []byte
+	if len(track.Sps) >= 4 {
+		avcc = append(avcc, 1, track.Sps[1], track.Sps[2], track.Sps[3], 0xff, 0xe1)
+	} else {
+		avcc = append(avcc, 1, 0, 0, 0, 0xff, 0xe1)
+	}
+	avcc = append(avcc, be(uint16(len(track.Sps)))...)
+	avcc = append(avcc, track.Sps...)
+	avcc = append(avcc, 1)
+	avcc = append(avcc, be(uint16(len(track.Pps)))...)
+	avcc = append(avcc, track.Pps...)
+	return box("avc1",
+		make([]byte, 6),
+		be(uint16(1), uint16(0), uint16(0)),
+		make([]byte, 12),
+		be(track.Width, track.Height, uint32(0x00480000), uint32(0x00480000), uint32(0), uint16(1)),
+		make([]byte, 32),
+		be(uint16(0x0018), uint16(0xffff)),
+		box("avcC", avcc),
+	)
+}
+
+// fmp4Mp4a creates an AAC sample entry.
+func fmp4Mp4a(track *Fmp4Track) []byte {
+	asc := track.AudioConfig
+	decoderSpecific := append([]byte{0x05, byte(len(asc))}, asc...)
+	decoderConfig := append([]byte{0x04, byte(13 + len(decoderSpecific)), 0x40, 0x15, 0, 0, 0}, be(uint32(0), uint32(0))...)
+	decoderConfig = append(decoderConfig, decoderSpecific...)
+	sl := []byte{0x06, 0x01, 0x02}
+	es := append([]byte{0x03, byte(3 + len(decoderConfig) + len(sl)), 0x00, 0x00, 0x00}, decoderConfig...)
+	es = append(es, sl...)
+	return box("mp4a",
+		make([]byte, 6),
+		be(uint16(1)),
+		make([]byte, 8),
+		be(track.Channels, uint16(16), uint16(0), uint16(0), track.Timescale<<16),
+		fullBox("esds", 0, 0, es),
+	)
+}
+
+// Fmp4MediaSegment creates a media segment (moof + mdat) from a list of track fragments.
+func Fmp4MediaSegment(sequence uint32, fragments []*Fmp4Fragment) []byte {
+	// the moof size doesn't depend on the data offsets, so we can build it twice
+	moof := fmp4Moof(sequence, fragments, nil)
+	offsets := make([]int32, len(fragments))
+	offset := len(moof) + 8
+	var mdat [][]byte
+	for i, fragment := range fragments {
+		offsets[i] = int32(offset)
+		for _, sample := range fragment.Samples {
+			mdat = append(mdat, sample.Data)
+			offset += len(sample.Data)
+		}
+	}
+	moof = fmp4Moof(sequence, fragments, offsets)
+	return append(moof, box("mdat", mdat...)...)
+}
+
+// fmp4Moof creates a movie fragment box.
+func fmp4Moof(sequence uint32, fragments []*Fmp4Fragment, offsets []int32) []byte {
+	parts := [][]byte{fullBox("mfhd", 0, 0, be(sequence))}
+	for i, fragment := range fragments {
+		var offset int32
+		if offsets != nil {
+			offset = offsets[i]
+		}
+		// data offset, duration, size, flags and composition offset present
+		trun := be(uint32(len(fragment.Samples)), offset)
+		for _, sample := range fragment.Samples {
+			flags := uint32(fmp4SampleNonSync)
+			if sample.Sync {
+				flags = fmp4SampleSync
+			}
+			trun = append(trun, be(sample.Duration, uint32(len(sample.Data)), flags, sample.CompositionOffset)...)
+		}
+		parts = append(parts, box("traf",
+			// default-base-is-moof
+			fullBox("tfhd", 0, 0x020000, be(fragment.Track.Id)),
+			fullBox("tfdt", 1, 0, be(fragment.BaseDecodeTime)),
+			fullBox("trun", 1, 0x000f01, trun),
+		))
+	}
+	return box("moof", parts...)
+}
+
+// SplitAnnexB splits an H.264 Annex B byte stream into NAL units, without start codes.
+func SplitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				end := i
+				// 4 byte start codes have an extra leading zero
+				for end > start && data[end-1] == 0 {
+					end--
+				}
+				nalus = append(nalus, data[start:end])
+			}
+			start = i + 3
+			i += 2
+		}
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+// H264NalType returns the type of an H.264 NAL unit.
+func H264NalType(nalu []byte) byte {
+	if len(nalu) < 1 {
+		return 0
+	}
+	return nalu[0] & 0x1f
+}
+
+// AnnexBToLengthPrefixed converts the NAL units of an access unit into the length-prefixed
+// format used in MP4 files. Parameter sets and access unit delimiters are removed,
+// as they are carried in the sample entry. Returns the sample data and the NAL units
+// of any SPS or PPS found, as well as a flag that tells if the access unit is an IDR.
+func AnnexBToLengthPrefixed(data []byte) (sample []byte, sps []byte, pps []byte, idr bool) {
+	for _, nalu := range SplitAnnexB(data) {
+		switch H264NalType(nalu) {
+		case h264NalSps:
+			sps = nalu
+		case h264NalPps:
+			pps = nalu
+		case h264NalAud:
+			// not needed in MP4
+		default:
+			if H264NalType(nalu) == h264NalIdr {
+				idr = true
+			}
+			sample = binary.BigEndian.AppendUint32(sample, uint32(len(nalu)))
+			sample = append(sample, nalu...)
+		}
+	}
+	return sample, sps, pps, idr
+}
+
+// AdtsFrame is a single AAC frame extracted from an ADTS stream.
+type AdtsFrame struct {
+	// Data is the raw AAC frame without ADTS header
+	Data []byte
+	// Config is the AudioSpecificConfig derived from the header
+	Config []byte
+	// SampleRate is the sampling frequency
+	SampleRate uint32
+	// Channels is the channel configuration
+	Channels uint16
+}
+
+// SplitAdts splits an ADTS stream into AAC frames.
+func SplitAdts(data []byte) ([]*AdtsFrame, error) {
+	var frames []*AdtsFrame
+	for len(data) >= 7 {
+		if data[0] != 0xff || data[1]&0xf0 != 0xf0 {
+			return frames, ErrInvalidAdts
+		}
+		header := 7
+		if data[1]&0x01 == 0 {
+			// CRC present
+			header = 9
+		}
+		length := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5
+		if length < header || length > len(data) {
+			return frames, ErrInvalidAdts
+		}
+		profile := data[2]>>6 + 1
+		frequency := (data[2] >> 2) & 0x0f
+		channels := (data[2]&0x01)<<2 | data[3]>>6
+		if int(frequency) >= len(aacSampleRates) {
+			return frames, ErrInvalidAdts
+		}
+		frames = append(frames, &AdtsFrame{
+			Data:       data[header:length],
+			Config:     []byte{profile<<3 | frequency>>1, (frequency&0x01)<<7 | channels<<3},
+			SampleRate: aacSampleRates[frequency],
+			Channels:   uint16(channels),
+		})
+		data = data[length:]
+	}
+	return frames, nil
+}
+
+// bitReader reads individual bits and Exp-Golomb codes from an RBSP.
+type bitReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *bitReader) bit() uint32 {
+	if r.offset >= len(r.data)*8 {
+		r.offset++
+		return 0
+	}
+	b := (r.data[r.offset/8] >> (7 - uint(r.offset%8))) & 0x01
+	r.offset++
+	return uint32(b)
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bit() == 0 && zeros < 32 {
+		zeros++
+	}
+	return (1<<uint(zeros) - 1) + r.bits(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&0x01 != 0 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
+
+func (r *bitReader) overrun() bool {
+	return r.offset > len(r.data)*8
+}
+
+// H264Resolution parses an SPS NAL unit and returns the cropped picture size.
+func H264Resolution(sps []byte) (width uint16, height uint16, err error) {
+	if len(sps) < 4 {
+		return 0, 0, ErrInvalidSps
+	}
+	// remove emulation prevention bytes
+	rbsp := make([]byte, 0, len(sps))
+	for i := 1; i < len(sps); i++ {
+		if i >= 3 && sps[i] == 0x03 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+	r := &bitReader{data: rbsp}
+	profile := r.bits(8)
+	r.bits(16)
+	r.ue()
+	chroma := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma = r.ue()
+		if chroma == 3 {
+			r.bit()
+		}
+		r.ue()
+		r.ue()
+		r.bit()
+		if r.bit() == 1 {
+			lists := 8
+			if chroma == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() == 1 {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					last, next := int32(8), int32(8)
+					for j := 0; j < size; j++ {
+						if next != 0 {
+							next = (last + r.se() + 256) % 256
+						}
+						if next != 0 {
+							last = next
+						}
+					}
+				}
+			}
+		}
+	}
+	r.ue()
+	switch r.ue() {
+	case 0:
+		r.ue()
+	case 1:
+		r.bit()
+		r.se()
+		r.se()
+		cycle := r.ue()
+		for i := uint32(0); i < cycle && !r.overrun(); i++ {
+			r.se()
+		}
+	}
+	r.ue()
+	r.bit()
+	mbWidth := r.ue() + 1
+	mapHeight := r.ue() + 1
+	frameMbsOnly := r.bit()
+	if frameMbsOnly == 0 {
+		r.bit()
+	}
+	r.bit()
+	var left, right, top, bottom uint32
+	if r.bit() == 1 {
+		left = r.ue()
+		right = r.ue()
+		top = r.ue()
+		bottom = r.ue()
+	}
+	if r.overrun() {
+		return 0, 0, ErrInvalidSps
+	}
+	cropX, cropY := uint32(1), 2-frameMbsOnly
+	switch chroma {
+	case 1:
+		cropX, cropY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		cropX = 2
+	}
+	w := mbWidth*16 - (left+right)*cropX
+	h := (2-frameMbsOnly)*mapHeight*16 - (top+bottom)*cropY
+	return uint16(w), uint16(h), nil
+}
@@ -0,0 +1,176 @@
+/* Copyright (c) 2026 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testSps is a baseline profile SPS for 1920x1080 (1088 lines, cropped by 8).
+var testSps = []byte{0x67, 0x42, 0x00, 0x28, 0xda, 0x01, 0xe0, 0x08, 0x9f, 0x95}
+
+// testPps is a matching PPS.
+var testPps = []byte{0x68, 0xce, 0x3c, 0x80}
+
+// findBox returns the payload of the first box along a path of box types,
+// or nil if there is none.
+func findBox(data []byte, path ...string) []byte {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			return nil
+		}
+		if string(data[4:8]) == path[0] {
+			if len(path) == 1 {
+				return data[8:size]
+			}
+			return findBox(data[8:size], path[1:]...)
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+func TestH264Resolution(t *testing.T) {
+	width, height, err := H264Resolution(testSps)
+	if err != nil || width != 1920 || height != 1080 {
+		t.Errorf("Got %dx%d (%v), expected 1920x1080", width, height, err)
+	}
+	if _, _, err := H264Resolution(testSps[:5]); err != ErrInvalidSps {
+		t.Errorf("Truncated SPS was not refused: %v", err)
+	}
+}
+
+func TestAnnexBToLengthPrefixed(t *testing.T) {
+	idr := []byte{0x65, 0x88, 0x84}
+	var stream []byte
+	for _, nalu := range [][]byte{{0x09, 0xf0}, testSps, testPps, idr} {
+		stream = append(stream, 0, 0, 0, 1)
+		stream = append(stream, nalu...)
+	}
+	sample, sps, pps, key := AnnexBToLengthPrefixed(stream)
+	if !bytes.Equal(sps, testSps) || !bytes.Equal(pps, testPps) || !key {
+		t.Errorf("Parameter sets or keyframe not detected")
+	}
+	// only the slice remains, the delimiter and parameter sets are removed
+	if !bytes.Equal(sample, append([]byte{0, 0, 0, 3}, idr...)) {
+		t.Errorf("Invalid sample: %x", sample)
+	}
+}
+
+func TestFmp4InitSegment(t *testing.T) {
+	video := &Fmp4Track{Id: 1, Video: true, Timescale: Fmp4VideoTimescale, Sps: testSps, Pps: testPps, Width: 1920, Height: 1080}
+	audio := &Fmp4Track{Id: 2, Timescale: 48000, AudioConfig: []byte{0x11, 0x90}, Channels: 2}
+	init := Fmp4InitSegment([]*Fmp4Track{video, audio})
+
+	if ftyp := findBox(init, "ftyp"); ftyp == nil || string(ftyp[:4]) != "iso6" {
+		t.Errorf("Missing or invalid ftyp")
+	}
+	moov := findBox(init, "moov")
+	if moov == nil {
+		t.Fatal("Missing moov")
+	}
+	tracks := 0
+	for data := moov; len(data) >= 8; data = data[binary.BigEndian.Uint32(data):] {
+		if string(data[4:8]) == "trak" {
+			tracks++
+		}
+	}
+	if tracks != 2 {
+		t.Errorf("Got %d tracks, expected 2", tracks)
+	}
+	if findBox(moov, "mvex", "trex") == nil {
+		t.Errorf("Missing trex, the file is not fragmented")
+	}
+	stsd := findBox(moov, "trak", "mdia", "minf", "stbl", "stsd")
+	if stsd == nil {
+		t.Fatal("Missing stsd")
+	}
+	// skip the full box header and the entry count
+	avcc := findBox(stsd[8:], "avc1")
+	if avcc == nil || !bytes.Contains(avcc, testSps) || !bytes.Contains(avcc, testPps) {
+		t.Errorf("Parameter sets are missing from the sample entry")
+	}
+}
+
+func TestFmp4MediaSegment(t *testing.T) {
+	video := &Fmp4Track{Id: 1, Video: true, Timescale: Fmp4VideoTimescale}
+	audio := &Fmp4Track{Id: 2, Timescale: 48000}
+	fragments := []*Fmp4Fragment{
+		{Track: video, BaseDecodeTime: 90000, Samples: []*Fmp4Sample{
+			{Data: []byte("keyframe"), Duration: 3000, Sync: true},
+			{Data: []byte("delta"), Duration: 3000, CompositionOffset: 3000},
+		}},
+		{Track: audio, BaseDecodeTime: 48000, Samples: []*Fmp4Sample{
+			{Data: []byte("aac"), Duration: 1024, Sync: true},
+		}},
+	}
+	segment := Fmp4MediaSegment(7, fragments)
+
+	moof := findBox(segment, "moof")
+	if moof == nil {
+		t.Fatal("Missing moof")
+	}
+	if mfhd := findBox(moof, "mfhd"); mfhd == nil || binary.BigEndian.Uint32(mfhd[4:]) != 7 {
+		t.Errorf("Invalid sequence number")
+	}
+	mdat := findBox(segment, "mdat")
+	if !bytes.Equal(mdat, []byte("keyframedeltaaac")) {
+		t.Errorf("Invalid mdat: %q", mdat)
+	}
+
+	var trafs [][]byte
+	for data := moof; len(data) >= 8; data = data[binary.BigEndian.Uint32(data):] {
+		if string(data[4:8]) == "traf" {
+			trafs = append(trafs, data[8:binary.BigEndian.Uint32(data)])
+		}
+	}
+	if len(trafs) != 2 {
+		t.Fatalf("Got %d track fragments, expected 2", len(trafs))
+	}
+	for i, first := range []string{"keyframe", "aac"} {
+		if tfdt := findBox(trafs[i], "tfdt"); binary.BigEndian.Uint64(tfdt[4:]) != fragments[i].BaseDecodeTime {
+			t.Errorf("Invalid decode time in fragment %d", i)
+		}
+		trun := findBox(trafs[i], "trun")
+		if count := binary.BigEndian.Uint32(trun[4:]); int(count) != len(fragments[i].Samples) {
+			t.Errorf("Got %d samples in fragment %d, expected %d", count, i, len(fragments[i].Samples))
+		}
+		// the data offset is relative to the start of the moof, which starts the segment
+		offset := int(binary.BigEndian.Uint32(trun[8:]))
+		if offset+len(first) > len(segment) || string(segment[offset:offset+len(first)]) != first {
+			t.Errorf("Data offset of fragment %d doesn't point to its first sample", i)
+		}
+	}
+}
+
+func TestSplitAdts(t *testing.T) {
+	// ADTS header for AAC LC, 48kHz, stereo, 9 bytes frame length, twice
+	frame := []byte{0xff, 0xf1, 0x4c, 0x80, 0x01, 0x3f, 0xfc, 1, 2}
+	frames, err := SplitAdts(append(append([]byte{}, frame...), frame...))
+	if err != nil || len(frames) != 2 {
+		t.Fatalf("Got %d frames (%v), expected 2", len(frames), err)
+	}
+	if !bytes.Equal(frames[1].Data, []byte{1, 2}) || !bytes.Equal(frames[1].Config, []byte{0x11, 0x90}) {
+		t.Errorf("Invalid frame: %x config %x", frames[1].Data, frames[1].Config)
+	}
+	if _, err := SplitAdts([]byte{0, 1, 2, 3, 4, 5, 6}); err != ErrInvalidAdts {
+		t.Errorf("Invalid header was not refused: %v", err)
+	}
+}
@@ -29,6 +29,13 @@ const (
 	//
 	errorForkExit       = "exit_error"
 	errorForkStderrRead = "stderr_read"
+	//
+	eventRtmpPlaying = "rtmp_playing"
+	//
+	eventPlaylistError = "error"
+	eventPlaylistNext  = "playlist_next"
+	//
+	errorPlaylistOpen = "playlist_open"
 )
 
 var logger = util.NewGlobalModuleLogger(moduleProtocol, nil)
@@ -0,0 +1,140 @@
+/* Copyright (c) 2019 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// LossSimulator holds the settings of a packet loss simulation.
+// It is shared by all LossyReaders of a stream, so the settings can be changed
+// while a connection is active.
+//
+// This is a testing aid. Never enable it on production streams.
+type LossSimulator struct {
+	// lock protects all fields, including rnd
+	lock sync.Mutex
+	// drop is the probability that a packet is dropped
+	drop float64
+	// delay is the probability that a packet is delayed
+	delay float64
+	// jitter is the maximum delay of a delayed packet
+	jitter time.Duration
+	// rnd is the random number generator
+	rnd *rand.Rand
+	// sleep waits for a delay, time.Sleep by default
+	sleep func(d time.Duration)
+}
+
+// NewLossSimulator creates a loss simulation that doesn't drop or delay any packets yet.
+func NewLossSimulator() *LossSimulator {
+	return &LossSimulator{
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		sleep: time.Sleep,
+	}
+}
+
+// Set changes the simulation settings.
+// drop is the probability (0..1) that a packet is discarded, delay is the probability
+// that a packet is held back for a random time of up to jitter before it is passed on.
+// Probabilities outside of 0..1 are clamped. Setting everything to 0 passes all packets through.
+func (sim *LossSimulator) Set(drop float64, delay float64, jitter time.Duration) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	sim.drop = clampProbability(drop)
+	sim.delay = clampProbability(delay)
+	sim.jitter = jitter
+}
+
+// clampProbability limits p to 0..1.
+func clampProbability(p float64) float64 {
+	if p < 0 || p != p {
+		return 0
+	}
+	if p > 1 {
+		return 1
+	}
+	return p
+}
+
+// decide returns if the next packet should be dropped, and how long it should be delayed otherwise.
+func (sim *LossSimulator) decide() (bool, time.Duration) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	if sim.drop > 0 && sim.rnd.Float64() < sim.drop {
+		return true, 0
+	}
+	if sim.delay > 0 && sim.jitter > 0 && sim.rnd.Float64() < sim.delay {
+		return false, time.Duration(sim.rnd.Int63n(int64(sim.jitter)) + 1)
+	}
+	return false, 0
+}
+
+// LossyReader passes MPEG-TS packets from an underlying io.Reader through,
+// but drops or delays some of them according to a LossSimulator.
+//
+// Packets are read in chunks of MpegTsPacketSize, so the input should be aligned
+// to packet boundaries. A delay holds up all following packets as well,
+// like a congested network does.
+type LossyReader struct {
+	reader io.Reader
+	sim    *LossSimulator
+	packet []byte
+	// pending is the part of packet that hasn't been read yet
+	pending []byte
+}
+
+// NewLossyReader creates a reader that simulates packet loss on the input from reader.
+func NewLossyReader(reader io.Reader, sim *LossSimulator) *LossyReader {
+	return &LossyReader{
+		reader: reader,
+		sim:    sim,
+		packet: make([]byte, MpegTsPacketSize),
+	}
+}
+
+// Read reads as many bytes of the current packet as can fit into p.
+//
+// If the packet has been consumed, the next one that isn't dropped is read
+// from the underlying reader. An incomplete packet at the end of the input is
+// passed on together with the read error.
+func (l *LossyReader) Read(p []byte) (int, error) {
+	for len(l.pending) == 0 {
+		n, err := io.ReadFull(l.reader, l.packet)
+		if err != nil {
+			l.pending = nil
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return copy(p, l.packet[:n]), err
+		}
+		drop, delay := l.sim.decide()
+		if drop {
+			continue
+		}
+		if delay > 0 {
+			l.sim.sleep(delay)
+		}
+		l.pending = l.packet
+	}
+	n := copy(p, l.pending)
+	l.pending = l.pending[n:]
+	return n, nil
+}
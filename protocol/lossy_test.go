@@ -0,0 +1,117 @@
+/* Copyright (c) 2019 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// lossyInput creates count packets, each filled with its index.
+func lossyInput(count int) *bytes.Buffer {
+	input := &bytes.Buffer{}
+	for i := 0; i < count; i++ {
+		input.Write(bytes.Repeat([]byte{byte(i)}, MpegTsPacketSize))
+	}
+	return input
+}
+
+func TestLossyReaderPassThrough(t *testing.T) {
+	sim := NewLossSimulator()
+	data, err := io.ReadAll(NewLossyReader(lossyInput(10), sim))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, lossyInput(10).Bytes()) {
+		t.Error("Packets were modified without loss")
+	}
+}
+
+func TestLossyReaderDropAll(t *testing.T) {
+	sim := NewLossSimulator()
+	sim.Set(1, 0, 0)
+	data, err := io.ReadAll(NewLossyReader(lossyInput(10), sim))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Errorf("Expected all packets to be dropped, got %d bytes", len(data))
+	}
+}
+
+func TestLossyReaderDropSome(t *testing.T) {
+	sim := NewLossSimulator()
+	sim.Set(0.5, 0, 0)
+	data, err := io.ReadAll(NewLossyReader(lossyInput(200), sim))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data)%MpegTsPacketSize != 0 {
+		t.Fatalf("Partial packet received: %d bytes", len(data))
+	}
+	count := len(data) / MpegTsPacketSize
+	if count == 0 || count == 200 {
+		t.Errorf("Expected some packets to be dropped, got %d of 200", count)
+	}
+	last := -1
+	for i := 0; i < count; i++ {
+		packet := data[i*MpegTsPacketSize : (i+1)*MpegTsPacketSize]
+		if !bytes.Equal(packet, bytes.Repeat(packet[:1], MpegTsPacketSize)) || int(packet[0]) <= last {
+			t.Fatalf("Packet %d is corrupted or out of order", i)
+		}
+		last = int(packet[0])
+	}
+}
+
+func TestLossyReaderDelay(t *testing.T) {
+	sim := NewLossSimulator()
+	var delays []time.Duration
+	sim.sleep = func(d time.Duration) {
+		delays = append(delays, d)
+	}
+	sim.Set(0, 1, 10*time.Millisecond)
+	data, err := io.ReadAll(NewLossyReader(lossyInput(5), sim))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, lossyInput(5).Bytes()) {
+		t.Error("Delayed packets were modified")
+	}
+	if len(delays) != 5 {
+		t.Fatalf("Expected 5 delays, got %d", len(delays))
+	}
+	for _, d := range delays {
+		if d <= 0 || d > 10*time.Millisecond {
+			t.Errorf("Delay out of range: %v", d)
+		}
+	}
+}
+
+func TestLossyReaderPartial(t *testing.T) {
+	input := lossyInput(1)
+	input.Write([]byte{0x47, 0x00})
+	reader := NewLossyReader(input, NewLossSimulator())
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != MpegTsPacketSize+2 {
+		t.Errorf("Expected the partial packet to be passed on, got %d bytes", len(data))
+	}
+}
@@ -31,6 +31,21 @@ const (
 // It is 188 bytes long and starts with 0x47.
 type MpegTsPacket []byte
 
+// NewMpegTsNullPacket creates a null packet (PID 0x1FFF) with a stuffing payload.
+// Decoders discard null packets, so they can be inserted anywhere in a stream.
+func NewMpegTsNullPacket() MpegTsPacket {
+	packet := make(MpegTsPacket, MpegTsPacketSize)
+	packet[0] = MpegTsSyncByte
+	packet[1] = 0x1f
+	packet[2] = 0xff
+	// payload only, continuity counter 0
+	packet[3] = 0x10
+	for i := 4; i < MpegTsPacketSize; i++ {
+		packet[i] = 0xff
+	}
+	return packet
+}
+
 // ReadMpegTsPacket reads data from the input stream,
 // scans for the sync byte and returns one packet from that point on.
 //
@@ -0,0 +1,306 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// playlistScanPackets is the number of packets that are searched for the first PCR of a file
+	playlistScanPackets = 10000
+)
+
+var (
+	// ErrPlaylistEmpty is returned when a playlist contains no files, or none of them can be opened.
+	ErrPlaylistEmpty = errors.New("restreamer: no playable files in playlist")
+	// ErrPlaylistClosed is returned when reading from a closed playlist.
+	ErrPlaylistClosed = errors.New("restreamer: playlist closed")
+)
+
+// PlaylistReader plays a list of MPEG-TS files in an endless loop, as a pseudo-live stream.
+//
+// Continuity counters, PCRs and PES timestamps are rewritten, so the stream stays
+// continuous across file boundaries, and packets are released in real time according
+// to the PCR. All files should have the same program structure (PIDs and stream types).
+type PlaylistReader struct {
+	// files is the list of files to play
+	files []string
+	// shuffle plays the files in random order, reshuffled on each loop
+	shuffle bool
+	// rnd is used for shuffling
+	rnd *rand.Rand
+	// next is the index of the next file to play
+	next int
+	// input is the file that is currently playing, nil between files
+	input *os.File
+	// reader buffers input
+	reader *bufio.Reader
+	// pending is the rest of the current packet, if it didn't fit into the last Read
+	pending []byte
+	// restamper makes the timeline continuous across files
+	restamper *Restamper
+	// lastPcr is the last PCR that was sent
+	lastPcr uint64
+	// started is true once a PCR has been sent
+	started bool
+	// clock is the wall clock time that corresponds to played
+	clock time.Time
+	// played is the stream time since clock was started
+	played time.Duration
+	// closed is closed by Close
+	closed chan struct{}
+	// closeOnce protects closed
+	closeOnce sync.Once
+}
+
+// NewPlaylistReader creates a reader that plays files in a loop.
+// If shuffle is true, the files are played in random order.
+func NewPlaylistReader(files []string, shuffle bool) (*PlaylistReader, error) {
+	if len(files) == 0 {
+		return nil, ErrPlaylistEmpty
+	}
+	reader := &PlaylistReader{
+		files:     append([]string{}, files...),
+		shuffle:   shuffle,
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		restamper: NewRestamper(),
+		closed:    make(chan struct{}),
+	}
+	if shuffle {
+		reader.rnd.Shuffle(len(reader.files), func(i, j int) {
+			reader.files[i], reader.files[j] = reader.files[j], reader.files[i]
+		})
+	}
+	return reader, nil
+}
+
+// ParsePlaylist reads an M3U style playlist: one file path or file:// URL per line.
+// Empty lines and lines starting with # are ignored.
+// Relative paths are resolved against the directory of the playlist.
+func ParsePlaylist(name string) ([]string, error) {
+	list, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer list.Close()
+	var files []string
+	scanner := bufio.NewScanner(list)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "file://") {
+			uri, err := url.Parse(line)
+			if err != nil {
+				return nil, err
+			}
+			line = uri.Path
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(name), line)
+		}
+		files = append(files, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Read returns the next packet, or as much of it as fits into p.
+// It blocks until the packet is due.
+func (playlist *PlaylistReader) Read(p []byte) (int, error) {
+	if len(playlist.pending) == 0 {
+		packet, err := playlist.nextPacket()
+		if err != nil {
+			return 0, err
+		}
+		playlist.pending = packet
+	}
+	n := copy(p, playlist.pending)
+	playlist.pending = playlist.pending[n:]
+	return n, nil
+}
+
+// Close stops playback. Blocked reads return immediately.
+func (playlist *PlaylistReader) Close() error {
+	playlist.closeOnce.Do(func() {
+		close(playlist.closed)
+	})
+	return nil
+}
+
+// nextPacket reads, rewrites and paces the next packet, advancing to the next file as needed.
+func (playlist *PlaylistReader) nextPacket() (MpegTsPacket, error) {
+	failures := 0
+	for {
+		select {
+		case <-playlist.closed:
+			playlist.closeFile()
+			return nil, ErrPlaylistClosed
+		default:
+		}
+		if playlist.input == nil {
+			if err := playlist.openNext(); err != nil {
+				failures++
+				logger.Logkv(
+					"event", eventPlaylistError,
+					"error", errorPlaylistOpen,
+					"message", fmt.Sprintf("Skipping playlist entry: %v", err),
+				)
+				if failures >= len(playlist.files) {
+					return nil, ErrPlaylistEmpty
+				}
+				continue
+			}
+		}
+		packet := make(MpegTsPacket, MpegTsPacketSize)
+		if _, err := io.ReadFull(playlist.reader, packet); err != nil {
+			// end of file, or a truncated packet at the end
+			playlist.closeFile()
+			continue
+		}
+		if packet[0] != MpegTsSyncByte {
+			continue
+		}
+		failures = 0
+		if pcr, ok := playlist.restamper.Rewrite(packet); ok && !playlist.pace(pcr) {
+			playlist.closeFile()
+			return nil, ErrPlaylistClosed
+		}
+		return packet, nil
+	}
+}
+
+// openNext opens the next file and maps its timeline to the end of the previous one.
+func (playlist *PlaylistReader) openNext() error {
+	if playlist.next >= len(playlist.files) {
+		playlist.next = 0
+		if playlist.shuffle {
+			playlist.rnd.Shuffle(len(playlist.files), func(i, j int) {
+				playlist.files[i], playlist.files[j] = playlist.files[j], playlist.files[i]
+			})
+		}
+	}
+	name := playlist.files[playlist.next]
+	playlist.next++
+
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	firstPcr, firstTimestamp, hasPcr, hasTimestamp := scanTimestamps(file)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		_ = file.Close()
+		return err
+	}
+	playlist.input = file
+	playlist.reader = bufio.NewReader(file)
+	if !hasPcr && hasTimestamp {
+		firstPcr = firstTimestamp
+	}
+	playlist.restamper.Splice(firstPcr, firstTimestamp, hasTimestamp)
+
+	logger.Logkv(
+		"event", eventPlaylistNext,
+		"file", name,
+		"message", fmt.Sprintf("Playing %s", name),
+	)
+	return nil
+}
+
+// closeFile closes the current file.
+func (playlist *PlaylistReader) closeFile() {
+	if playlist.input != nil {
+		_ = playlist.input.Close()
+		playlist.input = nil
+		playlist.reader = nil
+	}
+}
+
+// scanTimestamps looks for the first PCR and the first PES timestamp in the beginning of a file.
+func scanTimestamps(reader io.Reader) (pcr uint64, timestamp uint64, hasPcr bool, hasTimestamp bool) {
+	buffered := bufio.NewReader(reader)
+	packet := make(MpegTsPacket, MpegTsPacketSize)
+	for i := 0; i < playlistScanPackets && !(hasPcr && hasTimestamp); i++ {
+		if _, err := io.ReadFull(buffered, packet); err != nil {
+			break
+		}
+		if packet[0] != MpegTsSyncByte {
+			continue
+		}
+		if offset := pcrOffset(packet); offset > 0 && !hasPcr {
+			pcr = decodePcrBase(packet[offset:])
+			hasPcr = true
+		}
+		if offset := ptsOffset(packet); offset > 0 && !hasTimestamp {
+			timestamp = decodeTimestamp(packet[offset:])
+			hasTimestamp = true
+		}
+	}
+	return
+}
+
+// pace waits until a packet with the given PCR is due.
+// Returns false if the reader was closed while waiting.
+func (playlist *PlaylistReader) pace(pcr uint64) bool {
+	now := time.Now()
+	if !playlist.started {
+		playlist.started = true
+		playlist.clock = now
+		playlist.played = 0
+		playlist.lastPcr = pcr
+		return true
+	}
+	delta := (pcr - playlist.lastPcr) & timestampMask
+	playlist.lastPcr = pcr
+	if delta >= maxTimestampJump {
+		// a discontinuity in the file, start over
+		playlist.clock = now
+		playlist.played = 0
+		return true
+	}
+	playlist.played += time.Duration(delta) * time.Second / timestampClock
+	due := playlist.clock.Add(playlist.played)
+	if wait := due.Sub(now); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-playlist.closed:
+			return false
+		}
+	} else if -wait > time.Second {
+		// we fell far behind, don't try to catch up with a burst
+		playlist.clock = now
+		playlist.played = 0
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestFile writes a TS file with three video frames, 40ms apart, starting at dts.
+func writeTestFile(t *testing.T, name string, dts uint64) {
+	var output bytes.Buffer
+	mux := NewMpegTsMuxer(&output, true, false)
+	for i := uint64(0); i < 3; i++ {
+		if err := mux.WriteVideo([]byte{0, 0, 0, 1, 0x65}, dts+i*3600+1800, dts+i*3600, i == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(name, output.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParsePlaylist(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "list.m3u")
+	if err := os.WriteFile(list, []byte("#EXTM3U\n\na.ts\n/tmp/b.ts\nfile:///tmp/c.ts\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ParsePlaylist(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "a.ts"), "/tmp/b.ts", "/tmp/c.ts"}
+	if len(files) != len(expected) {
+		t.Fatalf("Got %v, expected %v", files, expected)
+	}
+	for i := range files {
+		if files[i] != expected[i] {
+			t.Errorf("Got %s at %d, expected %s", files[i], i, expected[i])
+		}
+	}
+}
+
+func TestPlaylistReader(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.ts")
+	b := filepath.Join(dir, "b.ts")
+	writeTestFile(t, a, 900)
+	writeTestFile(t, b, 5000000)
+	playlist, err := NewPlaylistReader([]string{a, b}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	continuity := make(map[uint16]byte)
+	var lastPcr, lastPts uint64
+	pcrs := 0
+	// play both files and the first frame of the next loop
+	for pcrs < 7 {
+		packet := make(MpegTsPacket, MpegTsPacketSize)
+		if _, err := io.ReadFull(playlist, packet); err != nil {
+			t.Fatal(err)
+		}
+		pid := MpegTsPacketPid(packet)
+		cc := packet[3] & 0x0f
+		if previous, ok := continuity[pid]; ok && cc != (previous+1)&0x0f {
+			t.Errorf("Continuity error on PID %d: %d after %d", pid, cc, previous)
+		}
+		continuity[pid] = cc
+		if offset := pcrOffset(packet); offset > 0 {
+			pcr := decodePcrBase(packet[offset:])
+			if pcrs > 0 && pcr != lastPcr+3600 {
+				t.Errorf("PCR %d follows %d, expected a distance of 3600", pcr, lastPcr)
+			}
+			lastPcr = pcr
+			pcrs++
+		}
+		if offset := ptsOffset(packet); offset > 0 {
+			pts := decodeTimestamp(packet[offset:])
+			if lastPts != 0 && pts <= lastPts {
+				t.Errorf("PTS %d follows %d", pts, lastPts)
+			}
+			lastPts = pts
+		}
+	}
+	// 6 frame intervals of 40ms
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Packets were not paced, playback took %v", elapsed)
+	}
+
+	playlist.Close()
+	if _, err := playlist.Read(make([]byte, MpegTsPacketSize)); err != ErrPlaylistClosed {
+		t.Errorf("Got %v after closing, expected %v", err, ErrPlaylistClosed)
+	}
+}
@@ -0,0 +1,106 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"sort"
+)
+
+// TableCache keeps the most recent PAT and PMT packets of a transport stream,
+// so they can be repeated for decoders that joined in between.
+//
+// Only tables that fit into a single packet are cached. A repeated copy is
+// identical to the last packet on its PID, including the continuity counter,
+// which makes it a legal duplicate packet for decoders that already have it.
+type TableCache struct {
+	// pmtPids contains the PMT PIDs of all programs in the last PAT
+	pmtPids map[uint16]bool
+	// tables contains the last packet of each table PID
+	tables map[uint16]MpegTsPacket
+}
+
+// NewTableCache creates an empty table cache.
+func NewTableCache() *TableCache {
+	return &TableCache{
+		pmtPids: make(map[uint16]bool),
+		tables:  make(map[uint16]MpegTsPacket),
+	}
+}
+
+// Push looks at one TS packet and caches it if it contains a PAT or PMT.
+func (cache *TableCache) Push(packet MpegTsPacket) {
+	pid := MpegTsPacketPid(packet)
+	if pid != MpegTsPidPat && !cache.pmtPids[pid] {
+		return
+	}
+	payload := mpegTsPayload(packet)
+	if payload == nil || packet[1]&0x40 == 0 {
+		// continuation of a table that didn't fit, or no payload at all
+		return
+	}
+	data := section(payload)
+	if data == nil {
+		// spans several packets, or it's broken
+		delete(cache.tables, pid)
+		return
+	}
+	if pid == MpegTsPidPat {
+		if data[0] != 0x00 {
+			return
+		}
+		pmtPids := make(map[uint16]bool)
+		for programs := data[8:]; len(programs) >= 4; programs = programs[4:] {
+			number := int(programs[0])<<8 | int(programs[1])
+			// program 0 points to the network information table
+			if number != 0 {
+				pmtPids[uint16(programs[2]&0x1f)<<8|uint16(programs[3])] = true
+			}
+		}
+		// forget programs that have disappeared
+		for old := range cache.pmtPids {
+			if !pmtPids[old] {
+				delete(cache.tables, old)
+			}
+		}
+		cache.pmtPids = pmtPids
+	} else if data[0] != 0x02 {
+		return
+	}
+	cache.tables[pid] = append(MpegTsPacket(nil), packet...)
+}
+
+// Tables returns the cached PAT, followed by the PMTs in PID order, as a single slice.
+// Returns nil if no PAT has been cached yet.
+func (cache *TableCache) Tables() MpegTsPacket {
+	pat, ok := cache.tables[MpegTsPidPat]
+	if !ok {
+		return nil
+	}
+	pids := make([]int, 0, len(cache.tables))
+	for pid := range cache.tables {
+		if pid != MpegTsPidPat {
+			pids = append(pids, int(pid))
+		}
+	}
+	sort.Ints(pids)
+	tables := make(MpegTsPacket, 0, (len(pids)+1)*MpegTsPacketSize)
+	tables = append(tables, pat...)
+	for _, pid := range pids {
+		tables = append(tables, cache.tables[uint16(pid)]...)
+	}
+	return tables
+}
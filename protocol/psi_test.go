@@ -0,0 +1,50 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTableCache(t *testing.T) {
+	cache := NewTableCache()
+	if cache.Tables() != nil {
+		t.Errorf("Empty cache returned tables")
+	}
+
+	var buffer bytes.Buffer
+	mux := NewMpegTsMuxer(&buffer, true, false)
+	if err := mux.WriteVideo([]byte{0, 0, 0, 1, 0x65}, 900, 900, true); err != nil {
+		t.Fatal(err)
+	}
+	packets := splitPackets(buffer.Bytes())
+	for _, packet := range packets {
+		cache.Push(packet)
+	}
+
+	tables := cache.Tables()
+	if len(tables) != 2*MpegTsPacketSize {
+		t.Fatalf("Got %d bytes of tables, expected a PAT and a PMT", len(tables))
+	}
+	if MpegTsPacketPid(tables) != MpegTsPidPat || MpegTsPacketPid(tables[MpegTsPacketSize:]) != tsMuxPidPmt {
+		t.Errorf("Got tables on PIDs %d and %d", MpegTsPacketPid(tables), MpegTsPacketPid(tables[MpegTsPacketSize:]))
+	}
+	if !bytes.Equal(tables[:MpegTsPacketSize], packets[0]) {
+		t.Errorf("Cached PAT differs from the original")
+	}
+}
@@ -19,6 +19,7 @@ package protocol
 import (
 	"bytes"
 	"io"
+	"sync"
 )
 
 // FixedReader implements a buffered reader that always reads a fixed amount
@@ -84,3 +85,184 @@ func (b *FixedReader) Close() error {
 	}
 	return nil
 }
+
+const (
+	// parallelQueueDepth is the number of packets each goroutine of a ParallelReader can queue.
+	parallelQueueDepth = 64
+	// parallelReorderDepth is the number of RTP packets per goroutine that a ParallelReader
+	// holds back while it waits for a missing sequence number.
+	parallelReorderDepth = 4
+)
+
+// ParallelReader is a variant of FixedReader that pulls in packets from
+// several goroutines at the same time.
+//
+// It is intended to spread the receive load of a single high-bitrate
+// datagram socket across several CPU cores. The underlying reader must
+// support concurrent Read calls, like net.UDPConn.
+//
+// RTP packets carrying TS are put back in order by their sequence numbers,
+// with their headers left intact. Packets that are lost are skipped once
+// enough later ones have arrived, packets that arrive after that are dropped.
+// Other datagrams, like bare TS packets, are passed on in the order the
+// goroutines received them. Since nothing identifies their original order,
+// datagrams that arrive at nearly the same time may be swapped, so parallel
+// reading is only safe for RTP inputs.
+//
+// Each Read returns at most one datagram, so the output can be passed to a
+// FormatReader.
+type ParallelReader struct {
+	reader     io.Reader
+	packetSize int
+	packets    chan []byte
+	// errors receives the first read error of any goroutine
+	errors    chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+	buffer    *bytes.Buffer
+	// pending holds RTP packets that arrived ahead of the next sequence number
+	pending map[uint16][]byte
+	// window is the maximum number of pending packets
+	window int
+	// next is the next RTP sequence number, valid if sequenced is true
+	next      uint16
+	sequenced bool
+}
+
+// NewParallelReader creates a buffered reader that pulls in data from an
+// io.Reader in chunks of psize bytes, using count goroutines.
+func NewParallelReader(reader io.Reader, psize int, count int) *ParallelReader {
+	if count < 1 {
+		count = 1
+	}
+	p := &ParallelReader{
+		reader:     reader,
+		packetSize: psize,
+		packets:    make(chan []byte, count*parallelQueueDepth),
+		errors:     make(chan error, 1),
+		closed:     make(chan struct{}),
+		buffer:     bytes.NewBuffer(make([]byte, 0, psize)),
+		pending:    make(map[uint16][]byte),
+		window:     count * parallelReorderDepth,
+	}
+	for i := 0; i < count; i++ {
+		go p.pull()
+	}
+	return p
+}
+
+// pull reads packets from the underlying reader until an error occurs or the reader is closed.
+func (p *ParallelReader) pull() {
+	for {
+		packet := make([]byte, p.packetSize)
+		n, err := p.reader.Read(packet)
+		if n > 0 {
+			select {
+			case p.packets <- packet[:n]:
+			case <-p.closed:
+				return
+			}
+		}
+		if err != nil {
+			// only the first error is reported, the others are most likely caused by it
+			select {
+			case p.errors <- err:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// Read reads as many bytes from the internal buffer as can fit into p.
+//
+// If the buffer has no data left, it waits for the next packet in sequence.
+// Packets that were queued before a read error are still returned before the error.
+func (p *ParallelReader) Read(b []byte) (int, error) {
+	for p.buffer.Len() == 0 {
+		// pass on the next packet in sequence, if it has arrived
+		if packet, ok := p.pending[p.next]; ok {
+			delete(p.pending, p.next)
+			p.next++
+			p.buffer.Write(packet)
+			break
+		}
+		// give up on a lost packet once the window is full
+		if len(p.pending) >= p.window {
+			p.skip()
+			continue
+		}
+		packet, err := p.receive()
+		if err != nil {
+			// flush the packets that are still held back first
+			if len(p.pending) > 0 {
+				p.skip()
+				continue
+			}
+			return 0, err
+		}
+		sequence, ok := rtpSequence(packet)
+		if !ok {
+			p.buffer.Write(packet)
+			break
+		}
+		distance := int16(sequence - p.next)
+		if !p.sequenced || distance < -rtpMaxMisorder {
+			// first packet, or the sender was restarted
+			p.next = sequence
+			p.sequenced = true
+		} else if distance < 0 {
+			// already skipped, passing it on would break the order
+			continue
+		}
+		p.pending[sequence] = packet
+	}
+	return p.buffer.Read(b)
+}
+
+// receive waits for the next packet from any of the reading goroutines.
+func (p *ParallelReader) receive() ([]byte, error) {
+	select {
+	case packet := <-p.packets:
+		return packet, nil
+	default:
+		select {
+		case packet := <-p.packets:
+			return packet, nil
+		case err := <-p.errors:
+			// put it back for subsequent calls
+			select {
+			case p.errors <- err:
+			default:
+			}
+			return nil, err
+		case <-p.closed:
+			return nil, io.EOF
+		}
+	}
+}
+
+// skip advances the next sequence number to the earliest pending packet.
+func (p *ParallelReader) skip() {
+	first := true
+	var nearest uint16
+	for sequence := range p.pending {
+		if first || sequence-p.next < nearest-p.next {
+			nearest = sequence
+			first = false
+		}
+	}
+	p.next = nearest
+}
+
+// Close stops the reading goroutines and closes the underlying reader.
+func (p *ParallelReader) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		if closer, ok := p.reader.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+	return err
+}
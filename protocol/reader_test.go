@@ -18,7 +18,9 @@ package protocol
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
+	"sync"
 	"testing"
 )
 
@@ -210,3 +212,98 @@ func TestFixedReaderCloseRemain(t *testing.T) {
 		t.Fatal("Expected 0 bytes and error")
 	}
 }
+
+// packetSource returns numbered packets and fails after count packets.
+type packetSource struct {
+	lock  sync.Mutex
+	next  int
+	count int
+}
+
+func (s *packetSource) Read(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.next >= s.count {
+		return 0, io.ErrUnexpectedEOF
+	}
+	p[0] = byte(s.next)
+	s.next++
+	return 2, nil
+}
+
+func TestParallelReader(t *testing.T) {
+	f := NewParallelReader(&packetSource{count: 100}, 10, 4)
+	defer f.Close()
+	seen := make(map[byte]bool)
+	for {
+		g := make([]byte, 2)
+		n, err := f.Read(g)
+		if err != nil {
+			if err != io.ErrUnexpectedEOF {
+				t.Fatalf("Expected the source error, got %v", err)
+			}
+			break
+		}
+		if n != 2 {
+			t.Fatalf("Expected 2 bytes, got %d", n)
+		}
+		seen[g[0]] = true
+	}
+	if len(seen) != 100 {
+		t.Errorf("Expected 100 distinct packets, got %d", len(seen))
+	}
+}
+
+func TestParallelReaderClose(t *testing.T) {
+	f := NewParallelReader(&packetSource{}, 10, 2)
+	f.Close()
+	if _, err := f.Read(make([]byte, 2)); err == nil {
+		t.Error("Expected an error after closing")
+	}
+}
+
+// rtpSequenced creates an RTP packet with the given sequence number.
+func rtpSequenced(sequence uint16) []byte {
+	packet := rtpPacket(tsPayload(1))
+	binary.BigEndian.PutUint16(packet[2:], sequence)
+	return packet
+}
+
+func TestParallelReaderRtpOrder(t *testing.T) {
+	var datagrams [][]byte
+	// swapped, wrapped around, lost (4) and late (4 again)
+	for _, sequence := range []uint16{65533, 65535, 65534, 1, 0, 2, 3, 5, 6, 7, 8, 4, 9} {
+		datagrams = append(datagrams, rtpSequenced(sequence))
+	}
+	// bare TS is passed through
+	datagrams = append(datagrams, tsPayload(1))
+	f := NewParallelReader(&datagramReader{datagrams: datagrams}, 1500, 1)
+	defer f.Close()
+	var sequences []uint16
+	for {
+		g := make([]byte, 1500)
+		n, err := f.Read(g)
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("Expected the source error, got %v", err)
+			}
+			break
+		}
+		if format := SniffFormat(g[:n]); format != InputFormatRtp {
+			if format != InputFormatMpegTs || len(sequences) != 12 {
+				t.Errorf("Got %s datagram after %d packets", format, len(sequences))
+			}
+			continue
+		}
+		sequences = append(sequences, binary.BigEndian.Uint16(g[2:]))
+	}
+	expected := []uint16{65533, 65534, 65535, 0, 1, 2, 3, 5, 6, 7, 8, 9}
+	if len(sequences) != len(expected) {
+		t.Fatalf("Got sequence %v, expected %v", sequences, expected)
+	}
+	for i := range expected {
+		if sequences[i] != expected[i] {
+			t.Fatalf("Got sequence %v, expected %v", sequences, expected)
+		}
+	}
+}
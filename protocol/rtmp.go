@@ -0,0 +1,897 @@
+//go:build rtmp
+
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// rtmpDefaultPort is the standard RTMP port
+	rtmpDefaultPort = "1935"
+	// rtmpHandshakeSize is the size of the C1/C2/S1/S2 handshake blocks
+	rtmpHandshakeSize = 1536
+	// rtmpDefaultChunkSize is the chunk size before any Set Chunk Size messages
+	rtmpDefaultChunkSize = 128
+	// rtmpMaxChunkSize is the largest valid chunk size, the top bit must be zero
+	rtmpMaxChunkSize = 0x7fffffff
+	// rtmpWindowSize is the acknowledgement window we announce
+	rtmpWindowSize = 2500000
+	// rtmpBufferLength is the client buffer length we announce, in milliseconds
+	rtmpBufferLength = 1000
+	// rtmpCommandChunkStream is the chunk stream we send commands on
+	rtmpCommandChunkStream = 3
+	// rtmpControlChunkStream is the chunk stream for protocol control messages
+	rtmpControlChunkStream = 2
+	// rtmpPlayChunkStream is the chunk stream for commands on the media message stream
+	rtmpPlayChunkStream = 8
+
+	rtmpMessageSetChunkSize     = 1
+	rtmpMessageAbort            = 2
+	rtmpMessageAcknowledgement  = 3
+	rtmpMessageUserControl      = 4
+	rtmpMessageWindowAckSize    = 5
+	rtmpMessageSetPeerBandwidth = 6
+	rtmpMessageAudio            = 8
+	rtmpMessageVideo            = 9
+	rtmpMessageDataAmf0         = 18
+	rtmpMessageCommandAmf0      = 20
+	rtmpMessageAggregate        = 22
+
+	rtmpUserControlStreamBegin  = 0
+	rtmpUserControlSetBuffer    = 3
+	rtmpUserControlPingRequest  = 6
+	rtmpUserControlPingResponse = 7
+
+	amf0Number     = 0x00
+	amf0Boolean    = 0x01
+	amf0String     = 0x02
+	amf0Object     = 0x03
+	amf0Null       = 0x05
+	amf0Undefined  = 0x06
+	amf0EcmaArray  = 0x08
+	amf0ObjectEnd  = 0x09
+	amf0Array      = 0x0a
+	amf0Date       = 0x0b
+	amf0LongString = 0x0c
+
+	flvCodecAvc          = 7
+	flvCodecAac          = 10
+	flvFrameKey          = 1
+	flvAvcSequenceHeader = 0
+	flvAvcNalu           = 1
+	flvAacSequenceHeader = 0
+	flvAacRaw            = 1
+)
+
+var (
+	// ErrRtmpHandshake is returned when the server sends an invalid handshake
+	ErrRtmpHandshake = errors.New("restreamer: invalid RTMP handshake")
+	// ErrRtmpCommand is returned when the server rejects a command
+	ErrRtmpCommand = errors.New("restreamer: RTMP command failed")
+	// ErrRtmpInvalidUrl is returned if the RTMP URL contains no application or stream name
+	ErrRtmpInvalidUrl = errors.New("restreamer: RTMP URL must contain an application and a stream name")
+	// ErrRtmpChunkSize is returned when the server sets an invalid chunk size
+	ErrRtmpChunkSize = errors.New("restreamer: invalid RTMP chunk size")
+	// ErrAmfDecode is returned when an AMF0 value cannot be decoded
+	ErrAmfDecode = errors.New("restreamer: invalid or unsupported AMF0 data")
+)
+
+// rtmpChunkStream holds the header state of one incoming chunk stream.
+type rtmpChunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typ       byte
+	stream    uint32
+	extended  bool
+	payload   []byte
+}
+
+// rtmpMessage is a fully reassembled RTMP message.
+type rtmpMessage struct {
+	timestamp uint32
+	typ       byte
+	stream    uint32
+	payload   []byte
+}
+
+// RtmpReader pulls a live stream from an RTMP server and remuxes it into MPEG-TS.
+//
+// Only H.264 video and AAC audio are supported; other codecs are silently dropped.
+// The resulting TS packets can be read with Read(), so an RtmpReader can be used
+// like any other upstream socket.
+type RtmpReader struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// chunk size for incoming and outgoing chunks
+	inChunkSize  uint32
+	outChunkSize uint32
+	// chunk stream state
+	streams map[uint32]*rtmpChunkStream
+	// acknowledgement handling
+	window   uint32
+	received uint32
+	acked    uint32
+	// transaction is the next command transaction ID
+	transaction float64
+	// stream is the message stream ID returned by createStream
+	stream uint32
+	// codec configuration
+	sps       [][]byte
+	pps       [][]byte
+	nalSize   int
+	aacConfig []byte
+	// muxer produces TS packets into output
+	muxer  *MpegTsMuxer
+	output bytes.Buffer
+}
+
+// NewRtmpReader connects to an RTMP server and starts playing the stream given in the URL.
+//
+// The URL has the form rtmp://host[:port]/application/streamname.
+// dialer is used to establish the connection, timeout limits the handshake and
+// the command exchange. A zero timeout disables the deadline.
+// Cancelling ctx aborts the connection attempt, but not playback once it has started.
+func NewRtmpReader(ctx context.Context, urly *url.URL, dialer *net.Dialer, timeout time.Duration) (io.ReadCloser, error) {
+	path := strings.TrimPrefix(urly.Path, "/")
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return nil, ErrRtmpInvalidUrl
+	}
+	app := parts[0]
+	name := parts[1]
+	if urly.RawQuery != "" {
+		name += "?" + urly.RawQuery
+	}
+	host := urly.Host
+	if urly.Port() == "" {
+		host = net.JoinHostPort(urly.Hostname(), rtmpDefaultPort)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	// abort the handshake and the command exchange when ctx is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	rtmp := &RtmpReader{
+		conn:         conn,
+		reader:       bufio.NewReader(conn),
+		inChunkSize:  rtmpDefaultChunkSize,
+		outChunkSize: rtmpDefaultChunkSize,
+		streams:      make(map[uint32]*rtmpChunkStream),
+		transaction:  1,
+	}
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	tcUrl := fmt.Sprintf("rtmp://%s/%s", urly.Host, app)
+	err = rtmp.handshake()
+	if err == nil {
+		err = rtmp.play(app, tcUrl, name)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	// the read timeout is handled by our owner from here on
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	logger.Logkv(
+		"event", eventRtmpPlaying,
+		"url", urly.String(),
+		"message", fmt.Sprintf("Playing RTMP stream %s", urly),
+	)
+	return rtmp, nil
+}
+
+// Read fills p with remuxed TS data, pulling in more RTMP messages as necessary.
+func (rtmp *RtmpReader) Read(p []byte) (int, error) {
+	for rtmp.output.Len() == 0 {
+		msg, err := rtmp.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if err := rtmp.handleMedia(msg); err != nil {
+			return 0, err
+		}
+	}
+	return rtmp.output.Read(p)
+}
+
+// Close closes the connection to the server.
+func (rtmp *RtmpReader) Close() error {
+	return rtmp.conn.Close()
+}
+
+// handshake performs the simple (unsigned) RTMP handshake.
+func (rtmp *RtmpReader) handshake() error {
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	c0c1[0] = 0x03
+	if _, err := rand.Read(c0c1[9:]); err != nil {
+		return err
+	}
+	if _, err := rtmp.conn.Write(c0c1); err != nil {
+		return err
+	}
+	s0s1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(rtmp.reader, s0s1); err != nil {
+		return err
+	}
+	if s0s1[0] != 0x03 {
+		return ErrRtmpHandshake
+	}
+	// C2 is an echo of S1
+	if _, err := rtmp.conn.Write(s0s1[1:]); err != nil {
+		return err
+	}
+	s2 := make([]byte, rtmpHandshakeSize)
+	if _, err := io.ReadFull(rtmp.reader, s2); err != nil {
+		return err
+	}
+	return nil
+}
+
+// play sends connect, createStream and play and waits until playback starts.
+func (rtmp *RtmpReader) play(app string, tcUrl string, name string) error {
+	connect := map[string]interface{}{
+		"app":           app,
+		"flashVer":      "LNX 9,0,124,2",
+		"tcUrl":         tcUrl,
+		"fpad":          false,
+		"capabilities":  15.0,
+		"audioCodecs":   3575.0,
+		"videoCodecs":   252.0,
+		"videoFunction": 1.0,
+	}
+	if _, err := rtmp.call(0, "connect", connect); err != nil {
+		return err
+	}
+	result, err := rtmp.call(0, "createStream", nil)
+	if err != nil {
+		return err
+	}
+	if len(result) < 4 {
+		return ErrRtmpCommand
+	}
+	id, ok := result[3].(float64)
+	if !ok {
+		return ErrRtmpCommand
+	}
+	rtmp.stream = uint32(id)
+
+	control := make([]byte, 10)
+	binary.BigEndian.PutUint16(control[0:], rtmpUserControlSetBuffer)
+	binary.BigEndian.PutUint32(control[2:], rtmp.stream)
+	binary.BigEndian.PutUint32(control[6:], rtmpBufferLength)
+	if err := rtmp.writeMessage(rtmpControlChunkStream, rtmpMessageUserControl, 0, control); err != nil {
+		return err
+	}
+
+	// play has no _result, the server replies with onStatus instead
+	payload := amfEncode("play", 0.0, nil, name, -2.0)
+	if err := rtmp.writeMessage(rtmpPlayChunkStream, rtmpMessageCommandAmf0, rtmp.stream, payload); err != nil {
+		return err
+	}
+	for {
+		msg, err := rtmp.readMessage()
+		if err != nil {
+			return err
+		}
+		if msg.typ != rtmpMessageCommandAmf0 {
+			// media might already arrive before the status message
+			if err := rtmp.handleMedia(msg); err != nil {
+				return err
+			}
+			continue
+		}
+		values, err := amfDecode(msg.payload)
+		if err != nil {
+			return err
+		}
+		if len(values) < 4 || values[0] != "onStatus" {
+			continue
+		}
+		info, _ := values[3].(map[string]interface{})
+		code, _ := info["code"].(string)
+		level, _ := info["level"].(string)
+		if level == "error" || strings.HasSuffix(code, "StreamNotFound") || strings.HasSuffix(code, "Failed") {
+			return fmt.Errorf("%w: %s", ErrRtmpCommand, code)
+		}
+		if code == "NetStream.Play.Start" || code == "NetStream.Play.Reset" {
+			return nil
+		}
+	}
+}
+
+// call sends a command and waits for the corresponding _result or _error response.
+// Unrelated messages that arrive in the meantime are handled as protocol control messages.
+func (rtmp *RtmpReader) call(stream uint32, command string, object interface{}) ([]interface{}, error) {
+	transaction := rtmp.transaction
+	rtmp.transaction++
+	payload := amfEncode(command, transaction, object)
+	if err := rtmp.writeMessage(rtmpCommandChunkStream, rtmpMessageCommandAmf0, stream, payload); err != nil {
+		return nil, err
+	}
+	for {
+		msg, err := rtmp.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg.typ != rtmpMessageCommandAmf0 {
+			continue
+		}
+		values, err := amfDecode(msg.payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) < 2 || values[1] != transaction {
+			continue
+		}
+		switch values[0] {
+		case "_result":
+			return values, nil
+		case "_error":
+			return nil, fmt.Errorf("%w: %s", ErrRtmpCommand, command)
+		}
+	}
+}
+
+// writeMessage sends a message split into chunks of the outgoing chunk size.
+func (rtmp *RtmpReader) writeMessage(csid uint32, typ byte, stream uint32, payload []byte) error {
+	var buffer bytes.Buffer
+	header := make([]byte, 12)
+	header[0] = byte(csid & 0x3f)
+	// timestamp is always 0 for our messages
+	header[4] = byte(len(payload) >> 16)
+	header[5] = byte(len(payload) >> 8)
+	header[6] = byte(len(payload))
+	header[7] = typ
+	binary.LittleEndian.PutUint32(header[8:], stream)
+	buffer.Write(header)
+	for offset := 0; offset < len(payload); offset += int(rtmp.outChunkSize) {
+		if offset > 0 {
+			// type 3 continuation header
+			buffer.WriteByte(0xc0 | byte(csid&0x3f))
+		}
+		end := offset + int(rtmp.outChunkSize)
+		if end > len(payload) {
+			end = len(payload)
+		}
+		buffer.Write(payload[offset:end])
+	}
+	_, err := rtmp.conn.Write(buffer.Bytes())
+	return err
+}
+
+// readFull reads exactly len(p) bytes and keeps track of the acknowledgement window.
+func (rtmp *RtmpReader) readFull(p []byte) error {
+	n, err := io.ReadFull(rtmp.reader, p)
+	rtmp.received += uint32(n)
+	if err != nil {
+		return err
+	}
+	if rtmp.window > 0 && rtmp.received-rtmp.acked >= rtmp.window {
+		rtmp.acked = rtmp.received
+		ack := make([]byte, 4)
+		binary.BigEndian.PutUint32(ack, rtmp.received)
+		return rtmp.writeMessage(rtmpControlChunkStream, rtmpMessageAcknowledgement, 0, ack)
+	}
+	return nil
+}
+
+// readMessage reads chunks until a complete message has been assembled.
+// Protocol control messages are handled internally and not returned.
+func (rtmp *RtmpReader) readMessage() (*rtmpMessage, error) {
+	for {
+		msg, err := rtmp.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			continue
+		}
+		handled, err := rtmp.handleControl(msg)
+		if err != nil {
+			return nil, err
+		}
+		if !handled {
+			return msg, nil
+		}
+	}
+}
+
+// readChunk reads a single chunk and returns a message if it was the last chunk.
+func (rtmp *RtmpReader) readChunk() (*rtmpMessage, error) {
+	basic := make([]byte, 1)
+	if err := rtmp.readFull(basic); err != nil {
+		return nil, err
+	}
+	format := basic[0] >> 6
+	csid := uint32(basic[0] & 0x3f)
+	switch csid {
+	case 0:
+		ext := make([]byte, 1)
+		if err := rtmp.readFull(ext); err != nil {
+			return nil, err
+		}
+		csid = uint32(ext[0]) + 64
+	case 1:
+		ext := make([]byte, 2)
+		if err := rtmp.readFull(ext); err != nil {
+			return nil, err
+		}
+		csid = uint32(ext[1])*256 + uint32(ext[0]) + 64
+	}
+
+	cs := rtmp.streams[csid]
+	if cs == nil {
+		cs = &rtmpChunkStream{}
+		rtmp.streams[csid] = cs
+	}
+
+	headerSizes := [4]int{11, 7, 3, 0}
+	header := make([]byte, headerSizes[format])
+	if err := rtmp.readFull(header); err != nil {
+		return nil, err
+	}
+	var ts uint32
+	if format < 3 {
+		ts = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+		cs.extended = ts == 0xffffff
+	}
+	if format < 2 {
+		cs.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+		cs.typ = header[6]
+	}
+	if format == 0 {
+		cs.stream = binary.LittleEndian.Uint32(header[7:])
+	}
+	if cs.extended {
+		ext := make([]byte, 4)
+		if err := rtmp.readFull(ext); err != nil {
+			return nil, err
+		}
+		ts = binary.BigEndian.Uint32(ext)
+	}
+	// a new message starts if there is no pending payload
+	if len(cs.payload) == 0 {
+		switch format {
+		case 0:
+			// a type 3 chunk after a type 0 chunk reuses the absolute timestamp as delta
+			cs.timestamp = ts
+			cs.delta = ts
+		case 1, 2:
+			cs.delta = ts
+			cs.timestamp += ts
+		case 3:
+			cs.timestamp += cs.delta
+		}
+	}
+
+	remain := cs.length - uint32(len(cs.payload))
+	if remain > rtmp.inChunkSize {
+		remain = rtmp.inChunkSize
+	}
+	data := make([]byte, remain)
+	if err := rtmp.readFull(data); err != nil {
+		return nil, err
+	}
+	cs.payload = append(cs.payload, data...)
+	if uint32(len(cs.payload)) < cs.length {
+		return nil, nil
+	}
+
+	msg := &rtmpMessage{
+		timestamp: cs.timestamp,
+		typ:       cs.typ,
+		stream:    cs.stream,
+		payload:   cs.payload,
+	}
+	cs.payload = nil
+	return msg, nil
+}
+
+// handleControl processes protocol control and user control messages.
+// Returns true if the message was consumed.
+func (rtmp *RtmpReader) handleControl(msg *rtmpMessage) (bool, error) {
+	switch msg.typ {
+	case rtmpMessageSetChunkSize:
+		if len(msg.payload) >= 4 {
+			size := binary.BigEndian.Uint32(msg.payload)
+			// readChunk can't make progress with an empty chunk
+			if size < 1 || size > rtmpMaxChunkSize {
+				rtmp.conn.Close()
+				return true, ErrRtmpChunkSize
+			}
+			rtmp.inChunkSize = size
+		}
+	case rtmpMessageAbort:
+		if len(msg.payload) >= 4 {
+			if cs := rtmp.streams[binary.BigEndian.Uint32(msg.payload)]; cs != nil {
+				cs.payload = nil
+			}
+		}
+	case rtmpMessageAcknowledgement:
+		// nothing to do, we don't send much
+	case rtmpMessageWindowAckSize:
+		if len(msg.payload) >= 4 {
+			rtmp.window = binary.BigEndian.Uint32(msg.payload)
+		}
+	case rtmpMessageSetPeerBandwidth:
+		ack := make([]byte, 4)
+		binary.BigEndian.PutUint32(ack, rtmpWindowSize)
+		return true, rtmp.writeMessage(rtmpControlChunkStream, rtmpMessageWindowAckSize, 0, ack)
+	case rtmpMessageUserControl:
+		if len(msg.payload) >= 6 && binary.BigEndian.Uint16(msg.payload) == rtmpUserControlPingRequest {
+			pong := make([]byte, 6)
+			binary.BigEndian.PutUint16(pong, rtmpUserControlPingResponse)
+			copy(pong[2:], msg.payload[2:6])
+			return true, rtmp.writeMessage(rtmpControlChunkStream, rtmpMessageUserControl, 0, pong)
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// handleMedia demuxes audio, video and aggregate messages and feeds them into the TS muxer.
+func (rtmp *RtmpReader) handleMedia(msg *rtmpMessage) error {
+	switch msg.typ {
+	case rtmpMessageVideo:
+		return rtmp.handleVideo(msg.payload, msg.timestamp)
+	case rtmpMessageAudio:
+		return rtmp.handleAudio(msg.payload, msg.timestamp)
+	case rtmpMessageAggregate:
+		// a sequence of FLV tags with timestamps relative to the first one
+		data := msg.payload
+		var base uint32
+		first := true
+		for len(data) >= 11 {
+			typ := data[0] & 0x1f
+			size := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+			ts := uint32(data[4])<<16 | uint32(data[5])<<8 | uint32(data[6]) | uint32(data[7])<<24
+			if len(data) < 11+size+4 {
+				break
+			}
+			if first {
+				base = ts
+				first = false
+			}
+			sub := &rtmpMessage{
+				timestamp: msg.timestamp + ts - base,
+				typ:       typ,
+				stream:    msg.stream,
+				payload:   data[11 : 11+size],
+			}
+			if err := rtmp.handleMedia(sub); err != nil {
+				return err
+			}
+			data = data[11+size+4:]
+		}
+	}
+	// everything else (metadata, status) is ignored
+	return nil
+}
+
+// initMuxer creates the TS muxer once the codec configuration is known.
+func (rtmp *RtmpReader) initMuxer() {
+	if rtmp.muxer == nil {
+		rtmp.muxer = NewMpegTsMuxer(&rtmp.output, rtmp.nalSize > 0, rtmp.aacConfig != nil)
+	}
+}
+
+// handleVideo converts an FLV video tag body into an Annex B access unit.
+func (rtmp *RtmpReader) handleVideo(data []byte, timestamp uint32) error {
+	if len(data) < 5 || data[0]&0x0f != flvCodecAvc {
+		return nil
+	}
+	keyframe := data[0]>>4 == flvFrameKey
+	cts := int32(uint32(data[2])<<16|uint32(data[3])<<8|uint32(data[4])) << 8 >> 8
+	switch data[1] {
+	case flvAvcSequenceHeader:
+		return rtmp.parseAvcConfig(data[5:])
+	case flvAvcNalu:
+		if rtmp.nalSize == 0 {
+			// no decoder configuration yet
+			return nil
+		}
+		rtmp.initMuxer()
+		au := []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xf0}
+		if keyframe {
+			for _, sps := range rtmp.sps {
+				au = append(au, 0x00, 0x00, 0x00, 0x01)
+				au = append(au, sps...)
+			}
+			for _, pps := range rtmp.pps {
+				au = append(au, 0x00, 0x00, 0x00, 0x01)
+				au = append(au, pps...)
+			}
+		}
+		nalus := data[5:]
+		for len(nalus) >= rtmp.nalSize {
+			size := 0
+			for i := 0; i < rtmp.nalSize; i++ {
+				size = size<<8 | int(nalus[i])
+			}
+			nalus = nalus[rtmp.nalSize:]
+			if size > len(nalus) {
+				break
+			}
+			au = append(au, 0x00, 0x00, 0x00, 0x01)
+			au = append(au, nalus[:size]...)
+			nalus = nalus[size:]
+		}
+		dts := uint64(timestamp) * 90
+		pts := uint64(int64(timestamp)+int64(cts)) * 90
+		return rtmp.muxer.WriteVideo(au, pts, dts, keyframe)
+	}
+	return nil
+}
+
+// parseAvcConfig parses an AVCDecoderConfigurationRecord.
+func (rtmp *RtmpReader) parseAvcConfig(data []byte) error {
+	if len(data) < 7 {
+		return nil
+	}
+	rtmp.nalSize = int(data[4]&0x03) + 1
+	rtmp.sps = nil
+	rtmp.pps = nil
+	count := int(data[5] & 0x1f)
+	data = data[6:]
+	for i := 0; i < count && len(data) >= 2; i++ {
+		size := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+size {
+			return nil
+		}
+		rtmp.sps = append(rtmp.sps, data[2:2+size])
+		data = data[2+size:]
+	}
+	if len(data) < 1 {
+		return nil
+	}
+	count = int(data[0])
+	data = data[1:]
+	for i := 0; i < count && len(data) >= 2; i++ {
+		size := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+size {
+			return nil
+		}
+		rtmp.pps = append(rtmp.pps, data[2:2+size])
+		data = data[2+size:]
+	}
+	return nil
+}
+
+// handleAudio converts an FLV audio tag body into an ADTS frame.
+func (rtmp *RtmpReader) handleAudio(data []byte, timestamp uint32) error {
+	if len(data) < 2 || data[0]>>4 != flvCodecAac {
+		return nil
+	}
+	switch data[1] {
+	case flvAacSequenceHeader:
+		if len(data) >= 4 {
+			rtmp.aacConfig = append([]byte{}, data[2:4]...)
+		}
+	case flvAacRaw:
+		if rtmp.aacConfig == nil {
+			return nil
+		}
+		rtmp.initMuxer()
+		raw := data[2:]
+		profile := rtmp.aacConfig[0]>>3 - 1
+		frequency := (rtmp.aacConfig[0]&0x07)<<1 | rtmp.aacConfig[1]>>7
+		channels := (rtmp.aacConfig[1] >> 3) & 0x0f
+		length := len(raw) + 7
+		adts := []byte{
+			0xff,
+			0xf1,
+			profile<<6 | frequency<<2 | channels>>2,
+			(channels&0x03)<<6 | byte(length>>11)&0x03,
+			byte(length >> 3),
+			byte(length&0x07)<<5 | 0x1f,
+			0xfc,
+		}
+		return rtmp.muxer.WriteAudio(append(adts, raw...), uint64(timestamp)*90)
+	}
+	return nil
+}
+
+// amfEncode serializes a list of values into AMF0.
+// Supported types are float64, bool, string, nil and map[string]interface{}.
+func amfEncode(values ...interface{}) []byte {
+	var buffer bytes.Buffer
+	for _, value := range values {
+		amfEncodeValue(&buffer, value)
+	}
+	return buffer.Bytes()
+}
+
+func amfEncodeValue(buffer *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case float64:
+		buffer.WriteByte(amf0Number)
+		binary.Write(buffer, binary.BigEndian, math.Float64bits(v))
+	case bool:
+		buffer.WriteByte(amf0Boolean)
+		if v {
+			buffer.WriteByte(1)
+		} else {
+			buffer.WriteByte(0)
+		}
+	case string:
+		buffer.WriteByte(amf0String)
+		binary.Write(buffer, binary.BigEndian, uint16(len(v)))
+		buffer.WriteString(v)
+	case map[string]interface{}:
+		buffer.WriteByte(amf0Object)
+		for key, item := range v {
+			binary.Write(buffer, binary.BigEndian, uint16(len(key)))
+			buffer.WriteString(key)
+			amfEncodeValue(buffer, item)
+		}
+		buffer.Write([]byte{0x00, 0x00, amf0ObjectEnd})
+	default:
+		buffer.WriteByte(amf0Null)
+	}
+}
+
+// amfDecode parses a sequence of AMF0 values.
+// Objects and ECMA arrays are returned as map[string]interface{}, strict arrays as []interface{}.
+func amfDecode(data []byte) ([]interface{}, error) {
+	var values []interface{}
+	for len(data) > 0 {
+		value, rest, err := amfDecodeValue(data)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, value)
+		data = rest
+	}
+	return values, nil
+}
+
+func amfDecodeValue(data []byte) (interface{}, []byte, error) {
+	if len(data) < 1 {
+		return nil, nil, ErrAmfDecode
+	}
+	typ := data[0]
+	data = data[1:]
+	switch typ {
+	case amf0Number:
+		if len(data) < 8 {
+			return nil, nil, ErrAmfDecode
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+	case amf0Boolean:
+		if len(data) < 1 {
+			return nil, nil, ErrAmfDecode
+		}
+		return data[0] != 0, data[1:], nil
+	case amf0String:
+		return amfDecodeString(data, 2)
+	case amf0LongString:
+		return amfDecodeString(data, 4)
+	case amf0Null, amf0Undefined:
+		return nil, data, nil
+	case amf0EcmaArray:
+		if len(data) < 4 {
+			return nil, nil, ErrAmfDecode
+		}
+		return amfDecodeObject(data[4:])
+	case amf0Object:
+		return amfDecodeObject(data)
+	case amf0Array:
+		if len(data) < 4 {
+			return nil, nil, ErrAmfDecode
+		}
+		count := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		array := make([]interface{}, 0)
+		for i := uint32(0); i < count; i++ {
+			var value interface{}
+			var err error
+			value, data, err = amfDecodeValue(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			array = append(array, value)
+		}
+		return array, data, nil
+	case amf0Date:
+		if len(data) < 10 {
+			return nil, nil, ErrAmfDecode
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[10:], nil
+	}
+	return nil, nil, ErrAmfDecode
+}
+
+func amfDecodeString(data []byte, size int) (interface{}, []byte, error) {
+	if len(data) < size {
+		return nil, nil, ErrAmfDecode
+	}
+	var length int
+	if size == 2 {
+		length = int(binary.BigEndian.Uint16(data))
+	} else {
+		length = int(binary.BigEndian.Uint32(data))
+	}
+	data = data[size:]
+	if len(data) < length {
+		return nil, nil, ErrAmfDecode
+	}
+	return string(data[:length]), data[length:], nil
+}
+
+func amfDecodeObject(data []byte) (interface{}, []byte, error) {
+	object := make(map[string]interface{})
+	for {
+		if len(data) < 3 {
+			return nil, nil, ErrAmfDecode
+		}
+		if data[0] == 0x00 && data[1] == 0x00 && data[2] == amf0ObjectEnd {
+			return object, data[3:], nil
+		}
+		key, rest, err := amfDecodeString(data, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		var value interface{}
+		value, data, err = amfDecodeValue(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		object[key.(string)] = value
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !rtmp
+
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// ErrRtmpUnsupported is returned when restreamer was built without RTMP support.
+var ErrRtmpUnsupported = errors.New("restreamer: RTMP support not compiled in, rebuild with -tags rtmp")
+
+// NewRtmpReader always fails, because RTMP support is disabled in this build.
+func NewRtmpReader(ctx context.Context, urly *url.URL, dialer *net.Dialer, timeout time.Duration) (io.ReadCloser, error) {
+	return nil, ErrRtmpUnsupported
+}
@@ -0,0 +1,81 @@
+//go:build rtmp
+
+/* Copyright (c) 2026 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRtmpCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// the server accepts the connection, but never answers the handshake
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(5 * time.Second)
+	}()
+
+	urly, _ := url.Parse("rtmp://" + listener.Addr().String() + "/live/stream")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = NewRtmpReader(ctx, urly, &net.Dialer{}, 0)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected the context error, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Handshake was not aborted")
+	}
+}
+
+func TestRtmpChunkSize(t *testing.T) {
+	for _, size := range []uint32{0, 0x80000000, 0xffffffff} {
+		local, remote := net.Pipe()
+		rtmp := &RtmpReader{conn: local, inChunkSize: rtmpDefaultChunkSize}
+		msg := &rtmpMessage{typ: rtmpMessageSetChunkSize, payload: be(size)}
+		if _, err := rtmp.handleControl(msg); err != ErrRtmpChunkSize {
+			t.Errorf("Chunk size %#x was accepted", size)
+		}
+		if rtmp.inChunkSize != rtmpDefaultChunkSize {
+			t.Errorf("Chunk size changed to %#x", rtmp.inChunkSize)
+		}
+		// the connection is closed
+		if _, err := remote.Read(make([]byte, 1)); err == nil {
+			t.Errorf("Connection still open after chunk size %#x", size)
+		}
+	}
+
+	local, _ := net.Pipe()
+	rtmp := &RtmpReader{conn: local, inChunkSize: rtmpDefaultChunkSize}
+	if _, err := rtmp.handleControl(&rtmpMessage{typ: rtmpMessageSetChunkSize, payload: be(uint32(4096))}); err != nil || rtmp.inChunkSize != 4096 {
+		t.Errorf("Valid chunk size was not applied: %v", err)
+	}
+	local.Close()
+}
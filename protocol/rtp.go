@@ -0,0 +1,193 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+const (
+	// rtpHeaderSize is the size of the fixed RTP header
+	rtpHeaderSize = 12
+	// rtpVersion is the only RTP version in use
+	rtpVersion = 2
+	// rtpMaxMisorder is the distance behind the expected sequence number that
+	// indicates a restarted sender instead of a late packet (RFC 3550, appendix A.1)
+	rtpMaxMisorder = 100
+)
+
+// InputFormat is the framing of the packets of a datagram input.
+type InputFormat int
+
+const (
+	// InputFormatUnknown is an input that hasn't been or couldn't be identified
+	InputFormatUnknown InputFormat = iota
+	// InputFormatMpegTs is an input that carries bare TS packets
+	InputFormatMpegTs
+	// InputFormatRtp is an input that carries TS packets in RTP (RFC 2250)
+	InputFormatRtp
+)
+
+// String returns the name of the format.
+func (format InputFormat) String() string {
+	switch format {
+	case InputFormatMpegTs:
+		return "mpegts"
+	case InputFormatRtp:
+		return "rtp"
+	default:
+		return "unknown"
+	}
+}
+
+// rtpPayload returns the payload of an RTP packet.
+// Returns false if data isn't a valid RTP version 2 packet.
+func rtpPayload(data []byte) ([]byte, bool) {
+	if len(data) < rtpHeaderSize || data[0]>>6 != rtpVersion {
+		return nil, false
+	}
+	offset := rtpHeaderSize + 4*int(data[0]&0x0f)
+	// header extension
+	if data[0]&0x10 != 0 {
+		if len(data) < offset+4 {
+			return nil, false
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(data[offset+2:]))
+	}
+	end := len(data)
+	// padding, the last byte contains its length
+	if data[0]&0x20 != 0 {
+		end -= int(data[len(data)-1])
+	}
+	if offset > end {
+		return nil, false
+	}
+	return data[offset:end], true
+}
+
+// rtpSequence returns the sequence number of an RTP packet that carries TS packets.
+// Returns false if data is anything else.
+func rtpSequence(data []byte) (uint16, bool) {
+	if SniffFormat(data) != InputFormatRtp {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(data[2:]), true
+}
+
+// isMpegTs tells if data consists of whole TS packets.
+func isMpegTs(data []byte) bool {
+	if len(data) < MpegTsPacketSize || len(data)%MpegTsPacketSize != 0 {
+		return false
+	}
+	for offset := 0; offset < len(data); offset += MpegTsPacketSize {
+		if data[offset] != MpegTsSyncByte {
+			return false
+		}
+	}
+	return true
+}
+
+// SniffFormat identifies the framing of a datagram.
+// TS sync bytes at every packet boundary indicate bare TS, an RTP header followed by
+// TS packets indicates RTP. Everything else is reported as unknown.
+func SniffFormat(datagram []byte) InputFormat {
+	if isMpegTs(datagram) {
+		return InputFormatMpegTs
+	}
+	if payload, ok := rtpPayload(datagram); ok && isMpegTs(payload) {
+		return InputFormatRtp
+	}
+	return InputFormatUnknown
+}
+
+// FormatReader detects the framing of a datagram input and removes RTP headers,
+// so the output contains only TS packets.
+//
+// Each Read from the underlying reader must return a single datagram, like net.UDPConn does,
+// and p must be large enough to hold it. Datagrams are passed through unchanged until
+// the format has been identified. After that, RTP packets that can't be parsed are dropped.
+//
+// Read may be called concurrently, as long as the underlying reader supports it.
+// If the underlying reader implements io.Closer, Close calls are forwarded.
+type FormatReader struct {
+	reader io.Reader
+	// detected is called once when the format has been identified, may be nil
+	detected func(format InputFormat)
+	// lock protects format
+	lock   sync.Mutex
+	format InputFormat
+}
+
+// NewFormatReader creates a reader that detects the format of the datagrams from reader.
+// detected is called when the format has been identified.
+func NewFormatReader(reader io.Reader, detected func(format InputFormat)) *FormatReader {
+	return &FormatReader{
+		reader:   reader,
+		detected: detected,
+	}
+}
+
+// Format returns the detected format, or InputFormatUnknown if it hasn't been identified yet.
+func (r *FormatReader) Format() InputFormat {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.format
+}
+
+// detect identifies the format from a datagram, unless it is already known.
+func (r *FormatReader) detect(datagram []byte) InputFormat {
+	notify := false
+	r.lock.Lock()
+	if r.format == InputFormatUnknown {
+		r.format = SniffFormat(datagram)
+		notify = r.format != InputFormatUnknown
+	}
+	format := r.format
+	r.lock.Unlock()
+	if notify && r.detected != nil {
+		r.detected(format)
+	}
+	return format
+}
+
+// Read reads a datagram into p and strips the RTP header, if the input is RTP.
+func (r *FormatReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.reader.Read(p)
+		if n == 0 || r.detect(p[:n]) != InputFormatRtp {
+			return n, err
+		}
+		payload, ok := rtpPayload(p[:n])
+		if ok && len(payload) > 0 {
+			return copy(p, payload), err
+		}
+		// drop the broken packet, but don't swallow errors
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close closes the underlying reader.
+func (r *FormatReader) Close() error {
+	if closer, ok := r.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// datagramReader returns one datagram per Read call.
+type datagramReader struct {
+	datagrams [][]byte
+}
+
+func (r *datagramReader) Read(p []byte) (int, error) {
+	if len(r.datagrams) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.datagrams[0])
+	r.datagrams = r.datagrams[1:]
+	return n, nil
+}
+
+// tsPayload creates count null packets.
+func tsPayload(count int) []byte {
+	var payload []byte
+	for i := 0; i < count; i++ {
+		payload = append(payload, NewMpegTsNullPacket()...)
+	}
+	return payload
+}
+
+// rtpPacket wraps payload in an RTP header with one CSRC, a header extension and padding.
+func rtpPacket(payload []byte) []byte {
+	header := []byte{
+		0xb1, 33, 0x00, 0x01, // version 2, padding, extension, 1 CSRC, payload type MP2T, sequence 1
+		0x00, 0x00, 0x00, 0x00, // timestamp
+		0x12, 0x34, 0x56, 0x78, // SSRC
+		0x00, 0x00, 0x00, 0x01, // CSRC
+		0xbe, 0xde, 0x00, 0x01, // extension header, one word
+		0x00, 0x00, 0x00, 0x00, // extension
+	}
+	packet := append(header, payload...)
+	return append(packet, 0x00, 0x00, 0x03)
+}
+
+func TestSniffFormat(t *testing.T) {
+	if format := SniffFormat(tsPayload(7)); format != InputFormatMpegTs {
+		t.Errorf("Bare TS detected as %s", format)
+	}
+	if format := SniffFormat(rtpPacket(tsPayload(7))); format != InputFormatRtp {
+		t.Errorf("RTP detected as %s", format)
+	}
+	if format := SniffFormat([]byte("garbage")); format != InputFormatUnknown {
+		t.Errorf("Garbage detected as %s", format)
+	}
+	if format := SniffFormat(rtpPacket([]byte("garbage"))); format != InputFormatUnknown {
+		t.Errorf("RTP without TS detected as %s", format)
+	}
+}
+
+func TestFormatReaderRtp(t *testing.T) {
+	var detected []InputFormat
+	reader := NewFormatReader(&datagramReader{datagrams: [][]byte{
+		[]byte("noise"),
+		rtpPacket(tsPayload(2)),
+		{0x80},
+		rtpPacket(tsPayload(1)),
+	}}, func(format InputFormat) {
+		detected = append(detected, format)
+	})
+	var output []byte
+	buffer := make([]byte, 1500)
+	for {
+		n, err := reader.Read(buffer)
+		output = append(output, buffer[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	// the noise before detection is passed through, the broken RTP packet is dropped
+	expected := append([]byte("noise"), tsPayload(3)...)
+	if !bytes.Equal(output, expected) {
+		t.Errorf("Invalid output of %d bytes, expected %d", len(output), len(expected))
+	}
+	if len(detected) != 1 || detected[0] != InputFormatRtp || reader.Format() != InputFormatRtp {
+		t.Errorf("Invalid detection: %v", detected)
+	}
+}
+
+func TestFormatReaderMpegTs(t *testing.T) {
+	reader := NewFixedReader(NewFormatReader(&datagramReader{datagrams: [][]byte{tsPayload(7)}}, nil), 1500)
+	packet, err := ReadMpegTsPacket(reader)
+	if err != nil || !bytes.Equal(packet, NewMpegTsNullPacket()) {
+		t.Errorf("Invalid packet: %v", err)
+	}
+}
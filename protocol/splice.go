@@ -0,0 +1,288 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+const (
+	// timestampMask is the range of PTS, DTS and PCR base values (33 bits)
+	timestampMask = 1<<33 - 1
+	// timestampClock is the frequency of PTS, DTS and PCR base values
+	timestampClock = 90000
+	// defaultTimestampStep is the assumed distance between the last PCR of a source and the first of the next,
+	// if it can't be determined from the stream (40ms)
+	defaultTimestampStep = timestampClock / 25
+	// maxTimestampJump is the largest distance between two PCRs that is considered continuous
+	maxTimestampJump = 10 * timestampClock
+	// splicerMaxHeld is the maximum number of packets a Splicer holds back while waiting for a new source
+	splicerMaxHeld = 20000
+)
+
+// Restamper rewrites the continuity counters and timestamps of a TS stream,
+// so the stream stays continuous when the source changes.
+type Restamper struct {
+	// continuity is the last continuity counter per PID
+	continuity map[uint16]byte
+	// base is the first PCR of the current source
+	base uint64
+	// origin is what base is mapped to
+	origin uint64
+	// lastPcr is the last PCR that was sent
+	lastPcr uint64
+	// step is the distance between the last two PCRs
+	step uint64
+	// lastTimestamp is the last PTS or DTS that was sent
+	lastTimestamp uint64
+	// started is true once a PCR has been sent
+	started bool
+}
+
+// NewRestamper creates a Restamper that passes the timeline of the first source through unchanged.
+func NewRestamper() *Restamper {
+	return &Restamper{
+		continuity: make(map[uint16]byte),
+		step:       defaultTimestampStep,
+	}
+}
+
+// Splice starts a new source, whose first PCR is pcr.
+// If the first PES timestamp of the source is known, pass it as timestamp
+// and set hasTimestamp, so timestamps are never moved back.
+// The new source continues one PCR interval after the last PCR of the previous one.
+func (restamper *Restamper) Splice(pcr uint64, timestamp uint64, hasTimestamp bool) {
+	restamper.base = pcr
+	if !restamper.started {
+		// keep the original timeline for the first source
+		restamper.origin = pcr
+		return
+	}
+	// continue right after the last PCR
+	restamper.origin = (restamper.lastPcr + restamper.step) & timestampMask
+	// but don't let the timestamps go back
+	if hasTimestamp {
+		first := restamper.shift(timestamp)
+		if behind := (restamper.lastTimestamp + restamper.step - first) & timestampMask; behind < maxTimestampJump {
+			restamper.origin = (restamper.origin + behind) & timestampMask
+		}
+	}
+}
+
+// Rewrite fixes up the continuity counter and timestamps of a packet in place.
+// Returns the new PCR, if the packet contains one.
+func (restamper *Restamper) Rewrite(packet MpegTsPacket) (uint64, bool) {
+	pid := MpegTsPacketPid(packet)
+	if pid != MpegTsPidNull {
+		cc, seen := restamper.continuity[pid]
+		if !seen {
+			cc = packet[3] & 0x0f
+		} else if packet[3]&0x10 != 0 {
+			// only packets with payload increment the counter
+			cc = (cc + 1) & 0x0f
+		}
+		packet[3] = packet[3]&0xf0 | cc
+		restamper.continuity[pid] = cc
+	}
+
+	if offset := ptsOffset(packet); offset > 0 {
+		payload := packet[offset:]
+		pts := restamper.shift(decodeTimestamp(payload))
+		copy(payload, encodeTimestamp(payload[0]>>4, pts))
+		last := pts
+		// the DTS follows the PTS, if the header flags say so
+		if packet[offset-2]&0x40 != 0 && len(payload) >= 10 {
+			dts := restamper.shift(decodeTimestamp(payload[5:]))
+			copy(payload[5:], encodeTimestamp(0x1, dts))
+			last = dts
+		}
+		restamper.lastTimestamp = last
+	}
+
+	if offset := pcrOffset(packet); offset > 0 {
+		pcr := restamper.shift(decodePcrBase(packet[offset:]))
+		if restamper.started {
+			if step := (pcr - restamper.lastPcr) & timestampMask; step > 0 && step < maxTimestampJump {
+				restamper.step = step
+			}
+		}
+		restamper.started = true
+		restamper.lastPcr = pcr
+		encodePcrBase(packet[offset:], pcr)
+		return pcr, true
+	}
+	return 0, false
+}
+
+// shift maps a timestamp of the current source to the output timeline.
+func (restamper *Restamper) shift(ts uint64) uint64 {
+	return (ts - restamper.base + restamper.origin) & timestampMask
+}
+
+// Splicer joins the TS streams of consecutive sources into one continuous stream,
+// for seamless failover.
+//
+// After Switch, packets of the new source are discarded until a PAT arrives,
+// and held back until a PCR and, if the previous source marked them, a random
+// access point (keyframe) have been received. They are then restamped to
+// continue where the previous source ended.
+type Splicer struct {
+	// restamper rewrites the packets
+	restamper *Restamper
+	// waiting is true while the new source is not passed through yet
+	waiting bool
+	// held contains the packets since the last PAT
+	held []MpegTsPacket
+	// pcr is the first PCR in held
+	pcr uint64
+	// hasPcr is true if held contains a PCR
+	hasPcr bool
+	// timestamp is the first PES timestamp in held
+	timestamp uint64
+	// hasTimestamp is true if held contains a PES timestamp
+	hasTimestamp bool
+	// randomAccess is true if held contains a random access point
+	randomAccess bool
+	// expectRandomAccess is true if the previous source had random access indicators
+	expectRandomAccess bool
+	// sourceRandomAccess is true if the current source has random access indicators
+	sourceRandomAccess bool
+}
+
+// NewSplicer creates a new Splicer.
+// Call Switch before passing the packets of the first source.
+func NewSplicer() *Splicer {
+	return &Splicer{
+		restamper: NewRestamper(),
+	}
+}
+
+// Switch announces that the following packets come from a new source.
+func (splicer *Splicer) Switch() {
+	splicer.expectRandomAccess = splicer.sourceRandomAccess
+	splicer.sourceRandomAccess = false
+	splicer.waiting = true
+	splicer.reset()
+}
+
+// reset discards the held packets.
+func (splicer *Splicer) reset() {
+	splicer.held = nil
+	splicer.hasPcr = false
+	splicer.hasTimestamp = false
+	splicer.randomAccess = false
+}
+
+// Push processes a packet of the current source.
+// Returns the packets that are ready to be sent, which may be none.
+func (splicer *Splicer) Push(packet MpegTsPacket) []MpegTsPacket {
+	randomAccess := isRandomAccess(packet)
+	if randomAccess {
+		splicer.sourceRandomAccess = true
+	}
+	if !splicer.waiting {
+		splicer.restamper.Rewrite(packet)
+		return []MpegTsPacket{packet}
+	}
+
+	if MpegTsPacketPid(packet) == MpegTsPidPat && !splicer.randomAccess {
+		// start over at every PAT until a keyframe has been seen
+		splicer.reset()
+		splicer.held = make([]MpegTsPacket, 0, 64)
+	}
+	if splicer.held == nil {
+		// discard everything before the first PAT
+		return nil
+	}
+	splicer.held = append(splicer.held, packet)
+	if offset := pcrOffset(packet); offset > 0 && !splicer.hasPcr {
+		splicer.pcr = decodePcrBase(packet[offset:])
+		splicer.hasPcr = true
+	}
+	if offset := ptsOffset(packet); offset > 0 && !splicer.hasTimestamp {
+		splicer.timestamp = decodeTimestamp(packet[offset:])
+		splicer.hasTimestamp = true
+	}
+	if randomAccess {
+		splicer.randomAccess = true
+	}
+
+	if !splicer.hasPcr || (splicer.expectRandomAccess && !splicer.randomAccess) {
+		if len(splicer.held) >= splicerMaxHeld {
+			// no luck, maybe this source doesn't mark keyframes
+			splicer.expectRandomAccess = false
+			splicer.reset()
+		}
+		return nil
+	}
+
+	splicer.restamper.Splice(splicer.pcr, splicer.timestamp, splicer.hasTimestamp)
+	ready := splicer.held
+	for _, held := range ready {
+		splicer.restamper.Rewrite(held)
+	}
+	splicer.waiting = false
+	splicer.reset()
+	return ready
+}
+
+// isRandomAccess returns true if the random access indicator of a packet is set.
+func isRandomAccess(packet MpegTsPacket) bool {
+	return packet[3]&0x20 != 0 && packet[4] > 0 && packet[5]&0x40 != 0
+}
+
+// pcrOffset returns the offset of the PCR in a packet, or 0 if it has none.
+func pcrOffset(packet MpegTsPacket) int {
+	if packet[3]&0x20 == 0 || packet[4] < 7 || packet[5]&0x10 == 0 {
+		return 0
+	}
+	return 6
+}
+
+// ptsOffset returns the offset of the PTS in a packet that starts a PES packet, or 0 if it has none.
+func ptsOffset(packet MpegTsPacket) int {
+	if packet[1]&0x40 == 0 {
+		return 0
+	}
+	payload := mpegTsPayload(packet)
+	if len(payload) < 14 || payload[0] != 0x00 || payload[1] != 0x00 || payload[2] != 0x01 {
+		return 0
+	}
+	switch payload[3] {
+	case 0xbc, 0xbe, 0xbf, 0xf0, 0xf1, 0xf2, 0xf8, 0xff:
+		// streams without the optional PES header
+		return 0
+	}
+	if payload[7]&0x80 == 0 {
+		return 0
+	}
+	return MpegTsPacketSize - len(payload) + 9
+}
+
+// decodePcrBase decodes the 33 bit base of a PCR.
+func decodePcrBase(data []byte) uint64 {
+	return uint64(data[0])<<25 |
+		uint64(data[1])<<17 |
+		uint64(data[2])<<9 |
+		uint64(data[3])<<1 |
+		uint64(data[4]>>7)
+}
+
+// encodePcrBase replaces the 33 bit base of a PCR, keeping the extension.
+func encodePcrBase(data []byte, base uint64) {
+	data[0] = byte(base >> 25)
+	data[1] = byte(base >> 17)
+	data[2] = byte(base >> 9)
+	data[3] = byte(base >> 1)
+	data[4] = byte(base<<7)&0x80 | data[4]&0x7f
+}
@@ -0,0 +1,95 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// splitPackets splits a buffer into TS packets.
+func splitPackets(data []byte) []MpegTsPacket {
+	var packets []MpegTsPacket
+	for len(data) >= MpegTsPacketSize {
+		packets = append(packets, MpegTsPacket(data[:MpegTsPacketSize]))
+		data = data[MpegTsPacketSize:]
+	}
+	return packets
+}
+
+func TestSplicer(t *testing.T) {
+	var first, second bytes.Buffer
+	mux := NewMpegTsMuxer(&first, true, false)
+	for i := uint64(0); i < 3; i++ {
+		if err := mux.WriteVideo([]byte{0, 0, 0, 1, 0x65}, 900+i*3600+1800, 900+i*3600, i == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the second source starts in the middle of a GOP
+	mux = NewMpegTsMuxer(&second, true, false)
+	if err := mux.WriteVideo([]byte{0, 0, 0, 1, 0x41}, 5000000+1800, 5000000, false); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i < 3; i++ {
+		if err := mux.WriteVideo([]byte{0, 0, 0, 1, 0x65}, 5000000+i*3600+1800, 5000000+i*3600, i == 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	splicer := NewSplicer()
+	var output []MpegTsPacket
+	splicer.Switch()
+	for _, packet := range splitPackets(first.Bytes()) {
+		output = append(output, splicer.Push(packet)...)
+	}
+	switched := len(output)
+	splicer.Switch()
+	for _, packet := range splitPackets(second.Bytes()) {
+		output = append(output, splicer.Push(packet)...)
+	}
+
+	if MpegTsPacketPid(output[switched]) != MpegTsPidPat {
+		t.Errorf("Second source starts with PID %d, expected the PAT", MpegTsPacketPid(output[switched]))
+	}
+	continuity := make(map[uint16]byte)
+	var lastPcr uint64
+	pcrs := 0
+	keyframes := 0
+	for _, packet := range output {
+		pid := MpegTsPacketPid(packet)
+		cc := packet[3] & 0x0f
+		if previous, ok := continuity[pid]; ok && cc != (previous+1)&0x0f {
+			t.Errorf("Continuity error on PID %d: %d after %d", pid, cc, previous)
+		}
+		continuity[pid] = cc
+		if offset := pcrOffset(packet); offset > 0 {
+			pcr := decodePcrBase(packet[offset:])
+			if pcrs > 0 && pcr != lastPcr+3600 {
+				t.Errorf("PCR %d follows %d, expected a distance of 3600", pcr, lastPcr)
+			}
+			lastPcr = pcr
+			pcrs++
+		}
+		if isRandomAccess(packet) {
+			keyframes++
+		}
+	}
+	// the frame before the keyframe of the second source is dropped
+	if pcrs != 5 || keyframes != 2 {
+		t.Errorf("Got %d PCRs and %d keyframes, expected 5 and 2", pcrs, keyframes)
+	}
+}
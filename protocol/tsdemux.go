@@ -0,0 +1,265 @@
+/* Copyright (c) 2026 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+// ElementaryPacket is a reassembled PES payload from an MPEG-TS elementary stream.
+type ElementaryPacket struct {
+	// Pid is the PID the packet was received on
+	Pid uint16
+	// StreamType is the stream type from the PMT
+	StreamType byte
+	// Pts is the presentation time stamp in 90kHz units
+	Pts uint64
+	// Dts is the decoding time stamp in 90kHz units (equal to Pts if not present)
+	Dts uint64
+	// Data is the elementary stream payload
+	Data []byte
+}
+
+// demuxStream is the reassembly state of a single elementary stream.
+type demuxStream struct {
+	typ    byte
+	length int
+	buffer []byte
+}
+
+// MpegTsDemuxer extracts elementary stream packets from the first program of a transport stream.
+//
+// Only elementary streams that are listed in the PMT are processed.
+type MpegTsDemuxer struct {
+	// pmtPid is the PID of the program map table, or -1 if the PAT hasn't been seen yet
+	pmtPid int
+	// streams maps elementary stream PIDs to their reassembly state
+	streams map[uint16]*demuxStream
+}
+
+// NewMpegTsDemuxer creates a new demuxer.
+func NewMpegTsDemuxer() *MpegTsDemuxer {
+	return &MpegTsDemuxer{
+		pmtPid:  -1,
+		streams: make(map[uint16]*demuxStream),
+	}
+}
+
+// StreamTypes returns the PIDs and stream types of all elementary streams in the PMT.
+// The map is empty if no PMT was received yet.
+func (demux *MpegTsDemuxer) StreamTypes() map[uint16]byte {
+	types := make(map[uint16]byte, len(demux.streams))
+	for pid, stream := range demux.streams {
+		types[pid] = stream.typ
+	}
+	return types
+}
+
+// MpegTsPacketPid returns the PID of a TS packet.
+func MpegTsPacketPid(packet MpegTsPacket) uint16 {
+	return uint16(packet[1]&0x1f)<<8 | uint16(packet[2])
+}
+
+// MpegTsPacketPcr returns the 33 bit base of the PCR of a TS packet, in 90kHz units.
+// The second return value is false if the packet carries no PCR.
+func MpegTsPacketPcr(packet MpegTsPacket) (uint64, bool) {
+	if len(packet) != MpegTsPacketSize {
+		return 0, false
+	}
+	offset := pcrOffset(packet)
+	if offset == 0 {
+		return 0, false
+	}
+	return decodePcrBase(packet[offset:]), true
+}
+
+// mpegTsPayload returns the payload of a TS packet after the adaptation field.
+// Returns nil if the packet has no payload.
+func mpegTsPayload(packet MpegTsPacket) []byte {
+	if len(packet) != MpegTsPacketSize {
+		return nil
+	}
+	control := (packet[3] >> 4) & 0x03
+	offset := 4
+	if control&0x02 != 0 {
+		offset += 1 + int(packet[4])
+	}
+	if control&0x01 == 0 || offset >= MpegTsPacketSize {
+		return nil
+	}
+	return packet[offset:]
+}
+
+// Push processes one TS packet and returns any elementary stream packets that were completed by it.
+func (demux *MpegTsDemuxer) Push(packet MpegTsPacket) []*ElementaryPacket {
+	payload := mpegTsPayload(packet)
+	if payload == nil {
+		return nil
+	}
+	pid := MpegTsPacketPid(packet)
+	start := packet[1]&0x40 != 0
+
+	if pid == MpegTsPidPat {
+		if start {
+			demux.parsePat(payload)
+		}
+		return nil
+	}
+	if int(pid) == demux.pmtPid {
+		if start {
+			demux.parsePmt(payload)
+		}
+		return nil
+	}
+
+	stream := demux.streams[pid]
+	if stream == nil {
+		return nil
+	}
+	var complete []*ElementaryPacket
+	if start {
+		// a new PES packet starts, flush the previous one
+		if pes := demux.flush(pid, stream); pes != nil {
+			complete = append(complete, pes)
+		}
+		stream.length = 0
+		if len(payload) >= 6 {
+			stream.length = int(payload[4])<<8 | int(payload[5])
+		}
+		stream.buffer = append(stream.buffer[:0], payload...)
+	} else if len(stream.buffer) > 0 {
+		stream.buffer = append(stream.buffer, payload...)
+	}
+	// bounded PES packets can be returned immediately
+	if stream.length > 0 && len(stream.buffer) >= stream.length+6 {
+		if pes := demux.flush(pid, stream); pes != nil {
+			complete = append(complete, pes)
+		}
+	}
+	return complete
+}
+
+// Flush returns all partially received PES packets.
+// Useful at the end of a stream, when no further start indicator will arrive.
+func (demux *MpegTsDemuxer) Flush() []*ElementaryPacket {
+	var complete []*ElementaryPacket
+	for pid, stream := range demux.streams {
+		if pes := demux.flush(pid, stream); pes != nil {
+			complete = append(complete, pes)
+		}
+	}
+	return complete
+}
+
+// flush parses the buffered PES packet of a stream and resets the buffer.
+func (demux *MpegTsDemuxer) flush(pid uint16, stream *demuxStream) *ElementaryPacket {
+	data := stream.buffer
+	stream.buffer = nil
+	if len(data) < 9 || data[0] != 0x00 || data[1] != 0x00 || data[2] != 0x01 {
+		return nil
+	}
+	if stream.length > 0 && len(data) > stream.length+6 {
+		data = data[:stream.length+6]
+	}
+	flags := data[7]
+	header := 9 + int(data[8])
+	if header > len(data) {
+		return nil
+	}
+	pes := &ElementaryPacket{
+		Pid:        pid,
+		StreamType: stream.typ,
+		Data:       data[header:],
+	}
+	if flags&0x80 != 0 && len(data) >= 14 {
+		pes.Pts = decodeTimestamp(data[9:14])
+		pes.Dts = pes.Pts
+	}
+	if flags&0x40 != 0 && len(data) >= 19 {
+		pes.Dts = decodeTimestamp(data[14:19])
+	}
+	return pes
+}
+
+// section returns the PSI section from a payload with pointer field, or nil if it is invalid.
+func section(payload []byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	pointer := 1 + int(payload[0])
+	if pointer+3 > len(payload) {
+		return nil
+	}
+	data := payload[pointer:]
+	length := int(data[1]&0x0f)<<8 | int(data[2])
+	if 3+length > len(data) || length < 9 {
+		return nil
+	}
+	// cut off the CRC
+	return data[:3+length-4]
+}
+
+// parsePat extracts the PMT PID of the first program.
+func (demux *MpegTsDemuxer) parsePat(payload []byte) {
+	data := section(payload)
+	if data == nil || data[0] != 0x00 {
+		return
+	}
+	for programs := data[8:]; len(programs) >= 4; programs = programs[4:] {
+		number := int(programs[0])<<8 | int(programs[1])
+		if number != 0 {
+			demux.pmtPid = int(programs[2]&0x1f)<<8 | int(programs[3])
+			return
+		}
+	}
+}
+
+// parsePmt registers all elementary streams of the program.
+func (demux *MpegTsDemuxer) parsePmt(payload []byte) {
+	data := section(payload)
+	if data == nil || data[0] != 0x02 || len(data) < 12 {
+		return
+	}
+	info := int(data[10]&0x0f)<<8 | int(data[11])
+	if 12+info > len(data) {
+		return
+	}
+	seen := make(map[uint16]bool)
+	for streams := data[12+info:]; len(streams) >= 5; {
+		typ := streams[0]
+		pid := uint16(streams[1]&0x1f)<<8 | uint16(streams[2])
+		esinfo := int(streams[3]&0x0f)<<8 | int(streams[4])
+		seen[pid] = true
+		if stream, ok := demux.streams[pid]; !ok || stream.typ != typ {
+			demux.streams[pid] = &demuxStream{typ: typ}
+		}
+		if 5+esinfo > len(streams) {
+			break
+		}
+		streams = streams[5+esinfo:]
+	}
+	for pid := range demux.streams {
+		if !seen[pid] {
+			delete(demux.streams, pid)
+		}
+	}
+}
+
+// decodeTimestamp decodes a 33 bit PTS or DTS.
+func decodeTimestamp(data []byte) uint64 {
+	return uint64(data[0]>>1&0x07)<<30 |
+		uint64(data[1])<<22 |
+		uint64(data[2]>>1)<<15 |
+		uint64(data[3])<<7 |
+		uint64(data[4]>>1)
+}
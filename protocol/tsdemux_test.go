@@ -0,0 +1,99 @@
+/* Copyright (c) 2026 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMpegTsDemuxer(t *testing.T) {
+	var output bytes.Buffer
+	mux := NewMpegTsMuxer(&output, true, true)
+
+	video := make([]byte, 1000)
+	for i := range video {
+		video[i] = byte(i)
+	}
+	// ADTS header for AAC LC, 48kHz, stereo, 16 bytes frame length
+	audio := []byte{0xff, 0xf1, 0x4c, 0x80, 0x02, 0x1f, 0xfc, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	if err := mux.WriteVideo(video, 1800, 900, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := mux.WriteAudio(audio, 900); err != nil {
+		t.Fatal(err)
+	}
+	// trigger flushing of the unbounded video PES
+	if err := mux.WriteVideo(video[:10], 5400, 4500, false); err != nil {
+		t.Fatal(err)
+	}
+
+	demux := NewMpegTsDemuxer()
+	var packets []*ElementaryPacket
+	for data := output.Bytes(); len(data) > 0; data = data[MpegTsPacketSize:] {
+		packets = append(packets, demux.Push(MpegTsPacket(data[:MpegTsPacketSize]))...)
+	}
+	types := demux.StreamTypes()
+	if types[tsMuxPidVideo] != MpegTsStreamTypeH264 || types[tsMuxPidAudio] != MpegTsStreamTypeAacAdts {
+		t.Fatalf("Invalid stream types: %v", types)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("Expected 2 PES packets, got %d", len(packets))
+	}
+	for _, pes := range packets {
+		switch pes.Pid {
+		case tsMuxPidAudio:
+			if !bytes.Equal(pes.Data, audio) || pes.Pts != 900 {
+				t.Errorf("Audio packet mismatch")
+			}
+			frames, err := SplitAdts(pes.Data)
+			if err != nil || len(frames) != 1 || frames[0].SampleRate != 48000 || frames[0].Channels != 2 {
+				t.Errorf("Invalid ADTS frame: %v", err)
+			}
+		case tsMuxPidVideo:
+			if !bytes.Equal(pes.Data, video) || pes.Pts != 1800 || pes.Dts != 900 {
+				t.Errorf("Video packet mismatch")
+			}
+		}
+	}
+}
+
+func TestMpegTsPacketPcr(t *testing.T) {
+	var buffer bytes.Buffer
+	mux := NewMpegTsMuxer(&buffer, true, false)
+	if err := mux.WriteVideo([]byte{0, 0, 0, 1, 0x65}, 900+1800, 900, true); err != nil {
+		t.Fatal(err)
+	}
+	pcrs := 0
+	for _, packet := range splitPackets(buffer.Bytes()) {
+		pcr, ok := MpegTsPacketPcr(packet)
+		if ok {
+			pcrs++
+			if pcr != 900 {
+				t.Errorf("Invalid PCR %d, expected 900", pcr)
+			}
+		} else if pcr != 0 {
+			t.Errorf("Packet without PCR returned %d", pcr)
+		}
+	}
+	if pcrs != 1 {
+		t.Errorf("Expected 1 packet with a PCR, got %d", pcrs)
+	}
+	if _, ok := MpegTsPacketPcr(MpegTsPacket{MpegTsSyncByte}); ok {
+		t.Error("Truncated packet returned a PCR")
+	}
+}
@@ -0,0 +1,302 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"io"
+)
+
+const (
+	// MpegTsPidPat is the fixed PID of the program association table
+	MpegTsPidPat = 0x0000
+	// MpegTsPidNull is the PID of null (padding) packets
+	MpegTsPidNull = 0x1fff
+	// MpegTsStreamTypeH264 is the PMT stream type for H.264 video
+	MpegTsStreamTypeH264 = 0x1b
+	// MpegTsStreamTypeAacAdts is the PMT stream type for AAC audio with ADTS framing
+	MpegTsStreamTypeAacAdts = 0x0f
+
+	// tsMuxPidPmt is the PID that the muxer uses for its program map table
+	tsMuxPidPmt = 0x1000
+	// tsMuxPidVideo is the PID of the video elementary stream
+	tsMuxPidVideo = 0x0100
+	// tsMuxPidAudio is the PID of the audio elementary stream
+	tsMuxPidAudio = 0x0101
+	// tsMuxStreamIdVideo is the PES stream ID for video
+	tsMuxStreamIdVideo = 0xe0
+	// tsMuxStreamIdAudio is the PES stream ID for audio
+	tsMuxStreamIdAudio = 0xc0
+	// tsMuxPayloadSize is the maximum payload per TS packet
+	tsMuxPayloadSize = MpegTsPacketSize - 4
+)
+
+// mpegTsCrcTable is the lookup table for the MPEG-2 CRC32 (polynomial 0x04c11db7, not reflected)
+var mpegTsCrcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = (crc << 1) ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// MpegTsCrc32 calculates the CRC32 checksum used in MPEG-TS PSI sections.
+func MpegTsCrc32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = (crc << 8) ^ mpegTsCrcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// MpegTsMuxer packs H.264 and AAC elementary streams into an MPEG-TS
+// with a single program.
+//
+// The PAT and PMT are sent before the first packet and before every video keyframe,
+// so decoders can join at any random access point.
+// PCR is carried on the video PID, or the audio PID if there is no video.
+//
+// All timestamps are in 90kHz units.
+type MpegTsMuxer struct {
+	writer io.Writer
+	// video and audio enable the corresponding elementary streams in the PMT
+	video bool
+	audio bool
+	// counters holds the continuity counters per PID
+	counters map[uint16]byte
+	// tables is true once the PAT/PMT have been sent
+	tables bool
+	// packet is a scratch buffer for one TS packet
+	packet [MpegTsPacketSize]byte
+}
+
+// NewMpegTsMuxer creates a muxer that writes complete 188 byte TS packets to writer.
+// The video and audio flags determine which elementary streams are announced in the PMT.
+func NewMpegTsMuxer(writer io.Writer, video bool, audio bool) *MpegTsMuxer {
+	return &MpegTsMuxer{
+		writer:   writer,
+		video:    video,
+		audio:    audio,
+		counters: make(map[uint16]byte),
+	}
+}
+
+// pcrPid returns the PID that carries the program clock reference.
+func (mux *MpegTsMuxer) pcrPid() uint16 {
+	if mux.video {
+		return tsMuxPidVideo
+	}
+	return tsMuxPidAudio
+}
+
+// WriteVideo writes one H.264 access unit in Annex B format.
+// keyframe must be set for IDR frames, so that PSI tables and a random access indicator are emitted.
+func (mux *MpegTsMuxer) WriteVideo(data []byte, pts uint64, dts uint64, keyframe bool) error {
+	if keyframe || !mux.tables {
+		if err := mux.WriteTables(); err != nil {
+			return err
+		}
+	}
+	pes := makePes(tsMuxStreamIdVideo, data, pts, dts, true)
+	return mux.writePes(tsMuxPidVideo, pes, dts, keyframe)
+}
+
+// WriteAudio writes one or more ADTS framed AAC frames.
+func (mux *MpegTsMuxer) WriteAudio(data []byte, pts uint64) error {
+	if !mux.tables {
+		if err := mux.WriteTables(); err != nil {
+			return err
+		}
+	}
+	pes := makePes(tsMuxStreamIdAudio, data, pts, pts, false)
+	return mux.writePes(tsMuxPidAudio, pes, pts, false)
+}
+
+// WriteTables sends the PAT and PMT.
+func (mux *MpegTsMuxer) WriteTables() error {
+	mux.tables = true
+
+	pat := []byte{
+		0x00,       // table_id
+		0xb0, 0x0d, // section_syntax_indicator, section_length
+		0x00, 0x01, // transport_stream_id
+		0xc1,       // version 0, current_next_indicator
+		0x00, 0x00, // section_number, last_section_number
+		0x00, 0x01, // program_number
+		0xe0 | byte(tsMuxPidPmt>>8), byte(tsMuxPidPmt & 0xff),
+	}
+	if err := mux.writeSection(MpegTsPidPat, pat); err != nil {
+		return err
+	}
+
+	pcr := mux.pcrPid()
+	pmt := []byte{
+		0x02,       // table_id
+		0xb0, 0x00, // section_syntax_indicator, section_length (filled in below)
+		0x00, 0x01, // program_number
+		0xc1,       // version 0, current_next_indicator
+		0x00, 0x00, // section_number, last_section_number
+		0xe0 | byte(pcr>>8), byte(pcr & 0xff),
+		0xf0, 0x00, // program_info_length
+	}
+	if mux.video {
+		pmt = append(pmt, MpegTsStreamTypeH264, 0xe0|byte(tsMuxPidVideo>>8), byte(tsMuxPidVideo&0xff), 0xf0, 0x00)
+	}
+	if mux.audio {
+		pmt = append(pmt, MpegTsStreamTypeAacAdts, 0xe0|byte(tsMuxPidAudio>>8), byte(tsMuxPidAudio&0xff), 0xf0, 0x00)
+	}
+	// section length counts everything after the length field, including the CRC
+	length := len(pmt) - 3 + 4
+	pmt[1] |= byte(length >> 8)
+	pmt[2] = byte(length)
+	return mux.writeSection(tsMuxPidPmt, pmt)
+}
+
+// writeSection appends a CRC to a PSI section and sends it in a single TS packet.
+func (mux *MpegTsMuxer) writeSection(pid uint16, section []byte) error {
+	crc := MpegTsCrc32(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	packet := mux.packet[:]
+	mux.header(packet, pid, true, 0x01)
+	// pointer field
+	packet[4] = 0x00
+	n := copy(packet[5:], section)
+	for i := 5 + n; i < len(packet); i++ {
+		packet[i] = 0xff
+	}
+	_, err := mux.writer.Write(packet)
+	return err
+}
+
+// header fills in the 4 byte TS header, including the next continuity counter.
+func (mux *MpegTsMuxer) header(packet []byte, pid uint16, start bool, control byte) {
+	cc := mux.counters[pid]
+	mux.counters[pid] = (cc + 1) & 0x0f
+	packet[0] = MpegTsSyncByte
+	packet[1] = byte(pid>>8) & 0x1f
+	if start {
+		packet[1] |= 0x40
+	}
+	packet[2] = byte(pid)
+	packet[3] = control<<4 | cc
+}
+
+// writePes splits a PES packet into TS packets.
+// The first packet carries a PCR if pid is the PCR PID.
+func (mux *MpegTsMuxer) writePes(pid uint16, pes []byte, dts uint64, keyframe bool) error {
+	first := true
+	for len(pes) > 0 {
+		packet := mux.packet[:]
+
+		// assemble the adaptation field, if any
+		var adaptation []byte
+		if first && pid == mux.pcrPid() {
+			flags := byte(0x10)
+			if keyframe {
+				flags |= 0x40
+			}
+			adaptation = append(adaptation, 0, flags)
+			adaptation = append(adaptation, encodePcr(dts)...)
+		}
+		space := tsMuxPayloadSize - len(adaptation)
+		if len(pes) < space {
+			// pad with stuffing bytes
+			stuffing := space - len(pes)
+			if len(adaptation) == 0 {
+				// the length byte counts towards the stuffing
+				adaptation = append(adaptation, 0)
+				stuffing--
+				if stuffing > 0 {
+					adaptation = append(adaptation, 0x00)
+					stuffing--
+				}
+			}
+			for i := 0; i < stuffing; i++ {
+				adaptation = append(adaptation, 0xff)
+			}
+			space = len(pes)
+		}
+
+		control := byte(0x01)
+		if len(adaptation) > 0 {
+			control = 0x03
+			adaptation[0] = byte(len(adaptation) - 1)
+		}
+		mux.header(packet, pid, first, control)
+		offset := 4 + copy(packet[4:], adaptation)
+		copy(packet[offset:], pes[:space])
+		pes = pes[space:]
+		first = false
+
+		if _, err := mux.writer.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makePes creates a PES packet with a PTS and optional DTS.
+// If unbounded is set, the PES length field is set to 0, as is allowed for video streams.
+func makePes(streamId byte, data []byte, pts uint64, dts uint64, unbounded bool) []byte {
+	var header []byte
+	if pts != dts {
+		header = append([]byte{0x80, 0xc0, 10}, encodeTimestamp(0x3, pts)...)
+		header = append(header, encodeTimestamp(0x1, dts)...)
+	} else {
+		header = append([]byte{0x80, 0x80, 5}, encodeTimestamp(0x2, pts)...)
+	}
+	length := len(header) + len(data)
+	if unbounded || length > 0xffff {
+		length = 0
+	}
+	pes := make([]byte, 0, 6+len(header)+len(data))
+	pes = append(pes, 0x00, 0x00, 0x01, streamId, byte(length>>8), byte(length))
+	pes = append(pes, header...)
+	pes = append(pes, data...)
+	return pes
+}
+
+// encodeTimestamp encodes a 33 bit PTS or DTS with the given 4 bit prefix.
+func encodeTimestamp(prefix byte, ts uint64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0e | 0x01,
+		byte(ts >> 22),
+		byte(ts>>14)&0xfe | 0x01,
+		byte(ts >> 7),
+		byte(ts<<1)&0xfe | 0x01,
+	}
+}
+
+// encodePcr encodes a PCR from a 90kHz time base, with the 27MHz extension set to 0.
+func encodePcr(base uint64) []byte {
+	return []byte{
+		byte(base >> 25),
+		byte(base >> 17),
+		byte(base >> 9),
+		byte(base >> 1),
+		byte(base<<7)&0x80 | 0x7e,
+		0x00,
+	}
+}
@@ -0,0 +1,63 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMpegTsCrc32(t *testing.T) {
+	// PAT for program 1 on PMT PID 0x1000, checksum taken from a known good stream
+	pat := []byte{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00}
+	if crc := MpegTsCrc32(pat); crc != 0x2ab104b2 {
+		t.Errorf("Invalid CRC: %08x", crc)
+	}
+}
+
+func TestMpegTsMuxer(t *testing.T) {
+	var output bytes.Buffer
+	mux := NewMpegTsMuxer(&output, true, true)
+
+	frame := make([]byte, 1000)
+	if err := mux.WriteVideo(frame, 1800, 900, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := mux.WriteAudio(frame[:100], 900); err != nil {
+		t.Fatal(err)
+	}
+	if output.Len()%MpegTsPacketSize != 0 {
+		t.Fatalf("Output is not a multiple of the packet size: %d", output.Len())
+	}
+
+	counters := make(map[int]int)
+	for data := output.Bytes(); len(data) > 0; data = data[MpegTsPacketSize:] {
+		if data[0] != MpegTsSyncByte {
+			t.Fatalf("Missing sync byte")
+		}
+		pid := int(data[1]&0x1f)<<8 | int(data[2])
+		if cc, ok := counters[pid]; ok && int(data[3]&0x0f) != (cc+1)&0x0f {
+			t.Errorf("Continuity error on PID %d", pid)
+		}
+		counters[pid] = int(data[3] & 0x0f)
+	}
+	for _, pid := range []int{MpegTsPidPat, tsMuxPidPmt, tsMuxPidVideo, tsMuxPidAudio} {
+		if _, ok := counters[pid]; !ok {
+			t.Errorf("PID %d missing from output", pid)
+		}
+	}
+}
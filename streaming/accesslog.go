@@ -0,0 +1,104 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/onitake/restreamer/util"
+)
+
+// accessRecorder wraps a response writer and records the status and
+// response size for the access log.
+type accessRecorder struct {
+	http.ResponseWriter
+	// status is the response status, 0 if no header was written yet
+	status int
+	// bytes is the number of body bytes written
+	bytes uint64
+}
+
+// WriteHeader records the status and passes it on.
+func (recorder *accessRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the bytes written and passes them on.
+func (recorder *accessRecorder) Write(p []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	n, err := recorder.ResponseWriter.Write(p)
+	recorder.bytes += uint64(n)
+	return n, err
+}
+
+// Flush passes flushes on, if the underlying writer supports them.
+func (recorder *accessRecorder) Flush() {
+	if flusher := flusherOf(recorder.ResponseWriter); flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (recorder *accessRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// entry assembles the access log entry for a request that was started at start.
+func (recorder *accessRecorder) entry(request *http.Request, client string, start time.Time) *util.AccessEntry {
+	user, _, _ := request.BasicAuth()
+	status := recorder.status
+	if status == 0 {
+		// nothing was written, the server will send an empty 200 response
+		status = http.StatusOK
+	}
+	return &util.AccessEntry{
+		Remote:    client,
+		User:      user,
+		Time:      start,
+		Method:    request.Method,
+		Path:      request.URL.Path,
+		Proto:     request.Proto,
+		Status:    status,
+		Bytes:     recorder.bytes,
+		Duration:  time.Since(start),
+		Referer:   request.Referer(),
+		UserAgent: request.UserAgent(),
+	}
+}
+
+// AccessLogHandler wraps handler and writes a line to log for each completed request.
+// The client address is determined with proxies.
+// If log is nil, handler is returned unchanged.
+func AccessLogHandler(handler http.Handler, log *util.AccessLogger, proxies util.ProxyList) http.Handler {
+	if log == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		recorder := &accessRecorder{ResponseWriter: writer}
+		start := time.Now()
+		defer func() {
+			log.Log(recorder.entry(request, proxies.ClientAddress(request), start))
+		}()
+		handler.ServeHTTP(recorder, request)
+	})
+}
@@ -17,10 +17,22 @@
 package streaming
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 )
 
+// waiter is a client in the waiting room.
+type waiter struct {
+	// wakeup is signalled when a slot is freed for this client.
+	// It is buffered, so a release is never lost, even if the client is not waiting yet.
+	wakeup chan struct{}
+	// streamer is set if the client was refused by the limits of this stream.
+	// Only slots freed by the same stream are of any use then.
+	streamer *Streamer
+}
+
 // AccessController implements a connection broker that limits
 // the maximum number of concurrent connections.
 type AccessController struct {
@@ -33,6 +45,21 @@ type AccessController struct {
 	connections uint
 	// inhibit is a global connection inhibitor flag.
 	inhibit bool
+	// waitSize is the maximum number of clients in the waiting room.
+	waitSize uint
+	// waitTimeout is the maximum time a client is held in the waiting room.
+	// If it is 0, the waiting room is disabled.
+	waitTimeout time.Duration
+	// waiters are the clients in the waiting room, in order of arrival.
+	// Each one is woken up through its own channel when a slot is freed.
+	waiters []*waiter
+	// releases counts the freed connection slots.
+	releases uint64
+	// memoryBudget is the maximum estimated memory held by all connections, in bytes.
+	// If it is 0, memory is not limited.
+	memoryBudget uint64
+	// memory is the estimated memory held by all active connections, in bytes.
+	memory uint64
 }
 
 // NewAccessController creates a connection broker object that
@@ -43,6 +70,120 @@ func NewAccessController(maxconnections uint) *AccessController {
 	}
 }
 
+// SetWaitingRoom enables holding incoming connections while the connection limit is reached.
+// At most size clients are held, for up to timeout each.
+// A timeout of 0 disables the waiting room.
+func (control *AccessController) SetWaitingRoom(size uint, timeout time.Duration) {
+	control.lock.Lock()
+	control.waitSize = size
+	control.waitTimeout = timeout
+	control.lock.Unlock()
+}
+
+// SetMemoryBudget limits the estimated memory held by all connections.
+// Each connection is charged Streamer.ConnectionMemory() bytes.
+// A budget of 0 disables the limit.
+func (control *AccessController) SetMemoryBudget(budget uint64) {
+	control.lock.Lock()
+	control.memoryBudget = budget
+	control.lock.Unlock()
+}
+
+// WaitTimeout returns the maximum time a client may be held in the waiting room.
+func (control *AccessController) WaitTimeout() time.Duration {
+	control.lock.Lock()
+	defer control.lock.Unlock()
+	return control.waitTimeout
+}
+
+// Releases returns the number of connection slots freed so far.
+func (control *AccessController) Releases() uint64 {
+	control.lock.Lock()
+	defer control.lock.Unlock()
+	return control.releases
+}
+
+// Wait blocks until a connection slot is released, the deadline is reached
+// or the context is cancelled.
+// since is the value of Releases() from before the caller's last refused attempt.
+// If the caller was refused by the limits of a stream, streamer must be set to it,
+// so the caller is only woken up by connections leaving the same stream.
+// It returns true if a slot was released and the caller should try to connect again.
+// If the waiting room is full, false is returned immediately.
+func (control *AccessController) Wait(ctx context.Context, deadline time.Time, since uint64, streamer *Streamer) bool {
+	if ctx.Err() != nil || !time.Now().Before(deadline) {
+		return false
+	}
+	control.lock.Lock()
+	if control.waitTimeout == 0 || uint(len(control.waiters)) >= control.waitSize {
+		control.lock.Unlock()
+		return false
+	}
+	// a slot may have been freed after the caller was refused
+	if control.releases != since {
+		control.lock.Unlock()
+		return true
+	}
+	self := &waiter{
+		wakeup:   make(chan struct{}, 1),
+		streamer: streamer,
+	}
+	control.waiters = append(control.waiters, self)
+	control.lock.Unlock()
+	metricWaiting.Inc()
+
+	timer := time.NewTimer(time.Until(deadline))
+	released := false
+	select {
+	case <-self.wakeup:
+		released = true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	timer.Stop()
+
+	control.lock.Lock()
+	if !released {
+		queued := false
+		for i, other := range control.waiters {
+			if other == self {
+				control.waiters = append(control.waiters[:i], control.waiters[i+1:]...)
+				queued = true
+				break
+			}
+		}
+		// we were woken up while giving up, pass the slot on
+		if !queued {
+			control.wakeup(self.streamer)
+		}
+	}
+	control.lock.Unlock()
+	metricWaiting.Dec()
+	return released
+}
+
+// Pass hands a slot the caller was woken up for to the next client in the waiting room.
+// It must be called when the caller was refused by the limits of its stream after waiting,
+// as the slot is still free for clients of other streams.
+func (control *AccessController) Pass() {
+	control.lock.Lock()
+	control.wakeup(nil)
+	control.lock.Unlock()
+}
+
+// wakeup signals the first client in the waiting room that can use a slot freed by streamer:
+// clients that were refused by the connection limit, or by the limits of the same stream.
+// Must be called with the lock held.
+func (control *AccessController) wakeup(streamer *Streamer) {
+	for i, waiter := range control.waiters {
+		if waiter.streamer == nil || waiter.streamer == streamer {
+			waiter.wakeup <- struct{}{}
+			control.waiters = append(control.waiters[:i], control.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
 // SetInhibit allows setting and clearing the inhibit flag.
 // If it is set, no further connections are accepted, irrespective of the
 // maxconnections limit.
@@ -57,31 +198,38 @@ func (control *AccessController) SetInhibit(inhibit bool) {
 // has not been reached yet.
 func (control *AccessController) Accept(remoteaddr string, streamer *Streamer) bool {
 	accept := false
+	estimate := streamer.ConnectionMemory()
 	// protect concurrent access
 	control.lock.Lock()
-	// check if the limit is disabled or unreached, and no inhibit is set
-	if !control.inhibit && (control.maxconnections == 0 || control.connections < control.maxconnections) {
-		// and increase the counter
+	// check if the limits are disabled or unreached, and no inhibit is set
+	if !control.inhibit && (control.maxconnections == 0 || control.connections < control.maxconnections) && (control.memoryBudget == 0 || control.memory+estimate <= control.memoryBudget) {
+		// and increase the counters
 		control.connections++
+		control.memory += estimate
 		accept = true
 	}
+	// take a snapshot for logging
+	connections := control.connections
+	memory := control.memory
 	control.lock.Unlock()
+	metricMemoryReserved.Set(float64(memory))
 	// print some info
 	if accept {
 		logger.Logkv(
 			"event", eventAclAccepted,
 			"remote", remoteaddr,
-			"connections", control.connections,
+			"connections", connections,
 			"max", control.maxconnections,
-			"message", fmt.Sprintf("Accepted connection from %s, active=%d, max=%d", remoteaddr, control.connections, control.maxconnections),
+			"message", fmt.Sprintf("Accepted connection from %s, active=%d, max=%d", remoteaddr, connections, control.maxconnections),
 		)
 	} else {
 		logger.Logkv(
 			"event", eventAclDenied,
 			"remote", remoteaddr,
-			"connections", control.connections,
+			"connections", connections,
 			"max", control.maxconnections,
-			"message", fmt.Sprintf("Denied connection from %s, active=%d, max=%d", remoteaddr, control.connections, control.maxconnections),
+			"memory", memory,
+			"message", fmt.Sprintf("Denied connection from %s, active=%d, max=%d, memory=%d", remoteaddr, connections, control.maxconnections, memory),
 		)
 	}
 	// return the result
@@ -91,20 +239,33 @@ func (control *AccessController) Accept(remoteaddr string, streamer *Streamer) b
 // Release decrements the open connections count.
 func (control *AccessController) Release(streamer *Streamer) {
 	remove := false
+	estimate := streamer.ConnectionMemory()
 	// protect concurrent access
 	control.lock.Lock()
 	if control.connections > 0 {
-		// and decrease the counter
+		// and decrease the counters
 		control.connections--
+		if control.memory >= estimate {
+			control.memory -= estimate
+		} else {
+			control.memory = 0
+		}
 		remove = true
+		// hand the slot to a waiting client, if there is one
+		control.releases++
+		control.wakeup(streamer)
 	}
+	// take a snapshot for logging
+	connections := control.connections
+	memory := control.memory
 	control.lock.Unlock()
+	metricMemoryReserved.Set(float64(memory))
 	if remove {
 		logger.Logkv(
 			"event", eventAclRemoved,
-			"connections", control.connections,
+			"connections", connections,
 			"max", control.maxconnections,
-			"message", fmt.Sprintf("Removed connection, active=%d, max=%d", control.connections, control.maxconnections),
+			"message", fmt.Sprintf("Removed connection, active=%d, max=%d", connections, control.maxconnections),
 		)
 	} else {
 		logger.Logkv(
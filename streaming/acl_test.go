@@ -17,10 +17,12 @@
 package streaming
 
 import (
+	"context"
 	"github.com/onitake/restreamer/util"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type mockAclLogger struct {
@@ -145,3 +147,183 @@ func TestAccessController02(t *testing.T) {
 		t.Error("t06: Incorrectly accepted connection on full controller")
 	}
 }
+
+func TestAccessControllerWaitingRoom(t *testing.T) {
+	l := &mockAclLogger{t, "waiting"}
+	logger = l
+
+	c := NewAccessController(1)
+	if c.Wait(context.Background(), time.Now().Add(time.Second), c.Releases(), nil) {
+		t.Error("Disabled waiting room did not refuse to wait")
+	}
+
+	c.SetWaitingRoom(1, time.Second)
+	c.Accept("", nil)
+	done := make(chan bool)
+	go func() {
+		done <- c.Wait(context.Background(), time.Now().Add(time.Second), c.Releases(), nil)
+	}()
+	// wait until the client has entered the waiting room
+	for {
+		c.lock.Lock()
+		waiting := len(c.waiters)
+		c.lock.Unlock()
+		if waiting > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if c.Wait(context.Background(), time.Now().Add(time.Second), c.Releases(), nil) {
+		t.Error("Full waiting room did not refuse to wait")
+	}
+	c.Release(nil)
+	if !<-done {
+		t.Error("Waiting client was not woken up by release")
+	}
+	if !c.Accept("", nil) {
+		t.Error("Woken client could not connect")
+	}
+
+	if c.Wait(context.Background(), time.Now().Add(10*time.Millisecond), c.Releases(), nil) {
+		t.Error("Wait did not time out")
+	}
+}
+
+func TestAccessControllerWaitingRoomOrder(t *testing.T) {
+	l := &mockAclLogger{t, "order"}
+	logger = l
+
+	c := NewAccessController(1)
+	c.SetWaitingRoom(2, time.Second)
+	c.Accept("", nil)
+	since := c.Releases()
+	if c.Accept("", nil) {
+		t.Fatal("Full controller accepted a connection")
+	}
+	// the slot is freed before the refused client enters the waiting room
+	c.Release(nil)
+	start := time.Now()
+	if !c.Wait(context.Background(), time.Now().Add(time.Second), since, nil) || time.Since(start) > 500*time.Millisecond {
+		t.Error("Slot freed before waiting was missed")
+	}
+	// an old release doesn't wake up clients that were refused later, or after their deadline
+	c.Accept("", nil)
+	if c.Wait(context.Background(), time.Now().Add(10*time.Millisecond), c.Releases(), nil) {
+		t.Error("Release before the last refusal woke up the client")
+	}
+	if c.Wait(context.Background(), time.Now(), since, nil) {
+		t.Error("Client was woken up after its deadline")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if c.Wait(ctx, time.Now().Add(time.Second), since, nil) {
+		t.Error("Client was woken up after its context was cancelled")
+	}
+
+	// all waiting clients are woken up, one per released slot
+	c = NewAccessController(2)
+	c.SetWaitingRoom(2, time.Second)
+	c.Accept("", nil)
+	c.Accept("", nil)
+	woken := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			woken <- c.Wait(context.Background(), time.Now().Add(time.Second), c.Releases(), nil)
+		}()
+	}
+	for {
+		c.lock.Lock()
+		waiting := len(c.waiters)
+		c.lock.Unlock()
+		if waiting == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Release(nil)
+	c.Release(nil)
+	for i := 0; i < 2; i++ {
+		if !<-woken {
+			t.Error("Waiting client was not woken up by release")
+		}
+	}
+}
+
+func TestAccessControllerWaitingRoomStreams(t *testing.T) {
+	l := &mockAclLogger{t, "streams"}
+	logger = l
+
+	s1 := NewStreamer("s1", 10, nil, nil)
+	s2 := NewStreamer("s2", 10, nil, nil)
+	c := NewAccessController(0)
+	c.SetWaitingRoom(3, time.Second)
+	c.Accept("", s1)
+	c.Accept("", s2)
+	// the first client waits for a slot on s1, the second one for s2, the third for any slot
+	woken := make([]chan bool, 3)
+	for i, streamer := range []*Streamer{s1, s2, nil} {
+		woken[i] = make(chan bool, 1)
+		since := c.Releases()
+		go func(i int, streamer *Streamer) {
+			woken[i] <- c.Wait(context.Background(), time.Now().Add(time.Second), since, streamer)
+		}(i, streamer)
+		for {
+			c.lock.Lock()
+			waiting := len(c.waiters)
+			c.lock.Unlock()
+			if waiting == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// a connection leaving s2 skips the client waiting for s1
+	c.Release(s2)
+	if !<-woken[1] {
+		t.Error("Client waiting for s2 was not woken up")
+	}
+	// the slot is passed on to the client waiting for any slot, not the one waiting for s1
+	c.Pass()
+	if !<-woken[2] {
+		t.Error("Passed slot did not wake up the next client")
+	}
+	select {
+	case <-woken[0]:
+		t.Fatal("Client waiting for s1 was woken up by another stream")
+	default:
+	}
+	c.Release(s1)
+	if !<-woken[0] {
+		t.Error("Client waiting for s1 was not woken up")
+	}
+}
+
+func TestAccessControllerMemoryBudget(t *testing.T) {
+	l := &mockAclLogger{t, "memory"}
+	logger = l
+
+	// 10 packets per connection
+	streamer := NewStreamer("memory", 10, nil, nil)
+	estimate := streamer.ConnectionMemory()
+	if estimate != 10*(188+packetOverhead) {
+		t.Errorf("Unexpected connection memory estimate: %d", estimate)
+	}
+
+	c := NewAccessController(0)
+	c.SetMemoryBudget(2*estimate + estimate/2)
+	if !c.Accept("a", streamer) || !c.Accept("b", streamer) {
+		t.Fatal("Refused connection within memory budget")
+	}
+	if c.Accept("c", streamer) {
+		t.Error("Accepted connection exceeding memory budget")
+	}
+	c.Release(streamer)
+	if !c.Accept("c", streamer) {
+		t.Error("Refused connection after release")
+	}
+	// connections without a streamer are not charged
+	if !c.Accept("d", nil) {
+		t.Error("Refused connection without memory estimate")
+	}
+}
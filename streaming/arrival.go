@@ -0,0 +1,210 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/onitake/restreamer/protocol"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultArrivalLogSize is the number of packets an arrival log keeps if no size is configured
+	DefaultArrivalLogSize = 100000
+	// DefaultArrivalLogWindow is the time an arrival log records if no window is requested
+	DefaultArrivalLogWindow = 10 * time.Second
+)
+
+// arrivalEntry is the arrival time of a single packet.
+type arrivalEntry struct {
+	// when is the time the packet was read from the upstream
+	when time.Time
+	// pid is the PID of the packet
+	pid uint16
+	// pcr is the PCR base of the packet, if hasPcr is true
+	pcr uint64
+	// hasPcr is true if the packet carries a PCR
+	hasPcr bool
+}
+
+// arrivalLog records packet arrival times and PCRs into a ring buffer for a limited time.
+// When the time is up, the most recent entries are written to a file as CSV,
+// or as JSON if the file name ends in .json.
+//
+// It is only accessed by the goroutine that reads from the upstream.
+type arrivalLog struct {
+	// name is the stream name
+	name string
+	// path is the file the log is written to
+	path string
+	// pcrOnly records only packets with a PCR
+	pcrOnly bool
+	// entries is the ring buffer
+	entries []arrivalEntry
+	// next is the index of the next entry that is written
+	next int
+	// full is true when the ring buffer has wrapped around
+	full bool
+	// end is the time when recording stops
+	end time.Time
+}
+
+// newArrivalLog creates an arrival log that records up to size packets until window has passed.
+// The file name is created from template, see NewRecorder.
+func newArrivalLog(name string, template string, size int, pcrOnly bool, window time.Duration) *arrivalLog {
+	if size <= 0 {
+		size = DefaultArrivalLogSize
+	}
+	if window <= 0 {
+		window = DefaultArrivalLogWindow
+	}
+	now := time.Now()
+	return &arrivalLog{
+		name:    name,
+		path:    expandFileName(template, name, now),
+		pcrOnly: pcrOnly,
+		entries: make([]arrivalEntry, size),
+		end:     now.Add(window),
+	}
+}
+
+// Add records the arrival of a packet.
+// Returns true when the recording window is over.
+func (log *arrivalLog) Add(packet protocol.MpegTsPacket) bool {
+	now := time.Now()
+	if now.After(log.end) {
+		return true
+	}
+	pcr, hasPcr := protocol.MpegTsPacketPcr(packet)
+	if log.pcrOnly && !hasPcr {
+		return false
+	}
+	log.entries[log.next] = arrivalEntry{
+		when:   now,
+		pid:    protocol.MpegTsPacketPid(packet),
+		pcr:    pcr,
+		hasPcr: hasPcr,
+	}
+	log.next++
+	if log.next == len(log.entries) {
+		log.next = 0
+		log.full = true
+	}
+	return false
+}
+
+// ordered returns the recorded entries, oldest first.
+func (log *arrivalLog) ordered() []arrivalEntry {
+	if !log.full {
+		return log.entries[:log.next]
+	}
+	return append(append([]arrivalEntry{}, log.entries[log.next:]...), log.entries[:log.next]...)
+}
+
+// Dump writes the recorded entries to the log file.
+func (log *arrivalLog) Dump() {
+	entries := log.ordered()
+	err := log.write(entries)
+	if err != nil {
+		logger.Logkv(
+			"event", eventClientError,
+			"error", errorClientArrivalLog,
+			"stream", log.name,
+			"path", log.path,
+			"message", fmt.Sprintf("Error writing arrival log: %v", err),
+		)
+		return
+	}
+	logger.Logkv(
+		"event", eventClientArrivalLog,
+		"stream", log.name,
+		"path", log.path,
+		"packets", len(entries),
+		"message", fmt.Sprintf("Wrote arrival times of %d packets to %s", len(entries), log.path),
+	)
+}
+
+// write creates the log file and writes entries in the format selected by its extension.
+func (log *arrivalLog) write(entries []arrivalEntry) error {
+	if err := os.MkdirAll(filepath.Dir(log.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(log.path)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if strings.HasSuffix(log.path, ".json") {
+		err = writeArrivalJson(writer, entries)
+	} else {
+		err = writeArrivalCsv(writer, entries)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeArrivalCsv writes entries as CSV, with the arrival time in Unix nanoseconds.
+// The pcr column is empty for packets without a PCR.
+func writeArrivalCsv(writer io.Writer, entries []arrivalEntry) error {
+	if _, err := io.WriteString(writer, "time,pid,pcr\n"); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		pcr := ""
+		if entry.hasPcr {
+			pcr = strconv.FormatUint(entry.pcr, 10)
+		}
+		if _, err := fmt.Fprintf(writer, "%d,%d,%s\n", entry.when.UnixNano(), entry.pid, pcr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// arrivalJson is the JSON representation of an arrivalEntry.
+type arrivalJson struct {
+	Time int64   `json:"time"`
+	Pid  uint16  `json:"pid"`
+	Pcr  *uint64 `json:"pcr,omitempty"`
+}
+
+// writeArrivalJson writes entries as a JSON array, with the arrival time in Unix nanoseconds.
+func writeArrivalJson(writer io.Writer, entries []arrivalEntry) error {
+	list := make([]arrivalJson, len(entries))
+	for i := range entries {
+		list[i] = arrivalJson{
+			Time: entries[i].when.UnixNano(),
+			Pid:  entries[i].pid,
+		}
+		if entries[i].hasPcr {
+			list[i].Pcr = &entries[i].pcr
+		}
+	}
+	return json.NewEncoder(writer).Encode(list)
+}
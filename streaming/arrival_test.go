@@ -0,0 +1,107 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pcrPacket creates an empty TS packet with a PCR.
+func pcrPacket(pid uint16, pcr uint64) []byte {
+	packet := packetWithPid(pid)
+	packet[3] = 0x20
+	packet[4] = 7
+	packet[5] = 0x10
+	packet[6] = byte(pcr >> 25)
+	packet[7] = byte(pcr >> 17)
+	packet[8] = byte(pcr >> 9)
+	packet[9] = byte(pcr >> 1)
+	packet[10] = byte(pcr<<7) & 0x80
+	return packet
+}
+
+func TestArrivalLogRing(t *testing.T) {
+	log := newArrivalLog("/ring.ts", "", 3, false, time.Hour)
+	for pid := uint16(1); pid <= 5; pid++ {
+		if log.Add(packetWithPid(pid)) {
+			t.Fatal("Recording window ended early")
+		}
+	}
+	entries := log.ordered()
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.pid != uint16(i+3) {
+			t.Errorf("Entry %d has PID %d, expected %d", i, entry.pid, i+3)
+		}
+	}
+	log.end = time.Now().Add(-time.Second)
+	if !log.Add(packetWithPid(6)) {
+		t.Error("Recording window didn't end")
+	}
+}
+
+func TestArrivalLogCsv(t *testing.T) {
+	dir := t.TempDir()
+	log := newArrivalLog("/live/csv.ts", filepath.Join(dir, "{stream}.csv"), 0, true, 0)
+	log.Add(packetWithPid(0x100))
+	log.Add(pcrPacket(0x100, 90000))
+	log.Dump()
+	data, err := os.ReadFile(filepath.Join(dir, "live_csv.ts.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || lines[0] != "time,pid,pcr" || !strings.HasSuffix(lines[1], ",256,90000") {
+		t.Errorf("Invalid CSV arrival log: %q", lines)
+	}
+}
+
+func TestArrivalLogJson(t *testing.T) {
+	dir := t.TempDir()
+	log := newArrivalLog("/json.ts", filepath.Join(dir, "{stream}.json"), 0, false, 0)
+	log.Add(packetWithPid(0x100))
+	log.Add(pcrPacket(0x101, 90000))
+	log.Dump()
+	data, err := os.ReadFile(filepath.Join(dir, "json.ts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []arrivalJson
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Pcr != nil || entries[1].Pid != 0x101 || entries[1].Pcr == nil || *entries[1].Pcr != 90000 {
+		t.Errorf("Invalid JSON arrival log: %s", data)
+	}
+}
+
+func TestClientArrivalLogDisabled(t *testing.T) {
+	client, err := NewClient("/disabled.ts", []string{"tcp://127.0.0.1:1"}, nil, 1, 0, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.ArmArrivalLog(0) != ErrNoArrivalLog {
+		t.Error("Arrival log armed without a file name")
+	}
+}
@@ -0,0 +1,150 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBreakerCooldown is the first cooldown of a circuit breaker if none is configured.
+const DefaultBreakerCooldown = time.Minute
+
+// breakerState is the state of a circuit breaker.
+type breakerState int32
+
+const (
+	// breakerClosed lets connection attempts through normally.
+	breakerClosed breakerState = iota
+	// breakerOpen holds back connection attempts during a cooldown.
+	breakerOpen
+	// breakerHalfOpen lets a single trial attempt through after a cooldown.
+	breakerHalfOpen
+)
+
+// String returns the name of a breaker state.
+func (state breakerState) String() string {
+	switch state {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// circuitBreaker stops an upstream that keeps failing from being reconnected in a tight loop.
+//
+// After threshold failures in a row, the breaker opens and holds back the next
+// attempt for a cooldown. The attempt after the cooldown is a trial: if it fails as
+// well, the breaker opens again with twice the cooldown, up to maxCooldown.
+// An attempt that doesn't fail closes the breaker and resets the cooldown.
+//
+// Outcomes are only recorded by the connection loop, but the state may be read at any time.
+// A nil circuitBreaker never opens.
+type circuitBreaker struct {
+	// threshold is the number of failures in a row that open the breaker
+	threshold uint
+	// cooldown is the first cooldown
+	cooldown time.Duration
+	// maxCooldown is the upper limit of the cooldown
+	maxCooldown time.Duration
+	// failures is the number of failures since the last good attempt
+	failures uint
+	// next is the cooldown of the next time the breaker opens
+	next time.Duration
+	// state is the current breakerState, accessed atomically
+	state int32
+	// metric reports the state
+	metric prometheus.Gauge
+}
+
+// newCircuitBreaker creates a breaker that opens after threshold failures in a row.
+// If cooldown is 0, DefaultBreakerCooldown is used. maxCooldown is raised to cooldown if it is smaller.
+// Returns nil if threshold is 0.
+func newCircuitBreaker(name string, threshold uint, cooldown time.Duration, maxCooldown time.Duration) *circuitBreaker {
+	if threshold == 0 {
+		return nil
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultBreakerCooldown
+	}
+	if maxCooldown < cooldown {
+		maxCooldown = cooldown
+	}
+	breaker := &circuitBreaker{
+		threshold:   threshold,
+		cooldown:    cooldown,
+		maxCooldown: maxCooldown,
+		next:        cooldown,
+		metric:      metricBreakerState.With(prometheus.Labels{"stream": name}),
+	}
+	breaker.metric.Set(float64(breakerClosed))
+	return breaker
+}
+
+// State returns the current state. A nil breaker is always closed.
+func (breaker *circuitBreaker) State() breakerState {
+	if breaker == nil {
+		return breakerClosed
+	}
+	return breakerState(atomic.LoadInt32(&breaker.state))
+}
+
+// setState changes the state and updates the metric.
+func (breaker *circuitBreaker) setState(state breakerState) {
+	atomic.StoreInt32(&breaker.state, int32(state))
+	breaker.metric.Set(float64(state))
+}
+
+// record registers the outcome of a connection attempt.
+// Returns the cooldown to wait before the next attempt if the breaker opened, 0 otherwise.
+func (breaker *circuitBreaker) record(failed bool) time.Duration {
+	if breaker == nil {
+		return 0
+	}
+	if !failed {
+		breaker.failures = 0
+		breaker.next = breaker.cooldown
+		if breaker.State() != breakerClosed {
+			breaker.setState(breakerClosed)
+		}
+		return 0
+	}
+	breaker.failures++
+	if breaker.State() != breakerHalfOpen && breaker.failures < breaker.threshold {
+		return 0
+	}
+	cooldown := breaker.next
+	breaker.next *= 2
+	if breaker.next > breaker.maxCooldown {
+		breaker.next = breaker.maxCooldown
+	}
+	breaker.setState(breakerOpen)
+	return cooldown
+}
+
+// halfOpen ends a cooldown, the next attempt is a trial.
+func (breaker *circuitBreaker) halfOpen() {
+	if breaker != nil {
+		breaker.setState(breakerHalfOpen)
+	}
+}
@@ -0,0 +1,72 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var disabled *circuitBreaker
+	if disabled.record(true) != 0 || disabled.State() != breakerClosed {
+		t.Error("Nil breaker opened")
+	}
+
+	breaker := newCircuitBreaker("TestCircuitBreaker", 3, time.Second, 3*time.Second)
+	for i := 0; i < 2; i++ {
+		if wait := breaker.record(true); wait != 0 {
+			t.Fatalf("Breaker opened after %d failures", i+1)
+		}
+	}
+	// a good connection resets the count
+	breaker.record(false)
+	breaker.record(true)
+	breaker.record(true)
+	if breaker.State() != breakerClosed {
+		t.Fatal("Breaker opened before the threshold")
+	}
+	if wait := breaker.record(true); wait != time.Second || breaker.State() != breakerOpen {
+		t.Fatalf("Breaker didn't open with a cooldown of 1s: %v %v", wait, breaker.State())
+	}
+	if testutil.ToFloat64(breaker.metric) != float64(breakerOpen) {
+		t.Errorf("Breaker metric not updated: %v", testutil.ToFloat64(breaker.metric))
+	}
+
+	// failed trials double the cooldown up to the limit
+	for _, expected := range []time.Duration{2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		breaker.halfOpen()
+		if breaker.State().String() != "half-open" {
+			t.Errorf("Breaker not half-open: %v", breaker.State())
+		}
+		if wait := breaker.record(true); wait != expected {
+			t.Errorf("Expected a cooldown of %v, got %v", expected, wait)
+		}
+	}
+
+	// a good trial closes the breaker and resets the cooldown
+	breaker.halfOpen()
+	if wait := breaker.record(false); wait != 0 || breaker.State() != breakerClosed {
+		t.Errorf("Breaker not closed after a good trial: %v", breaker.State())
+	}
+	breaker.record(true)
+	breaker.record(true)
+	if wait := breaker.record(true); wait != time.Second {
+		t.Errorf("Cooldown not reset: %v", wait)
+	}
+}
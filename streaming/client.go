@@ -17,8 +17,11 @@
 package streaming
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/onitake/restreamer/event"
 	"github.com/onitake/restreamer/metrics"
 	"github.com/onitake/restreamer/protocol"
 	"github.com/onitake/restreamer/util"
@@ -26,9 +29,13 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -47,6 +54,15 @@ var (
 	ErrInvalidResponse = errors.New("restreamer: unsupported response code")
 	// ErrNoUrl is thrown when the list of upstream URLs was empty
 	ErrNoUrl = errors.New("restreamer: no parseable upstream URL")
+	// ErrStreamStalled is returned when the stream loop stopped taking packets
+	// for longer than the watchdog timeout.
+	ErrStreamStalled = errors.New("restreamer: stream stalled")
+	// ErrLossSimulationDisabled is returned when the packet loss simulation
+	// of a stream is changed without allowing it first.
+	ErrLossSimulationDisabled = errors.New("restreamer: packet loss simulation is not allowed")
+	// ErrNoArrivalLog is returned when an arrival log is requested for a stream
+	// that has no arrival log file configured.
+	ErrNoArrivalLog = errors.New("restreamer: no arrival log configured")
 )
 
 var (
@@ -71,12 +87,36 @@ var (
 		},
 		[]string{"stream", "url"},
 	)
+	metricWatchdogStalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streaming_watchdog_stalls_total",
+			Help: "Number of times the stream loop stopped taking packets and was restarted.",
+		},
+		[]string{"stream"},
+	)
+	metricNullBytesDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streaming_null_bytes_dropped",
+			Help: "Total number of bytes in null packets that were filtered from the input.",
+		},
+		[]string{"stream"},
+	)
+	metricBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "streaming_breaker_state",
+			Help: "Upstream circuit breaker state, 0=closed 1=open 2=half-open.",
+		},
+		[]string{"stream"},
+	)
 )
 
 func init() {
 	metrics.MustRegister(metricSourceConnected)
 	metrics.MustRegister(metricPacketsReceived)
 	metrics.MustRegister(metricBytesReceived)
+	metrics.MustRegister(metricNullBytesDropped)
+	metrics.MustRegister(metricBreakerState)
+	metrics.MustRegister(metricWatchdogStalls)
 }
 
 // Client implements a streaming HTTP client with failover support.
@@ -106,10 +146,14 @@ type Client struct {
 	getter *http.Client
 	// urls is the URLs to GET (either of them)
 	urls []*url.URL
-	// response is the HTTP response, including the body reader
+	// response is the HTTP response, including the body reader.
+	// Guarded by inputLock.
 	response *http.Response
-	// input is the input stream (socket)
+	// input is the input stream (socket).
+	// Guarded by inputLock, as it may be closed from other goroutines.
 	input io.ReadCloser
+	// inputLock protects input and response
+	inputLock sync.Mutex
 	// Wait is the time before reconnecting a disconnected upstream.
 	// This is a deadline: If a connection (or connection attempt) takes longer
 	// than this duration, a reconnection is attempted immediately.
@@ -119,10 +163,12 @@ type Client struct {
 	// streamer is the attached packet distributor
 	streamer *Streamer
 	// running is true while the client is streaming into the queue.
-	// Use ReadBool(client.running) to get the current value.
+	// Use LoadBool(&client.running) to get the current value.
 	running util.AtomicBool
 	// stats is the statistics collector for this client
 	stats metrics.Collector
+	// events receives upstream connection changes, nil if there is no receiver
+	events event.Notifiable
 	// queueSize is the size of the input queue
 	queueSize uint
 	// interf denotes a specific network interface to create the connection on
@@ -132,8 +178,108 @@ type Client struct {
 	readBufferSize int
 	// packetSize defines the size of individual datagram packets (UDP)
 	packetSize int
+	// udpReaders is the number of goroutines that receive from a UDP socket
+	udpReaders int
+	// watchdog is the time the stream loop may take to accept a packet, 0 to wait forever
+	watchdog time.Duration
+	// urlLabels is the scheme for the url label of upstream metrics
+	urlLabels UrlLabelScheme
+	// readChunk is the size of the read buffer for stream-oriented inputs, 0 to read each packet separately
+	readChunk int
 	// promCounter allows enabling/disabling Prometheus packet metrics.
 	promCounter bool
+	// dropNull enables filtering of null packets
+	dropNull bool
+	// nullKeep is the interval of null packets that are passed through despite filtering, 0 to drop all
+	nullKeep uint
+	// nullCount counts the null packets since the last one that was passed through
+	nullCount uint
+	// onDemand enables connecting only while there are viewers
+	onDemand bool
+	// idleTimeout is the time an on-demand upstream stays connected without viewers
+	idleTimeout time.Duration
+	// demandLock protects wanted, idle, hold and idleTimer
+	demandLock sync.Mutex
+	// wanted is true while an on-demand upstream has (or waits for) viewers
+	wanted bool
+	// idle is true while no viewers are connected
+	idle bool
+	// hold keeps an on-demand upstream connected, irrespective of viewers
+	hold bool
+	// idleTimer disconnects an on-demand upstream when it fires
+	idleTimer *time.Timer
+	// wake is signalled when an on-demand upstream is wanted again
+	wake chan struct{}
+	// schedule contains the times when an on-demand upstream is held connected
+	schedule []ScheduleWindow
+	// warmup is the time before a scheduled window when the upstream is connected
+	warmup time.Duration
+	// sampling enables the periodic packet summary log.
+	// Use LoadBool(&client.sampling) to get the current value.
+	sampling util.AtomicBool
+	// samplePackets is the number of packets between summaries
+	samplePackets uint
+	// sampleInterval is the time between summaries
+	sampleInterval time.Duration
+	// pidStatistics enables counting the received packets per PID.
+	// Use LoadBool(&client.pidStatistics) to get the current value.
+	pidStatistics util.AtomicBool
+	// batchSize is the number of TS packets that are combined before they are queued
+	batchSize int
+	// dnsRefresh is the interval at which the upstream host name is resolved again, 0 to disable
+	dnsRefresh time.Duration
+	// dnsReconnect reconnects the upstream when its address is no longer in DNS
+	dnsReconnect bool
+	// lookupHost resolves host names, net.DefaultResolver.LookupHost by default
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	// remoteAddress is the IP address the upstream is connected to, if known
+	remoteAddress string
+	// splicer joins the packets of consecutive upstream connections, nil if disabled
+	splicer *protocol.Splicer
+	// queue is the streamer input that is kept across upstream connections when splicing
+	queue chan protocol.MpegTsPacket
+	// loss drops and delays incoming packets for testing, nil unless the simulation is allowed
+	loss *protocol.LossSimulator
+	// connectLimiter staggers the first connection attempt, nil for no limit
+	connectLimiter *ConnectLimiter
+	// arrivalTemplate is the file name template of arrival logs, empty if they are disabled
+	arrivalTemplate string
+	// arrivalSize is the number of packets an arrival log keeps
+	arrivalSize int
+	// arrivalPcrOnly only logs the arrival of packets with a PCR
+	arrivalPcrOnly bool
+	// arrivalArmed is true while an arrival log is requested or recording.
+	// Use LoadBool(&client.arrivalArmed) to get the current value.
+	arrivalArmed util.AtomicBool
+	// arrivalLock protects arrivalPending
+	arrivalLock sync.Mutex
+	// arrivalPending is an arrival log that hasn't been picked up by the reading goroutine yet
+	arrivalPending *arrivalLog
+	// maxAttempts is the number of rounds through all upstreams without receiving data
+	// before the stream is given up, 0 to retry forever
+	maxAttempts uint
+	// delivered is set when a connection has received data.
+	// It is only accessed by the connection loop.
+	delivered bool
+	// dead is true while the stream has given up reconnecting.
+	// Use LoadBool(&client.dead) to get the current value.
+	dead util.AtomicBool
+	// revive is signalled to resume reconnecting a dead stream
+	revive chan struct{}
+	// breaker holds back reconnects to an upstream that keeps failing, nil if disabled
+	breaker *circuitBreaker
+	// preroll is the number of packets that are buffered before a connection is reported up
+	preroll int
+	// buffering is true while a new connection is filling its pre-roll.
+	// Use LoadBool(&client.buffering) to get the current value.
+	buffering util.AtomicBool
+}
+
+// ScheduleWindow is a time span during which an on-demand stream is held connected.
+// If End is equal to Start, the stream is only held until Start.
+type ScheduleWindow struct {
+	Start time.Time
+	End   time.Time
 }
 
 // NewClient constructs a new streaming HTTP client, without connecting the socket yet.
@@ -159,7 +305,7 @@ func NewClient(name string, uris []string, streamer *Streamer, timeout uint, rec
 	urls := make([]*url.URL, len(uris))
 	count := 0
 	for _, uri := range uris {
-		parsed, err := url.Parse(uri)
+		parsed, err := url.Parse(escapeZone(uri))
 		if err == nil {
 			urls[count] = parsed
 			count++
@@ -189,13 +335,18 @@ func NewClient(name string, uris []string, streamer *Streamer, timeout uint, rec
 	// this timeout is only used for establishing connections
 	toduration := time.Duration(timeout) * time.Second
 	dialer := &net.Dialer{
-		Timeout:   toduration,
+		Timeout: toduration,
+		// use the default keepalive interval, see SetKeepAlive
 		KeepAlive: 0,
+		// race IPv4 against IPv6 when a host has both (RFC 6555), using the default fallback delay
+		FallbackDelay: 0,
 	}
 	transport := &http.Transport{
-		Proxy:                 http.ProxyFromEnvironment,
-		DialContext:           dialer.DialContext,
-		DisableKeepAlives:     true,
+		Proxy:             http.ProxyFromEnvironment,
+		DialContext:       dialer.DialContext,
+		DisableKeepAlives: true,
+		// TS streams don't compress well, don't ask for it. See decodeBody for origins that compress anyway.
+		DisableCompression:    true,
 		TLSHandshakeTimeout:   toduration,
 		ResponseHeaderTimeout: toduration,
 		ExpectContinueTimeout: toduration,
@@ -218,6 +369,8 @@ func NewClient(name string, uris []string, streamer *Streamer, timeout uint, rec
 		interf:         pintf,
 		readBufferSize: int(bufferSize * protocol.MpegTsPacketSize),
 		packetSize:     int(packetSize),
+		lookupHost:     net.DefaultResolver.LookupHost,
+		revive:         make(chan struct{}, 1),
 	}
 	return &client, nil
 }
@@ -227,6 +380,471 @@ func (client *Client) SetCollector(stats metrics.Collector) {
 	client.stats = stats
 }
 
+// SetNotifier assigns an event notifier for upstream connects and disconnects.
+// The upstream URL is passed without credentials, query string and fragment.
+func (client *Client) SetNotifier(events event.Notifiable) {
+	client.events = events
+}
+
+// SetConnectLimiter makes the first connection attempt wait for the limiter,
+// so clients that share it don't all connect at the same time.
+// Reconnects are not limited.
+// Must be called before Connect.
+func (client *Client) SetConnectLimiter(limiter *ConnectLimiter) {
+	client.connectLimiter = limiter
+}
+
+// SetKeepAlive sets the TCP keepalive interval of upstream connections.
+// 0 uses the Go runtime default, a negative value disables keepalives.
+// Must be called before Connect.
+func (client *Client) SetKeepAlive(interval time.Duration) {
+	client.connector.KeepAlive = interval
+}
+
+// SetDnsRefresh resolves the host name of a connected upstream again every interval
+// and logs when its addresses change. Go doesn't cache DNS lookups, but a long-lived
+// connection stays with the address it was opened to.
+// If reconnect is true, the upstream is reconnected when the address it is connected to
+// disappears from DNS, so it follows DNS based failover without waiting for the
+// connection to fail. If the connected address is unknown, any change causes a reconnect.
+// An interval of 0 disables re-resolution.
+// Must be called before Connect.
+func (client *Client) SetDnsRefresh(interval time.Duration, reconnect bool) {
+	client.dnsRefresh = interval
+	client.dnsReconnect = reconnect
+}
+
+// SetReadChunk reads stream-oriented inputs like HTTP, TCP and files through a buffer of
+// this many bytes, instead of reading each TS packet separately. This saves a lot of syscalls
+// at high bitrates. Data is passed on as soon as it has been received, so it adds no latency.
+// Datagram inputs like UDP and paced playlists are not buffered. 0 disables the buffer.
+// Must be called before Connect.
+func (client *Client) SetReadChunk(size uint) {
+	client.readChunk = int(size)
+}
+
+// SetUrlLabels sets how upstream URLs are turned into the url label of the
+// upstream metrics. The default is UrlLabelSanitized.
+// Must be called before Connect.
+func (client *Client) SetUrlLabels(scheme UrlLabelScheme) {
+	client.urlLabels = scheme
+}
+
+// SetWatchdog sets the time the stream loop may take to accept a packet while
+// its input queue is full. If it takes longer, the loop is considered wedged:
+// an alert is logged, the loop is told to stop and the upstream is reconnected.
+// The new loop takes over once the wedged one has woken up and disconnected its viewers.
+// 0 disables the watchdog.
+// Must be called before Connect.
+func (client *Client) SetWatchdog(timeout time.Duration) {
+	client.watchdog = timeout
+}
+
+// SetSeamless keeps the stream running across reconnects and failovers, instead of
+// disconnecting all viewers when the upstream connection is lost.
+// Continuity counters and timestamps of the new upstream are rewritten, so the
+// stream stays continuous, and its packets are discarded until a PAT, a PCR and
+// (if the previous upstream marked them) a keyframe have been received.
+// Viewers receive no data while the upstream is down.
+// Must be called before Connect.
+func (client *Client) SetSeamless(enable bool) {
+	if enable {
+		client.splicer = protocol.NewSplicer()
+	} else {
+		client.splicer = nil
+	}
+}
+
+// SetUdpReaders sets the number of goroutines that receive from UDP sockets at the same time.
+// This spreads the receive load of high-bitrate streams across several CPU cores.
+// RTP packets are put back in order by their sequence numbers, but bare TS datagrams
+// that arrive at nearly the same time may be swapped, so this is only safe for RTP inputs.
+// Several sockets with SO_REUSEPORT wouldn't help: Linux delivers a copy of every
+// multicast packet to each socket, and sends all packets of a unicast sender to the same one.
+// 0 or 1 receive from a single goroutine.
+// Must be called before Connect.
+func (client *Client) SetUdpReaders(count uint) {
+	client.udpReaders = int(count)
+}
+
+// SetNullPacketFilter enables dropping of null packets (PID 0x1FFF) before they are queued.
+// If keep is not 0, every keep-th null packet is still passed through, which leaves a bit of
+// padding for players that derive timing from a constant bitrate.
+// Must be called before Connect.
+func (client *Client) SetNullPacketFilter(enable bool, keep uint) {
+	client.dropNull = enable
+	client.nullKeep = keep
+}
+
+// filterNull returns true if the packet is a null packet that should be dropped.
+func (client *Client) filterNull(packet protocol.MpegTsPacket) bool {
+	if !client.dropNull || protocol.MpegTsPacketPid(packet) != protocol.MpegTsPidNull {
+		return false
+	}
+	client.nullCount++
+	if client.nullKeep > 0 && client.nullCount >= client.nullKeep {
+		client.nullCount = 0
+		return false
+	}
+	metricNullBytesDropped.With(prometheus.Labels{"stream": client.name}).Add(float64(len(packet)))
+	return true
+}
+
+// AllowLossSimulation enables the packet loss simulation, initially without any loss.
+// Until this is called, SetLossSimulation fails, so it can't be turned on by accident.
+// Must be called before Connect.
+func (client *Client) AllowLossSimulation() {
+	client.loss = protocol.NewLossSimulator()
+}
+
+// SetLossSimulation drops each incoming packet with the probability drop, and delays it
+// by up to jitter with the probability delay. It takes effect on active connections immediately.
+// Delays longer than the read timeout cause a reconnect.
+// Returns ErrLossSimulationDisabled if AllowLossSimulation wasn't called.
+func (client *Client) SetLossSimulation(drop float64, delay float64, jitter time.Duration) error {
+	if client.loss == nil {
+		return ErrLossSimulationDisabled
+	}
+	client.loss.Set(drop, delay, jitter)
+	logger.Logkv(
+		"event", eventClientLossSimulation,
+		"drop", drop,
+		"delay", delay,
+		"jitter", jitter,
+		"message", fmt.Sprintf("Packet loss simulation set to drop=%v delay=%v jitter=%v", drop, delay, jitter),
+	)
+	return nil
+}
+
+// SetArrivalLog configures the packet arrival log for latency analysis.
+// template is the file name of the logs, with the same placeholders as recording files.
+// Logs are written as JSON if the name ends in .json, and as CSV otherwise.
+// size is the number of packets that are kept, the most recent ones win. 0 uses DefaultArrivalLogSize.
+// If pcrOnly is true, only packets with a PCR are logged.
+// An empty template disables the arrival log.
+// Must be called before Connect.
+func (client *Client) SetArrivalLog(template string, size uint, pcrOnly bool) {
+	client.arrivalTemplate = template
+	client.arrivalSize = int(size)
+	client.arrivalPcrOnly = pcrOnly
+}
+
+// ArmArrivalLog starts recording the arrival times of incoming packets for window,
+// or DefaultArrivalLogWindow if it is 0. When the first packet after the window arrives,
+// the log is written to a file and recording stops. Recording continues across reconnects.
+// A recording that is already running is replaced.
+// Returns ErrNoArrivalLog if no file name template was configured.
+func (client *Client) ArmArrivalLog(window time.Duration) error {
+	if client.arrivalTemplate == "" {
+		return ErrNoArrivalLog
+	}
+	log := newArrivalLog(client.name, client.arrivalTemplate, client.arrivalSize, client.arrivalPcrOnly, window)
+	client.arrivalLock.Lock()
+	client.arrivalPending = log
+	client.arrivalLock.Unlock()
+	util.StoreBool(&client.arrivalArmed, true)
+	logger.Logkv(
+		"event", eventClientArrivalLog,
+		"stream", client.name,
+		"path", log.path,
+		"message", fmt.Sprintf("Recording packet arrival times of stream %s", client.name),
+	)
+	return nil
+}
+
+// takeArrivalLog returns the arrival log that was armed since the last call, or nil.
+func (client *Client) takeArrivalLog() *arrivalLog {
+	client.arrivalLock.Lock()
+	defer client.arrivalLock.Unlock()
+	log := client.arrivalPending
+	client.arrivalPending = nil
+	return log
+}
+
+// SetOnDemand makes the client connect only when viewers arrive, and disconnect
+// after no viewers were connected for the idle timeout.
+// Also registers the client with its streamer, so it is woken up by new connections.
+// Must be called before Connect.
+func (client *Client) SetOnDemand(idle time.Duration, wait time.Duration) {
+	client.onDemand = true
+	client.idleTimeout = idle
+	client.idle = true
+	client.wake = make(chan struct{}, 1)
+	client.streamer.SetDemand(client, wait)
+}
+
+// Wake signals that an on-demand upstream is needed.
+// Cancels a pending idle disconnect. Has no effect if the client is not on-demand.
+func (client *Client) Wake() {
+	if !client.onDemand {
+		return
+	}
+	client.demandLock.Lock()
+	client.idle = false
+	client.demandLock.Unlock()
+	client.want()
+}
+
+// want marks an on-demand upstream as wanted and wakes up the connect loop.
+func (client *Client) want() {
+	client.demandLock.Lock()
+	wanted := client.wanted
+	client.wanted = true
+	if client.idleTimer != nil {
+		client.idleTimer.Stop()
+		client.idleTimer = nil
+	}
+	client.demandLock.Unlock()
+	if !wanted {
+		logger.Logkv(
+			"event", eventClientWake,
+			"stream", client.name,
+			"message", fmt.Sprintf("Connecting on-demand stream %s", client.name),
+		)
+	}
+	select {
+	case client.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Idle signals that no viewers are connected.
+// An on-demand upstream is disconnected when it stays idle for the idle timeout.
+func (client *Client) Idle() {
+	if !client.onDemand {
+		return
+	}
+	client.demandLock.Lock()
+	defer client.demandLock.Unlock()
+	client.idle = true
+	client.armIdleTimer()
+}
+
+// armIdleTimer starts the idle timer, unless it is already running or the upstream is held.
+// Must be called with demandLock held.
+func (client *Client) armIdleTimer() {
+	if client.idleTimer != nil || client.hold {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(client.idleTimeout, func() {
+		client.demandLock.Lock()
+		// a viewer may have arrived in the meantime
+		if client.idleTimer != timer {
+			client.demandLock.Unlock()
+			return
+		}
+		client.wanted = false
+		client.idleTimer = nil
+		client.demandLock.Unlock()
+		logger.Logkv(
+			"event", eventClientStandby,
+			"stream", client.name,
+			"message", fmt.Sprintf("No viewers, disconnecting on-demand stream %s", client.name),
+		)
+		client.Close()
+	})
+	client.idleTimer = timer
+}
+
+// SetHold keeps an on-demand upstream connected while hold is set, even without viewers.
+// When the hold is released and nobody is watching, the upstream is disconnected after
+// the idle timeout.
+func (client *Client) SetHold(hold bool) {
+	if !client.onDemand {
+		return
+	}
+	client.demandLock.Lock()
+	client.hold = hold
+	if hold {
+		client.demandLock.Unlock()
+		client.want()
+		return
+	}
+	if client.idle {
+		client.armIdleTimer()
+	}
+	client.demandLock.Unlock()
+}
+
+// SetSchedule holds an on-demand upstream connected during each window,
+// starting warmup before the window opens.
+// Windows that have already ended are ignored.
+// Must be called after SetOnDemand and before Connect.
+func (client *Client) SetSchedule(windows []ScheduleWindow, warmup time.Duration) {
+	client.schedule = windows
+	client.warmup = warmup
+}
+
+// runSchedule holds and releases the upstream according to the schedule,
+// until ctx is cancelled.
+func (client *Client) runSchedule(ctx context.Context) {
+	windows := make([]ScheduleWindow, len(client.schedule))
+	copy(windows, client.schedule)
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].Start.Before(windows[j].Start)
+	})
+	for _, window := range windows {
+		if time.Now().After(window.End) {
+			continue
+		}
+		if !sleepContext(ctx, time.Until(window.Start.Add(-client.warmup))) {
+			return
+		}
+		logger.Logkv(
+			"event", eventClientWarmup,
+			"stream", client.name,
+			"start", window.Start,
+			"message", fmt.Sprintf("Connecting on-demand stream %s for scheduled start at %s", client.name, window.Start),
+		)
+		client.SetHold(true)
+		if !sleepContext(ctx, time.Until(window.End)) {
+			return
+		}
+		client.SetHold(false)
+	}
+}
+
+// sleepContext waits for duration d.
+// Returns false if ctx was cancelled before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// OnDemandState returns "standby" if the client is on-demand and has no viewers,
+// "active" if it is on-demand and wanted, and the empty string if it isn't on-demand.
+func (client *Client) OnDemandState() string {
+	if !client.onDemand {
+		return ""
+	}
+	client.demandLock.Lock()
+	defer client.demandLock.Unlock()
+	if client.wanted {
+		return "active"
+	}
+	return "standby"
+}
+
+// waitForDemand blocks until an on-demand upstream is wanted.
+// Returns false if ctx was cancelled before.
+func (client *Client) waitForDemand(ctx context.Context) bool {
+	for {
+		client.demandLock.Lock()
+		wanted := client.wanted
+		client.demandLock.Unlock()
+		if wanted {
+			return true
+		}
+		select {
+		case <-client.wake:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// SetBatchSize combines size TS packets into a single slice before they are passed on
+// to the streamer, reducing the number of channel operations and writes at high bitrates.
+// Slow clients lose whole batches instead of single packets.
+// The input queue is shortened accordingly, so it holds about the same number of packets.
+// Must be called before Connect.
+func (client *Client) SetBatchSize(size uint) {
+	if size < 1 {
+		size = 1
+	}
+	client.batchSize = int(size)
+	client.streamer.SetBatchSize(size)
+}
+
+// SetSampleRate sets how often the packet summary is logged when sampling is enabled:
+// every packets packets or after interval has passed, whichever comes first.
+// If both are 0, a summary is logged every 10 seconds.
+// Must be called before Connect.
+func (client *Client) SetSampleRate(packets uint, interval time.Duration) {
+	client.samplePackets = packets
+	client.sampleInterval = interval
+}
+
+// SetSampling enables or disables the packet summary log.
+// It can be toggled at any time, the change takes effect with the next packet.
+func (client *Client) SetSampling(sampling bool) {
+	util.StoreBool(&client.sampling, sampling)
+}
+
+// SetPidStatistics enables or disables the per-PID packet counters in the stream statistics.
+// It can be toggled at any time, the change takes effect with the next packet.
+func (client *Client) SetPidStatistics(enable bool) {
+	util.StoreBool(&client.pidStatistics, enable)
+}
+
+// SetMaxAttempts gives up reconnecting after attempts rounds through all upstream URLs
+// without receiving any data. The stream is then marked dead until Revive is called.
+// 0 retries forever. Has no effect if reconnecting is disabled.
+// Must be called before Connect.
+func (client *Client) SetMaxAttempts(attempts uint) {
+	client.maxAttempts = attempts
+}
+
+// SetCircuitBreaker holds back reconnects after threshold failures in a row.
+// A failure is a connection attempt that ends without delivering any data,
+// no matter if it was refused right away or stalled after connecting.
+// The first cooldown lasts cooldown (DefaultBreakerCooldown if 0), and it doubles every
+// time the trial attempt after a cooldown fails as well, up to maxCooldown.
+// A threshold of 0 disables the breaker. The breaker has no effect if reconnecting
+// is disabled (Wait is 0) and the upstream isn't connected on demand, since there
+// are no further attempts to hold back.
+// Must be called before Connect.
+func (client *Client) SetCircuitBreaker(threshold uint, cooldown time.Duration, maxCooldown time.Duration) {
+	client.breaker = newCircuitBreaker(client.name, threshold, cooldown, maxCooldown)
+}
+
+// BreakerState returns the state of the circuit breaker: closed, open or half-open.
+// Returns the empty string if the breaker is disabled.
+func (client *Client) BreakerState() string {
+	if client.breaker == nil {
+		return ""
+	}
+	return client.breaker.State().String()
+}
+
+// SetPreroll buffers the first packets of each connection before the source is reported
+// connected and the packets are passed on to viewers, as a cushion against initial jitter.
+// 0 passes packets on as soon as they arrive.
+// Must be called before Connect.
+func (client *Client) SetPreroll(packets uint) {
+	client.preroll = int(packets)
+}
+
+// Buffering returns true while a new connection is filling its pre-roll.
+func (client *Client) Buffering() bool {
+	return util.LoadBool(&client.buffering)
+}
+
+// Dead returns true if the stream has given up reconnecting after too many failed attempts.
+func (client *Client) Dead() bool {
+	return util.LoadBool(&client.dead)
+}
+
+// Revive resumes reconnecting a dead stream, starting with the first upstream.
+// Returns false if the stream isn't dead.
+func (client *Client) Revive() bool {
+	if !util.LoadBool(&client.dead) {
+		return false
+	}
+	select {
+	case client.revive <- struct{}{}:
+	default:
+	}
+	return true
+}
+
 // SetInhibit calls the SetInhibit function on the attached streamer.
 func (client *Client) SetInhibit(inhibit bool) {
 	// delegate to the streamer
@@ -238,6 +856,8 @@ func (client *Client) SetInhibit(inhibit bool) {
 // This will cause the streaming thread to fail and try to reestablish
 // a connection (unless reconnects are disabled).
 func (client *Client) Close() error {
+	client.inputLock.Lock()
+	defer client.inputLock.Unlock()
 	if client.input != nil {
 		err := client.input.Close()
 		return err
@@ -245,15 +865,64 @@ func (client *Client) Close() error {
 	return ErrNoConnection
 }
 
+// onceCloser wraps a stream so it is closed only once.
+// Further calls to Close return the result of the first one.
+type onceCloser struct {
+	io.ReadCloser
+	once sync.Once
+	err  error
+}
+
+// Close closes the underlying stream, if it hasn't been closed yet.
+func (closer *onceCloser) Close() error {
+	closer.once.Do(func() {
+		closer.err = closer.ReadCloser.Close()
+	})
+	return closer.err
+}
+
+// setInput replaces the input stream and HTTP response.
+// The input stream is protected against double closing.
+func (client *Client) setInput(input io.ReadCloser, response *http.Response) {
+	client.inputLock.Lock()
+	defer client.inputLock.Unlock()
+	if input != nil {
+		input = &onceCloser{ReadCloser: input}
+	}
+	client.input = input
+	client.response = response
+}
+
+// getInput returns the current input stream, or nil if not connected.
+func (client *Client) getInput() io.ReadCloser {
+	client.inputLock.Lock()
+	defer client.inputLock.Unlock()
+	return client.input
+}
+
 // Connect spawns the connection loop.
 //
 // Do not call this method multiple times!
 func (client *Client) Connect() {
-	go client.loop()
+	client.ConnectContext(context.Background())
+}
+
+// ConnectContext spawns the connection loop, which runs until ctx is cancelled.
+// Cancelling ctx aborts connection attempts and reconnect delays,
+// and closes the active upstream connection.
+//
+// Do not call this method multiple times!
+func (client *Client) ConnectContext(ctx context.Context) {
+	if client.onDemand && len(client.schedule) > 0 {
+		go client.runSchedule(ctx)
+	}
+	go client.loop(ctx)
 }
 
 // StatusCode returns the HTTP status code, or 0 if not connected.
 func (client *Client) StatusCode() int {
+	client.inputLock.Lock()
+	defer client.inputLock.Unlock()
 	if client.response != nil {
 		return client.response.StatusCode
 	}
@@ -276,7 +945,16 @@ func (client *Client) Connected() bool {
 
 // loop tries to connect and loops until successful.
 // If client.Wait is 0, it only tries once.
-func (client *Client) loop() {
+// The loop ends when ctx is cancelled.
+func (client *Client) loop(ctx context.Context) {
+	// a spliced stream ends with the loop
+	defer func() {
+		if client.queue != nil {
+			close(client.queue)
+			client.queue = nil
+		}
+	}()
+
 	first := true
 
 	// deadline to avoid a busy loop, but still allow an immediate reconnect on loss
@@ -284,7 +962,13 @@ func (client *Client) loop() {
 
 	next := 0
 
-	for first || client.Wait != 0 {
+	// number of connection attempts without data since the last good connection
+	failures := uint(0)
+
+	for (first || client.Wait != 0 || client.onDemand) && ctx.Err() == nil {
+		if client.onDemand && !client.waitForDemand(ctx) {
+			break
+		}
 		if first {
 			// there is only one first attempt
 			first = false
@@ -299,7 +983,9 @@ func (client *Client) loop() {
 					"retry", wait.Seconds(),
 					"message", fmt.Sprintf("Retrying after %0.0f seconds.", wait.Seconds()),
 				)
-				time.Sleep(wait)
+				if !sleepContext(ctx, wait) {
+					break
+				}
 			}
 			// update the deadline
 			deadline = time.Now().Add(client.Wait)
@@ -309,12 +995,21 @@ func (client *Client) loop() {
 		nexturl := client.urls[next]
 		next = (next + 1) % len(client.urls)
 
+		// only the first attempt takes part in the startup ramp
+		limiter := client.connectLimiter
+		client.connectLimiter = nil
+
 		// connect
 		logger.Logkv(
 			"event", eventClientConnecting,
 			"url", nexturl.String(),
 		)
-		err := client.start(nexturl)
+		client.delivered = false
+		err := client.start(ctx, nexturl, limiter)
+		if ctx.Err() != nil {
+			// shutting down, errors are expected
+			break
+		}
 		if err != nil {
 			// not handled, log
 			logger.Logkv(
@@ -325,7 +1020,24 @@ func (client *Client) loop() {
 			)
 		}
 
-		if client.Wait == 0 {
+		if client.delivered {
+			failures = 0
+		} else {
+			failures++
+		}
+		if client.maxAttempts > 0 && failures >= client.maxAttempts*uint(len(client.urls)) && (client.Wait != 0 || client.onDemand) {
+			if !client.giveUp(ctx, failures) {
+				break
+			}
+			// start over with the first upstream, without delay
+			failures = 0
+			next = 0
+			deadline = time.Now()
+		} else if !client.cooldown(ctx, !client.delivered) {
+			break
+		}
+
+		if client.Wait == 0 && !client.onDemand {
 			logger.Logkv(
 				"event", eventClientOffline,
 				"url", nexturl.String(),
@@ -335,8 +1047,71 @@ func (client *Client) loop() {
 	}
 }
 
+// cooldown records the outcome of a connection attempt with the circuit breaker,
+// and waits if the breaker has opened.
+// Returns false if ctx was cancelled while waiting.
+func (client *Client) cooldown(ctx context.Context, failed bool) bool {
+	wasClosed := client.breaker.State() == breakerClosed
+	wait := client.breaker.record(failed)
+	if wait == 0 {
+		if !wasClosed {
+			logger.Logkv(
+				"event", eventClientBreakerClosed,
+				"stream", client.name,
+				"message", fmt.Sprintf("Upstream of %s has recovered", client.name),
+			)
+		}
+		return true
+	}
+	logger.Logkv(
+		"event", eventClientBreakerOpen,
+		"stream", client.name,
+		"cooldown", wait.Seconds(),
+		"message", fmt.Sprintf("Upstream of %s keeps failing, waiting %0.0f seconds before the next attempt", client.name, wait.Seconds()),
+	)
+	if !sleepContext(ctx, wait) {
+		return false
+	}
+	client.breaker.halfOpen()
+	return true
+}
+
+// giveUp marks the stream dead and waits until it is revived.
+// Returns false if ctx was cancelled before.
+func (client *Client) giveUp(ctx context.Context, failures uint) bool {
+	// discard a revive request that arrived while the stream was still alive
+	select {
+	case <-client.revive:
+	default:
+	}
+	util.StoreBool(&client.dead, true)
+	logger.Logkv(
+		"event", eventClientDead,
+		"stream", client.name,
+		"attempts", failures,
+		"message", fmt.Sprintf("Giving up on stream %s after %d failed connection attempts", client.name, failures),
+	)
+	if client.events != nil {
+		client.events.NotifyDead(client.name)
+	}
+	select {
+	case <-client.revive:
+	case <-ctx.Done():
+		return false
+	}
+	util.StoreBool(&client.dead, false)
+	logger.Logkv(
+		"event", eventClientRevive,
+		"stream", client.name,
+		"message", fmt.Sprintf("Reviving stream %s", client.name),
+	)
+	return true
+}
+
 // start connects the socket, sends the HTTP request and starts streaming.
-func (client *Client) start(urly *url.URL) error {
+// The connection attempt waits for limiter, if it is not nil.
+// If ctx is cancelled, the connection attempt is aborted or the connection is closed.
+func (client *Client) start(ctx context.Context, urly *url.URL, limiter *ConnectLimiter) error {
 	/*client.logger.Logkv(
 		"event", eventClientDebug,
 		"debug", map[string]interface{}{
@@ -344,172 +1119,368 @@ func (client *Client) start(urly *url.URL) error {
 		},
 		"urly": urly.String(),
 	)*/
-	if client.input == nil {
-		switch urly.Scheme {
-		// handled by os.Open
-		case "file":
+	if client.getInput() == nil {
+		if err := limiter.acquire(ctx); err != nil {
+			return err
+		}
+		err := client.open(ctx, urly)
+		limiter.release()
+		if err != nil {
+			return err
+		}
+
+		// close the connection when ctx is cancelled, which ends pull
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = client.Close()
+			case <-done:
+			}
+		}()
+		if client.dnsRefresh > 0 {
+			go client.watchDns(ctx, done, urly, client.remoteAddress)
+		}
+
+		if client.splicer != nil {
+			client.splicer.Switch()
+		}
+
+		// start streaming
+		util.StoreBool(&client.running, true)
+		logger.Logkv(
+			"event", eventClientPull,
+			"urly", urly.String(),
+			"message", fmt.Sprintf("Starting to pull stream %s.", urly),
+		)
+		err = client.pull(urly)
+		logger.Logkv(
+			"event", eventClientClosed,
+			"urly", urly.String(),
+			"message", fmt.Sprintf("Socket for stream %s closed", urly),
+		)
+
+		// cleanup
+		if err := client.Close(); err != nil {
 			logger.Logkv(
-				"event", eventClientOpenPath,
-				"path", urly.Path,
-				"message", fmt.Sprintf("Opening %s.", urly.Path),
+				"event", eventClientError,
+				"error", errorClientClose,
+				"message", err.Error(),
 			)
-			// prevent blocking on opening named pipes for reading.
-			//
-			// O_NONBLOCK is not portable, but should work at least on POSIX-compliant systems.
-			// we'd still need to reset back to blocking I/O once the file is open.
-			// O_RDWR without O_NONBLOCK will also work, according to POSIX semantics.
-			// since we never write to the pipe, this shouldn't cause problems.
-			// and non-POSIX systems probably don't support named pipes well anyway, so YMMV.
-			//
-			// see: https://pubs.opengroup.org/onlinepubs/007908799/xsh/open.html
-			// and: https://pubs.opengroup.org/onlinepubs/9699919799/functions/write.html
-			//file, err := os.OpenFile(urly.Path, syscall.O_RDONLY | syscall.O_NONBLOCK, 0666)
-			//syscall.SetNonblock(file.Fd(), false)
-			file, err := os.OpenFile(urly.Path, os.O_RDWR, 0666)
-			if err != nil {
-				return err
-			}
-			client.input = file
-		// both handled by http.Client
-		case "http":
-			fallthrough
-		case "https":
+		}
+		client.setInput(nil, nil)
+
+		return err
+	}
+	return ErrAlreadyConnected
+}
+
+// watchDns resolves the host name of urly every client.dnsRefresh,
+// until done is closed or ctx is cancelled.
+// remote is the address of the active connection, or the empty string if unknown.
+func (client *Client) watchDns(ctx context.Context, done <-chan struct{}, urly *url.URL, remote string) {
+	host := urly.Hostname()
+	if host == "" || net.ParseIP(host) != nil {
+		// nothing to resolve
+		return
+	}
+	previous, _ := client.lookupHost(ctx, host)
+	ticker := time.NewTicker(client.dnsRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		}
+		addresses, err := client.lookupHost(ctx, host)
+		if err != nil {
 			logger.Logkv(
-				"event", eventClientOpenHttp,
-				"urly", urly.String(),
-				"message", fmt.Sprintf("Connecting to %s.", urly),
+				"event", eventClientError,
+				"error", errorClientDnsLookup,
+				"host", host,
+				"message", fmt.Sprintf("Cannot resolve %s: %v", host, err),
 			)
-			request, err := http.NewRequest("GET", urly.String(), nil)
-			if err != nil {
-				return err
-			}
-			response, err := client.getter.Do(request)
-			if err != nil {
-				return err
-			}
-			client.response = response
-			client.input = response.Body
-		// handled directly by net.Dialer
-		case "tcp":
+			continue
+		}
+		if sameAddresses(previous, addresses) {
+			continue
+		}
+		logger.Logkv(
+			"event", eventClientDnsChange,
+			"host", host,
+			"previous", previous,
+			"addresses", addresses,
+			"message", fmt.Sprintf("Addresses of %s changed from %v to %v", host, previous, addresses),
+		)
+		previous = addresses
+		if client.dnsReconnect && !containsAddress(addresses, remote) {
 			logger.Logkv(
-				"event", eventClientOpenTcp,
-				"host", urly.Host,
-				"message", fmt.Sprintf("Connecting TCP socket to %s.", urly.Host),
+				"event", eventClientDnsReconnect,
+				"host", host,
+				"remote", remote,
+				"message", fmt.Sprintf("Reconnecting to %s, %s is no longer in DNS", host, remote),
 			)
-			conn, err := client.connector.Dial(urly.Scheme, urly.Host)
+			_ = client.Close()
+			return
+		}
+	}
+}
+
+// sameAddresses returns true if a and b contain the same addresses, in any order.
+func sameAddresses(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sorted := make([]string, len(a))
+	copy(sorted, a)
+	sort.Strings(sorted)
+	for _, address := range b {
+		if i := sort.SearchStrings(sorted, address); i >= len(sorted) || sorted[i] != address {
+			return false
+		}
+	}
+	return true
+}
+
+// containsAddress returns true if the IP address remote is in addresses.
+// An empty remote is never contained.
+func containsAddress(addresses []string, remote string) bool {
+	ip := net.ParseIP(remote)
+	if ip == nil {
+		return false
+	}
+	for _, address := range addresses {
+		if ip.Equal(net.ParseIP(address)) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIp returns the IP address of a network address, or the empty string if it has none.
+func remoteIp(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// open connects to an upstream and sets it as the input.
+// ctx cancels the connection attempt, where the protocol supports it.
+func (client *Client) open(ctx context.Context, urly *url.URL) error {
+	client.remoteAddress = ""
+	switch urly.Scheme {
+	// handled by os.Open
+	case "file":
+		logger.Logkv(
+			"event", eventClientOpenPath,
+			"path", urly.Path,
+			"message", fmt.Sprintf("Opening %s.", urly.Path),
+		)
+		// prevent blocking on opening named pipes for reading.
+		//
+		// O_NONBLOCK is not portable, but should work at least on POSIX-compliant systems.
+		// we'd still need to reset back to blocking I/O once the file is open.
+		// O_RDWR without O_NONBLOCK will also work, according to POSIX semantics.
+		// since we never write to the pipe, this shouldn't cause problems.
+		// and non-POSIX systems probably don't support named pipes well anyway, so YMMV.
+		//
+		// see: https://pubs.opengroup.org/onlinepubs/007908799/xsh/open.html
+		// and: https://pubs.opengroup.org/onlinepubs/9699919799/functions/write.html
+		//file, err := os.OpenFile(urly.Path, syscall.O_RDONLY | syscall.O_NONBLOCK, 0666)
+		//syscall.SetNonblock(file.Fd(), false)
+		file, err := os.OpenFile(urly.Path, os.O_RDWR, 0666)
+		if err != nil {
+			return err
+		}
+		client.setInput(file, nil)
+	// both handled by http.Client
+	case "http":
+		fallthrough
+	case "https":
+		logger.Logkv(
+			"event", eventClientOpenHttp,
+			"urly", urly.String(),
+			"message", fmt.Sprintf("Connecting to %s.", urly),
+		)
+		// remember which address we're connected to
+		var remote net.Addr
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				remote = info.Conn.RemoteAddr()
+			},
+		}
+		request, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), "GET", urly.String(), nil)
+		if err != nil {
+			return err
+		}
+		response, err := client.getter.Do(request)
+		if err != nil {
+			return err
+		}
+		if remote != nil {
+			client.remoteAddress = remoteIp(remote)
+		}
+		body, err := decodeBody(response)
+		if err != nil {
+			_ = response.Body.Close()
+			return err
+		}
+		client.setInput(body, response)
+	// handled directly by net.Dialer
+	case "tcp":
+		logger.Logkv(
+			"event", eventClientOpenTcp,
+			"host", urly.Host,
+			"message", fmt.Sprintf("Connecting TCP socket to %s.", urly.Host),
+		)
+		conn, err := client.connector.DialContext(ctx, urly.Scheme, urly.Host)
+		if err != nil {
+			return err
+		}
+		client.remoteAddress = remoteIp(conn.RemoteAddr())
+		client.setInput(conn, nil)
+	// handled by net.Dialer too, but different URL semantics
+	case "unix":
+		fallthrough
+	case "unixgram":
+		fallthrough
+	case "unixpacket":
+		logger.Logkv(
+			"event", eventClientOpenDomain,
+			"path", urly.Path,
+			"message", fmt.Sprintf("Connecting domain socket to %s.", urly.Path),
+		)
+		conn, err := client.connector.DialContext(ctx, urly.Scheme, urly.Path)
+		if err != nil {
+			return err
+		}
+		client.setInput(conn, nil)
+	case "udp":
+		addr, err := net.ResolveUDPAddr("udp", urly.Host)
+		if err != nil {
+			return err
+		}
+		var conn *net.UDPConn
+		if addr.IP.IsMulticast() {
+			interf, err := multicastInterface(addr, client.interf)
 			if err != nil {
 				return err
 			}
-			client.input = conn
-		// handled by net.Dialer too, but different URL semantics
-		case "unix":
-			fallthrough
-		case "unixgram":
-			fallthrough
-		case "unixpacket":
 			logger.Logkv(
-				"event", eventClientOpenDomain,
-				"path", urly.Path,
-				"message", fmt.Sprintf("Connecting domain socket to %s.", urly.Path),
+				"event", eventClientOpenUdpMulticast,
+				"address", addr,
+				"message", fmt.Sprintf("Joining UDP multicast group %s on interface %v.", urly.Host, interf),
 			)
-			conn, err := client.connector.Dial(urly.Scheme, urly.Path)
+			conn, err = net.ListenMulticastUDP("udp", interf, addr)
 			if err != nil {
 				return err
 			}
-			client.input = conn
-		case "udp":
-			addr, err := net.ResolveUDPAddr("udp", urly.Host)
+		} else {
+			logger.Logkv(
+				"event", eventClientOpenUdp,
+				"address", addr,
+				"message", fmt.Sprintf("Connecting to UDP address %s.", addr),
+			)
+			var err error
+			conn, err = net.ListenUDP("udp", addr)
 			if err != nil {
 				return err
 			}
-			var conn *net.UDPConn
-			if addr.IP.IsMulticast() {
-				logger.Logkv(
-					"event", eventClientOpenUdpMulticast,
-					"address", addr,
-					"message", fmt.Sprintf("Joining UDP multicast group %s on interface %v.", urly.Host, client.interf),
-				)
-				var err error
-				conn, err = net.ListenMulticastUDP("udp", client.interf, addr)
-				if err != nil {
-					return err
-				}
-			} else {
-				logger.Logkv(
-					"event", eventClientOpenUdp,
-					"address", addr,
-					"message", fmt.Sprintf("Connecting to UDP address %s.", addr),
-				)
-				var err error
-				conn, err = net.ListenUDP("udp", addr)
-				if err != nil {
-					return err
-				}
-			}
-			if err := conn.SetReadBuffer(client.readBufferSize); err != nil {
+		}
+		if err := conn.SetReadBuffer(client.readBufferSize); err != nil {
+			logger.Logkv(
+				"event", eventClientError,
+				"error", errorClientSetBufferSize,
+				"address", addr,
+				"message", fmt.Sprintf("Error setting read buffer size: %v (ignored)", err),
+			)
+		}
+		// parallel readers put RTP packets back in order, so they need to see the headers
+		var datagrams io.Reader = conn
+		if client.udpReaders > 1 {
+			datagrams = protocol.NewParallelReader(conn, client.packetSize, client.udpReaders)
+		}
+		// datagrams may carry bare TS packets or RTP, find out which
+		formatReader := protocol.NewFormatReader(datagrams, func(format protocol.InputFormat) {
+			logger.Logkv(
+				"event", eventClientInputFormat,
+				"address", addr,
+				"format", format.String(),
+				"message", fmt.Sprintf("Detected %s input on UDP address %s.", format, addr),
+			)
+			if client.udpReaders > 1 && format != protocol.InputFormatRtp {
 				logger.Logkv(
 					"event", eventClientError,
-					"error", errorClientSetBufferSize,
+					"error", errorClientUnordered,
 					"address", addr,
-					"message", fmt.Sprintf("Error setting read buffer size: %v (ignored)", err),
+					"message", fmt.Sprintf("Parallel readers can't restore the order of %s input on UDP address %s, packets may be swapped.", format, addr),
 				)
 			}
-			client.input = protocol.NewFixedReader(conn, client.packetSize)
-		case "fork":
-			command := urly.Hostname()
-			arguments, err := url.QueryUnescape(urly.RawQuery)
-			if err != nil {
-				return err
-			}
-			logger.Logkv(
-				"event", eventClientOpenFork,
-				"command", command,
-				"arguments", arguments,
-				"message", fmt.Sprintf("Executing command source: %s %s", command, arguments),
-			)
-			// FIXME This assumes none of the command line arguments contain spaces.
-			// To support arbitrary command lines and, in particular, shell commands, we need to find a different way
-			// to separate individual arguments. For example, we could use a query list with the arguments as
-			// keys and empty values. Or, we could simply use a "arg" key and specify it multiple times.
-			// url.Values object is a multimap, after all.
-			arglist := strings.Split(arguments, " ")
-			cmd, err := protocol.NewForkReader(command, arglist)
-			if err != nil {
-				return err
-			}
-			client.input = cmd
-		default:
-			return ErrInvalidProtocol
+		})
+		client.setInput(protocol.NewFixedReader(formatReader, client.packetSize), nil)
+	// handled by the RTMP client, if compiled in
+	case "rtmp":
+		logger.Logkv(
+			"event", eventClientOpenRtmp,
+			"url", urly.String(),
+			"message", fmt.Sprintf("Connecting to RTMP server %s.", urly.Host),
+		)
+		conn, err := protocol.NewRtmpReader(ctx, urly, client.connector, client.connector.Timeout)
+		if err != nil {
+			return err
 		}
-
-		// start streaming
-		util.StoreBool(&client.running, true)
+		client.setInput(conn, nil)
+	// a list of local files, played in a loop
+	case "playlist":
+		shuffle, _ := strconv.ParseBool(urly.Query().Get("shuffle"))
 		logger.Logkv(
-			"event", eventClientPull,
-			"urly", urly.String(),
-			"message", fmt.Sprintf("Starting to pull stream %s.", urly),
+			"event", eventClientOpenPlaylist,
+			"path", urly.Path,
+			"shuffle", shuffle,
+			"message", fmt.Sprintf("Playing files from %s.", urly.Path),
 		)
-		err := client.pull(urly)
+		files, err := protocol.ParsePlaylist(urly.Path)
+		if err != nil {
+			return err
+		}
+		playlist, err := protocol.NewPlaylistReader(files, shuffle)
+		if err != nil {
+			return err
+		}
+		client.setInput(playlist, nil)
+	case "fork":
+		command := urly.Hostname()
+		arguments, err := url.QueryUnescape(urly.RawQuery)
+		if err != nil {
+			return err
+		}
 		logger.Logkv(
-			"event", eventClientClosed,
-			"urly", urly.String(),
-			"message", fmt.Sprintf("Socket for stream %s closed", urly),
+			"event", eventClientOpenFork,
+			"command", command,
+			"arguments", arguments,
+			"message", fmt.Sprintf("Executing command source: %s %s", command, arguments),
 		)
-
-		// cleanup
-		if err := client.Close(); err != nil {
-			logger.Logkv(
-				"event", eventClientError,
-				"error", errorClientClose,
-				"message", err.Error(),
-			)
+		// FIXME This assumes none of the command line arguments contain spaces.
+		// To support arbitrary command lines and, in particular, shell commands, we need to find a different way
+		// to separate individual arguments. For example, we could use a query list with the arguments as
+		// keys and empty values. Or, we could simply use a "arg" key and specify it multiple times.
+		// url.Values object is a multimap, after all.
+		arglist := strings.Split(arguments, " ")
+		cmd, err := protocol.NewForkReader(command, arglist)
+		if err != nil {
+			return err
 		}
-		client.input = nil
-		client.response = nil
-
-		return err
+		client.setInput(cmd, nil)
+	default:
+		return ErrInvalidProtocol
 	}
-	return ErrAlreadyConnected
+	return nil
 }
 
 // pull streams data from the socket into the queue.
@@ -520,6 +1491,27 @@ func (client *Client) pull(url *url.URL) error {
 	var queue chan protocol.MpegTsPacket
 	// save a few bytes
 	var packet protocol.MpegTsPacket
+	// the debug sampler is created when sampling is enabled and kept until the connection is gone
+	var sampler *packetSampler
+	// the batch that is currently being filled
+	var batch protocol.MpegTsPacket
+	// the arrival log that is recording, if armed
+	var arrivals *arrivalLog
+	// the packets that are held back until the pre-roll is complete
+	var prerolled []protocol.MpegTsPacket
+
+	// input is only replaced by this goroutine, so it is safe to keep a reference
+	input := client.getInput()
+	// packets are read from the buffer, but the read timeout must close the input itself
+	var reader io.Reader = input
+	if client.readChunk > 0 && bufferedScheme(url.Scheme) {
+		reader = bufio.NewReaderSize(input, client.readChunk)
+	}
+	if client.loss != nil {
+		reader = protocol.NewLossyReader(reader, client.loss)
+	}
+	// metric labels of this connection
+	labels := prometheus.Labels{"stream": client.name, "url": client.urlLabels.Label(url)}
 
 	for util.LoadBool(&client.running) {
 		// somewhat hacky read timeout:
@@ -528,12 +1520,14 @@ func (client *Client) pull(url *url.URL) error {
 		// deadlines on reads or writes.
 		var timer *time.Timer
 		if client.ReadTimeout > 0 {
+			// only close the stream this timer was armed for,
+			// never one that was opened by a reconnect in the meantime
 			timer = time.AfterFunc(client.ReadTimeout, func() {
 				logger.Logkv(
 					"event", eventClientReadTimeout,
 					"message", "Read timeout exceeded, closing connection",
 				)
-				if err := client.input.Close(); err != nil {
+				if err := input.Close(); err != nil {
 					logger.Logkv(
 						"event", eventClientError,
 						"error", errorClientClose,
@@ -543,8 +1537,8 @@ func (client *Client) pull(url *url.URL) error {
 			})
 		}
 		// read a packet
-		//log.Printf("Reading a packet from %p\n", client.input)
-		packet, err = protocol.ReadMpegTsPacket(client.input)
+		//log.Printf("Reading a packet from %p\n", input)
+		packet, err = protocol.ReadMpegTsPacket(reader)
 		// we got a packet, stop the timer and drain it
 		if timer != nil && !timer.Stop() {
 			logger.Logkv(
@@ -567,36 +1561,122 @@ func (client *Client) pull(url *url.URL) error {
 			util.StoreBool(&client.running, false)
 		} else {
 			if packet != nil {
+				if util.LoadBool(&client.arrivalArmed) {
+					if armed := client.takeArrivalLog(); armed != nil {
+						arrivals = armed
+					}
+					if arrivals != nil && arrivals.Add(packet) {
+						go arrivals.Dump()
+						util.StoreBool(&client.arrivalArmed, false)
+						// a log that was armed in the meantime starts with the next packet
+						arrivals = client.takeArrivalLog()
+						if arrivals != nil {
+							util.StoreBool(&client.arrivalArmed, true)
+						}
+					}
+				}
+
+				// report the packet
+				client.stats.PacketReceived()
+				if util.LoadBool(&client.pidStatistics) {
+					client.stats.PidReceived(protocol.MpegTsPacketPid(packet))
+				}
+				if client.promCounter {
+					metricPacketsReceived.With(labels).Inc()
+					metricBytesReceived.With(labels).Add(protocol.MpegTsPacketSize)
+				}
+
+				if util.LoadBool(&client.sampling) {
+					if sampler == nil {
+						sampler = newPacketSampler(url.String(), client.samplePackets, client.sampleInterval)
+					}
+					sampler.Sample(packet)
+				} else {
+					sampler = nil
+				}
+				packets := []protocol.MpegTsPacket{packet}
+				// hold back the first packets until the pre-roll is complete
+				if queue == nil && client.preroll > 0 {
+					if len(prerolled) == 0 {
+						util.StoreBool(&client.buffering, true)
+						logger.Logkv(
+							"event", eventClientBuffering,
+							"url", url.String(),
+							"preroll", client.preroll,
+							"message", fmt.Sprintf("Buffering %d packets before starting", client.preroll),
+						)
+					}
+					prerolled = append(prerolled, packet)
+					if len(prerolled) < client.preroll {
+						continue
+					}
+					packets = prerolled
+					prerolled = nil
+					util.StoreBool(&client.buffering, false)
+				}
+
 				// report connection up
 				if queue == nil {
+					client.delivered = true
 					client.stats.SourceConnected()
-					metricSourceConnected.With(prometheus.Labels{"stream": client.name, "url": url.String()}).Set(1.0)
+					metricSourceConnected.With(labels).Set(1.0)
+					if client.events != nil {
+						client.events.NotifySource(client.name, sanitizeUrl(url), true)
+					}
 					logger.Logkv(
 						"event", eventClientStarted,
 						"url", url.String(),
 					)
-					queue = make(chan protocol.MpegTsPacket, client.queueSize)
-					go func() {
-						if err := client.streamer.Stream(queue); err != nil {
-							logger.Logkv(
-								"event", eventClientError,
-								"error", errorClientStream,
-								"message", err.Error(),
-							)
+					// a spliced stream continues on the queue of the previous connection
+					queue = client.queue
+					if queue == nil {
+						queue = make(chan protocol.MpegTsPacket, batchedQueueSize(int(client.queueSize), client.batchSize))
+						go func(queue chan protocol.MpegTsPacket) {
+							if err := client.streamer.Stream(queue); err != nil {
+								logger.Logkv(
+									"event", eventClientError,
+									"error", errorClientStream,
+									"message", err.Error(),
+								)
+							}
+						}(queue)
+						if client.splicer != nil {
+							client.queue = queue
 						}
-					}()
+					}
 				}
 
-				// report the packet
-				client.stats.PacketReceived()
-				if client.promCounter {
-					metricPacketsReceived.With(prometheus.Labels{"stream": client.name, "url": url.String()}).Inc()
-					metricBytesReceived.With(prometheus.Labels{"stream": client.name, "url": url.String()}).Add(protocol.MpegTsPacketSize)
+				if client.splicer != nil {
+					var spliced []protocol.MpegTsPacket
+					for _, packet := range packets {
+						spliced = append(spliced, client.splicer.Push(packet)...)
+					}
+					packets = spliced
+				}
+				for _, packet := range packets {
+					if client.filterNull(packet) {
+						continue
+					}
+					if client.batchSize > 1 {
+						if batch == nil {
+							batch = make(protocol.MpegTsPacket, 0, client.batchSize*protocol.MpegTsPacketSize)
+						}
+						batch = append(batch, packet...)
+						if len(batch) == cap(batch) {
+							if !client.send(queue, batch) {
+								err = ErrStreamStalled
+								break
+							}
+							batch = nil
+						}
+					} else if !client.send(queue, packet) {
+						err = ErrStreamStalled
+						break
+					}
+				}
+				if err == ErrStreamStalled {
+					client.stalled(url)
 				}
-
-				//log.Printf("Got a packet (length %d):\n%s\n", len(packet), hex.Dump(packet))
-				//log.Printf("Got a packet (length %d)\n", len(packet))
-				queue <- packet
 			} else {
 				logger.Logkv(
 					"event", eventClientNoPacket,
@@ -607,16 +1687,42 @@ func (client *Client) pull(url *url.URL) error {
 		}
 	}
 
+	// an incomplete pre-roll is discarded
+	util.StoreBool(&client.buffering, false)
+
+	// a recording arrival log continues on the next connection, unless it was replaced
+	if arrivals != nil {
+		client.arrivalLock.Lock()
+		if client.arrivalPending == nil {
+			client.arrivalPending = arrivals
+		}
+		client.arrivalLock.Unlock()
+	}
+
 	// and the connection is gone
 	if queue != nil {
-		logger.Logkv(
-			"event", eventClientTimerKill,
-			"url", url.String(),
-			"message", fmt.Sprintf("Killing queue on %s", url),
-		)
-		close(queue)
+		// pass on the rest of the last batch, unless nobody is taking it
+		if len(batch) > 0 && err != ErrStreamStalled && !client.send(queue, batch) {
+			err = ErrStreamStalled
+			client.stalled(url)
+		}
+		if err == ErrStreamStalled && client.splicer != nil {
+			// the next connection must start a new stream loop
+			close(queue)
+			client.queue = nil
+		} else if client.splicer == nil {
+			logger.Logkv(
+				"event", eventClientTimerKill,
+				"url", url.String(),
+				"message", fmt.Sprintf("Killing queue on %s", url),
+			)
+			close(queue)
+		}
 		client.stats.SourceDisconnected()
-		metricSourceConnected.With(prometheus.Labels{"stream": client.name, "url": url.String()}).Set(0.0)
+		metricSourceConnected.With(labels).Set(0.0)
+		if client.events != nil {
+			client.events.NotifySource(client.name, sanitizeUrl(url), false)
+		}
 		logger.Logkv(
 			"event", eventClientStopped,
 			"url", url.String(),
@@ -625,3 +1731,93 @@ func (client *Client) pull(url *url.URL) error {
 
 	return err
 }
+
+// bufferedScheme returns true if inputs with an URL scheme may be read through a buffer.
+// Datagram sockets must be read with a buffer of at least one datagram, or data is lost,
+// and playlists are paced by their own reader.
+func bufferedScheme(scheme string) bool {
+	switch scheme {
+	case "udp", "unixgram", "unixpacket", "playlist":
+		return false
+	default:
+		return true
+	}
+}
+
+// send passes a packet to the stream loop.
+// It returns false if the watchdog is enabled and the loop didn't take the packet in time.
+func (client *Client) send(queue chan<- protocol.MpegTsPacket, packet protocol.MpegTsPacket) bool {
+	// fast path, the queue isn't full
+	select {
+	case queue <- packet:
+		return true
+	default:
+	}
+	if client.watchdog <= 0 {
+		queue <- packet
+		return true
+	}
+	timer := time.NewTimer(client.watchdog)
+	defer timer.Stop()
+	select {
+	case queue <- packet:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// stalled abandons a stream loop that has stopped taking packets, so a new one can take over.
+func (client *Client) stalled(urly *url.URL) {
+	logger.Logkv(
+		"event", eventClientError,
+		"error", errorClientStalled,
+		"url", urly.String(),
+		"timeout", client.watchdog,
+		"message", fmt.Sprintf("Stream loop has not taken a packet for %v, restarting it", client.watchdog),
+	)
+	metricWatchdogStalls.With(prometheus.Labels{"stream": client.name}).Inc()
+	client.streamer.abandon()
+	util.StoreBool(&client.running, false)
+}
+
+// escapeZone percent-encodes the zone identifier of a bracketed IPv6 host,
+// so link-local addresses like udp://[ff02::1%eth0]:5000 can be written
+// without the %25 escape that url.Parse requires.
+// URLs that are already escaped are returned unchanged.
+func escapeZone(uri string) string {
+	// only look at the authority part of the URL
+	authority := strings.Index(uri, "://")
+	if authority < 0 {
+		return uri
+	}
+	authority += 3
+	host := uri[authority:]
+	if end := strings.IndexAny(host, "/?#"); end >= 0 {
+		host = host[:end]
+	}
+	start := strings.Index(host, "[")
+	end := strings.Index(host, "]")
+	if start < 0 || end < start {
+		return uri
+	}
+	zone := strings.Index(host[start:end], "%")
+	if zone < 0 || strings.HasPrefix(host[start+zone:], "%25") {
+		return uri
+	}
+	zone += authority + start
+	return uri[:zone] + "%25" + uri[zone+1:]
+}
+
+// multicastInterface returns the interface to join a multicast group on.
+// The zone of a link-local IPv6 group takes precedence over the configured interface.
+// Zones can be either interface names or numeric indexes.
+func multicastInterface(addr *net.UDPAddr, interf *net.Interface) (*net.Interface, error) {
+	if addr.Zone == "" {
+		return interf, nil
+	}
+	if index, err := strconv.Atoi(addr.Zone); err == nil {
+		return net.InterfaceByIndex(index)
+	}
+	return net.InterfaceByName(addr.Zone)
+}
@@ -0,0 +1,874 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/onitake/restreamer/auth"
+	"github.com/onitake/restreamer/configuration"
+	"github.com/onitake/restreamer/protocol"
+	"github.com/onitake/restreamer/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// packetWithPid creates an empty TS packet with the given PID.
+func packetWithPid(pid uint16) protocol.MpegTsPacket {
+	packet := make(protocol.MpegTsPacket, protocol.MpegTsPacketSize)
+	packet[0] = protocol.MpegTsSyncByte
+	packet[1] = byte(pid >> 8)
+	packet[2] = byte(pid)
+	return packet
+}
+
+func TestClientNullPacketFilter(t *testing.T) {
+	client, err := NewClient("test", []string{"file:///dev/null"}, nil, 0, 0, 0, 1, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	null := packetWithPid(protocol.MpegTsPidNull)
+	data := packetWithPid(0x100)
+	if client.filterNull(null) {
+		t.Error("Null packet dropped with disabled filter")
+	}
+
+	client.SetNullPacketFilter(true, 0)
+	if !client.filterNull(null) {
+		t.Error("Null packet not dropped")
+	}
+	if client.filterNull(data) {
+		t.Error("Data packet dropped")
+	}
+
+	client.SetNullPacketFilter(true, 3)
+	client.nullCount = 0
+	passed := 0
+	for i := 0; i < 9; i++ {
+		if !client.filterNull(null) {
+			passed++
+		}
+	}
+	if passed != 3 {
+		t.Errorf("Passed %d null packets, expected 3", passed)
+	}
+}
+
+// countingCloser counts how many times it was closed.
+type countingCloser struct {
+	closed int
+}
+
+func (closer *countingCloser) Read(p []byte) (int, error) {
+	return 0, errors.New("not readable")
+}
+
+func (closer *countingCloser) Close() error {
+	closer.closed++
+	return nil
+}
+
+func TestClientReadTimeoutReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// each upstream connection sends a single packet and stalls
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write(packetWithPid(0x100))
+			conns <- conn
+		}
+	}()
+
+	streamer := NewStreamer("test", 10, NewAccessController(0), nil)
+	client, err := NewClient("test", []string{"tcp://" + listener.Addr().String()}, streamer, 1, 0, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.ReadTimeout = 50 * time.Millisecond
+	upstream, _ := url.Parse("tcp://" + listener.Addr().String())
+
+	// reconnect rapidly, every connection must be ended by its own read timeout
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		if err := client.start(context.Background(), upstream, nil); err == nil {
+			t.Errorf("Connection %d: stalled connection ended without error", i)
+		}
+		if elapsed := time.Since(start); elapsed < client.ReadTimeout {
+			t.Errorf("Connection %d: closed after %v, before the read timeout", i, elapsed)
+		}
+		if client.getInput() != nil {
+			t.Errorf("Connection %d: input was not reset", i)
+		}
+		select {
+		case conn := <-conns:
+			conn.Close()
+		case <-time.After(time.Second):
+			t.Fatalf("Connection %d: upstream connection not established", i)
+		}
+	}
+
+	closer := &countingCloser{}
+	client.setInput(closer, nil)
+	_ = client.getInput().Close()
+	_ = client.Close()
+	if closer.closed != 1 {
+		t.Errorf("Input was closed %d times", closer.closed)
+	}
+	client.setInput(nil, nil)
+}
+
+func TestClientReadChunk(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// the upstream sends a few packets at once and stalls
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var data []byte
+		for i := 0; i < 5; i++ {
+			data = append(data, packetWithPid(0x100)...)
+		}
+		_, _ = conn.Write(data)
+		time.Sleep(5 * time.Second)
+	}()
+
+	streamer := NewStreamer("chunk", 10, NewAccessController(0), nil)
+	sink := make(chan protocol.MpegTsPacket, 10)
+	streamer.AddSink(sink)
+	client, err := NewClient("chunk", []string{"tcp://" + listener.Addr().String()}, streamer, 1, 0, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadChunk(4096)
+	client.ReadTimeout = 50 * time.Millisecond
+	upstream, _ := url.Parse("tcp://" + listener.Addr().String())
+
+	// the read timeout must still end the stalled connection through the buffer
+	done := make(chan error)
+	go func() {
+		done <- client.start(context.Background(), upstream, nil)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Stalled connection was not closed by the read timeout")
+	}
+	if len(sink) != 5 {
+		t.Errorf("Got %d packets, expected 5", len(sink))
+	}
+}
+
+func TestClientIpv6Urls(t *testing.T) {
+	tests := []struct {
+		uri  string
+		host string
+		zone string
+	}{
+		{"tcp://[::1]:5000", "[::1]:5000", ""},
+		{"http://[2001:db8::1]:8080/stream.ts", "[2001:db8::1]:8080", ""},
+		{"udp://[ff02::1%lo]:5000", "[ff02::1%lo]:5000", "lo"},
+		{"udp://[ff02::1%25lo]:5000", "[ff02::1%lo]:5000", "lo"},
+		{"udp://[ff02::1%1]:5000", "[ff02::1%1]:5000", "1"},
+	}
+	for i, test := range tests {
+		client, err := NewClient("test", []string{test.uri}, nil, 0, 0, 0, 1, "", 1, 1500)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if client.urls[0].Host != test.host {
+			t.Errorf("Test %d: got host %s, expected %s", i, client.urls[0].Host, test.host)
+		}
+		addr, err := net.ResolveUDPAddr("udp", client.urls[0].Host)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if addr.Zone != test.zone {
+			t.Errorf("Test %d: got zone %s, expected %s", i, addr.Zone, test.zone)
+		}
+	}
+
+	if escapeZone("fork://ffmpeg?-i%20[a%20b]") != "fork://ffmpeg?-i%20[a%20b]" {
+		t.Error("Zone escaping modified the query string")
+	}
+
+	loopback, err := net.InterfaceByIndex(1)
+	if err != nil {
+		t.Skip("No interface with index 1")
+	}
+	for _, zone := range []string{"1", loopback.Name} {
+		interf, err := multicastInterface(&net.UDPAddr{IP: net.ParseIP("ff02::1"), Zone: zone}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if interf.Index != 1 {
+			t.Errorf("Zone %s resolved to interface %d", zone, interf.Index)
+		}
+	}
+	interf, err := multicastInterface(&net.UDPAddr{IP: net.ParseIP("239.0.0.1")}, loopback)
+	if err != nil || interf != loopback {
+		t.Error("Configured interface not used for group without zone")
+	}
+}
+
+// newPacketServer starts a TCP server that sends packets on each connection until it is closed.
+// Connects and disconnects are signalled on the returned channels.
+func newPacketServer(t *testing.T) (net.Listener, chan bool, chan bool) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan bool, 10)
+	closed := make(chan bool, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- true
+			go func() {
+				for {
+					if _, err := conn.Write(packetWithPid(0x100)); err != nil {
+						closed <- true
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+	}()
+	return listener, accepted, closed
+}
+
+func TestClientOnDemand(t *testing.T) {
+	listener, accepted, closed := newPacketServer(t)
+	defer listener.Close()
+
+	streamer := NewStreamer("ondemand", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetNotifier(&countingNotifier{})
+	client, err := NewClient("ondemand", []string{"tcp://" + listener.Addr().String()}, streamer, 1, 0, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetOnDemand(50*time.Millisecond, time.Second)
+	client.Connect()
+
+	select {
+	case <-accepted:
+		t.Fatal("On-demand upstream connected without viewers")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if client.OnDemandState() != "standby" {
+		t.Errorf("Got state %s without viewers, expected standby", client.OnDemandState())
+	}
+
+	// a viewer arrives and receives data
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	served := make(chan bool)
+	go func() {
+		streamer.ServeHTTP(writer, httptest.NewRequest("GET", "/ondemand.ts", nil).WithContext(ctx))
+		served <- true
+	}()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("On-demand upstream not connected by viewer")
+	}
+	if client.OnDemandState() != "active" {
+		t.Errorf("Got state %s with a viewer, expected active", client.OnDemandState())
+	}
+
+	// the viewer leaves, the upstream is disconnected after the idle timeout
+	for atomic.LoadInt32(&writer.flushes) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-served
+	if writer.Code != http.StatusOK {
+		t.Errorf("Viewer got status %d, expected 200", writer.Code)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("On-demand upstream not disconnected after the idle timeout")
+	}
+	if client.OnDemandState() != "standby" {
+		t.Errorf("Got state %s after the idle timeout, expected standby", client.OnDemandState())
+	}
+}
+
+func TestClientOnDemandSchedule(t *testing.T) {
+	listener, accepted, closed := newPacketServer(t)
+	defer listener.Close()
+
+	streamer := NewStreamer("schedule", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetNotifier(&countingNotifier{})
+	client, err := NewClient("schedule", []string{"tcp://" + listener.Addr().String()}, streamer, 1, 0, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetOnDemand(10*time.Millisecond, time.Second)
+	start := time.Now().Add(200 * time.Millisecond)
+	end := start.Add(100 * time.Millisecond)
+	client.SetSchedule([]ScheduleWindow{
+		// already over
+		{Start: time.Now().Add(-time.Hour), End: time.Now().Add(-time.Minute)},
+		{Start: start, End: end},
+	}, 100*time.Millisecond)
+	client.Connect()
+
+	select {
+	case <-accepted:
+		if now := time.Now(); now.Before(start.Add(-150*time.Millisecond)) || now.After(start) {
+			t.Errorf("Upstream connected %v before the scheduled start, expected 100ms", start.Sub(now))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Upstream not connected before the scheduled start")
+	}
+	select {
+	case <-closed:
+		if time.Now().Before(end) {
+			t.Errorf("Upstream disconnected %v before the scheduled end", end.Sub(time.Now()))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Upstream not disconnected after the scheduled end")
+	}
+}
+
+func TestClientBatchSize(t *testing.T) {
+	listener, accepted, _ := newPacketServer(t)
+	defer listener.Close()
+
+	streamer := NewStreamer("batch", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetNotifier(&countingNotifier{})
+	sink := make(chan protocol.MpegTsPacket, 10)
+	streamer.AddSink(sink)
+	client, err := NewClient("batch", []string{"tcp://" + listener.Addr().String()}, streamer, 1, 0, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetBatchSize(4)
+	if streamer.connectionQueueSize() != 3 {
+		t.Errorf("Got connection queue size %d, expected 3", streamer.connectionQueueSize())
+	}
+	client.Connect()
+	<-accepted
+
+	select {
+	case batch := <-sink:
+		if len(batch) != 4*protocol.MpegTsPacketSize {
+			t.Errorf("Got a batch of %d bytes, expected %d", len(batch), 4*protocol.MpegTsPacketSize)
+		}
+		if protocol.MpegTsPacketPid(batch[3*protocol.MpegTsPacketSize:]) != 0x100 {
+			t.Errorf("Invalid packet at the end of the batch")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No batch received")
+	}
+	client.Close()
+}
+
+func TestClientContextCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// the upstream sends a single packet and stalls
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write(packetWithPid(0x100))
+		time.Sleep(5 * time.Second)
+	}()
+
+	streamer := NewStreamer("cancel", 10, NewAccessController(0), nil)
+	client, err := NewClient("cancel", []string{"tcp://" + listener.Addr().String()}, streamer, 1, 60, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		client.loop(ctx)
+		done <- true
+	}()
+	for !client.Connected() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// neither the stalled connection nor the reconnect delay may hold up the shutdown
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Connection loop did not end on context cancellation")
+	}
+	if client.getInput() != nil {
+		t.Errorf("Input was not closed")
+	}
+}
+
+func TestClientDnsReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write(packetWithPid(0x100))
+		time.Sleep(5 * time.Second)
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	upstream, _ := url.Parse("tcp://localhost:" + port)
+	streamer := NewStreamer("dns", 10, NewAccessController(0), nil)
+	client, err := NewClient("dns", []string{upstream.String()}, streamer, 1, 0, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetDnsRefresh(10*time.Millisecond, true)
+	// the upstream moves away after the first lookup
+	var lookups int32
+	client.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if atomic.AddInt32(&lookups, 1) == 1 {
+			return []string{"127.0.0.1", "::1"}, nil
+		}
+		return []string{"192.0.2.1"}, nil
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- client.start(context.Background(), upstream, nil)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Connection was not closed after the address changed")
+	}
+	if atomic.LoadInt32(&lookups) < 2 {
+		t.Errorf("Host name was not resolved again")
+	}
+}
+
+func TestSameAddresses(t *testing.T) {
+	if !sameAddresses([]string{"192.0.2.1", "192.0.2.2"}, []string{"192.0.2.2", "192.0.2.1"}) {
+		t.Errorf("Reordered addresses are not the same")
+	}
+	if sameAddresses([]string{"192.0.2.1", "192.0.2.2"}, []string{"192.0.2.1", "192.0.2.3"}) {
+		t.Errorf("Different addresses are the same")
+	}
+	if sameAddresses([]string{"192.0.2.1"}, nil) {
+		t.Errorf("Missing addresses are the same")
+	}
+}
+
+func TestClientSeamless(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// every upstream connection sends a short stream and ends
+	var accepted int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var data bytes.Buffer
+			mux := protocol.NewMpegTsMuxer(&data, true, false)
+			_ = mux.WriteVideo([]byte{0, 0, 0, 1, 0x65}, 2700, 900, true)
+			_, _ = conn.Write(data.Bytes())
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+
+	streamer := NewStreamer("seamless", 10, NewAccessController(0), nil)
+	client, err := NewClient("seamless", []string{"tcp://" + listener.Addr().String()}, streamer, 1, 1, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Wait = 10 * time.Millisecond
+	client.SetSeamless(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	client.ConnectContext(ctx)
+
+	for atomic.LoadInt32(&accepted) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	// the stream survives the reconnects
+	if !util.LoadBool(&streamer.running) {
+		t.Errorf("Stream was stopped on reconnect")
+	}
+	cancel()
+	for util.LoadBool(&streamer.running) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClientWatchdog(t *testing.T) {
+	listener, _, _ := newPacketServer(t)
+	defer listener.Close()
+
+	broker := &stallingBroker{AccessController: NewAccessController(0), stall: make(chan struct{})}
+	streamer := NewStreamer("watchdog", 10, broker, auth.NewAuthenticator(configuration.Authentication{}, nil))
+	stalled := make(chan protocol.MpegTsPacket)
+	go streamer.Stream(stalled)
+	for !util.LoadBool(&streamer.running) {
+		time.Sleep(time.Millisecond)
+	}
+	// wedge the stream loop in the broker, so it doesn't take any packets
+	refused := make(chan bool)
+	go func() {
+		streamer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/watchdog.ts", nil))
+		refused <- true
+	}()
+
+	upstream, _ := url.Parse("tcp://" + listener.Addr().String())
+	client, err := NewClient("watchdog", []string{upstream.String()}, streamer, 1, 0, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetWatchdog(50 * time.Millisecond)
+	stalls := testutil.ToFloat64(metricWatchdogStalls.With(prometheus.Labels{"stream": "watchdog"}))
+
+	done := make(chan error)
+	go func() {
+		done <- client.start(context.Background(), upstream, nil)
+	}()
+	select {
+	case err := <-done:
+		if err != ErrStreamStalled {
+			t.Errorf("Expected a stall, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wedged stream loop was not detected")
+	}
+	if testutil.ToFloat64(metricWatchdogStalls.With(prometheus.Labels{"stream": "watchdog"})) != stalls+1 {
+		t.Errorf("Stall was not counted")
+	}
+
+	// a new loop can take over once the wedged one has woken up
+	close(stalled)
+	close(broker.stall)
+	<-refused
+	for util.LoadBool(&streamer.running) {
+		time.Sleep(time.Millisecond)
+	}
+	queue := make(chan protocol.MpegTsPacket)
+	result := make(chan error)
+	go func() {
+		result <- streamer.Stream(queue)
+	}()
+	close(queue)
+	if err := <-result; err != nil {
+		t.Errorf("New stream loop could not be started: %v", err)
+	}
+}
+
+func TestClientWatchdogFlush(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// the upstream sends three full batches and a single packet, then disconnects
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		for i := 0; i < 3*4+1; i++ {
+			conn.Write(packetWithPid(0x100))
+		}
+		conn.Close()
+	}()
+
+	streamer := NewStreamer("flush", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	upstream, _ := url.Parse("tcp://" + listener.Addr().String())
+	client, err := NewClient("flush", []string{upstream.String()}, streamer, 1, 0, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetBatchSize(4)
+	client.SetWatchdog(50 * time.Millisecond)
+	// the stream is already served by another loop, nobody takes packets from the client
+	go streamer.Stream(make(chan protocol.MpegTsPacket))
+	for !util.LoadBool(&streamer.running) {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- client.start(context.Background(), upstream, nil)
+	}()
+	select {
+	case err := <-done:
+		if err != ErrStreamStalled {
+			t.Errorf("Expected a stall, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wedged stream loop was not detected when the last batch was flushed")
+	}
+}
+
+// sourceNotifier records upstream connection changes.
+type sourceNotifier struct {
+	countingNotifier
+	sources chan string
+}
+
+func (n *sourceNotifier) NotifySource(stream string, url string, connected bool) {
+	if connected {
+		n.sources <- "connected " + url
+	} else {
+		n.sources <- "disconnected " + url
+	}
+}
+
+func TestClientSourceEvents(t *testing.T) {
+	listener, accepted, _ := newPacketServer(t)
+	defer listener.Close()
+
+	streamer := NewStreamer("source", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetNotifier(&countingNotifier{})
+	upstream := "tcp://user:secret@" + listener.Addr().String()
+	client, err := NewClient("source", []string{upstream + "?token=secret"}, streamer, 1, 1, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier := &sourceNotifier{sources: make(chan string, 10)}
+	client.SetNotifier(notifier)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.ConnectContext(ctx)
+
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("Upstream not connected")
+	}
+	expect := func(event string) {
+		t.Helper()
+		select {
+		case got := <-notifier.sources:
+			if got != event {
+				t.Errorf("Expected %s, got %s", event, got)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected %s, got nothing", event)
+		}
+	}
+	sanitized := "tcp://" + listener.Addr().String()
+	expect("connected " + sanitized)
+	client.Close()
+	expect("disconnected " + sanitized)
+}
+
+// deadNotifier records dead stream notifications.
+type deadNotifier struct {
+	countingNotifier
+	dead chan string
+}
+
+func (n *deadNotifier) NotifyDead(stream string) {
+	n.dead <- stream
+}
+
+func TestClientMaxAttempts(t *testing.T) {
+	// reserve a port and close it again, so connections are refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := "tcp://" + listener.Addr().String()
+	listener.Close()
+
+	streamer := NewStreamer("dead", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	client, err := NewClient("dead", []string{upstream}, streamer, 1, 1, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier := &deadNotifier{dead: make(chan string, 10)}
+	client.SetNotifier(notifier)
+	client.SetMaxAttempts(1)
+	if client.Revive() {
+		t.Error("Revived a live stream")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.ConnectContext(ctx)
+
+	expect := func() {
+		t.Helper()
+		select {
+		case stream := <-notifier.dead:
+			if stream != "dead" {
+				t.Errorf("Dead notification for the wrong stream: %s", stream)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Stream was not given up")
+		}
+		if !client.Dead() {
+			t.Error("Stream not marked dead")
+		}
+	}
+	expect()
+	if !client.Revive() {
+		t.Error("Dead stream was not revived")
+	}
+	// the revived stream fails again right away
+	expect()
+}
+
+func TestClientBreakerStall(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// the upstream accepts connections, but never sends anything
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	streamer := NewStreamer("breakerstall", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	client, err := NewClient("breakerstall", []string{"tcp://" + listener.Addr().String()}, streamer, 1, 0, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each attempt lasts longer than the reconnect delay, but never delivers anything
+	client.Wait = 10 * time.Millisecond
+	client.ReadTimeout = 50 * time.Millisecond
+	client.SetCircuitBreaker(2, time.Minute, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.ConnectContext(ctx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for client.BreakerState() != "open" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if state := client.BreakerState(); state != "open" {
+		t.Errorf("Breaker is %s after stalled connections, expected open", state)
+	}
+}
+
+func TestClientPreroll(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// the upstream sends half of the pre-roll, then waits for the test
+	more := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write(append(packetWithPid(0x100), packetWithPid(0x100)...))
+		<-more
+		_, _ = conn.Write(append(packetWithPid(0x100), packetWithPid(0x100)...))
+		time.Sleep(time.Second)
+	}()
+
+	streamer := NewStreamer("preroll", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	client, err := NewClient("preroll", []string{"tcp://" + listener.Addr().String()}, streamer, 1, 0, 0, 10, "", 1, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier := &sourceNotifier{sources: make(chan string, 10)}
+	client.SetNotifier(notifier)
+	client.SetPreroll(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.ConnectContext(ctx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !client.Buffering() {
+		if time.Now().After(deadline) {
+			t.Fatal("Client is not buffering")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-notifier.sources:
+		t.Error("Source reported connected during the pre-roll")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(more)
+	select {
+	case source := <-notifier.sources:
+		if !strings.HasPrefix(source, "connected ") {
+			t.Errorf("Invalid source notification: %s", source)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Source not reported connected after the pre-roll")
+	}
+	if client.Buffering() {
+		t.Error("Client still buffering after the pre-roll")
+	}
+}
@@ -20,10 +20,16 @@ import (
 	"context"
 	"fmt"
 	"github.com/onitake/restreamer/protocol"
+	"github.com/onitake/restreamer/util"
+	"github.com/prometheus/client_golang/prometheus"
 	"net/http"
 	"time"
 )
 
+// defaultCoalesceDelay is the maximum time packets are held in the coalescing buffer,
+// if no delay is configured.
+const defaultCoalesceDelay = 20 * time.Millisecond
+
 // Connection is a single active client connection.
 //
 // This is meant to be called directly from a ServeHTTP handler.
@@ -33,6 +39,8 @@ type Connection struct {
 	Queue chan protocol.MpegTsPacket
 	// ClientAddress is the remote client address
 	ClientAddress string
+	// RequestId identifies the request in logs
+	RequestId string
 	// the destination socket
 	writer http.ResponseWriter
 	// Closed is true if Serve was ended because of a closed channel.
@@ -40,6 +48,32 @@ type Connection struct {
 	Closed bool
 	// context contains the cached context object for this connection
 	context context.Context
+	// egress is the shared bandwidth limiter, nil if unlimited
+	egress *EgressLimiter
+	// log is the logger for this connection
+	log util.Logger
+	// status is the response status sent with the stream header, 200 if 0
+	status int
+	// headers are additional response headers, they override the defaults
+	headers map[string]string
+	// framing decides how the response length is announced
+	framing ResponseFraming
+	// contentLength is the length announced with FramingLength, DefaultContentLength if 0
+	contentLength int64
+	// flushInterval is the maximum time written data is held in the response buffer, 0 if unlimited
+	flushInterval time.Duration
+	// coalesceSize is the size of the buffer that collects packets before they are written, 0 to write each packet
+	coalesceSize int
+	// coalesceDelay is the maximum time packets are held in the coalescing buffer
+	coalesceDelay time.Duration
+	// eventStream sends the stream as base64 encoded Server-Sent Events
+	eventStream bool
+	// client is the client address used for duplicate detection
+	client string
+	// firstByte observes the time until the first stream data was written, if it is not nil
+	firstByte prometheus.Observer
+	// idleKeepAlive is the time without data after which null packets are sent, 0 to disable
+	idleKeepAlive time.Duration
 }
 
 // NewConnection creates a new connection object.
@@ -53,48 +87,127 @@ func NewConnection(destination http.ResponseWriter, qsize int, clientaddr string
 		ClientAddress: clientaddr,
 		writer:        destination,
 		context:       ctx,
+		log:           logger,
 	}
 	return conn
 }
 
+// SetRequestId assigns a request ID, which is added to all log lines of this connection.
+func (conn *Connection) SetRequestId(id string) {
+	conn.RequestId = id
+	conn.log = util.WithDefaults(logger, util.Dict{"request": id})
+}
+
 // Serve starts serving data to a client, continuously feeding packets from the queue.
 // An optional preamble buffer can be passed that will be sent before streaming the live payload
 // (but after the HTTP response headers).
 func (conn *Connection) Serve(preamble []byte) {
-	// set the content type (important)
-	conn.writer.Header().Set("Content-Type", "video/mpeg")
-	// a stream is always current
-	conn.writer.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
-	// other headers to comply with the specs
-	conn.writer.Header().Set("Accept-Range", "none")
-	// suppress caching by intermediate proxies
-	conn.writer.Header().Set("Cache-Control", "no-cache,no-store,no-transform")
-	// use Add and Set to set more headers here
-	// chunked mode should be on by default
-	conn.writer.WriteHeader(http.StatusOK)
-	// try to flush the header
-	flusher, ok := conn.writer.(http.Flusher)
-	if !ok {
-		logger.Logkv(
+	start := time.Now()
+	// report the time to first byte after the first successful write
+	wrote := false
+	written := func() {
+		if !wrote && conn.firstByte != nil {
+			conn.firstByte.Observe(time.Since(start).Seconds())
+		}
+		wrote = true
+	}
+	status := conn.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	headers := framingHeaders(conn.headers, conn.framing, conn.contentLength)
+	// a live stream that can't be flushed is buffered until the server gives up, don't even start
+	if flusherOf(conn.writer) == nil {
+		conn.log.Logkv(
 			"event", eventConnectionError,
 			"error", errorConnectionNotFlushable,
-			"message", "ResponseWriter is not flushable!",
+			"message", "ResponseWriter is not flushable, refusing to stream",
 		)
-	} else {
-		flusher.Flush()
+		ServeStreamError(conn.writer, http.StatusInternalServerError)
+		return
+	}
+	// keep-alive comments for event streams
+	var keepAlive <-chan time.Time
+	if conn.eventStream {
+		custom := headers
+		headers = make(map[string]string, len(custom)+1)
+		for key, value := range custom {
+			headers[key] = value
+		}
+		headers["Content-Type"] = eventStreamContentType
+		events := newEventStreamWriter(conn.writer)
+		conn.writer = events
+		ticker := time.NewTicker(eventStreamKeepAlive)
+		defer ticker.Stop()
+		keepAlive = ticker.C
 	}
-	logger.Logkv(
+	// chunked mode should be on by default
+	writeStreamHeader(conn.writer, status, headers)
+	// flush the header
+	flusher := flusherOf(conn.writer)
+	flusher.Flush()
+	conn.log.Logkv(
 		"event", eventHeaderSent,
 		"message", "Sent header",
 	)
 
 	running := true
 
+	// periodically push out buffered data, if enabled.
+	// this is needed with HTTP/2 and some reverse proxies, which hold back
+	// partially filled buffers until more data arrives.
+	var flush <-chan time.Time
+	dirty := false
+	if conn.flushInterval > 0 {
+		ticker := time.NewTicker(conn.flushInterval)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+
+	// send null packets while no data arrives, so intermediaries don't close the connection.
+	// event streams have their own keep-alive.
+	var idle <-chan time.Time
+	active := true
+	if conn.idleKeepAlive > 0 && !conn.eventStream {
+		ticker := time.NewTicker(conn.idleKeepAlive)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+
+	// collect packets and send them out with a single write and flush,
+	// when the buffer is full or the oldest packet has waited long enough
+	var coalesced []byte
+	var coalesceTimer *time.Timer
+	var coalesce <-chan time.Time
+	if conn.coalesceSize > 0 {
+		coalesced = make([]byte, 0, conn.coalesceSize)
+		coalesceTimer = time.NewTimer(time.Hour)
+		coalesceTimer.Stop()
+		defer coalesceTimer.Stop()
+	}
+	writeCoalesced := func() error {
+		coalesce = nil
+		coalesceTimer.Stop()
+		_, err := conn.writer.Write(coalesced)
+		coalesced = coalesced[:0]
+		if err == nil {
+			written()
+			flusher.Flush()
+			dirty = false
+		}
+		return err
+	}
+
 	// send the preamble
 	if len(preamble) > 0 {
-		_, err := conn.writer.Write(preamble)
-		if err != nil {
-			logger.Logkv(
+		err := conn.egress.Wait(conn.context, len(preamble))
+		if err == nil {
+			_, err = conn.writer.Write(preamble)
+		}
+		if err == nil {
+			written()
+		} else {
+			conn.log.Logkv(
 				"event", eventConnectionClosed,
 				"message", "Downstream connection closed during preamble",
 			)
@@ -107,15 +220,31 @@ func (conn *Connection) Serve(preamble []byte) {
 		select {
 		case packet, ok := <-conn.Queue:
 			if ok {
-				// packet received, log
-				//log.Printf("Sending packet (length %d):\n%s\n", len(packet), hex.Dump(packet))
-				// send the packet out
-				_, err := conn.writer.Write(packet)
+				active = true
+				// packet received, wait for our share of the bandwidth and send the packet out
+				err := conn.egress.Wait(conn.context, len(packet))
+				if err == nil {
+					if coalesced != nil {
+						coalesced = append(coalesced, packet...)
+						if len(coalesced) >= conn.coalesceSize {
+							err = writeCoalesced()
+						} else if coalesce == nil {
+							coalesceTimer.Reset(conn.coalesceDelay)
+							coalesce = coalesceTimer.C
+						}
+					} else {
+						_, err = conn.writer.Write(packet)
+						dirty = true
+						if err == nil {
+							written()
+						}
+					}
+				}
 				// NOTE we shouldn't flush here, to avoid swamping the kernel with syscalls.
 				// see https://golang.org/pkg/net/http/?m=all#response.Write for details
 				// on how Go buffers HTTP responses (hint: a 2KiB bufio and a 4KiB bufio)
 				if err != nil {
-					logger.Logkv(
+					conn.log.Logkv(
 						"event", eventConnectionClosed,
 						"message", "Downstream connection closed",
 					)
@@ -124,16 +253,64 @@ func (conn *Connection) Serve(preamble []byte) {
 				//log.Printf("Wrote packet of %d bytes\n", bytes)
 			} else {
 				// channel closed, exit
-				logger.Logkv(
+				conn.log.Logkv(
 					"event", eventConnectionShutdown,
 					"message", "Shutting down client connection",
 				)
 				running = false
 				conn.Closed = true
+				// send what's left
+				if len(coalesced) > 0 {
+					_ = writeCoalesced()
+				}
+			}
+		case <-coalesce:
+			if err := writeCoalesced(); err != nil {
+				conn.log.Logkv(
+					"event", eventConnectionClosed,
+					"message", "Downstream connection closed",
+				)
+				running = false
+			}
+		case <-keepAlive:
+			if err := conn.writer.(*eventStreamWriter).KeepAlive(); err != nil {
+				conn.log.Logkv(
+					"event", eventConnectionClosed,
+					"message", "Downstream connection closed",
+				)
+				running = false
+			}
+		case <-idle:
+			if !active {
+				// null packets take their share of the bandwidth like stream data
+				null := protocol.NewMpegTsNullPacket()
+				err := conn.egress.Wait(conn.context, len(null))
+				if err == nil {
+					if coalesced != nil {
+						coalesced = append(coalesced, null...)
+						err = writeCoalesced()
+					} else if _, err = conn.writer.Write(null); err == nil {
+						flusher.Flush()
+						dirty = false
+					}
+				}
+				if err != nil {
+					conn.log.Logkv(
+						"event", eventConnectionClosed,
+						"message", "Downstream connection closed",
+					)
+					running = false
+				}
+			}
+			active = false
+		case <-flush:
+			if dirty {
+				flusher.Flush()
+				dirty = false
 			}
 		case <-conn.context.Done():
 			// connection closed while we were waiting for more data
-			logger.Logkv(
+			conn.log.Logkv(
 				"event", eventConnectionClosedWait,
 				"message", "Downstream connection closed (while waiting)",
 				"error", fmt.Sprintf("%v", conn.context.Err()),
@@ -145,14 +322,37 @@ func (conn *Connection) Serve(preamble []byte) {
 	// we cannot drain the channel here, as it might not be closed yet.
 	// better let our caller handle closure and draining.
 
-	logger.Logkv(
+	conn.log.Logkv(
 		"event", eventConnectionDone,
 		"message", "Streaming finished",
 	)
 }
 
+// flusherOf returns the flusher of a response writer, or nil if the response can't be flushed.
+// Like http.ResponseController, it looks through wrappers that have an Unwrap method.
+// Such a wrapper is only flushable if the writer it wraps is.
+func flusherOf(writer http.ResponseWriter) http.Flusher {
+	var inner http.Flusher
+	if wrapper, ok := writer.(interface{ Unwrap() http.ResponseWriter }); ok {
+		inner = flusherOf(wrapper.Unwrap())
+		if inner == nil {
+			return nil
+		}
+	}
+	if flusher, ok := writer.(http.Flusher); ok {
+		return flusher
+	}
+	return inner
+}
+
 // ServeStreamError returns an appropriate error response to the client.
 func ServeStreamError(writer http.ResponseWriter, status int) {
+	writeStreamHeader(writer, status, nil)
+}
+
+// writeStreamHeader sends the response header of a stream.
+// headers are added to the defaults and override them.
+func writeStreamHeader(writer http.ResponseWriter, status int, headers map[string]string) {
 	// set the content type (important)
 	writer.Header().Set("Content-Type", "video/mpeg")
 	// a stream is always current
@@ -161,6 +361,10 @@ func ServeStreamError(writer http.ResponseWriter, status int) {
 	writer.Header().Set("Accept-Range", "none")
 	// suppress caching by intermediate proxies
 	writer.Header().Set("Cache-Control", "no-cache,no-store,no-transform")
+	// add configured headers
+	for key, value := range headers {
+		writer.Header().Set(key, value)
+	}
 	// ...and the application-supplied status code
-	writer.WriteHeader(http.StatusNotFound)
+	writer.WriteHeader(status)
 }
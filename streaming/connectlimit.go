@@ -0,0 +1,92 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ConnectLimiter staggers the first upstream connection attempts of all clients that share it,
+// so a large number of streams doesn't hit the origins all at once on startup.
+// A nil ConnectLimiter does not limit anything.
+type ConnectLimiter struct {
+	// slots holds a token for each connection attempt in progress, nil for no limit
+	slots chan struct{}
+	// delay is the minimum time between two connection attempts
+	delay time.Duration
+	// lock protects next
+	lock sync.Mutex
+	// next is the earliest time the next connection attempt may start
+	next time.Time
+}
+
+// NewConnectLimiter creates a limiter that allows up to concurrency simultaneous
+// connection attempts, started at least delay apart.
+// A concurrency of 0 doesn't limit the number of attempts, only their spacing.
+// Returns nil if both are 0.
+func NewConnectLimiter(concurrency uint, delay time.Duration) *ConnectLimiter {
+	if concurrency == 0 && delay <= 0 {
+		return nil
+	}
+	limiter := &ConnectLimiter{
+		delay: delay,
+	}
+	if concurrency > 0 {
+		limiter.slots = make(chan struct{}, concurrency)
+	}
+	return limiter
+}
+
+// acquire blocks until a connection attempt may start.
+// Returns the context error if ctx is cancelled while waiting.
+// release must be called after a successful acquire.
+func (limiter *ConnectLimiter) acquire(ctx context.Context) error {
+	if limiter == nil {
+		return nil
+	}
+	if limiter.slots != nil {
+		select {
+		case limiter.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if limiter.delay > 0 {
+		limiter.lock.Lock()
+		now := time.Now()
+		start := limiter.next
+		if start.Before(now) {
+			start = now
+		}
+		limiter.next = start.Add(limiter.delay)
+		limiter.lock.Unlock()
+		if !sleepContext(ctx, start.Sub(now)) {
+			limiter.release()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// release ends a connection attempt.
+func (limiter *ConnectLimiter) release() {
+	if limiter != nil && limiter.slots != nil {
+		<-limiter.slots
+	}
+}
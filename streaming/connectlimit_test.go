@@ -0,0 +1,71 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConnectLimiterDisabled(t *testing.T) {
+	limiter := NewConnectLimiter(0, 0)
+	if limiter != nil {
+		t.Fatal("Expected no limiter without concurrency and delay")
+	}
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Errorf("Nil limiter failed: %v", err)
+	}
+	limiter.release()
+}
+
+func TestConnectLimiterConcurrency(t *testing.T) {
+	limiter := NewConnectLimiter(2, 0)
+	ctx := context.Background()
+	if limiter.acquire(ctx) != nil || limiter.acquire(ctx) != nil {
+		t.Fatal("Could not acquire free slots")
+	}
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if limiter.acquire(timeout) == nil {
+		t.Fatal("Acquired more slots than allowed")
+	}
+	limiter.release()
+	if limiter.acquire(ctx) != nil {
+		t.Error("Released slot could not be acquired")
+	}
+}
+
+func TestConnectLimiterDelay(t *testing.T) {
+	limiter := NewConnectLimiter(0, 50*time.Millisecond)
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limiter.acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+		limiter.release()
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Connection attempts were not staggered, took %v", elapsed)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if limiter.acquire(cancelled) == nil {
+		t.Error("Cancelled wait succeeded")
+	}
+}
@@ -0,0 +1,94 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"context"
+	"github.com/onitake/restreamer/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// egressMinBurst is the smallest burst size of the egress limiter, in bytes.
+	// It should be large enough to hold a few network writes.
+	egressMinBurst = 64 * 1024
+)
+
+var (
+	metricEgressLimit = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "streaming_egress_limit_bytes",
+			Help: "Configured total egress bandwidth limit in bytes per second, 0 if unlimited.",
+		},
+	)
+	metricEgressBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "streaming_egress_bytes",
+			Help: "Total number of bytes written to clients, for calculating the current egress rate.",
+		},
+	)
+)
+
+func init() {
+	metrics.MustRegister(metricEgressLimit)
+	metrics.MustRegister(metricEgressBytes)
+}
+
+// EgressLimiter caps the total outgoing bandwidth of all connections that share it.
+//
+// Writers wait for their turn before sending data, so the aggregate rate
+// is paced and slow connections fall behind without affecting the others.
+// A nil EgressLimiter does not limit anything, but still counts bytes.
+type EgressLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewEgressLimiter creates a new egress limiter with a total rate in bytes per second.
+// If rate is 0, nil is returned.
+func NewEgressLimiter(bytesPerSecond uint64) *EgressLimiter {
+	metricEgressLimit.Set(float64(bytesPerSecond))
+	if bytesPerSecond == 0 {
+		return nil
+	}
+	burst := int(bytesPerSecond / 10)
+	if burst < egressMinBurst {
+		burst = egressMinBurst
+	}
+	return &EgressLimiter{
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+	}
+}
+
+// Wait blocks until length bytes may be sent, or the context is cancelled.
+// Writes larger than the burst size are split into several waits.
+func (egress *EgressLimiter) Wait(ctx context.Context, length int) error {
+	if egress != nil {
+		for remaining := length; remaining > 0; {
+			chunk := remaining
+			if burst := egress.limiter.Burst(); chunk > burst {
+				chunk = burst
+			}
+			if err := egress.limiter.WaitN(ctx, chunk); err != nil {
+				return err
+			}
+			remaining -= chunk
+		}
+	}
+	metricEgressBytes.Add(float64(length))
+	return nil
+}
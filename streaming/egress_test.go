@@ -0,0 +1,49 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEgressLimiter(t *testing.T) {
+	if NewEgressLimiter(0) != nil {
+		t.Error("Unlimited egress limiter is not nil")
+	}
+	var unlimited *EgressLimiter
+	if err := unlimited.Wait(context.Background(), 1000000); err != nil {
+		t.Errorf("Unlimited wait failed: %v", err)
+	}
+
+	egress := NewEgressLimiter(egressMinBurst * 10)
+	start := time.Now()
+	// the burst is available immediately, writes larger than the burst must be split
+	if err := egress.Wait(context.Background(), egressMinBurst*2); err != nil {
+		t.Errorf("Large write failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Write exceeding the burst was not paced: %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := egress.Wait(ctx, egressMinBurst); err == nil {
+		t.Error("Wait on cancelled context succeeded")
+	}
+}
@@ -0,0 +1,101 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// decodeBody wraps the body of an HTTP response in a decompressor for its Content-Encoding.
+//
+// Compression is never requested, because MPEG-TS doesn't compress well, but some
+// origins compress anyway. gzip and deflate are supported, the body is returned
+// unchanged if it isn't encoded. Other encodings return an error.
+//
+// The decompressor is only set up on the first read, so a slow origin can't
+// block the connection attempt.
+func decodeBody(response *http.Response) (io.ReadCloser, error) {
+	encoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return response.Body, nil
+	case "gzip", "x-gzip":
+		return &decodingReader{
+			body: response.Body,
+			create: func(reader io.Reader) (io.Reader, error) {
+				return gzip.NewReader(reader)
+			},
+		}, nil
+	case "deflate":
+		return &decodingReader{
+			body:   response.Body,
+			create: newDeflateReader,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+	}
+}
+
+// newDeflateReader creates a decompressor for the HTTP deflate encoding.
+// The standard calls for zlib framing, but some servers send raw deflate data,
+// so the framing is detected from the zlib header.
+func newDeflateReader(reader io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(reader)
+	header, err := buffered.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// a zlib header declares the deflate method and carries a checksum
+	if header[0]&0x0f == 8 && (uint(header[0])<<8|uint(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+// decodingReader decompresses an HTTP response body.
+type decodingReader struct {
+	// body is the compressed response body
+	body io.ReadCloser
+	// create sets up the decompressor, it may read from the body
+	create func(io.Reader) (io.Reader, error)
+	// reader is the decompressor, nil until the first read
+	reader io.Reader
+}
+
+// Read reads decompressed data, setting up the decompressor first if needed.
+func (decoder *decodingReader) Read(p []byte) (int, error) {
+	if decoder.reader == nil {
+		reader, err := decoder.create(decoder.body)
+		if err != nil {
+			return 0, err
+		}
+		decoder.reader = reader
+	}
+	return decoder.reader.Read(p)
+}
+
+// Close closes the response body.
+func (decoder *decodingReader) Close() error {
+	return decoder.body.Close()
+}
@@ -0,0 +1,102 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// openEncoded serves stream with a Content-Encoding through compress, and returns the
+// client input after opening it. Accept-Encoding is ignored, like a misbehaving origin.
+func openEncoded(t *testing.T, encoding string, compress func(io.Writer) io.WriteCloser, stream []byte) (*Client, *httptest.Server) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Accept-Encoding") != "" {
+			t.Errorf("Client asked for compression: %s", request.Header.Get("Accept-Encoding"))
+		}
+		writer.Header().Set("Content-Encoding", encoding)
+		compressor := compress(writer)
+		compressor.Write(stream)
+		compressor.Close()
+	}))
+	client, err := NewClient("encoded", []string{server.URL}, nil, 1, 0, 0, 1, "", 64, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ := url.Parse(server.URL)
+	if err := client.open(context.Background(), parsed); err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestClientContentEncoding(t *testing.T) {
+	var stream []byte
+	for pid := uint16(0x100); pid < 0x110; pid++ {
+		stream = append(stream, packetWithPid(pid)...)
+	}
+	tests := []struct {
+		encoding string
+		compress func(io.Writer) io.WriteCloser
+	}{
+		{"gzip", func(writer io.Writer) io.WriteCloser { return gzip.NewWriter(writer) }},
+		{"deflate", func(writer io.Writer) io.WriteCloser { return zlib.NewWriter(writer) }},
+		// raw deflate without zlib framing, as sent by some servers
+		{"deflate", func(writer io.Writer) io.WriteCloser {
+			compressor, _ := flate.NewWriter(writer, flate.DefaultCompression)
+			return compressor
+		}},
+	}
+	for i, test := range tests {
+		client, server := openEncoded(t, test.encoding, test.compress, stream)
+		input := client.getInput()
+		data, err := io.ReadAll(input)
+		if err != nil {
+			t.Errorf("Test %d: error reading %s stream: %v", i, test.encoding, err)
+		}
+		if !bytes.Equal(data, stream) {
+			t.Errorf("Test %d: %s stream not decoded, got %d bytes", i, test.encoding, len(data))
+		}
+		input.Close()
+		server.Close()
+	}
+}
+
+func TestClientUnsupportedEncoding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Encoding", "br")
+		writer.Write(packetWithPid(0x100))
+	}))
+	defer server.Close()
+	client, err := NewClient("encoded", []string{server.URL}, nil, 1, 0, 0, 1, "", 64, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ := url.Parse(server.URL)
+	if err := client.open(context.Background(), parsed); err == nil {
+		t.Error("Stream with unsupported encoding was accepted")
+	}
+}
@@ -0,0 +1,106 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// eventStreamContentType is the MIME type of Server-Sent Events
+	eventStreamContentType = "text/event-stream"
+	// eventStreamKeepAlive is the interval of comment lines sent on an idle event stream,
+	// to keep proxies from closing the connection
+	eventStreamKeepAlive = 15 * time.Second
+)
+
+// eventStreamWriter sends each write as a base64 encoded Server-Sent Event.
+// Each event is flushed immediately, so browsers receive it without delay.
+// Combine it with write coalescing to send fewer, larger events.
+type eventStreamWriter struct {
+	http.ResponseWriter
+	// flusher is the underlying flusher, nil if the writer can't flush
+	flusher http.Flusher
+	// written is true if data was sent since the last call to idle
+	written bool
+}
+
+// newEventStreamWriter wraps a response writer in an event stream encoder.
+func newEventStreamWriter(writer http.ResponseWriter) *eventStreamWriter {
+	return &eventStreamWriter{
+		ResponseWriter: writer,
+		flusher:        flusherOf(writer),
+	}
+}
+
+// Write sends p as a single event.
+// Returns len(p) on success, so callers can account for the raw data.
+func (writer *eventStreamWriter) Write(p []byte) (int, error) {
+	size := base64.StdEncoding.EncodedLen(len(p))
+	event := make([]byte, len("data: ")+size+len("\n\n"))
+	copy(event, "data: ")
+	base64.StdEncoding.Encode(event[len("data: "):], p)
+	copy(event[len("data: ")+size:], "\n\n")
+	if _, err := writer.ResponseWriter.Write(event); err != nil {
+		return 0, err
+	}
+	writer.Flush()
+	writer.written = true
+	return len(p), nil
+}
+
+// Flush sends buffered data to the client.
+func (writer *eventStreamWriter) Flush() {
+	if writer.flusher != nil {
+		writer.flusher.Flush()
+	}
+}
+
+// KeepAlive sends a comment line if nothing was written since the last call.
+func (writer *eventStreamWriter) KeepAlive() error {
+	if writer.written {
+		writer.written = false
+		return nil
+	}
+	if _, err := writer.ResponseWriter.Write([]byte(": keepalive\n\n")); err != nil {
+		return err
+	}
+	writer.Flush()
+	return nil
+}
+
+// acceptsEventStream returns true if a client asked for Server-Sent Events.
+func acceptsEventStream(request *http.Request) bool {
+	return acceptsMediaType(request, eventStreamContentType)
+}
+
+// acceptsMediaType returns true if a client explicitly listed a media type in its Accept header.
+// Wildcards are not considered.
+func acceptsMediaType(request *http.Request, mediaType string) bool {
+	for _, accept := range request.Header.Values("Accept") {
+		for _, typ := range strings.Split(accept, ",") {
+			if media, _, err := mime.ParseMediaType(typ); err == nil && media == mediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnectionEventStream(t *testing.T) {
+	writer := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := NewConnection(writer, 10, "", ctx)
+	conn.eventStream = true
+	done := make(chan bool)
+	go func() {
+		conn.Serve(nil)
+		done <- true
+	}()
+	packet := packetWithPid(0x100)
+	conn.Queue <- packet
+	// header and event
+	for atomic.LoadInt32(&writer.flushes) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if writer.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Got content type %s, expected text/event-stream", writer.Header().Get("Content-Type"))
+	}
+	expected := "data: " + base64.StdEncoding.EncodeToString(packet) + "\n\n"
+	if writer.Body.String() != expected {
+		t.Errorf("Got event %q, expected %q", writer.Body.String(), expected)
+	}
+}
+
+func TestEventStreamKeepAlive(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writer := newEventStreamWriter(recorder)
+	writer.Write([]byte{1})
+	// data was sent, no keep-alive needed
+	writer.KeepAlive()
+	writer.KeepAlive()
+	if recorder.Body.String() != "data: AQ==\n\n: keepalive\n\n" {
+		t.Errorf("Got %q", recorder.Body.String())
+	}
+}
+
+func TestAcceptsEventStream(t *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+	if acceptsEventStream(request) {
+		t.Errorf("Accepted event stream without Accept header")
+	}
+	request.Header.Set("Accept", "video/mpeg, text/event-stream;q=0.9")
+	if !acceptsEventStream(request) {
+		t.Errorf("Event stream not accepted")
+	}
+}
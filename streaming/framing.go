@@ -0,0 +1,68 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"math"
+	"strconv"
+)
+
+// ResponseFraming decides how the length of a streaming response is announced to clients.
+//
+// Live streams have no length, so HTTP/1.1 responses are normally sent with chunked
+// transfer encoding. Some legacy players and set-top boxes can't handle that.
+type ResponseFraming int
+
+const (
+	// FramingChunked leaves the framing to the HTTP server, which uses chunked
+	// transfer encoding for HTTP/1.1 clients.
+	FramingChunked ResponseFraming = iota
+	// FramingClose sends the stream without chunking. The end of the stream is
+	// signalled by closing the connection, so it can't be kept alive afterwards.
+	FramingClose
+	// FramingLength announces a fixed Content-Length. The stream is cut off when
+	// the length is reached, and clients may preallocate or seek based on it.
+	FramingLength
+)
+
+// DefaultContentLength is the Content-Length sent with FramingLength if none is configured.
+// It is large enough to never be reached, but some clients can't parse lengths over 2^31-1.
+const DefaultContentLength = math.MaxInt64
+
+// framingHeaders returns a copy of headers with the headers that select a framing added.
+// Configured headers take precedence. headers is returned unchanged with FramingChunked.
+func framingHeaders(headers map[string]string, framing ResponseFraming, length int64) map[string]string {
+	var key, value string
+	switch framing {
+	case FramingClose:
+		// the Go HTTP server turns off chunking and closes the connection afterwards
+		key, value = "Transfer-Encoding", "identity"
+	case FramingLength:
+		if length <= 0 {
+			length = DefaultContentLength
+		}
+		key, value = "Content-Length", strconv.FormatInt(length, 10)
+	default:
+		return headers
+	}
+	framed := make(map[string]string, len(headers)+1)
+	framed[key] = value
+	for name, header := range headers {
+		framed[name] = header
+	}
+	return framed
+}
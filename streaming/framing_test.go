@@ -0,0 +1,99 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// readFramedResponse serves a single packet with framing and returns the raw response header
+// and the first bytes of the body. The connection is kept open, so the body must have been flushed
+// by the flush interval.
+func readFramedResponse(t *testing.T, framing ResponseFraming, length int64) (*http.Response, []byte) {
+	t.Helper()
+	packet := packetWithPid(0x100)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		conn := NewConnection(writer, 10, request.RemoteAddr, request.Context())
+		conn.framing = framing
+		conn.contentLength = length
+		conn.flushInterval = 10 * time.Millisecond
+		conn.Queue <- packet
+		conn.Serve(nil)
+	}))
+	defer server.Close()
+
+	client, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	fmt.Fprintf(client, "GET /stream HTTP/1.1\r\nHost: test\r\n\r\n")
+	reader := bufio.NewReader(client)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// read the raw body, without dechunking
+	body := make([]byte, len(packet))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		t.Fatalf("Packet not flushed: %v", err)
+	}
+	return response, body
+}
+
+func TestFramingClose(t *testing.T) {
+	response, body := readFramedResponse(t, FramingClose, 0)
+	if len(response.TransferEncoding) != 0 || response.ContentLength != -1 {
+		t.Errorf("Expected unchunked response without length, got %v %d", response.TransferEncoding, response.ContentLength)
+	}
+	if !bytes.Equal(body, packetWithPid(0x100)) {
+		t.Errorf("Body is not the raw packet: %x", body[:8])
+	}
+}
+
+func TestFramingLength(t *testing.T) {
+	response, body := readFramedResponse(t, FramingLength, 0)
+	if response.ContentLength != DefaultContentLength || len(response.TransferEncoding) != 0 {
+		t.Errorf("Expected Content-Length %d, got %v %d", int64(DefaultContentLength), response.TransferEncoding, response.ContentLength)
+	}
+	if !bytes.Equal(body, packetWithPid(0x100)) {
+		t.Errorf("Body is not the raw packet: %x", body[:8])
+	}
+	response, _ = readFramedResponse(t, FramingLength, 1<<31-1)
+	if response.ContentLength != 1<<31-1 {
+		t.Errorf("Expected Content-Length %d, got %d", 1<<31-1, response.ContentLength)
+	}
+}
+
+func TestFramingChunked(t *testing.T) {
+	response, body := readFramedResponse(t, FramingChunked, 0)
+	if len(response.TransferEncoding) != 1 || response.TransferEncoding[0] != "chunked" {
+		t.Errorf("Expected chunked response, got %v", response.TransferEncoding)
+	}
+	if !bytes.HasPrefix(body, []byte("bc\r\n")) {
+		t.Errorf("Body doesn't start with a chunk header: %q", body[:8])
+	}
+}
@@ -53,6 +53,22 @@ const (
 	eventClientOpenUdp          = "open_udp"
 	eventClientOpenUdpMulticast = "open_multicast"
 	eventClientOpenFork         = "open_fork"
+	eventClientOpenRtmp         = "open_rtmp"
+	eventClientOpenPlaylist     = "open_playlist"
+	eventClientStandby          = "standby"
+	eventClientWake             = "wake"
+	eventClientWarmup           = "warmup"
+	eventClientSample           = "sample"
+	eventClientDnsChange        = "dns_change"
+	eventClientDnsReconnect     = "dns_reconnect"
+	eventClientLossSimulation   = "loss_simulation"
+	eventClientArrivalLog       = "arrival_log"
+	eventClientDead             = "dead"
+	eventClientRevive           = "revive"
+	eventClientBreakerOpen      = "breaker_open"
+	eventClientBreakerClosed    = "breaker_closed"
+	eventClientBuffering        = "buffering"
+	eventClientInputFormat      = "input_format"
 	//
 	errorClientConnect       = "connect"
 	errorClientParse         = "parse"
@@ -60,6 +76,10 @@ const (
 	errorClientSetBufferSize = "buffersize"
 	errorClientClose         = "close"
 	errorClientStream        = "stream"
+	errorClientDnsLookup     = "dns_lookup"
+	errorClientStalled       = "stalled"
+	errorClientUnordered     = "unordered"
+	errorClientArrivalLog    = "arrival_log"
 	//
 	eventConnectionDebug      = "debug"
 	eventConnectionError      = "error"
@@ -69,8 +89,7 @@ const (
 	eventConnectionShutdown   = "shutdown"
 	eventConnectionDone       = "done"
 	//
-	errorConnectionNotFlushable  = "noflush"
-	errorConnectionNoCloseNotify = "noclosenotify"
+	errorConnectionNotFlushable = "noflush"
 	//
 	eventProxyError           = "error"
 	eventProxyStart           = "start"
@@ -84,6 +103,8 @@ const (
 	eventProxyReplyNotChanged = "replynotchanged"
 	eventProxyReplyContent    = "replycontent"
 	eventProxyStale           = "stale"
+	eventProxyRevalidate      = "revalidate"
+	eventProxyMirrorFailed    = "mirrorfailed"
 	eventProxyReturn          = "return"
 	//
 	errorProxyInvalidUrl      = "invalidurl"
@@ -103,10 +124,46 @@ const (
 	eventStreamerClosed       = "closed"
 	eventStreamerInhibit      = "inhibit"
 	eventStreamerAllow        = "allow"
+	eventStreamerWaiting      = "waiting"
+	eventStreamerIdle         = "idle"
+	eventStreamerNoConsumers  = "noconsumers"
+	eventStreamerConsumers    = "consumers"
+	eventStreamerDuplicate    = "duplicate"
+	eventStreamerSoftLimit    = "softlimit"
 	//
 	errorStreamerInvalidCommand = "invalidcmd"
 	errorStreamerPoolFull       = "poolfull"
 	errorStreamerOffline        = "offline"
+	errorStreamerAcceptTimeout  = "accepttimeout"
+	errorStreamerDuplicate      = "duplicate"
+	errorStreamerSlowClient     = "slowclient"
+	errorStreamerWrite          = "write"
+	errorStreamerMethod         = "method"
+	errorStreamerCountry        = "country"
+	errorStreamerHeader         = "header"
+	errorStreamerLimit          = "limit"
+	//
+	eventPackagerError   = "error"
+	eventPackagerStart   = "start"
+	eventPackagerSegment = "segment"
+	//
+	errorPackagerSps   = "sps"
+	errorPackagerAdts  = "adts"
+	errorPackagerWrite = "write"
+	//
+	eventRecorderError = "error"
+	eventRecorderStart = "recordstart"
+	eventRecorderStop  = "recordstop"
+	eventRecorderFile  = "recordfile"
+	//
+	errorRecorderOverrun = "overrun"
+	errorRecorderOpen    = "open"
+	errorRecorderWrite   = "write"
+	//
+	eventRateLimited = "ratelimited"
+	//
+	eventProbeStart = "probestart"
+	eventProbeDone  = "probedone"
 )
 
 var logger = util.NewGlobalModuleLogger(moduleStreaming, nil)
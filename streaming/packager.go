@@ -0,0 +1,527 @@
+/* Copyright (c) 2026 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/onitake/restreamer/auth"
+	"github.com/onitake/restreamer/metrics"
+	"github.com/onitake/restreamer/protocol"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// packagerTargetDuration is the minimum segment duration, in 90kHz units.
+	// Segments are cut at the first keyframe after this duration.
+	packagerTargetDuration = 2 * protocol.Fmp4VideoTimescale
+	// packagerWindow is the number of segments that are kept in the playlist
+	packagerWindow = 6
+	// packagerQueueSize is the size of the packet input queue
+	packagerQueueSize = 1000
+	// packagerAudioFrameSize is the number of samples in an AAC frame
+	packagerAudioFrameSize = 1024
+	// packagerVideoTrack and packagerAudioTrack are the track IDs in the fMP4 output
+	packagerVideoTrack = 1
+	packagerAudioTrack = 2
+	// packagerPlaylist, packagerInit and packagerSegmentPrefix/Suffix are the resource names under the serve prefix
+	packagerPlaylist      = "index.m3u8"
+	packagerInit          = "init.mp4"
+	packagerSegmentPrefix = "segment"
+	packagerSegmentSuffix = ".m4s"
+	// packagerSessionTimeout is the idle time after which a client session ends
+	packagerSessionTimeout = 30 * time.Second
+)
+
+// packagerSession is a client that is playing the stream.
+type packagerSession struct {
+	// start is the time of the first request
+	start time.Time
+	// last is the time of the latest request
+	last time.Time
+	// timer ends the session once it has been idle for too long
+	timer *time.Timer
+}
+
+// packagerSegment is a complete media segment.
+type packagerSegment struct {
+	// sequence is the media sequence number
+	sequence uint32
+	// duration is the segment duration in seconds
+	duration float64
+	// discontinuity is set if the timeline or codec configuration changed before this segment
+	discontinuity bool
+	// data is the moof+mdat payload
+	data []byte
+}
+
+// Packager remuxes an MPEG-TS stream into fragmented MP4 (CMAF) segments and serves them
+// as an HLS playlist.
+//
+// It receives packets from a Streamer through a packet sink. Only H.264 video and
+// AAC audio (with ADTS framing) are supported, other elementary streams are ignored.
+// Segments are cut on video keyframes, or at regular intervals for audio-only streams.
+// Only regular HLS playlists are generated, there is no DASH manifest and no support
+// for Low-Latency HLS partial segments.
+//
+// Client requests are subject to the same authentication and connection policy as
+// the Streamer the packager is attached to. Since players fetch the playlist and each
+// segment with a separate request, the connection broker is consulted once per client
+// session. A session ends when the client hasn't made any request for the session timeout.
+type Packager struct {
+	// name is a unique name for this stream, only used for logging and metrics
+	name string
+	// prefix is the URL path prefix that the packager is served under
+	prefix string
+	// streamer is the packet source, also passed to the broker for policy decisions
+	streamer *Streamer
+	// broker is a global connection broker
+	broker ConnectionBroker
+	// auth is an authentication verifier for client requests
+	auth auth.Authenticator
+	// stats is the statistics collector for this stream
+	stats metrics.Collector
+	// input is the packet queue fed by the streamer
+	input chan protocol.MpegTsPacket
+	// sessionTimeout is the idle time after which a client session ends
+	sessionTimeout time.Duration
+
+	// sessionLock protects sessions
+	sessionLock sync.Mutex
+	// sessions are the active client sessions, by client address
+	sessions map[string]*packagerSession
+
+	// lock protects the init segment and the segment list
+	lock sync.RWMutex
+	// init is the current initialization segment, or nil if it is not available yet
+	init []byte
+	// segments is the list of available segments, oldest first
+	segments []*packagerSegment
+
+	// the following fields are only accessed by the segmenter goroutine
+	demux         *protocol.MpegTsDemuxer
+	video         *protocol.Fmp4Track
+	audio         *protocol.Fmp4Track
+	videoFragment *protocol.Fmp4Fragment
+	audioFragment *protocol.Fmp4Fragment
+	pendingVideo  *protocol.Fmp4Sample
+	pendingDts    uint64
+	segmentStart  uint64
+	lastTime      uint64
+	sequence      uint32
+	discontinuity bool
+}
+
+// NewPackager creates a new CMAF packager and attaches it to a streamer.
+//
+// prefix is the URL path the packager is served under and must end with a slash.
+// The playlist is available as index.m3u8 under this prefix.
+func NewPackager(name string, prefix string, streamer *Streamer, broker ConnectionBroker, auth auth.Authenticator) *Packager {
+	packager := &Packager{
+		name:     name,
+		prefix:   prefix,
+		streamer: streamer,
+		broker:   broker,
+		auth:     auth,
+		stats:    &metrics.DummyCollector{},
+		input:    make(chan protocol.MpegTsPacket, packagerQueueSize),
+		demux:    protocol.NewMpegTsDemuxer(),
+
+		sessionTimeout: packagerSessionTimeout,
+		sessions:       make(map[string]*packagerSession),
+	}
+	streamer.AddSink(packager.input)
+	go packager.run()
+	return packager
+}
+
+// SetCollector assigns a stats collector
+func (packager *Packager) SetCollector(stats metrics.Collector) {
+	packager.stats = stats
+}
+
+// SetSessionTimeout sets the idle time after which a client session ends
+// and its connection slot is released.
+// Must be called before the packager is added to an HTTP server.
+func (packager *Packager) SetSessionTimeout(timeout time.Duration) {
+	packager.sessionTimeout = timeout
+}
+
+// run is the segmenter loop.
+func (packager *Packager) run() {
+	logger.Logkv(
+		"event", eventPackagerStart,
+		"stream", packager.name,
+		"message", fmt.Sprintf("Starting CMAF packager for %s", packager.name),
+	)
+	for batch := range packager.input {
+		// the demuxer can only handle single packets
+		for offset := 0; offset+protocol.MpegTsPacketSize <= len(batch); offset += protocol.MpegTsPacketSize {
+			packager.push(batch[offset : offset+protocol.MpegTsPacketSize])
+		}
+	}
+}
+
+// push demuxes a single TS packet and packages the completed elementary stream packets.
+func (packager *Packager) push(packet protocol.MpegTsPacket) {
+	for _, pes := range packager.demux.Push(packet) {
+		switch pes.StreamType {
+		case protocol.MpegTsStreamTypeH264:
+			packager.handleVideo(pes)
+		case protocol.MpegTsStreamTypeAacAdts:
+			packager.handleAudio(pes)
+		}
+	}
+}
+
+// hasVideo tells if the program contains a supported video stream.
+func (packager *Packager) hasVideo() bool {
+	for _, typ := range packager.demux.StreamTypes() {
+		if typ == protocol.MpegTsStreamTypeH264 {
+			return true
+		}
+	}
+	return false
+}
+
+// reset drops all pending samples and marks the next segment as discontinuous.
+func (packager *Packager) reset() {
+	packager.videoFragment = nil
+	packager.audioFragment = nil
+	packager.pendingVideo = nil
+	packager.discontinuity = true
+}
+
+// handleVideo adds an H.264 access unit to the current segment.
+func (packager *Packager) handleVideo(pes *protocol.ElementaryPacket) {
+	sample, sps, pps, idr := protocol.AnnexBToLengthPrefixed(pes.Data)
+	if sps != nil && pps != nil && (packager.video == nil || !bytes.Equal(sps, packager.video.Sps) || !bytes.Equal(pps, packager.video.Pps)) {
+		width, height, err := protocol.H264Resolution(sps)
+		if err != nil {
+			logger.Logkv(
+				"event", eventPackagerError,
+				"error", errorPackagerSps,
+				"stream", packager.name,
+				"message", err.Error(),
+			)
+			return
+		}
+		if packager.video != nil {
+			// codec configuration changed, we need a new init segment
+			packager.reset()
+			packager.lock.Lock()
+			packager.init = nil
+			packager.lock.Unlock()
+		}
+		packager.video = &protocol.Fmp4Track{
+			Id:        packagerVideoTrack,
+			Video:     true,
+			Timescale: protocol.Fmp4VideoTimescale,
+			Sps:       sps,
+			Pps:       pps,
+			Width:     width,
+			Height:    height,
+		}
+	}
+	if packager.video == nil || len(sample) == 0 {
+		return
+	}
+	if pes.Dts < packager.lastTime {
+		packager.reset()
+	}
+	packager.lastTime = pes.Dts
+
+	if packager.pendingVideo != nil && packager.videoFragment != nil {
+		packager.pendingVideo.Duration = uint32(pes.Dts - packager.pendingDts)
+		packager.videoFragment.Samples = append(packager.videoFragment.Samples, packager.pendingVideo)
+		packager.pendingVideo = nil
+	}
+	if idr && packager.videoFragment != nil && pes.Dts-packager.segmentStart >= packagerTargetDuration {
+		packager.cut(pes.Dts)
+	}
+	if packager.videoFragment == nil {
+		// segments must start with a keyframe
+		if !idr {
+			return
+		}
+		packager.videoFragment = &protocol.Fmp4Fragment{
+			Track:          packager.video,
+			BaseDecodeTime: pes.Dts,
+		}
+		packager.segmentStart = pes.Dts
+	}
+	packager.pendingVideo = &protocol.Fmp4Sample{
+		Data:              sample,
+		CompositionOffset: int32(int64(pes.Pts) - int64(pes.Dts)),
+		Sync:              idr,
+	}
+	packager.pendingDts = pes.Dts
+}
+
+// handleAudio adds AAC frames to the current segment.
+func (packager *Packager) handleAudio(pes *protocol.ElementaryPacket) {
+	frames, err := protocol.SplitAdts(pes.Data)
+	if err != nil {
+		logger.Logkv(
+			"event", eventPackagerError,
+			"error", errorPackagerAdts,
+			"stream", packager.name,
+			"message", err.Error(),
+		)
+	}
+	if len(frames) == 0 {
+		return
+	}
+	if packager.audio == nil || !bytes.Equal(frames[0].Config, packager.audio.AudioConfig) {
+		if packager.audio != nil {
+			packager.reset()
+			packager.lock.Lock()
+			packager.init = nil
+			packager.lock.Unlock()
+		}
+		packager.audio = &protocol.Fmp4Track{
+			Id:          packagerAudioTrack,
+			Timescale:   frames[0].SampleRate,
+			AudioConfig: frames[0].Config,
+			Channels:    frames[0].Channels,
+		}
+	}
+
+	video := packager.hasVideo()
+	if video {
+		// align audio to the video segments
+		if packager.videoFragment == nil {
+			return
+		}
+	} else {
+		if pes.Pts < packager.lastTime {
+			packager.reset()
+		}
+		packager.lastTime = pes.Pts
+		if packager.audioFragment != nil && pes.Pts-packager.segmentStart >= packagerTargetDuration {
+			packager.cut(pes.Pts)
+		}
+	}
+	if packager.audioFragment == nil {
+		packager.audioFragment = &protocol.Fmp4Fragment{
+			Track:          packager.audio,
+			BaseDecodeTime: pes.Pts * uint64(packager.audio.Timescale) / protocol.Fmp4VideoTimescale,
+		}
+		if !video {
+			packager.segmentStart = pes.Pts
+		}
+	}
+	for _, frame := range frames {
+		packager.audioFragment.Samples = append(packager.audioFragment.Samples, &protocol.Fmp4Sample{
+			Data:     frame.Data,
+			Duration: packagerAudioFrameSize,
+			Sync:     true,
+		})
+	}
+}
+
+// cut finalizes the current segment and adds it to the playlist.
+func (packager *Packager) cut(end uint64) {
+	var tracks []*protocol.Fmp4Track
+	var fragments []*protocol.Fmp4Fragment
+	if packager.video != nil && packager.hasVideo() {
+		tracks = append(tracks, packager.video)
+		if packager.videoFragment != nil && len(packager.videoFragment.Samples) > 0 {
+			fragments = append(fragments, packager.videoFragment)
+		}
+	}
+	if packager.audio != nil {
+		tracks = append(tracks, packager.audio)
+		if packager.audioFragment != nil && len(packager.audioFragment.Samples) > 0 {
+			fragments = append(fragments, packager.audioFragment)
+		}
+	}
+	packager.videoFragment = nil
+	packager.audioFragment = nil
+	if len(fragments) == 0 {
+		return
+	}
+
+	packager.sequence++
+	segment := &packagerSegment{
+		sequence:      packager.sequence,
+		duration:      float64(end-packager.segmentStart) / protocol.Fmp4VideoTimescale,
+		discontinuity: packager.discontinuity,
+		data:          protocol.Fmp4MediaSegment(packager.sequence, fragments),
+	}
+	packager.discontinuity = false
+
+	packager.lock.Lock()
+	if packager.init == nil {
+		packager.init = protocol.Fmp4InitSegment(tracks)
+	}
+	packager.segments = append(packager.segments, segment)
+	if len(packager.segments) > packagerWindow {
+		packager.segments = packager.segments[len(packager.segments)-packagerWindow:]
+	}
+	packager.lock.Unlock()
+
+	logger.Logkv(
+		"event", eventPackagerSegment,
+		"stream", packager.name,
+		"sequence", segment.sequence,
+		"duration", segment.duration,
+		"length", len(segment.data),
+	)
+}
+
+// playlist generates the current HLS media playlist.
+// Must be called with the read lock held.
+func (packager *Packager) playlist() []byte {
+	var buffer bytes.Buffer
+	target := 1.0
+	for _, segment := range packager.segments {
+		target = math.Max(target, math.Ceil(segment.duration))
+	}
+	fmt.Fprintf(&buffer, "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:%d\n", int(target))
+	if len(packager.segments) > 0 {
+		fmt.Fprintf(&buffer, "#EXT-X-MEDIA-SEQUENCE:%d\n", packager.segments[0].sequence)
+	}
+	fmt.Fprintf(&buffer, "#EXT-X-INDEPENDENT-SEGMENTS\n#EXT-X-MAP:URI=\"%s\"\n", packagerInit)
+	for _, segment := range packager.segments {
+		if segment.discontinuity {
+			buffer.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&buffer, "#EXTINF:%.3f,\n%s%d%s\n", segment.duration, packagerSegmentPrefix, segment.sequence, packagerSegmentSuffix)
+	}
+	return buffer.Bytes()
+}
+
+// ServeHTTP handles requests for the playlist, the init segment and media segments.
+func (packager *Packager) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// fail-fast: verify that this user can access this resource first
+	if !auth.HandleHttpAuthentication(packager.auth, request, writer) {
+		return
+	}
+
+	if !packager.join(request.RemoteAddr) {
+		logger.Logkv(
+			"event", eventPackagerError,
+			"error", errorStreamerPoolFull,
+			"remote", request.RemoteAddr,
+			"message", fmt.Sprintf("Refusing request from %s, pool is full or offline", request.RemoteAddr),
+		)
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	resource := strings.TrimPrefix(request.URL.Path, packager.prefix)
+
+	var data []byte
+	var mime string
+	packager.lock.RLock()
+	switch {
+	case resource == packagerPlaylist:
+		if packager.init != nil {
+			data = packager.playlist()
+		}
+		mime = "application/vnd.apple.mpegurl"
+	case resource == packagerInit:
+		data = packager.init
+		mime = "video/mp4"
+	case strings.HasPrefix(resource, packagerSegmentPrefix) && strings.HasSuffix(resource, packagerSegmentSuffix):
+		number := strings.TrimSuffix(strings.TrimPrefix(resource, packagerSegmentPrefix), packagerSegmentSuffix)
+		if sequence, err := strconv.ParseUint(number, 10, 32); err == nil {
+			for _, segment := range packager.segments {
+				if segment.sequence == uint32(sequence) {
+					data = segment.data
+				}
+			}
+		}
+		mime = "video/iso.segment"
+	}
+	packager.lock.RUnlock()
+
+	if data == nil {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writer.Header().Set("Content-Type", mime)
+	writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if resource == packagerPlaylist {
+		// playlists change all the time
+		writer.Header().Set("Cache-Control", "no-cache")
+	}
+	writer.WriteHeader(http.StatusOK)
+	if _, err := writer.Write(data); err != nil {
+		logger.Logkv(
+			"event", eventPackagerError,
+			"error", errorPackagerWrite,
+			"remote", request.RemoteAddr,
+			"message", err.Error(),
+		)
+	}
+}
+
+// join adds a request to the session of its client.
+// A new session takes a slot from the connection broker, false is returned if it was refused.
+func (packager *Packager) join(remoteaddr string) bool {
+	// players may open a new connection for each request
+	client, _, err := net.SplitHostPort(remoteaddr)
+	if err != nil {
+		client = remoteaddr
+	}
+	packager.sessionLock.Lock()
+	defer packager.sessionLock.Unlock()
+	now := time.Now()
+	if session, ok := packager.sessions[client]; ok {
+		session.last = now
+		return true
+	}
+	if !packager.broker.Accept(remoteaddr, packager.streamer) {
+		return false
+	}
+	session := &packagerSession{
+		start: now,
+		last:  now,
+	}
+	// the timer can't fire before it is assigned, expire waits for the lock
+	session.timer = time.AfterFunc(packager.sessionTimeout, func() {
+		packager.expire(client, session)
+	})
+	packager.sessions[client] = session
+	packager.stats.ConnectionAdded()
+	return true
+}
+
+// expire ends a session if it has been idle for the session timeout,
+// and releases its connection slot.
+func (packager *Packager) expire(client string, session *packagerSession) {
+	packager.sessionLock.Lock()
+	if idle := time.Since(session.last); idle < packager.sessionTimeout {
+		session.timer.Reset(packager.sessionTimeout - idle)
+		packager.sessionLock.Unlock()
+		return
+	}
+	delete(packager.sessions, client)
+	packager.sessionLock.Unlock()
+
+	packager.stats.ConnectionRemoved()
+	packager.stats.StreamDuration(session.last.Sub(session.start))
+	packager.broker.Release(packager.streamer)
+}
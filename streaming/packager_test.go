@@ -0,0 +1,136 @@
+/* Copyright (c) 2026 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"bytes"
+	"github.com/onitake/restreamer/auth"
+	"github.com/onitake/restreamer/configuration"
+	"github.com/onitake/restreamer/protocol"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	// packagerTestKeyframe is an access unit with parameter sets for 1920x1080 and an IDR slice
+	packagerTestKeyframe = []byte{
+		0, 0, 0, 1, 0x67, 0x42, 0x00, 0x28, 0xda, 0x01, 0xe0, 0x08, 0x9f, 0x95,
+		0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80,
+		0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00,
+	}
+	// packagerTestFrame is an access unit with a non-IDR slice
+	packagerTestFrame = []byte{0, 0, 0, 1, 0x41, 0x9a, 0x02, 0x00}
+)
+
+// newTestPackager creates a packager that isn't fed by its streamer.
+func newTestPackager(broker ConnectionBroker) *Packager {
+	streamer := NewStreamer("cmaf", 10, broker, auth.NewAuthenticator(configuration.Authentication{}, nil))
+	return NewPackager("cmaf", "/cmaf/", streamer, broker, auth.NewAuthenticator(configuration.Authentication{}, nil))
+}
+
+// packagerGet requests a resource from the packager on behalf of a client.
+func packagerGet(packager *Packager, resource string, client string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", "/cmaf/"+resource, nil)
+	request.RemoteAddr = client
+	writer := httptest.NewRecorder()
+	packager.ServeHTTP(writer, request)
+	return writer
+}
+
+func TestPackagerPlaylist(t *testing.T) {
+	packager := newTestPackager(NewAccessController(0))
+
+	var output bytes.Buffer
+	mux := protocol.NewMpegTsMuxer(&output, true, false)
+	// 30 frames per second with a keyframe every 2 seconds, the last frame flushes the third keyframe
+	for frame := uint64(0); frame <= 121; frame++ {
+		dts := frame * 3000
+		var err error
+		if frame%60 == 0 {
+			err = mux.WriteVideo(packagerTestKeyframe, dts, dts, true)
+		} else {
+			err = mux.WriteVideo(packagerTestFrame, dts, dts, false)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for data := output.Bytes(); len(data) >= protocol.MpegTsPacketSize; data = data[protocol.MpegTsPacketSize:] {
+		packager.push(protocol.MpegTsPacket(data[:protocol.MpegTsPacketSize]))
+	}
+
+	playlist := packagerGet(packager, "index.m3u8", "192.0.2.1:1000")
+	expected := "#EXTM3U\n" +
+		"#EXT-X-VERSION:7\n" +
+		"#EXT-X-TARGETDURATION:2\n" +
+		"#EXT-X-MEDIA-SEQUENCE:1\n" +
+		"#EXT-X-INDEPENDENT-SEGMENTS\n" +
+		"#EXT-X-MAP:URI=\"init.mp4\"\n" +
+		"#EXTINF:2.000,\nsegment1.m4s\n" +
+		"#EXTINF:2.000,\nsegment2.m4s\n"
+	if playlist.Code != http.StatusOK || playlist.Body.String() != expected {
+		t.Errorf("Got playlist with status %d:\n%s", playlist.Code, playlist.Body.String())
+	}
+	if playlist.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("Playlist may be cached")
+	}
+
+	init := packagerGet(packager, "init.mp4", "192.0.2.1:1001")
+	if init.Code != http.StatusOK || !bytes.Contains(init.Body.Bytes(), []byte("avc1")) {
+		t.Errorf("Got init segment with status %d", init.Code)
+	}
+	segment := packagerGet(packager, "segment2.m4s", "192.0.2.1:1002")
+	if segment.Code != http.StatusOK || segment.Header().Get("Content-Type") != "video/iso.segment" || !bytes.Contains(segment.Body.Bytes(), []byte("moof")) {
+		t.Errorf("Got media segment with status %d", segment.Code)
+	}
+	if missing := packagerGet(packager, "segment3.m4s", "192.0.2.1:1003"); missing.Code != http.StatusNotFound {
+		t.Errorf("Got status %d for an incomplete segment, expected 404", missing.Code)
+	}
+}
+
+func TestPackagerSessions(t *testing.T) {
+	broker := &countingBroker{AccessController: NewAccessController(1)}
+	packager := newTestPackager(broker)
+	packager.SetSessionTimeout(50 * time.Millisecond)
+
+	// nothing has been packaged yet, but the client joins anyway
+	if code := packagerGet(packager, "index.m3u8", "192.0.2.1:1000").Code; code != http.StatusNotFound {
+		t.Errorf("Got status %d for the first request, expected 404", code)
+	}
+	// further requests of the same client don't take another slot, even from other ports
+	if code := packagerGet(packager, "segment1.m4s", "192.0.2.1:1001").Code; code != http.StatusNotFound {
+		t.Errorf("Got status %d for a request of a known client, expected 404", code)
+	}
+	if code := packagerGet(packager, "index.m3u8", "192.0.2.2:1000").Code; code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d for a second client, expected 503", code)
+	}
+
+	// the slot is released once the session is idle
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&broker.released) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if released := atomic.LoadInt32(&broker.released); released != 1 {
+		t.Fatalf("Released %d sessions, expected 1", released)
+	}
+	if code := packagerGet(packager, "index.m3u8", "192.0.2.2:1000").Code; code != http.StatusNotFound {
+		t.Errorf("Got status %d for a second client after the first left, expected 404", code)
+	}
+}
@@ -0,0 +1,188 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"github.com/onitake/restreamer/protocol"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// probeSchemes are the upstream protocols that may be probed.
+// Local resources (files, domain sockets and commands) are excluded,
+// as probe URLs come from API clients.
+var probeSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
+	"tcp":   true,
+	"udp":   true,
+	"rtmp":  true,
+}
+
+// ProbeReport summarizes what was received from an upstream during a probe.
+type ProbeReport struct {
+	// Url is the probed upstream
+	Url string `json:"url"`
+	// Valid is true if MPEG-TS packets, a PAT and a PMT were received
+	Valid bool `json:"valid"`
+	// Error is the connection or read error, if any
+	Error string `json:"error,omitempty"`
+	// Status is the HTTP status code, or 200 for other protocols once connected
+	Status int `json:"status,omitempty"`
+	// Duration is the time spent reading, in seconds
+	Duration float64 `json:"duration"`
+	// Packets is the number of TS packets received
+	Packets uint64 `json:"packets"`
+	// SyncErrors is the number of reads that didn't contain a sync byte
+	SyncErrors uint64 `json:"sync_errors"`
+	// Bitrate is the measured bitrate in bits per second
+	Bitrate float64 `json:"bitrate"`
+	// Pat is true if a program association table was received
+	Pat bool `json:"pat"`
+	// Pmt is true if a program map table was received
+	Pmt bool `json:"pmt"`
+	// Pids maps each received PID to its packet count
+	Pids map[uint16]uint64 `json:"pids"`
+	// Streams maps the elementary stream PIDs of the first program to their stream types
+	Streams map[uint16]byte `json:"streams"`
+}
+
+// Prober connects to upstreams for a short time and reports
+// whether they deliver a usable MPEG-TS stream.
+//
+// Only one probe runs at a time, further requests wait for their turn.
+type Prober struct {
+	// timeout is the connect timeout in seconds
+	timeout uint
+	// duration is the time to read from an upstream
+	duration time.Duration
+	// busy is held while a probe is running
+	busy chan struct{}
+}
+
+// NewProber creates a new upstream prober.
+// timeout is the connect timeout in seconds, the probe duration is used if it is 0.
+// duration is the time spent reading from each upstream.
+func NewProber(timeout uint, duration time.Duration) *Prober {
+	if timeout == 0 {
+		timeout = uint(duration.Seconds() + 1)
+	}
+	return &Prober{
+		timeout:  timeout,
+		duration: duration,
+		busy:     make(chan struct{}, 1),
+	}
+}
+
+// Probe connects to an upstream, reads from it for the configured duration and
+// returns a report.
+//
+// An error is returned if the URL is invalid or uses a protocol that may not be probed,
+// or if the context was cancelled before the probe could start.
+// Connection and read errors are part of the report.
+func (prober *Prober) Probe(ctx context.Context, uri string) (*ProbeReport, error) {
+	parsed, err := url.Parse(escapeZone(uri))
+	if err != nil {
+		return nil, err
+	}
+	if !probeSchemes[parsed.Scheme] {
+		return nil, ErrInvalidProtocol
+	}
+
+	select {
+	case prober.busy <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-prober.busy }()
+
+	logger.Logkv(
+		"event", eventProbeStart,
+		"url", parsed.String(),
+		"message", fmt.Sprintf("Probing %s", parsed),
+	)
+
+	report := &ProbeReport{
+		Url:     parsed.String(),
+		Pids:    make(map[uint16]uint64),
+		Streams: make(map[uint16]byte),
+	}
+	client, err := NewClient("probe", []string{parsed.String()}, nil, prober.timeout, 0, 0, 1, "", 64, 1500)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.open(ctx, parsed); err != nil {
+		report.Error = err.Error()
+		return report, nil
+	}
+	input := client.getInput()
+	report.Status = client.StatusCode()
+	if report.Status != http.StatusOK {
+		input.Close()
+		report.Error = ErrInvalidResponse.Error()
+		return report, nil
+	}
+
+	// stop reading when the time is up or the caller goes away
+	ctx, cancel := context.WithTimeout(ctx, prober.duration)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		input.Close()
+	}()
+
+	demux := protocol.NewMpegTsDemuxer()
+	start := time.Now()
+	for {
+		packet, err := protocol.ReadMpegTsPacket(input)
+		if err != nil {
+			// closing the input at the end of the probe is not an error
+			if ctx.Err() == nil {
+				report.Error = err.Error()
+			}
+			break
+		}
+		if packet == nil {
+			report.SyncErrors++
+			continue
+		}
+		report.Packets++
+		report.Pids[protocol.MpegTsPacketPid(packet)]++
+		demux.Push(packet)
+	}
+	report.Duration = time.Since(start).Seconds()
+
+	report.Pat = report.Pids[protocol.MpegTsPidPat] > 0
+	report.Streams = demux.StreamTypes()
+	report.Pmt = len(report.Streams) > 0
+	report.Valid = report.Packets > 0 && report.Pat && report.Pmt
+	if report.Duration > 0 {
+		report.Bitrate = float64(report.Packets*protocol.MpegTsPacketSize*8) / report.Duration
+	}
+
+	logger.Logkv(
+		"event", eventProbeDone,
+		"url", parsed.String(),
+		"valid", report.Valid,
+		"packets", report.Packets,
+		"message", fmt.Sprintf("Probe of %s finished, valid=%t packets=%d", parsed, report.Valid, report.Packets),
+	)
+	return report, nil
+}
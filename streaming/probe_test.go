@@ -0,0 +1,69 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"bytes"
+	"context"
+	"github.com/onitake/restreamer/protocol"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProber(t *testing.T) {
+	var stream bytes.Buffer
+	mux := protocol.NewMpegTsMuxer(&stream, true, false)
+	if err := mux.WriteTables(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mux.WriteVideo(make([]byte, 1000), 1800, 900, true); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write(stream.Bytes())
+		writer.(http.Flusher).Flush()
+		// keep the connection open like a live stream
+		<-request.Context().Done()
+	}))
+	defer server.Close()
+
+	prober := NewProber(1, 200*time.Millisecond)
+	report, err := prober.Probe(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid || !report.Pat || !report.Pmt {
+		t.Errorf("Valid stream not detected: %+v", report)
+	}
+	if report.Error != "" {
+		t.Errorf("Unexpected error: %s", report.Error)
+	}
+	if report.Packets != uint64(stream.Len()/protocol.MpegTsPacketSize) {
+		t.Errorf("Got %d packets, expected %d", report.Packets, stream.Len()/protocol.MpegTsPacketSize)
+	}
+	if len(report.Streams) != 1 || report.Bitrate <= 0 {
+		t.Errorf("Invalid stream details: %+v", report)
+	}
+
+	for _, uri := range []string{"fork://ls", "file:///etc/passwd", "unix:///tmp/socket", "%zz"} {
+		if _, err := prober.Probe(context.Background(), uri); err == nil {
+			t.Errorf("Probing %s was not refused", uri)
+		}
+	}
+}
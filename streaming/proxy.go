@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"github.com/onitake/restreamer/auth"
 	"github.com/onitake/restreamer/metrics"
+	"github.com/prometheus/client_golang/prometheus"
 	"hash/fnv"
 	"io"
 	"mime"
@@ -29,6 +30,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -37,18 +39,112 @@ const (
 	proxyDefaultLimit = 10 * 1024 * 1024
 	proxyDefaultMime  = "application/octet-stream"
 	proxyFetchQueue   = 10
+	// proxyDefaultErrorCache is the cache time of upstream error responses, unless configured otherwise
+	proxyDefaultErrorCache = 5 * time.Second
 )
 
 var (
-	// headerList is a list of HTTP headers that are allowed to be sent through the proxy.
+	// headerList is the default list of HTTP headers that are allowed to be sent through the proxy.
 	headerList = []string{
 		"Content-Type",
+		"Content-Language",
+		"Content-Disposition",
+	}
+	// hopHeaders are never forwarded, they only apply to a single connection.
+	// Content-Length is also included, as it is calculated by the proxy.
+	hopHeaders = []string{
+		"Connection",
+		"Keep-Alive",
+		"Proxy-Authenticate",
+		"Proxy-Authorization",
+		"Proxy-Connection",
+		"Te",
+		"Trailer",
+		"Transfer-Encoding",
+		"Upgrade",
+		"Content-Length",
 	}
 	ErrNoLength      = errors.New("restreamer: Fetching of remote resource with unknown length not supported")
 	ErrLimitExceeded = errors.New("restreamer: Resource too large for cache")
 	ErrShortRead     = errors.New("restreamer: Short read, not all data was transferred in one go")
 )
 
+var (
+	metricProxyFetchWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "streaming_proxy_fetch_wait_seconds",
+			Help: "Time requests to static resources waited for the fetcher, in seconds.",
+		},
+	)
+	metricProxyCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streaming_proxy_cache_requests_total",
+			Help: "Number of requests to static resources, by whether they were served from the cache (hit) or had to wait for upstream (miss).",
+		},
+		[]string{"resource", "result"},
+	)
+	metricProxyFetchDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "streaming_proxy_fetch_duration_seconds",
+			Help: "Time it took to fetch static resources from upstream, in seconds.",
+		},
+		[]string{"resource"},
+	)
+	metricProxyBytesServed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streaming_proxy_bytes_served_total",
+			Help: "Total number of bytes of static resources sent to clients.",
+		},
+		[]string{"resource"},
+	)
+	metricProxyCacheSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "streaming_proxy_cache_size_bytes",
+			Help: "Size of the most recently fetched copy of static resources, in bytes.",
+		},
+		[]string{"resource"},
+	)
+)
+
+func init() {
+	metrics.MustRegister(metricProxyFetchWait)
+	metrics.MustRegister(metricProxyCacheRequests)
+	metrics.MustRegister(metricProxyFetchDuration)
+	metrics.MustRegister(metricProxyBytesServed)
+	metrics.MustRegister(metricProxyCacheSize)
+}
+
+// FetchLimiter caps the number of concurrent upstream fetches of all proxies that share it.
+// A nil FetchLimiter does not limit anything.
+type FetchLimiter struct {
+	slots chan struct{}
+}
+
+// NewFetchLimiter creates a limiter that allows up to concurrency simultaneous fetches.
+// Returns nil if concurrency is 0.
+func NewFetchLimiter(concurrency uint) *FetchLimiter {
+	if concurrency == 0 {
+		return nil
+	}
+	return &FetchLimiter{
+		slots: make(chan struct{}, concurrency),
+	}
+}
+
+// acquire blocks until a fetch slot is available.
+func (limiter *FetchLimiter) acquire() {
+	if limiter != nil {
+		limiter.slots <- struct{}{}
+	}
+}
+
+// release returns a fetch slot.
+func (limiter *FetchLimiter) release() {
+	if limiter != nil {
+		<-limiter.slots
+	}
+}
+
 // fetchableResource contains a cachable resource and its metadata.
 // This encapsulated type is used to ship data between the fetcher and the server.
 type fetchableResource struct {
@@ -62,16 +158,35 @@ type fetchableResource struct {
 	header http.Header
 	// last update time (for aging)
 	updated time.Time
+	// last modification time reported by upstream, zero if unknown
+	modified time.Time
+}
+
+// failed tells if the resource is an error response.
+func (res *fetchableResource) failed() bool {
+	return res.statusCode < http.StatusOK || res.statusCode >= http.StatusMultipleChoices
 }
 
 // Proxy implements a caching HTTP proxy.
 type Proxy struct {
-	// the upstream URL (file/http/https)
-	url *url.URL
+	// name is the resource label of the proxy metrics
+	name string
+	// the upstream URLs (file/http/https), tried in order
+	urls []*url.URL
 	// HTTP client timeout
 	timeout time.Duration
 	// the cache time
 	stale time.Duration
+	// how long a stale resource may still be served while it is refreshed in the background
+	maxStale time.Duration
+	// the cache time of upstream error responses
+	errorStale time.Duration
+	// delivers resources refreshed in the background to the fetcher
+	refreshed chan *fetchableResource
+	// delivers resources that requests are waiting for to the fetcher
+	fetched chan *fetchableResource
+	// limits concurrent upstream fetches, shared with other proxies
+	limiter *FetchLimiter
 	// maximum size of remote resource
 	limit int64
 	// fetcher data request channel
@@ -86,6 +201,14 @@ type Proxy struct {
 	stats metrics.Statistics
 	// auth is an authentication verifier for client requests
 	auth auth.Authenticator
+	// defaultMime is the content type sent if it is unknown
+	defaultMime string
+	// contentType overrides the upstream content type if it is not empty
+	contentType string
+	// allowHeaders is the list of upstream headers that are forwarded
+	allowHeaders []string
+	// denyHeaders is the list of upstream headers that are never forwarded
+	denyHeaders []string
 }
 
 // NewProxy constructs a new HTTP proxy.
@@ -95,23 +218,41 @@ type Proxy struct {
 // every time it is requested.
 // timeout sets the upstream HTTP connection timeout.
 func NewProxy(uri string, timeout uint, cache uint, auth auth.Authenticator) (*Proxy, error) {
-	parsed, err := url.Parse(uri)
-	if err != nil {
-		return nil, err
+	return NewMirrorProxy([]string{uri}, timeout, cache, auth)
+}
+
+// NewMirrorProxy constructs a new HTTP proxy with several upstream mirrors.
+// The mirrors are tried in order until one of them delivers the resource.
+// Otherwise, it behaves like NewProxy.
+func NewMirrorProxy(uris []string, timeout uint, cache uint, auth auth.Authenticator) (*Proxy, error) {
+	if len(uris) < 1 {
+		return nil, ErrNoUrl
+	}
+	urls := make([]*url.URL, len(uris))
+	for i, uri := range uris {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+		urls[i] = parsed
 	}
 
 	return &Proxy{
-		url:     parsed,
-		timeout: time.Duration(timeout) * time.Second,
-		stale:   time.Duration(cache) * time.Second,
+		urls:       urls,
+		timeout:    time.Duration(timeout) * time.Second,
+		stale:      time.Duration(cache) * time.Second,
+		errorStale: proxyDefaultErrorCache,
 		// TODO make this configurable
-		limit: proxyDefaultLimit,
-		// TODO make queue length configurable
-		fetcher:  make(chan chan<- *fetchableResource, proxyFetchQueue),
-		shutdown: make(chan struct{}),
-		resource: nil,
-		stats:    &metrics.DummyStatistics{},
-		auth:     auth,
+		limit:        proxyDefaultLimit,
+		fetcher:      make(chan chan<- *fetchableResource, proxyFetchQueue),
+		shutdown:     make(chan struct{}),
+		resource:     nil,
+		refreshed:    make(chan *fetchableResource, 1),
+		fetched:      make(chan *fetchableResource, 1),
+		stats:        &metrics.DummyStatistics{},
+		auth:         auth,
+		defaultMime:  proxyDefaultMime,
+		allowHeaders: headerList,
 	}, nil
 }
 
@@ -120,6 +261,127 @@ func (proxy *Proxy) SetStatistics(stats metrics.Statistics) {
 	proxy.stats = stats
 }
 
+// SetName sets the name of the resource, as it is reported in metrics.
+// The serving path is a good choice.
+// Must be called before Start.
+func (proxy *Proxy) SetName(name string) {
+	proxy.name = name
+}
+
+// SetFetchQueue sets the number of requests that can be queued for the fetcher.
+// If length is 0, the default of 10 is used.
+// Must be called before Start.
+func (proxy *Proxy) SetFetchQueue(length uint) {
+	if length == 0 {
+		length = proxyFetchQueue
+	}
+	proxy.fetcher = make(chan chan<- *fetchableResource, length)
+}
+
+// SetFetchLimiter assigns a limiter for concurrent upstream fetches.
+// Pass nil to disable the limit.
+// Must be called before Start.
+func (proxy *Proxy) SetFetchLimiter(limiter *FetchLimiter) {
+	proxy.limiter = limiter
+}
+
+// SetMaxStale enables stale-while-revalidate.
+// Once the cache time has passed, the stale resource is still served for up to maxStale,
+// while a fresh copy is fetched in the background. Older resources are refetched before
+// the request is answered.
+// A maxStale of 0 disables background refreshing.
+// Must be called before Start.
+func (proxy *Proxy) SetMaxStale(maxStale time.Duration) {
+	proxy.maxStale = maxStale
+}
+
+// SetErrorCache sets the cache time of non-2xx upstream responses,
+// so a transient upstream error isn't served for the full cache time.
+// Errors are never served while they are revalidated, and clients are told not to cache them.
+// If errorCache is 0, errors are cached for 5 seconds. The cache time of the resource is never exceeded.
+// Must be called before Start.
+func (proxy *Proxy) SetErrorCache(errorCache time.Duration) {
+	if errorCache <= 0 {
+		errorCache = proxyDefaultErrorCache
+	}
+	proxy.errorStale = errorCache
+}
+
+// lifetime returns the cache time of a resource and how long it may be served after that.
+func (proxy *Proxy) lifetime(res *fetchableResource) (time.Duration, time.Duration) {
+	if res.failed() {
+		if proxy.errorStale < proxy.stale {
+			return proxy.errorStale, 0
+		}
+		return proxy.stale, 0
+	}
+	return proxy.stale, proxy.maxStale
+}
+
+// SetHeaders configures which upstream headers are forwarded to clients.
+// Header names may end with a *, which matches all headers starting with the name,
+// like X-*. A single * forwards all headers.
+// Headers in deny are never forwarded, even if they are allowed.
+// If allow is empty, the default list (Content-Type, Content-Language and Content-Disposition) is used.
+// Hop-by-hop headers like Connection or Transfer-Encoding are always dropped.
+func (proxy *Proxy) SetHeaders(allow []string, deny []string) {
+	if len(allow) == 0 {
+		allow = headerList
+	}
+	proxy.allowHeaders = allow
+	proxy.denyHeaders = deny
+}
+
+// matchHeader checks if a header name matches any entry of a header list.
+func matchHeader(list []string, key string) bool {
+	for _, entry := range list {
+		if strings.HasSuffix(entry, "*") {
+			prefix := http.CanonicalHeaderKey(strings.TrimSuffix(entry, "*"))
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if http.CanonicalHeaderKey(entry) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardHeaders copies the allowed upstream headers to a response.
+func (proxy *Proxy) forwardHeaders(dst http.Header, src http.Header) {
+	// headers listed in Connection are hop-by-hop as well
+	var connection []string
+	for _, value := range src.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			connection = append(connection, strings.TrimSpace(name))
+		}
+	}
+	for key, values := range src {
+		if matchHeader(hopHeaders, key) || matchHeader(connection, key) || matchHeader(proxy.denyHeaders, key) {
+			continue
+		}
+		if matchHeader(proxy.allowHeaders, key) {
+			dst[key] = append([]string(nil), values...)
+		}
+	}
+}
+
+// SetDefaultMime sets the content type that is sent when neither upstream
+// nor the file extension provide one.
+// Passing an empty string restores the default, application/octet-stream.
+func (proxy *Proxy) SetDefaultMime(mime string) {
+	if mime == "" {
+		mime = proxyDefaultMime
+	}
+	proxy.defaultMime = mime
+}
+
+// SetContentType overrides the content type of the resource, including parameters like the charset.
+// Passing an empty string uses the upstream content type again.
+func (proxy *Proxy) SetContentType(ctype string) {
+	proxy.contentType = ctype
+}
+
 // Get opens a remote or local resource specified by URL and returns a reader,
 // upstream HTTP headers, an HTTP status code and the resource data length, or -1 if no length is available.
 // Local resources contain guessed data.
@@ -140,6 +402,7 @@ func Get(url *url.URL, timeout time.Duration) (reader io.Reader, header http.Hea
 			info, err2 := os.Stat(url.Path)
 			if err2 == nil {
 				length = info.Size()
+				header.Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
 			} else {
 				// we can't stat, so the length is indefinite...
 				length = -1
@@ -198,13 +461,38 @@ func (proxy *Proxy) Shutdown() {
 // fetch waits for fetch requests and handles them one-by-one.
 // If the resource is already cached and not stale, it replies very quickly.
 // Performance impact should be minimal in this case.
-// Blocks while the resource is fetched.
+//
+// Upstream fetches run in a separate goroutine, so the fetcher stays responsive.
+// Requests that arrive while the resource is being fetched wait for the same fetch,
+// instead of triggering another one.
+// If a stale resource may still be served, it is returned immediately and refreshed
+// in the background.
 func (proxy *Proxy) fetch() {
 	running := true
+	refreshing := false
+	// requests waiting for the resource to be fetched
+	var waiting []chan<- *fetchableResource
 	for running {
 		select {
 		case <-proxy.shutdown:
 			running = false
+		case res := <-proxy.refreshed:
+			refreshing = false
+			// don't replace a resource that was fetched synchronously in the meantime
+			if proxy.resource == nil || res.updated.After(proxy.resource.updated) {
+				proxy.resource = res
+			}
+		case res := <-proxy.fetched:
+			proxy.resource = res
+			logger.Logkv(
+				"event", eventProxyReturn,
+				"message", "Returning resource",
+				"waiting", len(waiting),
+			)
+			for _, request := range waiting {
+				request <- res
+			}
+			waiting = nil
 		case request := <-proxy.fetcher:
 			logger.Logkv(
 				"event", eventProxyRequest,
@@ -213,15 +501,37 @@ func (proxy *Proxy) fetch() {
 			)
 			// verify if we need to refetch
 			now := time.Now()
-			if proxy.resource == nil || now.Sub(proxy.resource.updated) > proxy.stale {
-				// stale, cache first
+			var stale, maxStale time.Duration
+			if proxy.resource != nil {
+				stale, maxStale = proxy.lifetime(proxy.resource)
+			}
+			if proxy.resource == nil || now.Sub(proxy.resource.updated) > stale+maxStale {
+				// stale, wait for a fresh copy
+				metricProxyCacheRequests.With(prometheus.Labels{"resource": proxy.name, "result": "miss"}).Inc()
+				if len(waiting) == 0 {
+					logger.Logkv(
+						"event", eventProxyStale,
+						"message", "Resource is stale",
+					)
+					go func() {
+						proxy.fetched <- proxy.cache()
+					}()
+				}
+				waiting = append(waiting, request)
+				continue
+			} else if now.Sub(proxy.resource.updated) > stale && !refreshing {
+				// still usable, refresh in the background
 				logger.Logkv(
-					"event", eventProxyStale,
-					"message", "Resource is stale",
+					"event", eventProxyRevalidate,
+					"message", "Resource is stale, revalidating in the background",
 				)
-				proxy.resource = proxy.cache()
+				refreshing = true
+				go func() {
+					proxy.refreshed <- proxy.cache()
+				}()
 			}
 			// and return
+			metricProxyCacheRequests.With(prometheus.Labels{"resource": proxy.name, "result": "hit"}).Inc()
 			logger.Logkv(
 				"event", eventProxyReturn,
 				"message", "Returning resource",
@@ -254,13 +564,45 @@ func Etag(data []byte) string {
 // cache fetches the remote resource into memory.
 // Does not return errors. Instead, the cached resource contains a suitable return code and error content.
 func (proxy *Proxy) cache() *fetchableResource {
+	proxy.limiter.acquire()
+	defer proxy.limiter.release()
+
+	start := time.Now()
+	var res *fetchableResource
+	for _, mirror := range proxy.urls {
+		var err error
+		res, err = proxy.cacheFrom(mirror)
+		if err == nil && res.statusCode < http.StatusBadRequest {
+			break
+		}
+		logger.Logkv(
+			"event", eventProxyMirrorFailed,
+			"url", mirror.String(),
+			"status", res.statusCode,
+			"message", fmt.Sprintf("Fetching from %s failed", mirror),
+		)
+	}
+	labels := prometheus.Labels{"resource": proxy.name}
+	metricProxyFetchDuration.With(labels).Observe(time.Since(start).Seconds())
+	metricProxyCacheSize.With(labels).Set(float64(len(res.data)))
+	return res
+}
+
+// cacheFrom fetches the resource from a single upstream URL.
+// The returned resource contains a suitable return code and error content if fetching failed.
+func (proxy *Proxy) cacheFrom(url *url.URL) (*fetchableResource, error) {
 	logger.Logkv(
 		"event", eventProxyFetch,
-		"message", "Fetching resource from upstream",
+		"url", url.String(),
+		"message", fmt.Sprintf("Fetching resource from %s", url),
 	)
 
 	// fetch from upstream
-	getter, header, status, length, err := Get(proxy.url, proxy.timeout)
+	getter, header, status, length, err := Get(url, proxy.timeout)
+	if closer, ok := getter.(io.Closer); ok {
+		//goland:noinspection GoUnhandledErrorResult
+		defer closer.Close()
+	}
 	if err != nil {
 		logger.Logkv(
 			"event", eventProxyError,
@@ -323,22 +665,48 @@ func (proxy *Proxy) cache() *fetchableResource {
 	}
 
 	res.updated = time.Now()
+	// keep the modification time for conditional requests
+	if modified, err := http.ParseTime(res.header.Get("Last-Modified")); err == nil {
+		res.modified = modified
+	}
 	// calculate the content hash
 	res.etag = Etag(res.data)
 
 	logger.Logkv(
 		"event", eventProxyFetched,
-		"message", "Fetched resource from upstream",
+		"url", url.String(),
+		"message", fmt.Sprintf("Fetched resource from %s", url),
 		"etag", res.etag,
 		"length", len(res.data),
 		"status", res.statusCode,
 	)
 
-	return res
+	return res, err
+}
+
+// notModified checks if a conditional request can be answered with a 304.
+// If-None-Match takes precedence over If-Modified-Since, as required by RFC 7232.
+func notModified(request *http.Request, res *fetchableResource) bool {
+	if match := request.Header.Get("If-None-Match"); match != "" {
+		return res.etag != "" && match == res.etag
+	}
+	if res.statusCode != http.StatusOK || res.modified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(request.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// HTTP dates only have second resolution
+	return !res.modified.Truncate(time.Second).After(since)
 }
 
 // ServeHTTP handles an incoming connection.
 // Satisfies the http.Handler interface, so it can be used in an HTTP server.
+//
+// HEAD requests are answered with the headers of the cached resource, including
+// ETag and Content-Length, but without the body. The resource is only fetched
+// if it isn't cached yet.
 func (proxy *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	// fail-fast: verify that this user can access this resource first
 	if !auth.HandleHttpAuthentication(proxy.auth, request, writer) {
@@ -355,6 +723,7 @@ func (proxy *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 		"event", eventProxyRequesting,
 		"message", "Handling incoming request",
 	)
+	start := time.Now()
 	proxy.fetcher <- fetchable
 	logger.Logkv(
 		"event", "waiting",
@@ -362,27 +731,36 @@ func (proxy *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 	)
 	res := <-fetchable
 	close(fetchable)
+	metricProxyFetchWait.Observe(time.Since(start).Seconds())
 	logger.Logkv(
 		"event", eventProxyRequestDone,
 		"message", "Request complete",
 	)
 
 	// copy (appropriate) headers
-	for _, key := range headerList {
-		value := res.header.Get(key)
-		if value != "" {
-			writer.Header().Set(key, value)
-		}
+	proxy.forwardHeaders(writer.Header(), res.header)
+	if proxy.contentType != "" {
+		writer.Header().Set("Content-Type", proxy.contentType)
+	} else if writer.Header().Get("Content-Type") == "" {
+		writer.Header().Set("Content-Type", proxy.defaultMime)
 	}
 
 	// headers for cached data
 	writer.Header().Set("ETag", res.etag)
+	if !res.modified.IsZero() {
+		writer.Header().Set("Last-Modified", res.modified.UTC().Format(http.TimeFormat))
+	}
 	// TODO maybe use the actual resource stale time here (Since())
-	// TODO no-cache for errors!
-	writer.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(proxy.stale.Seconds())))
+	if res.failed() {
+		writer.Header().Set("Cache-Control", "no-cache")
+	} else if proxy.maxStale > 0 {
+		writer.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, stale-while-revalidate=%d", int(proxy.stale.Seconds()), int(proxy.maxStale.Seconds())))
+	} else {
+		writer.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(proxy.stale.Seconds())))
+	}
 
-	// verify if ETag has matched
-	if res.etag != "" && request.Header.Get("If-None-Match") == res.etag {
+	// verify if ETag has matched, or if the resource wasn't modified
+	if notModified(request, res) {
 		logger.Logkv(
 			"event", eventProxyReplyNotChanged,
 			"message", "Returning 304",
@@ -399,8 +777,14 @@ func (proxy *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 		// otherwise, send updated data
 		writer.Header().Set("Content-Length", strconv.Itoa(len(res.data)))
 		writer.WriteHeader(res.statusCode)
+		// HEAD only wants the headers
+		if request.Method == http.MethodHead {
+			return
+		}
 		// and push the content
-		if _, err := writer.Write(res.data); err != nil {
+		bytes, err := writer.Write(res.data)
+		metricProxyBytesServed.With(prometheus.Labels{"resource": proxy.name}).Add(float64(bytes))
+		if err != nil {
 			logger.Logkv(
 				"event", eventProxyError,
 				"error", errorProxyWrite,
@@ -21,8 +21,15 @@ import (
 	"github.com/onitake/restreamer/auth"
 	"github.com/onitake/restreamer/configuration"
 	"github.com/onitake/restreamer/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -115,3 +122,352 @@ func TestProxy(t *testing.T) {
 	cached, _ := NewProxy("file:///tmp/test.txt", 10, 1, authenticator)
 	testWithProxy(t, l, cached)
 }
+
+func TestProxyContentType(t *testing.T) {
+	l := &mockProxyLogger{t, make(chan bool, 1)}
+	logger = l
+
+	file := filepath.Join(t.TempDir(), "playlist.unknown")
+	if err := os.WriteFile(file, []byte("#EXTM3U\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	authenticator := auth.NewAuthenticator(configuration.Authentication{}, nil)
+
+	tests := []struct {
+		defaultMime string
+		contentType string
+		expected    string
+	}{
+		{"", "", "application/octet-stream"},
+		{"text/plain", "", "text/plain"},
+		{"text/plain", "application/vnd.apple.mpegurl; charset=utf-8", "application/vnd.apple.mpegurl; charset=utf-8"},
+	}
+	for i, test := range tests {
+		proxy, _ := NewProxy("file://"+file, 10, 0, authenticator)
+		proxy.SetDefaultMime(test.defaultMime)
+		proxy.SetContentType(test.contentType)
+		proxy.Start()
+		writer := httptest.NewRecorder()
+		proxy.ServeHTTP(writer, httptest.NewRequest("GET", "/playlist", nil))
+		proxy.Shutdown()
+		<-l.Closed
+		if ctype := writer.Header().Get("Content-Type"); ctype != test.expected {
+			t.Errorf("Test %d: got content type %s, expected %s", i, ctype, test.expected)
+		}
+	}
+}
+
+func TestProxyIfModifiedSince(t *testing.T) {
+	l := &mockProxyLogger{t, make(chan bool, 1)}
+	logger = l
+
+	file := filepath.Join(t.TempDir(), "test.txt")
+	if err := os.WriteFile(file, []byte("test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(file, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	authenticator := auth.NewAuthenticator(configuration.Authentication{}, nil)
+	proxy, _ := NewProxy("file://"+file, 10, 0, authenticator)
+	proxy.Start()
+
+	tests := []struct {
+		since    time.Time
+		match    string
+		expected int
+	}{
+		{time.Time{}, "", http.StatusOK},
+		{modified.Add(-time.Second), "", http.StatusOK},
+		{modified, "", http.StatusNotModified},
+		{modified.Add(time.Hour), "", http.StatusNotModified},
+		// ETag takes precedence
+		{modified.Add(time.Hour), "\"mismatch\"", http.StatusOK},
+	}
+	for i, test := range tests {
+		request := httptest.NewRequest("GET", "/test.txt", nil)
+		if !test.since.IsZero() {
+			request.Header.Set("If-Modified-Since", test.since.Format(http.TimeFormat))
+		}
+		if test.match != "" {
+			request.Header.Set("If-None-Match", test.match)
+		}
+		writer := httptest.NewRecorder()
+		proxy.ServeHTTP(writer, request)
+		if writer.Code != test.expected {
+			t.Errorf("Test %d: got status %d, expected %d", i, writer.Code, test.expected)
+		}
+		if writer.Header().Get("Last-Modified") != modified.Format(http.TimeFormat) {
+			t.Errorf("Test %d: invalid Last-Modified header: %s", i, writer.Header().Get("Last-Modified"))
+		}
+	}
+
+	proxy.Shutdown()
+	<-l.Closed
+}
+
+func TestProxyStaleWhileRevalidate(t *testing.T) {
+	l := &mockProxyLogger{t, make(chan bool, 1)}
+	logger = l
+
+	file := filepath.Join(t.TempDir(), "test.txt")
+	if err := os.WriteFile(file, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	authenticator := auth.NewAuthenticator(configuration.Authentication{}, nil)
+	proxy, _ := NewProxy("file://"+file, 10, 0, authenticator)
+	proxy.SetMaxStale(time.Hour)
+	proxy.Start()
+	get := func() *httptest.ResponseRecorder {
+		writer := httptest.NewRecorder()
+		proxy.ServeHTTP(writer, httptest.NewRequest("GET", "/test.txt", nil))
+		return writer
+	}
+
+	first := get()
+	if first.Body.String() != "old" {
+		t.Errorf("Invalid initial content: %s", first.Body.String())
+	}
+	if cc := first.Header().Get("Cache-Control"); cc != "max-age=0, stale-while-revalidate=3600" {
+		t.Errorf("Invalid Cache-Control header: %s", cc)
+	}
+	if err := os.WriteFile(file, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the stale copy is served right away, the refresh happens in the background
+	if second := get(); second.Body.String() != "old" {
+		t.Errorf("Stale content not served: %s", second.Body.String())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for get().Body.String() != "new" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Resource was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	proxy.Shutdown()
+	<-l.Closed
+}
+
+func TestProxyMirrors(t *testing.T) {
+	l := &mockProxyLogger{t, make(chan bool, 1)}
+	logger = l
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "test.txt")
+	if err := os.WriteFile(file, []byte("mirror"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	authenticator := auth.NewAuthenticator(configuration.Authentication{}, nil)
+	proxy, err := NewMirrorProxy([]string{"file://" + filepath.Join(dir, "missing.txt"), "file://" + file}, 10, 0, authenticator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Start()
+	writer := httptest.NewRecorder()
+	proxy.ServeHTTP(writer, httptest.NewRequest("GET", "/test.txt", nil))
+	proxy.Shutdown()
+	<-l.Closed
+	if writer.Code != http.StatusOK || writer.Body.String() != "mirror" {
+		t.Errorf("Mirror was not used: status %d, body %s", writer.Code, writer.Body.String())
+	}
+}
+
+func TestProxyCoalescing(t *testing.T) {
+	l := &mockProxyLogger{t, make(chan bool, 1)}
+	logger = l
+
+	var fetches int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = writer.Write([]byte("slow"))
+	}))
+	defer upstream.Close()
+
+	authenticator := auth.NewAuthenticator(configuration.Authentication{}, nil)
+	proxy, _ := NewProxy(upstream.URL, 10, 60, authenticator)
+	proxy.SetFetchLimiter(NewFetchLimiter(1))
+	proxy.Start()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writer := httptest.NewRecorder()
+			proxy.ServeHTTP(writer, httptest.NewRequest("GET", "/slow", nil))
+			if writer.Body.String() != "slow" {
+				t.Errorf("Invalid content: %s", writer.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	proxy.Shutdown()
+	<-l.Closed
+
+	if count := atomic.LoadInt32(&fetches); count != 1 {
+		t.Errorf("Upstream was fetched %d times, expected 1", count)
+	}
+}
+
+func TestProxyErrorCache(t *testing.T) {
+	l := &mockProxyLogger{t, make(chan bool, 1)}
+	logger = l
+
+	var fetches int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			writer.WriteHeader(http.StatusBadGateway)
+		}
+		_, _ = writer.Write([]byte("data"))
+	}))
+	defer upstream.Close()
+
+	authenticator := auth.NewAuthenticator(configuration.Authentication{}, nil)
+	proxy, _ := NewProxy(upstream.URL, 10, 60, authenticator)
+	proxy.SetMaxStale(time.Hour)
+	proxy.SetErrorCache(50 * time.Millisecond)
+	proxy.Start()
+	get := func() *httptest.ResponseRecorder {
+		writer := httptest.NewRecorder()
+		proxy.ServeHTTP(writer, httptest.NewRequest("GET", "/data", nil))
+		return writer
+	}
+
+	first := get()
+	if first.Code != http.StatusBadGateway {
+		t.Errorf("Invalid initial status: %d", first.Code)
+	}
+	if cc := first.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Invalid Cache-Control header on error: %s", cc)
+	}
+	if cached := get(); cached.Code != http.StatusBadGateway {
+		t.Errorf("Error was not cached: %d", cached.Code)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// errors are not served while they are revalidated
+	second := get()
+	if second.Code != http.StatusOK || second.Body.String() != "data" {
+		t.Errorf("Error was not refetched: %d %s", second.Code, second.Body.String())
+	}
+	if cc := second.Header().Get("Cache-Control"); cc != "max-age=60, stale-while-revalidate=3600" {
+		t.Errorf("Invalid Cache-Control header: %s", cc)
+	}
+
+	proxy.Shutdown()
+	<-l.Closed
+
+	if count := atomic.LoadInt32(&fetches); count != 2 {
+		t.Errorf("Upstream was fetched %d times, expected 2", count)
+	}
+}
+
+func TestProxyHead(t *testing.T) {
+	l := &mockProxyLogger{t, make(chan bool, 1)}
+	logger = l
+
+	file := filepath.Join(t.TempDir(), "test.txt")
+	if err := os.WriteFile(file, []byte("head"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	authenticator := auth.NewAuthenticator(configuration.Authentication{}, nil)
+	proxy, _ := NewProxy("file://"+file, 10, 60, authenticator)
+	proxy.Start()
+
+	head := httptest.NewRecorder()
+	proxy.ServeHTTP(head, httptest.NewRequest(http.MethodHead, "/test.txt", nil))
+	if head.Code != http.StatusOK {
+		t.Errorf("Invalid status: %d", head.Code)
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("Body was sent: %s", head.Body.String())
+	}
+	if length := head.Header().Get("Content-Length"); length != "4" {
+		t.Errorf("Invalid Content-Length: %s", length)
+	}
+	get := httptest.NewRecorder()
+	proxy.ServeHTTP(get, httptest.NewRequest(http.MethodGet, "/test.txt", nil))
+	if get.Body.String() != "head" {
+		t.Errorf("Invalid content: %s", get.Body.String())
+	}
+	if head.Header().Get("ETag") != get.Header().Get("ETag") {
+		t.Errorf("ETag mismatch: %s != %s", head.Header().Get("ETag"), get.Header().Get("ETag"))
+	}
+
+	proxy.Shutdown()
+	<-l.Closed
+}
+
+func TestProxyMetrics(t *testing.T) {
+	l := &mockProxyLogger{t, make(chan bool, 1)}
+	logger = l
+
+	file := filepath.Join(t.TempDir(), "test.txt")
+	if err := os.WriteFile(file, []byte("metrics"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	authenticator := auth.NewAuthenticator(configuration.Authentication{}, nil)
+	proxy, _ := NewProxy("file://"+file, 10, 60, authenticator)
+	proxy.SetName("/metrics.txt")
+	proxy.Start()
+	for i := 0; i < 3; i++ {
+		proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics.txt", nil))
+	}
+	proxy.Shutdown()
+	<-l.Closed
+
+	labels := prometheus.Labels{"resource": "/metrics.txt"}
+	if miss := testutil.ToFloat64(metricProxyCacheRequests.With(prometheus.Labels{"resource": "/metrics.txt", "result": "miss"})); miss != 1 {
+		t.Errorf("Invalid number of cache misses: %v", miss)
+	}
+	if hit := testutil.ToFloat64(metricProxyCacheRequests.With(prometheus.Labels{"resource": "/metrics.txt", "result": "hit"})); hit != 2 {
+		t.Errorf("Invalid number of cache hits: %v", hit)
+	}
+	if served := testutil.ToFloat64(metricProxyBytesServed.With(labels)); served != 21 {
+		t.Errorf("Invalid number of bytes served: %v", served)
+	}
+	if size := testutil.ToFloat64(metricProxyCacheSize.With(labels)); size != 7 {
+		t.Errorf("Invalid cache size: %v", size)
+	}
+	if count := testutil.CollectAndCount(metricProxyFetchDuration, "streaming_proxy_fetch_duration_seconds"); count == 0 {
+		t.Errorf("No fetch duration recorded")
+	}
+}
+
+func TestProxyForwardHeaders(t *testing.T) {
+	upstream := http.Header{}
+	upstream.Set("Content-Type", "text/plain")
+	upstream.Set("Content-Language", "en")
+	upstream.Set("X-Origin", "test")
+	upstream.Set("X-Secret", "hidden")
+	upstream.Set("Transfer-Encoding", "chunked")
+	upstream.Set("Connection", "X-Hop")
+	upstream.Set("X-Hop", "hop")
+
+	tests := []struct {
+		allow    []string
+		deny     []string
+		expected []string
+	}{
+		{nil, nil, []string{"Content-Type", "Content-Language"}},
+		{[]string{"content-type", "x-*"}, []string{"X-Secret"}, []string{"Content-Type", "X-Origin"}},
+		{[]string{"*"}, nil, []string{"Content-Type", "Content-Language", "X-Origin", "X-Secret"}},
+	}
+	for i, test := range tests {
+		proxy, _ := NewProxy("file:///dev/null", 10, 0, nil)
+		proxy.SetHeaders(test.allow, test.deny)
+		header := http.Header{}
+		proxy.forwardHeaders(header, upstream)
+		if len(header) != len(test.expected) {
+			t.Errorf("Test %d: got headers %v, expected %v", i, header, test.expected)
+		}
+		for _, key := range test.expected {
+			if header.Get(key) != upstream.Get(key) {
+				t.Errorf("Test %d: header %s not forwarded", i, key)
+			}
+		}
+	}
+}
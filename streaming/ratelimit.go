@@ -0,0 +1,143 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"fmt"
+	"github.com/onitake/restreamer/util"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimitSweepInterval is the minimum time between two purges of idle client buckets
+	rateLimitSweepInterval = time.Minute
+)
+
+// rateBucket is the token bucket of a single client.
+type rateBucket struct {
+	// tokens is the number of available tokens at the time of the last update
+	tokens float64
+	// updated is the time of the last update
+	updated time.Time
+}
+
+// RateLimiter limits the rate of new connections per client IP address,
+// using a token bucket algorithm.
+//
+// It is checked before a connection is handed to the ConnectionBroker,
+// so rate limited requests do not count against connection limits.
+// A single limiter can be shared among several streams to apply
+// the limit globally.
+type RateLimiter struct {
+	// rate is the number of connections per second that are replenished
+	rate float64
+	// burst is the maximum number of connections that can be made at once
+	burst float64
+	// proxies is the list of trusted reverse proxies
+	proxies util.ProxyList
+	// lock protects the bucket map
+	lock sync.Mutex
+	// buckets contains the token buckets per client address
+	buckets map[string]*rateBucket
+	// swept is the time of the last purge
+	swept time.Time
+}
+
+// NewRateLimiter creates a new connection rate limiter.
+// rate is the number of connections per second that each client may open,
+// burst is the number of connections that may be opened at once.
+// A burst of 0 is treated like 1.
+// If a request comes from one of the trusted proxies, the forwarded address is used instead.
+func NewRateLimiter(rate float64, burst uint, proxies util.ProxyList) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   math.Max(float64(burst), 1),
+		proxies: proxies,
+		buckets: make(map[string]*rateBucket),
+		swept:   time.Now(),
+	}
+}
+
+// Allow consumes a token for the client that sent the request.
+// If no token was available, false is returned, along with the time
+// after which the next token will be available.
+func (limiter *RateLimiter) Allow(request *http.Request) (bool, time.Duration) {
+	client := limiter.proxies.ClientAddress(request)
+	now := time.Now()
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	if now.Sub(limiter.swept) >= rateLimitSweepInterval {
+		limiter.sweep(now)
+	}
+
+	bucket := limiter.buckets[client]
+	if bucket == nil {
+		bucket = &rateBucket{
+			tokens: limiter.burst,
+		}
+		limiter.buckets[client] = bucket
+	} else {
+		bucket.tokens = math.Min(limiter.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*limiter.rate)
+	}
+	bucket.updated = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep removes all buckets that have been refilled completely.
+// Must be called with the lock held.
+func (limiter *RateLimiter) sweep(now time.Time) {
+	for client, bucket := range limiter.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*limiter.rate >= limiter.burst {
+			delete(limiter.buckets, client)
+		}
+	}
+	limiter.swept = now
+}
+
+// HandleHttpRateLimit checks if a request is within the rate limit.
+// If not, a "429 Too Many Requests" response with a Retry-After header is sent,
+// and false is returned.
+// A nil limiter allows all requests.
+func HandleHttpRateLimit(limiter *RateLimiter, request *http.Request, writer http.ResponseWriter) bool {
+	if limiter == nil {
+		return true
+	}
+	allow, wait := limiter.Allow(request)
+	if !allow {
+		logger.Logkv(
+			"event", eventRateLimited,
+			"remote", request.RemoteAddr,
+			"client", limiter.proxies.ClientAddress(request),
+			"message", fmt.Sprintf("Rate limit exceeded for %s", request.RemoteAddr),
+		)
+		writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writer.WriteHeader(http.StatusTooManyRequests)
+	}
+	return allow
+}
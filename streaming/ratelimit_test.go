@@ -0,0 +1,53 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimiter(t *testing.T) {
+	logger = &mockAclLogger{t, "ratelimit"}
+
+	limiter := NewRateLimiter(0.001, 2, nil)
+	request := httptest.NewRequest("GET", "/", nil)
+	request.RemoteAddr = "1.2.3.4:1000"
+	for i := 0; i < 2; i++ {
+		if !HandleHttpRateLimit(limiter, request, httptest.NewRecorder()) {
+			t.Errorf("Request %d within burst was rejected", i)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	if HandleHttpRateLimit(limiter, request, recorder) {
+		t.Error("Request exceeding burst was accepted")
+	}
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("Invalid rate limit response: %d", recorder.Code)
+	}
+
+	// other clients are not affected
+	request.RemoteAddr = "5.6.7.8:1000"
+	if !HandleHttpRateLimit(limiter, request, httptest.NewRecorder()) {
+		t.Error("Request from a different client was rejected")
+	}
+	// and no limiter means no limit
+	if !HandleHttpRateLimit(nil, request, httptest.NewRecorder()) {
+		t.Error("Request without limiter was rejected")
+	}
+}
@@ -0,0 +1,262 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"fmt"
+	"github.com/onitake/restreamer/metrics"
+	"github.com/onitake/restreamer/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// recorderQueueSize is the number of packets the recorder can take from the streamer
+	// before packets are dropped.
+	recorderQueueSize = 1000
+	// recorderChunkSize is the number of bytes collected before they are handed off to the file writer.
+	recorderChunkSize = 64 * 1024
+	// recorderChunkQueueSize is the number of chunks that can be waiting for the file writer.
+	// Chunks are dropped when the disk can't keep up.
+	recorderChunkQueueSize = 64
+	// recorderFlushInterval is the maximum time data is held back before it is written out.
+	recorderFlushInterval = time.Second
+	// recorderTimeFormat is the format of the {time} placeholder in file names.
+	recorderTimeFormat = "20060102T150405Z"
+)
+
+var (
+	metricRecordBytesWritten = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streaming_record_bytes_written",
+			Help: "Total number of bytes written to recording files.",
+		},
+		[]string{"stream"},
+	)
+	metricRecordBytesDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streaming_record_bytes_dropped",
+			Help: "Total number of bytes that could not be recorded because the disk was too slow.",
+		},
+		[]string{"stream"},
+	)
+)
+
+func init() {
+	metrics.MustRegister(metricRecordBytesWritten)
+	metrics.MustRegister(metricRecordBytesDropped)
+}
+
+// Recorder archives a stream to disk while it is being served.
+//
+// Packets are collected into chunks and passed on to a separate writer,
+// so a slow disk never blocks the live path. If the writer can't keep up,
+// chunks are dropped and a warning is logged.
+//
+// Files are rotated when they reach a maximum size or age.
+type Recorder struct {
+	// name is the name of the stream
+	name string
+	// template is the file name template, with {stream} and {time} placeholders
+	template string
+	// maxSize is the size after which a new file is started, 0 for no limit
+	maxSize uint64
+	// maxDuration is the time after which a new file is started, 0 for no limit
+	maxDuration time.Duration
+	// input receives packets from the streamer
+	input chan protocol.MpegTsPacket
+	// control switches recording on and off
+	control chan bool
+	// chunks are handed from the collector to the writer.
+	// a nil chunk closes the current file.
+	chunks chan []byte
+}
+
+// NewRecorder creates a stream recorder and attaches it to a streamer.
+//
+// template is the path of the recording files. The placeholder {stream} is replaced with the stream name,
+// {time} with the UTC time when the file was created.
+// If recording is false, the recorder waits until it is started with SetRecording.
+func NewRecorder(name string, template string, maxSize uint64, maxDuration time.Duration, recording bool, streamer *Streamer) *Recorder {
+	recorder := &Recorder{
+		name:        name,
+		template:    template,
+		maxSize:     maxSize,
+		maxDuration: maxDuration,
+		input:       make(chan protocol.MpegTsPacket, recorderQueueSize),
+		control:     make(chan bool),
+		chunks:      make(chan []byte, recorderChunkQueueSize),
+	}
+	streamer.AddSink(recorder.input)
+	go recorder.collect(recording)
+	go recorder.write()
+	return recorder
+}
+
+// SetRecording starts or stops recording.
+// When recording is stopped, the current file is closed.
+// Starting it again creates a new file.
+func (recorder *Recorder) SetRecording(recording bool) {
+	recorder.control <- recording
+}
+
+// collect gathers packets into chunks and hands them off to the writer.
+func (recorder *Recorder) collect(recording bool) {
+	ticker := time.NewTicker(recorderFlushInterval)
+	defer ticker.Stop()
+	chunk := make([]byte, 0, recorderChunkSize)
+	for {
+		select {
+		case packet := <-recorder.input:
+			if recording {
+				chunk = append(chunk, packet...)
+				if len(chunk) >= recorderChunkSize {
+					chunk = recorder.handOff(chunk)
+				}
+			}
+		case <-ticker.C:
+			if len(chunk) > 0 {
+				chunk = recorder.handOff(chunk)
+			}
+		case command := <-recorder.control:
+			if recording && !command {
+				if len(chunk) > 0 {
+					chunk = recorder.handOff(chunk)
+				}
+				// always deliver the close marker, the writer will get to it eventually
+				recorder.chunks <- nil
+				logger.Logkv(
+					"event", eventRecorderStop,
+					"stream", recorder.name,
+					"message", fmt.Sprintf("Stopped recording stream %s", recorder.name),
+				)
+			} else if !recording && command {
+				logger.Logkv(
+					"event", eventRecorderStart,
+					"stream", recorder.name,
+					"message", fmt.Sprintf("Started recording stream %s", recorder.name),
+				)
+			}
+			recording = command
+		}
+	}
+}
+
+// handOff passes a chunk to the writer, or drops it if the writer is busy.
+// Returns a fresh chunk buffer.
+func (recorder *Recorder) handOff(chunk []byte) []byte {
+	select {
+	case recorder.chunks <- chunk:
+	default:
+		metricRecordBytesDropped.With(prometheus.Labels{"stream": recorder.name}).Add(float64(len(chunk)))
+		logger.Logkv(
+			"event", eventRecorderError,
+			"error", errorRecorderOverrun,
+			"stream", recorder.name,
+			"bytes", len(chunk),
+			"message", fmt.Sprintf("Disk can't keep up, dropped %d bytes of stream %s", len(chunk), recorder.name),
+		)
+	}
+	return make([]byte, 0, recorderChunkSize)
+}
+
+// fileName generates the name of a new recording file.
+func (recorder *Recorder) fileName(now time.Time) string {
+	return expandFileName(recorder.template, recorder.name, now)
+}
+
+// expandFileName replaces the {stream} and {time} placeholders of a file name template.
+func expandFileName(template string, name string, now time.Time) string {
+	// stream names are URL paths, keep them from creating subdirectories
+	stream := strings.ReplaceAll(strings.Trim(name, "/"), "/", "_")
+	replacer := strings.NewReplacer("{stream}", stream, "{time}", now.UTC().Format(recorderTimeFormat))
+	return replacer.Replace(template)
+}
+
+// write stores chunks in the recording file, rotating it as necessary.
+func (recorder *Recorder) write() {
+	var file *os.File
+	var size uint64
+	var opened time.Time
+	closeFile := func() {
+		if file != nil {
+			if err := file.Close(); err != nil {
+				logger.Logkv(
+					"event", eventRecorderError,
+					"error", errorRecorderWrite,
+					"stream", recorder.name,
+					"message", fmt.Sprintf("Error closing recording file: %v", err),
+				)
+			}
+			file = nil
+		}
+	}
+	for chunk := range recorder.chunks {
+		if chunk == nil {
+			closeFile()
+			continue
+		}
+		now := time.Now()
+		if file != nil && ((recorder.maxSize > 0 && size+uint64(len(chunk)) > recorder.maxSize) || (recorder.maxDuration > 0 && now.Sub(opened) >= recorder.maxDuration)) {
+			closeFile()
+		}
+		if file == nil {
+			name := recorder.fileName(now)
+			err := os.MkdirAll(filepath.Dir(name), 0755)
+			if err == nil {
+				file, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			}
+			if err != nil {
+				metricRecordBytesDropped.With(prometheus.Labels{"stream": recorder.name}).Add(float64(len(chunk)))
+				logger.Logkv(
+					"event", eventRecorderError,
+					"error", errorRecorderOpen,
+					"stream", recorder.name,
+					"file", name,
+					"message", fmt.Sprintf("Cannot open recording file %s: %v", name, err),
+				)
+				file = nil
+				continue
+			}
+			logger.Logkv(
+				"event", eventRecorderFile,
+				"stream", recorder.name,
+				"file", name,
+				"message", fmt.Sprintf("Recording stream %s to %s", recorder.name, name),
+			)
+			size = 0
+			opened = now
+		}
+		written, err := file.Write(chunk)
+		size += uint64(written)
+		metricRecordBytesWritten.With(prometheus.Labels{"stream": recorder.name}).Add(float64(written))
+		if err != nil {
+			logger.Logkv(
+				"event", eventRecorderError,
+				"error", errorRecorderWrite,
+				"stream", recorder.name,
+				"message", fmt.Sprintf("Error writing recording file: %v", err),
+			)
+			// try again with a new file
+			closeFile()
+		}
+	}
+	closeFile()
+}
@@ -0,0 +1,78 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"github.com/onitake/restreamer/protocol"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordedBytes sums up the size of all files in a directory tree.
+func recordedBytes(t *testing.T, dir string) int64 {
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return total
+}
+
+// waitDrained waits until the recorder has picked up all queued packets.
+func waitDrained(recorder *Recorder) {
+	for len(recorder.input) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	dir := t.TempDir()
+	streamer := NewStreamer("/live/test.ts", 10, NewAccessController(0), nil)
+	recorder := NewRecorder("/live/test.ts", filepath.Join(dir, "{stream}", "{time}.ts"), 0, 0, false, streamer)
+
+	if name := recorder.fileName(time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)); name != filepath.Join(dir, "live_test.ts", "20230102T030405Z.ts") {
+		t.Errorf("Invalid file name: %s", name)
+	}
+
+	packet := make(protocol.MpegTsPacket, protocol.MpegTsPacketSize)
+	// not recording yet, must be discarded
+	recorder.input <- packet
+	waitDrained(recorder)
+	recorder.SetRecording(true)
+	count := recorderChunkSize/protocol.MpegTsPacketSize + 1
+	for i := 0; i < count; i++ {
+		recorder.input <- packet
+	}
+	waitDrained(recorder)
+	recorder.SetRecording(false)
+
+	expected := int64(count * protocol.MpegTsPacketSize)
+	deadline := time.Now().Add(5 * time.Second)
+	for recordedBytes(t, dir) < expected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if total := recordedBytes(t, dir); total != expected {
+		t.Errorf("Recorded %d bytes, expected %d", total, expected)
+	}
+}
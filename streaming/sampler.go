@@ -0,0 +1,134 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/onitake/restreamer/protocol"
+)
+
+const (
+	// defaultSampleInterval is used when neither a packet count nor an interval is configured
+	defaultSampleInterval = 10 * time.Second
+	// mpegTsSyncByte is the first byte of every valid TS packet
+	mpegTsSyncByte = 0x47
+)
+
+// packetSampler collects a compact summary of the packets passing through
+// and logs it every few packets or seconds.
+// It is only used from a single goroutine and needs no locking.
+type packetSampler struct {
+	// url is the upstream the packets come from
+	url string
+	// every is the number of packets between summaries, 0 to only use the interval
+	every uint
+	// interval is the time between summaries, 0 to only use the packet count
+	interval time.Duration
+	// started is the start time of the current sampling period
+	started time.Time
+	// packets is the number of packets in the current period
+	packets uint
+	// bytes is the number of bytes in the current period
+	bytes uint64
+	// pids counts the packets per PID in the current period
+	pids map[uint16]uint
+	// continuity is the last continuity counter seen on each PID
+	continuity map[uint16]byte
+	// ccErrors is the number of continuity counter discontinuities in the current period
+	ccErrors uint
+	// syncErrors is the number of packets without sync byte in the current period
+	syncErrors uint
+	// last is the most recent packet
+	last protocol.MpegTsPacket
+}
+
+// newPacketSampler creates a sampler that logs a summary every packets
+// or after interval has passed, whichever comes first.
+// If both are 0, a summary is logged every 10 seconds.
+func newPacketSampler(url string, packets uint, interval time.Duration) *packetSampler {
+	if packets == 0 && interval == 0 {
+		interval = defaultSampleInterval
+	}
+	return &packetSampler{
+		url:        url,
+		every:      packets,
+		interval:   interval,
+		started:    time.Now(),
+		pids:       make(map[uint16]uint),
+		continuity: make(map[uint16]byte),
+	}
+}
+
+// Sample adds a packet to the summary and logs it when the period is over.
+func (sampler *packetSampler) Sample(packet protocol.MpegTsPacket) {
+	sampler.packets++
+	sampler.bytes += uint64(len(packet))
+	sampler.last = packet
+	if len(packet) < 4 || packet[0] != mpegTsSyncByte {
+		sampler.syncErrors++
+	} else {
+		pid := protocol.MpegTsPacketPid(packet)
+		sampler.pids[pid]++
+		// the counter only increments on packets with payload, null packets don't have one
+		if pid != protocol.MpegTsPidNull && packet[3]&0x10 != 0 {
+			cc := packet[3] & 0x0f
+			if last, ok := sampler.continuity[pid]; ok && cc != (last+1)&0x0f && cc != last {
+				sampler.ccErrors++
+			}
+			sampler.continuity[pid] = cc
+		}
+	}
+	if (sampler.every > 0 && sampler.packets >= sampler.every) || (sampler.interval > 0 && time.Since(sampler.started) >= sampler.interval) {
+		sampler.flush()
+	}
+}
+
+// flush logs the summary of the current period and starts a new one.
+// The continuity counters are kept, so discontinuities across periods are detected.
+func (sampler *packetSampler) flush() {
+	pids := make([]int, 0, len(sampler.pids))
+	for pid := range sampler.pids {
+		pids = append(pids, int(pid))
+	}
+	sort.Ints(pids)
+	histogram := make([]string, len(pids))
+	for i, pid := range pids {
+		histogram[i] = fmt.Sprintf("%d:%d", pid, sampler.pids[uint16(pid)])
+	}
+	logger.Logkv(
+		"event", eventClientSample,
+		"url", sampler.url,
+		"duration", time.Since(sampler.started).Seconds(),
+		"packets", sampler.packets,
+		"bytes", sampler.bytes,
+		"pids", strings.Join(histogram, " "),
+		"cc_errors", sampler.ccErrors,
+		"sync_errors", sampler.syncErrors,
+		"last", hex.Dump(sampler.last),
+	)
+	sampler.started = time.Now()
+	sampler.packets = 0
+	sampler.bytes = 0
+	sampler.pids = make(map[uint16]uint)
+	sampler.ccErrors = 0
+	sampler.syncErrors = 0
+}
@@ -0,0 +1,74 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"testing"
+	"time"
+
+	"github.com/onitake/restreamer/protocol"
+)
+
+func samplePacket(pid uint16, cc byte) protocol.MpegTsPacket {
+	packet := make(protocol.MpegTsPacket, protocol.MpegTsPacketSize)
+	packet[0] = mpegTsSyncByte
+	packet[1] = byte(pid>>8) & 0x1f
+	packet[2] = byte(pid)
+	packet[3] = 0x10 | cc&0x0f
+	return packet
+}
+
+func TestPacketSampler(t *testing.T) {
+	sampler := newPacketSampler("test", 0, time.Hour)
+	sampler.Sample(samplePacket(0x100, 0))
+	sampler.Sample(samplePacket(0x100, 1))
+	// duplicate packets are allowed
+	sampler.Sample(samplePacket(0x100, 1))
+	// discontinuity
+	sampler.Sample(samplePacket(0x100, 3))
+	sampler.Sample(samplePacket(0x101, 7))
+	sampler.Sample(samplePacket(protocol.MpegTsPidNull, 5))
+	sampler.Sample(make(protocol.MpegTsPacket, protocol.MpegTsPacketSize))
+	if sampler.packets != 7 {
+		t.Errorf("Invalid packet count: %d", sampler.packets)
+	}
+	if sampler.bytes != 7*protocol.MpegTsPacketSize {
+		t.Errorf("Invalid byte count: %d", sampler.bytes)
+	}
+	if sampler.pids[0x100] != 4 || sampler.pids[0x101] != 1 || sampler.pids[protocol.MpegTsPidNull] != 1 {
+		t.Errorf("Invalid PID histogram: %v", sampler.pids)
+	}
+	if sampler.ccErrors != 1 {
+		t.Errorf("Invalid continuity error count: %d", sampler.ccErrors)
+	}
+	if sampler.syncErrors != 1 {
+		t.Errorf("Invalid sync error count: %d", sampler.syncErrors)
+	}
+
+	// the packet count limit starts a new period
+	sampler = newPacketSampler("test", 2, 0)
+	sampler.Sample(samplePacket(0x100, 0))
+	sampler.Sample(samplePacket(0x100, 2))
+	if sampler.packets != 0 || sampler.ccErrors != 0 || len(sampler.pids) != 0 {
+		t.Errorf("Sampling period not reset: %d packets, %d errors", sampler.packets, sampler.ccErrors)
+	}
+	// continuity is tracked across periods
+	sampler.Sample(samplePacket(0x100, 4))
+	if sampler.ccErrors != 1 {
+		t.Errorf("Invalid continuity error count after reset: %d", sampler.ccErrors)
+	}
+}
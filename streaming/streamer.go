@@ -17,6 +17,9 @@
 package streaming
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/onitake/restreamer/auth"
@@ -25,7 +28,11 @@ import (
 	"github.com/onitake/restreamer/protocol"
 	"github.com/onitake/restreamer/util"
 	"github.com/prometheus/client_golang/prometheus"
+	"math"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -72,6 +79,27 @@ var (
 		},
 		[]string{"stream"},
 	)
+	metricPacketsNoConsumers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streaming_packets_no_consumers_total",
+			Help: "Total number of MPEG-TS packets received while no clients were connected.",
+		},
+		[]string{"stream"},
+	)
+	metricDuplicateConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streaming_duplicate_connections_total",
+			Help: "Total number of connections from clients that were already connected to the same stream too many times.",
+		},
+		[]string{"stream"},
+	)
+	metricSlowDisconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streaming_slow_disconnects_total",
+			Help: "Total number of client connections closed because their output buffer overflowed.",
+		},
+		[]string{"stream"},
+	)
 	metricConnections = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "streaming_connections",
@@ -79,6 +107,61 @@ var (
 		},
 		[]string{"stream"},
 	)
+	metricWaiting = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "streaming_waiting",
+			Help: "Number of clients held in the waiting room.",
+		},
+	)
+	metricConnectionMemory = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "streaming_connection_memory_bytes",
+			Help: "Estimated worst-case memory held by a single client connection.",
+		},
+		[]string{"stream"},
+	)
+	metricMemoryReserved = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "streaming_memory_reserved_bytes",
+			Help: "Estimated worst-case memory held by all active client connections.",
+		},
+	)
+	metricLastProgress = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "streaming_last_progress_timestamp_seconds",
+			Help: "Unix time at which the stream last distributed a packet, updated about once per second.",
+		},
+		[]string{"stream"},
+	)
+	metricTimeToFirstByte = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "streaming_time_to_first_byte_seconds",
+			Help:    "Time from accepting a client connection until the first stream data was written to it.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		},
+		[]string{"stream"},
+	)
+	metricCountryConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streaming_country_connections_total",
+			Help: "Total number of client connections by country, only counted if enabled.",
+		},
+		[]string{"stream", "country"},
+	)
+	metricGeoBlocked = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streaming_geo_blocked_total",
+			Help: "Total number of requests refused because of the client's country.",
+		},
+		[]string{"stream"},
+	)
+	metricProtocolConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streaming_protocol_connections_total",
+			Help: "Total number of client connections by HTTP protocol and TLS version.",
+		},
+		[]string{"stream", "proto", "tls"},
+	)
 	metricDuration = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "streaming_duration",
@@ -93,10 +176,60 @@ func init() {
 	metrics.MustRegister(metricBytesSent)
 	metrics.MustRegister(metricPacketsDropped)
 	metrics.MustRegister(metricBytesDropped)
+	metrics.MustRegister(metricPacketsNoConsumers)
+	metrics.MustRegister(metricDuplicateConnections)
+	metrics.MustRegister(metricSlowDisconnects)
 	metrics.MustRegister(metricConnections)
 	metrics.MustRegister(metricDuration)
+	metrics.MustRegister(metricLastProgress)
+	metrics.MustRegister(metricTimeToFirstByte)
+	metrics.MustRegister(metricCountryConnections)
+	metrics.MustRegister(metricGeoBlocked)
+	metrics.MustRegister(metricProtocolConnections)
+	metrics.MustRegister(metricWaiting)
+	metrics.MustRegister(metricConnectionMemory)
+	metrics.MustRegister(metricMemoryReserved)
 }
 
+// tlsVersionName returns a short name for the TLS version of a connection, or "none"
+// for unencrypted connections.
+func tlsVersionName(state *tls.ConnectionState) string {
+	if state == nil {
+		return "none"
+	}
+	switch state.Version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04x", state.Version)
+	}
+}
+
+// demandPollInterval is the interval at which a viewer checks if an on-demand stream has started.
+const demandPollInterval = 50 * time.Millisecond
+
+// DefaultMethods are the request methods accepted by a stream, unless configured otherwise.
+var DefaultMethods = []string{http.MethodGet, http.MethodHead}
+
+// DefaultRetryAfter is the retry time suggested to clients that were refused
+// because the stream is offline or full.
+const DefaultRetryAfter = 10 * time.Second
+
+// DefaultAcceptTimeout is the time a new connection waits for the streaming thread to take it.
+const DefaultAcceptTimeout = 5 * time.Second
+
+// progressInterval is the minimum interval between updates of the last progress metric.
+const progressInterval = time.Second
+
+// packetOverhead is the size of a slice header, which is stored for each queued packet.
+const packetOverhead = 24
+
 // Command is one of several possible constants.
 // See StreamerCommandAdd for more information.
 type Command int
@@ -118,6 +251,31 @@ const (
 	StreamerCommandAllow
 )
 
+// OverflowPolicy decides what happens to a client whose output buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDrop discards packets until the client catches up.
+	OverflowDrop OverflowPolicy = iota
+	// OverflowDisconnect closes the connection.
+	OverflowDisconnect
+)
+
+// SoftLimitPolicy decides what happens to new viewers while a stream is at its soft connection limit.
+type SoftLimitPolicy int
+
+const (
+	// SoftLimitAdmit accepts new viewers, the stream is only reported as full.
+	SoftLimitAdmit SoftLimitPolicy = iota
+	// SoftLimitQueue holds new viewers in the waiting room until the stream drops below the soft limit.
+	// Without a waiting room, they are refused.
+	SoftLimitQueue
+)
+
+// bitrateInterval is the period over which the stream bitrate is measured
+// for duration-based output buffers.
+const bitrateInterval = time.Second
+
 // ConnectionRequest encapsulates a request that new connection be added or removed.
 type ConnectionRequest struct {
 	// Command is the command to execute
@@ -133,6 +291,15 @@ type ConnectionRequest struct {
 	// Ok tells the caller if a connection was handled without error.
 	// You should always wait on the Waiter before checking it.
 	Ok bool
+	// Full is set if an Add command was refused by the connection broker,
+	// as opposed to the stream being offline.
+	Full bool
+	// Limited is set together with Full if the connection was refused by the
+	// limits of the stream, rather than the connection broker.
+	Limited bool
+	// Duplicate is set if an Add command was refused because the client
+	// already has too many connections to the stream.
+	Duplicate bool
 }
 
 // Streamer implements a TS packet multiplier,
@@ -151,6 +318,13 @@ type Streamer struct {
 	// incoming connections are allowed.
 	// If false, incoming connections are blocked.
 	running util.AtomicBool
+	// stop ends the Stream loop when it is closed.
+	// It is nil if no loop is running, or if the running loop was already told to stop.
+	// Protected by lock.
+	stop chan struct{}
+	// done is closed when the last Stream loop has finished cleaning up.
+	// Protected by lock.
+	done chan struct{}
 	// stats is the statistics collector for this stream
 	stats metrics.Collector
 	// request is an unbuffered queue for requests to add or remove a connection
@@ -163,6 +337,89 @@ type Streamer struct {
 	promCounter bool
 	// preamble contains a static preamble that is sent before the actual streamed data
 	preamble []byte
+	// sinks receive a copy of every packet, independent of the connection pool
+	sinks []chan<- protocol.MpegTsPacket
+	// limiter is an optional connection rate limiter
+	limiter *RateLimiter
+	// egress is an optional bandwidth limiter shared by all connections
+	egress *EgressLimiter
+	// status is the response status for streaming connections, 200 if 0
+	status int
+	// headers are additional response headers for streaming connections
+	headers map[string]string
+	// framing decides how the response length is announced
+	framing ResponseFraming
+	// contentLength is the length announced with FramingLength
+	contentLength int64
+	// refusedStatus is the response status for connections that are refused because the stream is offline or full
+	refusedStatus int
+	// retryAfter is sent in the Retry-After header of refused connections with status 503
+	retryAfter time.Duration
+	// refusedBody is sent to refused connections instead of an empty response, if it is not nil
+	refusedBody []byte
+	// refusedType is the content type of refusedBody
+	refusedType string
+	// refusedRedirect redirects refused connections to this URL, if it is not empty
+	refusedRedirect string
+	// methods is the list of accepted request methods
+	methods []string
+	// idleResponse enables answering with 204 No Content while no packets have been received yet
+	idleResponse bool
+	// flushInterval is the maximum time data is held in a connection's response buffer
+	flushInterval time.Duration
+	// demand is notified of arriving and leaving viewers, nil if the upstream is always connected
+	demand Demand
+	// demandWait is the maximum time a viewer waits for an on-demand upstream to start
+	demandWait time.Duration
+	// flowing is set once the first packet of an upstream connection has been received
+	flowing util.AtomicBool
+	// inhibited mirrors the inhibit flag of the stream loop, for monitoring requests
+	inhibited util.AtomicBool
+	// acceptTimeout is the time a new connection waits for the streaming thread to take it
+	acceptTimeout time.Duration
+	// batchSize is the number of TS packets in each queued packet slice
+	batchSize int
+	// tableInterval is the interval at which the latest PAT and PMT are repeated to all connections, 0 to disable
+	tableInterval time.Duration
+	// tablesOnJoin sends the latest PAT and PMT to each new connection
+	tablesOnJoin bool
+	// coalesceSize is the size of the connection write buffer, 0 to write each packet
+	coalesceSize int
+	// coalesceDelay is the maximum time packets are held in the write buffer
+	coalesceDelay time.Duration
+	// eventStream allows clients to request the stream as Server-Sent Events
+	eventStream bool
+	// idleKeepAlive is the time without data after which null packets are sent to clients, 0 to disable
+	idleKeepAlive time.Duration
+	// accessLog receives a line for each completed request, nil to disable
+	accessLog *util.AccessLogger
+	// geo resolves client addresses to countries, nil to disable country checks
+	geo *util.GeoDatabase
+	// countryMetrics counts connections by country
+	countryMetrics bool
+	// allowCountries are the countries that may connect, all if empty
+	allowCountries util.Set
+	// denyCountries are the countries that are refused
+	denyCountries util.Set
+	// requireHeaders are the request headers that clients must send
+	requireHeaders []HeaderRule
+	// hardLimit is the maximum number of connections to this stream, 0 if unlimited
+	hardLimit int
+	// softLimit is the number of connections at which the stream is reported as full, 0 to disable
+	softLimit int
+	// softPolicy decides how new connections are handled at the soft limit
+	softPolicy SoftLimitPolicy
+	// duplicateLimit is the number of concurrent connections per client before further ones
+	// are considered duplicates, 0 disables detection
+	duplicateLimit int
+	// rejectDuplicates refuses duplicate connections instead of only reporting them
+	rejectDuplicates bool
+	// proxies are the trusted reverse proxies, used to determine the client address
+	proxies util.ProxyList
+	// outputDuration limits the output buffers to this much data at the observed bitrate, 0 if unlimited
+	outputDuration time.Duration
+	// overflow is the policy for clients with a full output buffer
+	overflow OverflowPolicy
 }
 
 // ConnectionBroker represents a policy handler for new connections.
@@ -177,6 +434,37 @@ type ConnectionBroker interface {
 	Release(streamer *Streamer)
 }
 
+// WaitingRoom is an optional extension of ConnectionBroker that can hold
+// clients while no connection slots are available.
+type WaitingRoom interface {
+	// WaitTimeout returns the maximum time a client may be held.
+	// If it is 0, waiting is disabled.
+	WaitTimeout() time.Duration
+	// Releases returns a counter of freed connection slots.
+	// Callers take it before each attempt to connect and pass it to Wait.
+	Releases() uint64
+	// Wait blocks until a connection slot may have become available
+	// since the counter was taken, the deadline is reached or the context is cancelled.
+	// If the caller was refused by the limits of a stream, it passes the streamer,
+	// and only slots freed by the same stream are considered.
+	// It returns true if the caller should try to connect again.
+	Wait(ctx context.Context, deadline time.Time, since uint64, streamer *Streamer) bool
+	// Pass hands a slot the caller was woken up for, but could not use
+	// because of the limits of its stream, to the next waiting client.
+	Pass()
+}
+
+// Demand is notified when viewers arrive and leave.
+// It is used to connect upstreams on demand.
+type Demand interface {
+	// Wake is called when a viewer arrives.
+	Wake()
+	// Idle is called when the last viewer leaves, or when a viewer could not be added to an empty stream.
+	Idle()
+	// Dead returns true if the upstream has given up connecting, so viewers are refused.
+	Dead() bool
+}
+
 // NewStreamer creates a new packet streamer.
 // queue is an input packet queue.
 // qsize is the length of each connection's queue (in packets).
@@ -188,15 +476,34 @@ func NewStreamer(name string, qsize uint, broker ConnectionBroker, auth auth.Aut
 		broker:    broker,
 		queueSize: int(qsize),
 		running:   util.AtomicFalse,
+		flowing:   util.AtomicFalse,
 		stats:     &metrics.DummyCollector{},
 		request:   make(chan *ConnectionRequest),
 		auth:      auth,
+
+		acceptTimeout: DefaultAcceptTimeout,
+		batchSize:     1,
+		refusedStatus: http.StatusServiceUnavailable,
+		retryAfter:    DefaultRetryAfter,
+		methods:       DefaultMethods,
 	}
+	metricConnectionMemory.With(prometheus.Labels{"stream": name}).Set(float64(streamer.ConnectionMemory()))
 	// start the command eater
 	go streamer.eatCommands()
 	return streamer
 }
 
+// ConnectionMemory estimates the worst-case memory held by a single connection, in bytes.
+// Packets are shared between connections, but a slow client can pin a full queue of
+// packets that would otherwise have been released.
+// Returns 0 on a nil streamer.
+func (streamer *Streamer) ConnectionMemory() uint64 {
+	if streamer == nil {
+		return 0
+	}
+	return uint64(streamer.connectionQueueSize()) * uint64(streamer.batchSize*protocol.MpegTsPacketSize+packetOverhead)
+}
+
 // SetCollector assigns a stats collector
 func (streamer *Streamer) SetCollector(stats metrics.Collector) {
 	streamer.stats = stats
@@ -207,6 +514,331 @@ func (streamer *Streamer) SetNotifier(events event.Notifiable) {
 	streamer.events = events
 }
 
+// AddSink registers an additional packet receiver.
+// Sinks are not subject to connection policies and are not counted as connections.
+// If a sink's queue is full, packets are dropped.
+// Must be called before Stream.
+func (streamer *Streamer) AddSink(sink chan<- protocol.MpegTsPacket) {
+	streamer.sinks = append(streamer.sinks, sink)
+}
+
+// SetRateLimiter assigns a connection rate limiter.
+// Pass nil to disable rate limiting.
+func (streamer *Streamer) SetRateLimiter(limiter *RateLimiter) {
+	streamer.limiter = limiter
+}
+
+// SetEgressLimiter assigns a bandwidth limiter that all connections of this stream pass through.
+// Pass nil to disable bandwidth limiting.
+func (streamer *Streamer) SetEgressLimiter(egress *EgressLimiter) {
+	streamer.egress = egress
+}
+
+// SetResponse sets a custom success status and additional headers for streaming responses.
+// Headers override the defaults. A status of 0 sends 200 OK.
+func (streamer *Streamer) SetResponse(status int, headers map[string]string) {
+	streamer.status = status
+	streamer.headers = headers
+}
+
+// SetFraming selects how the length of streaming responses is announced, for clients
+// that can't handle chunked transfer encoding. length is the Content-Length sent with
+// FramingLength, DefaultContentLength if it is 0. Headers set with SetResponse take precedence.
+func (streamer *Streamer) SetFraming(framing ResponseFraming, length int64) {
+	streamer.framing = framing
+	streamer.contentLength = length
+}
+
+// SetRefusedResponse sets the status sent to clients that are refused because
+// the stream is offline or the connection limit is reached.
+// A status of 0 sends 503 Service Unavailable, which load balancers and CDNs
+// treat as temporary. A 503 response carries a Retry-After header with retryAfter,
+// rounded up to seconds, or DefaultRetryAfter if retryAfter is 0.
+func (streamer *Streamer) SetRefusedResponse(status int, retryAfter time.Duration) {
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	if retryAfter <= 0 {
+		retryAfter = DefaultRetryAfter
+	}
+	streamer.refusedStatus = status
+	streamer.retryAfter = retryAfter
+}
+
+// SetRefusedContent sets a response body for refused connections, like a short
+// MPEG-TS clip or an HTML page. If contentType is empty, video/mpeg is assumed.
+// Clients that explicitly accept application/json get a JSON error instead.
+func (streamer *Streamer) SetRefusedContent(body []byte, contentType string) {
+	if contentType == "" {
+		contentType = "video/mpeg"
+	}
+	streamer.refusedBody = body
+	streamer.refusedType = contentType
+}
+
+// SetRefusedRedirect redirects refused connections to location with 302 Found,
+// instead of sending the refused status. This takes precedence over all other content.
+func (streamer *Streamer) SetRefusedRedirect(location string) {
+	streamer.refusedRedirect = location
+}
+
+// SetMethods sets the request methods that are accepted, others are answered with
+// 405 Method Not Allowed. HEAD requests only get the response headers and don't
+// take up a connection slot. If methods is empty, DefaultMethods are accepted.
+func (streamer *Streamer) SetMethods(methods []string) {
+	if len(methods) == 0 {
+		methods = DefaultMethods
+	}
+	streamer.methods = methods
+}
+
+// SetIdleResponse enables answering requests with 204 No Content while the upstream
+// is connected, but hasn't delivered any packets yet.
+// Otherwise, clients are held until data arrives.
+func (streamer *Streamer) SetIdleResponse(enable bool) {
+	streamer.idleResponse = enable
+}
+
+// SetDemand registers a listener for arriving and leaving viewers.
+// When a viewer arrives while the stream is offline, it waits up to wait for
+// the stream to start.
+func (streamer *Streamer) SetDemand(demand Demand, wait time.Duration) {
+	streamer.demand = demand
+	streamer.demandWait = wait
+}
+
+// SetFlushInterval sets the maximum time written data is held in the response buffer
+// before it is flushed to the client. 0 leaves flushing to the HTTP server, which only
+// sends data when its buffer is full.
+func (streamer *Streamer) SetFlushInterval(interval time.Duration) {
+	streamer.flushInterval = interval
+}
+
+// SetIdleKeepAlive sends a null packet to each client when no stream data was sent to it
+// for an interval, so proxies and load balancers don't close the connection during brief
+// upstream stalls. Null packets don't count as upstream data, so read timeouts and
+// stall detection still work. They are paced by the egress limit like stream data.
+// 0 disables keep-alive packets.
+func (streamer *Streamer) SetIdleKeepAlive(interval time.Duration) {
+	streamer.idleKeepAlive = interval
+}
+
+// SetAccessLog writes a line to log for each completed request, including refused ones.
+// The line contains the response status, the number of bytes sent and the connection duration.
+func (streamer *Streamer) SetAccessLog(log *util.AccessLogger) {
+	streamer.accessLog = log
+}
+
+// SetGeoDatabase enables country lookups of clients with db.
+// If metrics is true, connections are counted by country. This adds a time series
+// for each country and stream, so only enable it if the number of streams is small.
+// A nil database disables country checks and metrics.
+func (streamer *Streamer) SetGeoDatabase(db *util.GeoDatabase, metrics bool) {
+	streamer.geo = db
+	streamer.countryMetrics = metrics
+}
+
+// SetCountries restricts access to clients from some countries, identified by their
+// ISO 3166-1 alpha-2 codes. If allow is not empty, only clients from these countries
+// are accepted, and clients with unknown location are refused. Clients from countries
+// in deny are always refused. Refused clients get a 403 Forbidden.
+// Has no effect without a GeoIP database.
+func (streamer *Streamer) SetCountries(allow []string, deny []string) {
+	streamer.allowCountries = util.MakeSet()
+	for _, country := range allow {
+		streamer.allowCountries.Add(strings.ToUpper(country))
+	}
+	streamer.denyCountries = util.MakeSet()
+	for _, country := range deny {
+		streamer.denyCountries.Add(strings.ToUpper(country))
+	}
+}
+
+// allowsCountry tells if clients from country may connect.
+func (streamer *Streamer) allowsCountry(country string) bool {
+	if len(streamer.allowCountries) > 0 && !streamer.allowCountries.Contains(country) {
+		return false
+	}
+	return !streamer.denyCountries.Contains(country)
+}
+
+// HeaderRule is a request header that clients must send.
+// The header must have one of Values, or match Pattern. If neither are set, it only needs to be present.
+type HeaderRule struct {
+	Name    string
+	Values  []string
+	Pattern *regexp.Regexp
+}
+
+// matches tells if the rule accepts the headers of a request.
+func (rule *HeaderRule) matches(header http.Header) bool {
+	values := header.Values(rule.Name)
+	if len(values) == 0 {
+		return false
+	}
+	if len(rule.Values) == 0 && rule.Pattern == nil {
+		return true
+	}
+	for _, value := range values {
+		for _, allowed := range rule.Values {
+			if value == allowed {
+				return true
+			}
+		}
+		if rule.Pattern != nil && rule.Pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRequiredHeaders refuses clients with 403 Forbidden unless their requests satisfy all rules.
+// The rules are checked after authentication, as a crude measure against hotlinking.
+func (streamer *Streamer) SetRequiredHeaders(rules []HeaderRule) {
+	streamer.requireHeaders = rules
+}
+
+// SetConnectionLimits sets limits on the number of connections to this stream,
+// in addition to the global limits of the connection broker.
+// Connections beyond the hard limit are refused. At the soft limit, the stream is
+// reported as full, and new connections are handled according to policy.
+// 0 disables a limit.
+// Must be called before Stream.
+func (streamer *Streamer) SetConnectionLimits(hard uint, soft uint, policy SoftLimitPolicy) {
+	streamer.hardLimit = int(hard)
+	streamer.softLimit = int(soft)
+	streamer.softPolicy = policy
+}
+
+// admits tells if a new connection can be added to a pool of the given size,
+// according to the per-stream connection limits.
+func (streamer *Streamer) admits(connections int) bool {
+	if streamer.hardLimit > 0 && connections >= streamer.hardLimit {
+		return false
+	}
+	if streamer.softLimit > 0 && connections >= streamer.softLimit && streamer.softPolicy == SoftLimitQueue {
+		return false
+	}
+	return true
+}
+
+// SetWriteCoalescing collects packets in a buffer of size bytes and sends them to the client
+// with a single write and flush, when the buffer is full or delay has passed.
+// This saves a lot of syscalls with many clients, at the expense of a bit of latency.
+// If size is 0, each packet is written separately.
+// If delay is 0, packets are held for up to 20ms.
+func (streamer *Streamer) SetWriteCoalescing(size uint, delay time.Duration) {
+	if delay <= 0 {
+		delay = defaultCoalesceDelay
+	}
+	streamer.coalesceSize = int(size)
+	streamer.coalesceDelay = delay
+}
+
+// SetEventStream allows clients to receive the stream as Server-Sent Events, for environments
+// where only text/event-stream is let through. Clients that send Accept: text/event-stream
+// (like the browser EventSource API) get one base64 encoded TS packet per event, or one
+// buffer per event with write coalescing. All other clients receive the plain stream.
+func (streamer *Streamer) SetEventStream(enable bool) {
+	streamer.eventStream = enable
+}
+
+// SetDuplicateLimit enables detection of clients that open more than limit concurrent
+// connections to this stream, as some buggy players do. Duplicates are logged and counted,
+// and refused with 429 Too Many Requests if reject is true.
+// Clients are identified by their IP address, or the forwarded address if the request
+// comes from one of the trusted proxies.
+// A limit of 0 disables detection.
+// Must be called before Stream.
+func (streamer *Streamer) SetDuplicateLimit(limit uint, reject bool, proxies util.ProxyList) {
+	streamer.duplicateLimit = int(limit)
+	streamer.rejectDuplicates = reject
+	streamer.proxies = proxies
+}
+
+// SetOutputBuffer changes the size of the per-connection output buffers.
+// If bytes is not 0, it replaces the packet count passed to NewStreamer.
+// If duration is not 0, the buffers are further limited to the amount of data
+// received in that time, measured from the bitrate of the stream. This keeps latency
+// and memory use predictable on high-bitrate streams, while the byte or packet size
+// remains the upper limit.
+// policy decides what happens when a buffer is full: the packet is dropped,
+// or the client is disconnected.
+// Must be called before Stream.
+func (streamer *Streamer) SetOutputBuffer(bytes uint, duration time.Duration, policy OverflowPolicy) {
+	if bytes > 0 {
+		streamer.queueSize = int(bytes) / protocol.MpegTsPacketSize
+		if streamer.queueSize < 1 {
+			streamer.queueSize = 1
+		}
+	}
+	streamer.outputDuration = duration
+	streamer.overflow = policy
+	metricConnectionMemory.With(prometheus.Labels{"stream": streamer.name}).Set(float64(streamer.ConnectionMemory()))
+}
+
+// durationQueueSize calculates how many slices of batch packets each must be queued
+// to hold duration worth of data, if size bytes were received during elapsed.
+// The result is at least 1 and at most capacity.
+func durationQueueSize(size int, elapsed time.Duration, duration time.Duration, batch int, capacity int) int {
+	if elapsed <= 0 {
+		return capacity
+	}
+	bytes := float64(size) * duration.Seconds() / elapsed.Seconds()
+	slices := int(math.Ceil(bytes / float64(batch*protocol.MpegTsPacketSize)))
+	if slices < 1 {
+		return 1
+	}
+	if slices > capacity {
+		return capacity
+	}
+	return slices
+}
+
+// SetBatchSize tells the streamer how many TS packets are combined into each slice
+// that is sent through the input queue. This is normally set through Client.SetBatchSize.
+// The connection queues are shortened accordingly, so they still hold about the same
+// number of TS packets.
+// Must be called before Stream.
+func (streamer *Streamer) SetBatchSize(size uint) {
+	if size < 1 {
+		size = 1
+	}
+	streamer.batchSize = int(size)
+	metricConnectionMemory.With(prometheus.Labels{"stream": streamer.name}).Set(float64(streamer.ConnectionMemory()))
+}
+
+// SetTableRepeat makes the streamer repeat the most recent PAT and PMT of the stream,
+// so decoders don't have to wait for the upstream to send them again.
+// If interval is not 0, the tables are sent to all connections at this interval.
+// If onJoin is true, they are sent to each new connection before the first packet.
+// Only tables that fit into a single TS packet are repeated.
+// Must be called before Stream.
+func (streamer *Streamer) SetTableRepeat(interval time.Duration, onJoin bool) {
+	streamer.tableInterval = interval
+	streamer.tablesOnJoin = onJoin
+}
+
+// connectionQueueSize returns the number of batches a connection queue can hold.
+func (streamer *Streamer) connectionQueueSize() int {
+	return batchedQueueSize(streamer.queueSize, streamer.batchSize)
+}
+
+// batchedQueueSize divides a queue size in TS packets by the batch size, rounding up.
+func batchedQueueSize(packets int, batch int) int {
+	if batch <= 1 {
+		return packets
+	}
+	return (packets + batch - 1) / batch
+}
+
+// SetAcceptTimeout sets the time a new connection waits for the streaming thread to take it.
+// If the streaming thread is stalled for longer, the client receives 503 Service Unavailable.
+// 0 waits indefinitely.
+func (streamer *Streamer) SetAcceptTimeout(timeout time.Duration) {
+	streamer.acceptTimeout = timeout
+}
+
 func (streamer *Streamer) SetPreamble(preamble []byte) {
 	streamer.preamble = preamble
 }
@@ -263,13 +895,46 @@ func (streamer *Streamer) eatCommands() {
 //
 // go streamer.Stream(queue)
 func (streamer *Streamer) Stream(queue <-chan protocol.MpegTsPacket) error {
+	streamer.lock.Lock()
+	if streamer.stop != nil {
+		streamer.lock.Unlock()
+		return ErrAlreadyRunning
+	}
+	previous := streamer.done
+	streamer.lock.Unlock()
+	// an abandoned loop must finish before this one can take over,
+	// discard packets in the meantime so the upstream doesn't stall
+	if previous != nil {
+		waiting := true
+		for waiting {
+			select {
+			case <-previous:
+				waiting = false
+			case _, ok := <-queue:
+				if !ok {
+					return nil
+				}
+			}
+		}
+	}
+
 	// interlock and check for availability first
 	if !util.CompareAndSwapBool(&streamer.running, false, true) {
 		return ErrAlreadyRunning
 	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	streamer.lock.Lock()
+	streamer.stop = stop
+	streamer.done = done
+	streamer.lock.Unlock()
 
 	// create the local outgoing connection pool
 	pool := make(map[*Connection]bool)
+	// number of connections in the pool per client address
+	clients := make(map[string]int)
+	// connections that were closed by the streamer and removed from the pool early
+	evicted := make(map[*Connection]bool)
 	// prevent new connections if this is true
 	inhibit := false
 
@@ -283,46 +948,154 @@ func (streamer *Streamer) Stream(queue <-chan protocol.MpegTsPacket) error {
 		"message", "Starting streaming",
 	)
 
+	// number of packets received since the last viewer left
+	var unconsumed uint64
+	// this counter is always enabled, unlike the other packet metrics,
+	// so look it up once instead of on every packet
+	noConsumers := metricPacketsNoConsumers.With(prometheus.Labels{"stream": streamer.name})
+
+	// number of queued slices per connection, lowered according to the bitrate for duration-based buffers
+	limit := streamer.connectionQueueSize()
+	// bytes received since measureStart
+	measured := 0
+	measureStart := time.Now()
+	// look up the progress gauge once, and only update it once in a while
+	progress := metricLastProgress.With(prometheus.Labels{"stream": streamer.name})
+	var progressReported time.Time
+
+	// the latest PAT and PMT, if they are repeated
+	var tables *protocol.TableCache
+	var repeat <-chan time.Time
+	if streamer.tableInterval > 0 || streamer.tablesOnJoin {
+		tables = protocol.NewTableCache()
+	}
+	if streamer.tableInterval > 0 {
+		ticker := time.NewTicker(streamer.tableInterval)
+		defer ticker.Stop()
+		repeat = ticker.C
+	}
+
 	// loop until the input channel is closed
 	running := true
 	for running {
 		select {
 		case packet, ok := <-queue:
 			if ok {
+				util.StoreBool(&streamer.flowing, true)
+				// the packet may be a batch of several TS packets
+				count := len(packet) / protocol.MpegTsPacketSize
+				if now := time.Now(); now.Sub(progressReported) >= progressInterval {
+					progress.Set(float64(now.UnixNano()) / float64(time.Second))
+					progressReported = now
+				}
+				if tables != nil {
+					for offset := 0; offset+protocol.MpegTsPacketSize <= len(packet); offset += protocol.MpegTsPacketSize {
+						tables.Push(packet[offset : offset+protocol.MpegTsPacketSize])
+					}
+				}
+				// account for packets nobody is watching, separately from slow readers
+				if len(pool) == 0 {
+					if unconsumed == 0 {
+						logger.Logkv(
+							"event", eventStreamerNoConsumers,
+							"message", "No viewers connected, discarding packets",
+						)
+					}
+					unconsumed += uint64(count)
+					noConsumers.Add(float64(count))
+				} else if unconsumed > 0 {
+					logger.Logkv(
+						"event", eventStreamerConsumers,
+						"message", fmt.Sprintf("Viewers connected, %d packets were discarded", unconsumed),
+						"discarded", unconsumed,
+					)
+					unconsumed = 0
+				}
+				if streamer.outputDuration > 0 {
+					measured += len(packet)
+					if elapsed := time.Since(measureStart); elapsed >= bitrateInterval {
+						limit = durationQueueSize(measured, elapsed, streamer.outputDuration, streamer.batchSize, streamer.connectionQueueSize())
+						measured = 0
+						measureStart = measureStart.Add(elapsed)
+					}
+				}
 				// got a packet, distribute
-				//log.Printf("Got packet (length %d):\n%s\n", len(packet), hex.Dump(packet))
-				//log.Printf("Got packet (length %d)\n", len(packet))
-
 				for conn := range pool {
-					select {
-					case conn.Queue <- packet:
+					sent := false
+					if len(conn.Queue) < limit {
+						select {
+						case conn.Queue <- packet:
+							sent = true
+						default:
+						}
+					}
+					if sent {
 						// packet distributed, done
-						//log.Printf("Queued packet (length %d):\n%s\n", len(packet), hex.Dump(packet))
-
 						// report the packet
-						streamer.stats.PacketSent()
+						for i := 0; i < count; i++ {
+							streamer.stats.PacketSent()
+						}
 						if streamer.promCounter {
-							metricPacketsSent.With(prometheus.Labels{"stream": streamer.name}).Inc()
-							metricBytesSent.With(prometheus.Labels{"stream": streamer.name}).Add(protocol.MpegTsPacketSize)
+							metricPacketsSent.With(prometheus.Labels{"stream": streamer.name}).Add(float64(count))
+							metricBytesSent.With(prometheus.Labels{"stream": streamer.name}).Add(float64(len(packet)))
 						}
 
-					default:
+					} else {
 						// queue is full
 						//log.Print(ErrSlowRead)
 
-						// report the drop
-						streamer.stats.PacketDropped()
+						// report the drop, a whole batch is dropped at once
+						for i := 0; i < count; i++ {
+							streamer.stats.PacketDropped()
+						}
 						if streamer.promCounter {
-							metricPacketsDropped.With(prometheus.Labels{"stream": streamer.name}).Inc()
-							metricBytesDropped.With(prometheus.Labels{"stream": streamer.name}).Add(protocol.MpegTsPacketSize)
+							metricPacketsDropped.With(prometheus.Labels{"stream": streamer.name}).Add(float64(count))
+							metricBytesDropped.With(prometheus.Labels{"stream": streamer.name}).Add(float64(len(packet)))
+						}
+						if streamer.overflow == OverflowDisconnect {
+							// the client can't keep up, let it go
+							logger.Logkv(
+								"event", eventStreamerError,
+								"error", errorStreamerSlowClient,
+								"remote", conn.ClientAddress,
+								"message", fmt.Sprintf("Disconnecting %s, output buffer overflow", conn.ClientAddress),
+							)
+							metricSlowDisconnects.With(prometheus.Labels{"stream": streamer.name}).Inc()
+							close(conn.Queue)
+							delete(pool, conn)
+							evicted[conn] = true
+							clients[conn.client]--
+							if clients[conn.client] <= 0 {
+								delete(clients, conn.client)
+							}
 						}
 					}
 				}
+
+				for _, sink := range streamer.sinks {
+					select {
+					case sink <- packet:
+					default:
+					}
+				}
 			} else {
 				// channel closed, exit
 				running = false
-				// and stop everything
-				util.StoreBool(&streamer.running, false)
+			}
+		case <-stop:
+			// abandoned by the watchdog
+			running = false
+		case <-repeat:
+			if current := tables.Tables(); current != nil {
+				for conn := range pool {
+					// slow connections just miss the repetition
+					if len(conn.Queue) < limit {
+						select {
+						case conn.Queue <- current:
+						default:
+						}
+					}
+				}
 			}
 		case request := <-streamer.request:
 			switch request.Command {
@@ -331,20 +1104,88 @@ func (streamer *Streamer) Stream(queue <-chan protocol.MpegTsPacket) error {
 					"event", eventStreamerClientRemove,
 					"message", fmt.Sprintf("Removing client %s from pool", request.Address),
 				)
-				if !request.Connection.Closed {
+				if evicted[request.Connection] {
+					// already closed and removed from the pool
+					delete(evicted, request.Connection)
+				} else if !request.Connection.Closed {
 					close(request.Connection.Queue)
 				}
+				if pool[request.Connection] {
+					client := request.Connection.client
+					clients[client]--
+					if clients[client] <= 0 {
+						delete(clients, client)
+					}
+				}
 				delete(pool, request.Connection)
+				if len(pool) == 0 && streamer.demand != nil {
+					streamer.demand.Idle()
+				}
 			case StreamerCommandAdd:
+				client := request.Connection.client
+				duplicate := streamer.duplicateLimit > 0 && clients[client] >= streamer.duplicateLimit
+				if duplicate {
+					metricDuplicateConnections.With(prometheus.Labels{"stream": streamer.name}).Inc()
+				}
 				// check if the connection can be accepted
-				if !inhibit && streamer.broker.Accept(request.Address, streamer) {
+				if duplicate && streamer.rejectDuplicates {
+					logger.Logkv(
+						"event", eventStreamerError,
+						"error", errorStreamerDuplicate,
+						"remote", request.Address,
+						"client", client,
+						"connections", clients[client],
+						"message", fmt.Sprintf("Refusing connection from %s, client already has %d connections", request.Address, clients[client]),
+					)
+					request.Ok = false
+					request.Duplicate = true
+				} else if !inhibit && !streamer.admits(len(pool)) {
+					logger.Logkv(
+						"event", eventStreamerError,
+						"error", errorStreamerLimit,
+						"remote", request.Address,
+						"connections", len(pool),
+						"message", fmt.Sprintf("Refusing connection from %s, stream has %d connections", request.Address, len(pool)),
+					)
+					request.Ok = false
+					request.Full = true
+					request.Limited = true
+				} else if !inhibit && streamer.broker.Accept(request.Address, streamer) {
+					if duplicate {
+						logger.Logkv(
+							"event", eventStreamerDuplicate,
+							"remote", request.Address,
+							"client", client,
+							"connections", clients[client],
+							"message", fmt.Sprintf("Client %s already has %d connections", client, clients[client]),
+						)
+					}
 					logger.Logkv(
 						"event", eventStreamerClientAdd,
 						"remote", request.Address,
 						"message", fmt.Sprintf("Adding client %s to pool", request.Address),
 					)
 					pool[request.Connection] = true
+					clients[client]++
 					request.Ok = true
+					if streamer.softLimit > 0 && len(pool) == streamer.softLimit {
+						logger.Logkv(
+							"event", eventStreamerSoftLimit,
+							"connections", len(pool),
+							"message", fmt.Sprintf("Stream reached its soft limit of %d connections", streamer.softLimit),
+						)
+					}
+					if streamer.tablesOnJoin {
+						if current := tables.Tables(); current != nil {
+							select {
+							case request.Connection.Queue <- current:
+							default:
+							}
+						}
+					}
+					if streamer.demand != nil {
+						streamer.demand.Wake()
+					}
 				} else {
 					logger.Logkv(
 						"event", eventStreamerError,
@@ -353,6 +1194,10 @@ func (streamer *Streamer) Stream(queue <-chan protocol.MpegTsPacket) error {
 						"message", fmt.Sprintf("Refusing connection from %s, pool is full or offline", request.Address),
 					)
 					request.Ok = false
+					request.Full = !inhibit
+					if len(pool) == 0 && streamer.demand != nil {
+						streamer.demand.Idle()
+					}
 				}
 			case StreamerCommandInhibit:
 				logger.Logkv(
@@ -360,6 +1205,7 @@ func (streamer *Streamer) Stream(queue <-chan protocol.MpegTsPacket) error {
 					"message", fmt.Sprintf("Turning stream offline"),
 				)
 				inhibit = true
+				util.StoreBool(&streamer.inhibited, true)
 				// close all downstream connections
 				for conn := range pool {
 					close(conn.Queue)
@@ -371,6 +1217,7 @@ func (streamer *Streamer) Stream(queue <-chan protocol.MpegTsPacket) error {
 					"message", fmt.Sprintf("Turning stream online"),
 				)
 				inhibit = false
+				util.StoreBool(&streamer.inhibited, false)
 				// TODO implement inhibit in the check api
 			default:
 				logger.Logkv(
@@ -394,9 +1241,18 @@ func (streamer *Streamer) Stream(queue <-chan protocol.MpegTsPacket) error {
 		close(conn.Queue)
 	}
 
-	// start the command eater again
+	// start the command eater again, it handles the removal of the closed connections
 	go streamer.eatCommands()
 
+	streamer.lock.Lock()
+	streamer.stop = nil
+	streamer.lock.Unlock()
+	util.StoreBool(&streamer.running, false)
+	util.StoreBool(&streamer.flowing, false)
+	util.StoreBool(&streamer.inhibited, false)
+	// let a waiting successor take over
+	close(done)
+
 	logger.Logkv(
 		"event", eventStreamerStop,
 		"message", "Ending streaming",
@@ -404,34 +1260,204 @@ func (streamer *Streamer) Stream(queue <-chan protocol.MpegTsPacket) error {
 	return nil
 }
 
+// abandon tells a Stream loop that has stopped taking packets to exit.
+//
+// The loop can't be interrupted while it is wedged. Once it wakes up again,
+// it disconnects its viewers and exits as soon as its input queue is closed.
+// A new loop waits until then before it takes over.
+func (streamer *Streamer) abandon() {
+	streamer.lock.Lock()
+	defer streamer.lock.Unlock()
+	if streamer.stop != nil {
+		close(streamer.stop)
+		streamer.stop = nil
+		util.StoreBool(&streamer.flowing, false)
+	}
+}
+
 // ServeHTTP handles an incoming HTTP connection.
 // Satisfies the http.Handler interface, so it can be used in an HTTP server.
 func (streamer *Streamer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// tag all log lines and responses of this request, so they can be correlated
+	id := util.RequestId(request)
+	writer.Header().Set(util.RequestIdHeader, id)
+	log := util.WithDefaults(logger, util.Dict{"request": id})
+
+	if streamer.accessLog != nil {
+		recorder := &accessRecorder{ResponseWriter: writer}
+		writer = recorder
+		start := time.Now()
+		defer func() {
+			streamer.accessLog.Log(recorder.entry(request, streamer.proxies.ClientAddress(request), start))
+		}()
+	}
+
+	if !streamer.allowsMethod(request.Method) {
+		log.Logkv(
+			"event", eventStreamerError,
+			"error", errorStreamerMethod,
+			"remote", request.RemoteAddr,
+			"method", request.Method,
+			"message", fmt.Sprintf("Refusing %s request from %s", request.Method, request.RemoteAddr),
+		)
+		writer.Header().Set("Allow", strings.Join(streamer.methods, ", "))
+		ServeStreamError(writer, http.StatusMethodNotAllowed)
+		return
+	}
+
+	// reject clients that reconnect too fast
+	if !HandleHttpRateLimit(streamer.limiter, request, writer) {
+		return
+	}
+
 	// fail-fast: verify that this user can access this resource first
 	if !auth.HandleHttpAuthentication(streamer.auth, request, writer) {
 		return
 	}
 
+	for i := range streamer.requireHeaders {
+		rule := &streamer.requireHeaders[i]
+		if !rule.matches(request.Header) {
+			log.Logkv(
+				"event", eventStreamerError,
+				"error", errorStreamerHeader,
+				"remote", request.RemoteAddr,
+				"header", rule.Name,
+				"message", fmt.Sprintf("Refusing connection from %s, header %s is missing or not allowed", request.RemoteAddr, rule.Name),
+			)
+			ServeStreamError(writer, http.StatusForbidden)
+			return
+		}
+	}
+
+	country := ""
+	if streamer.geo != nil {
+		country = streamer.geo.Country(request.RemoteAddr)
+		if !streamer.allowsCountry(country) {
+			log.Logkv(
+				"event", eventStreamerError,
+				"error", errorStreamerCountry,
+				"remote", request.RemoteAddr,
+				"country", country,
+				"message", fmt.Sprintf("Refusing connection from %s, country %q is not allowed", request.RemoteAddr, country),
+			)
+			metricGeoBlocked.With(prometheus.Labels{"stream": streamer.name}).Inc()
+			ServeStreamError(writer, http.StatusForbidden)
+			return
+		}
+	}
+
+	// monitoring checks only want to know if the stream is available, don't take up a slot for them.
+	// an on-demand stream is available as long as it hasn't given up, viewers will wake it.
+	if request.Method == http.MethodHead {
+		available := util.LoadBool(&streamer.running) || streamer.demand != nil && !streamer.demand.Dead()
+		if available && !util.LoadBool(&streamer.inhibited) {
+			status := streamer.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			writeStreamHeader(writer, status, framingHeaders(streamer.headers, streamer.framing, streamer.contentLength))
+		} else {
+			streamer.setRetryAfter(writer, streamer.refusedStatus)
+			ServeStreamError(writer, streamer.refusedStatus)
+		}
+		return
+	}
+
+	// the stream exists, but there is nothing to send yet
+	if streamer.idleResponse && util.LoadBool(&streamer.running) && !util.LoadBool(&streamer.flowing) {
+		log.Logkv(
+			"event", eventStreamerIdle,
+			"remote", request.RemoteAddr,
+			"message", fmt.Sprintf("No data received yet, sending empty response to %s", request.RemoteAddr),
+		)
+		writeStreamHeader(writer, http.StatusNoContent, streamer.headers)
+		return
+	}
+
+	// bring up an on-demand upstream and give it some time to start
+	if streamer.demand != nil && !util.LoadBool(&streamer.running) {
+		streamer.demand.Wake()
+		deadline := time.Now().Add(streamer.demandWait)
+		for !util.LoadBool(&streamer.running) && time.Now().Before(deadline) && request.Context().Err() == nil {
+			time.Sleep(demandPollInterval)
+		}
+		if !util.LoadBool(&streamer.running) {
+			// let the upstream go back to sleep if it doesn't come up
+			streamer.demand.Idle()
+		}
+	}
+
 	// create the connection object first
-	conn := NewConnection(writer, streamer.queueSize, request.RemoteAddr, request.Context())
+	conn := NewConnection(writer, streamer.connectionQueueSize(), request.RemoteAddr, request.Context())
+	conn.egress = streamer.egress
+	conn.status = streamer.status
+	conn.headers = streamer.headers
+	conn.framing = streamer.framing
+	conn.contentLength = streamer.contentLength
+	conn.flushInterval = streamer.flushInterval
+	conn.idleKeepAlive = streamer.idleKeepAlive
+	conn.coalesceSize = streamer.coalesceSize
+	conn.coalesceDelay = streamer.coalesceDelay
+	conn.eventStream = streamer.eventStream && acceptsEventStream(request)
+	conn.firstByte = metricTimeToFirstByte.With(prometheus.Labels{"stream": streamer.name})
+	if streamer.duplicateLimit > 0 {
+		conn.client = streamer.proxies.ClientAddress(request)
+	}
+	conn.SetRequestId(id)
+	// remember how many slots were freed before the attempt, so the waiting room knows
+	// if one became available in the meantime
+	room, _ := streamer.broker.(WaitingRoom)
+	var released uint64
+	if room != nil {
+		released = room.Releases()
+	}
 	// and pass it on
-	command := &ConnectionRequest{
-		Command:    StreamerCommandAdd,
-		Address:    request.RemoteAddr,
-		Connection: conn,
-		Waiter:     &sync.WaitGroup{},
+	command, accepted := streamer.add(request.Context(), conn, request.RemoteAddr)
+	if !accepted {
+		log.Logkv(
+			"event", eventStreamerError,
+			"error", errorStreamerAcceptTimeout,
+			"remote", request.RemoteAddr,
+			"message", fmt.Sprintf("Refusing connection from %s, the stream didn't accept it in time", request.RemoteAddr),
+		)
+		ServeStreamError(writer, http.StatusServiceUnavailable)
+		return
 	}
-	command.Waiter.Add(1)
-	streamer.request <- command
 
-	// wait for the handler
-	command.Waiter.Wait()
+	// if the pool is full, hold the client in the waiting room until a slot is free
+	waited := false
+	if room != nil && !command.Ok && command.Full && room.WaitTimeout() > 0 {
+		waited = true
+		log.Logkv(
+			"event", eventStreamerWaiting,
+			"remote", request.RemoteAddr,
+			"message", fmt.Sprintf("Holding connection from %s in the waiting room", request.RemoteAddr),
+		)
+		deadline := time.Now().Add(room.WaitTimeout())
+		for accepted && !command.Ok && command.Full {
+			// clients refused by the stream limits can only use slots freed by this stream
+			var limited *Streamer
+			if command.Limited {
+				limited = streamer
+			}
+			if !room.Wait(request.Context(), deadline, released, limited) {
+				break
+			}
+			released = room.Releases()
+			command, accepted = streamer.add(request.Context(), conn, request.RemoteAddr)
+			if accepted && command.Limited {
+				// the freed slot is of no use to this stream, but maybe to another one
+				room.Pass()
+			}
+		}
+	}
 
 	// verify that the connection was added
 	if !command.Ok {
 		// nope, destroy the connection
 		conn = nil
-		logger.Logkv(
+		log.Logkv(
 			"event", eventStreamerError,
 			"error", errorStreamerOffline,
 			"message", fmt.Sprintf("Refusing connection from %s, stream is offline", request.RemoteAddr),
@@ -442,14 +1468,33 @@ func (streamer *Streamer) ServeHTTP(writer http.ResponseWriter, request *http.Re
 		// connection will be handled, report
 		streamer.stats.ConnectionAdded()
 		metricConnections.With(prometheus.Labels{"stream": streamer.name}).Inc()
+		if streamer.geo != nil && streamer.countryMetrics {
+			if country == "" {
+				country = "unknown"
+			}
+			metricCountryConnections.With(prometheus.Labels{"stream": streamer.name, "country": country}).Inc()
+		}
 		// also notify the event queue
-		streamer.events.NotifyConnect(1)
+		streamer.events.NotifyConnect(streamer.name, 1)
 
-		logger.Logkv(
+		security := tlsVersionName(request.TLS)
+		details := []interface{}{
 			"event", eventStreamerStreaming,
-			"message", fmt.Sprintf("Streaming to %s", request.RemoteAddr),
+			"message", fmt.Sprintf("Streaming to %s over %s (%s)", request.RemoteAddr, request.Proto, security),
 			"remote", request.RemoteAddr,
-		)
+			"proto", request.Proto,
+			"tls", security,
+		}
+		if request.TLS != nil {
+			details = append(details,
+				"cipher", tls.CipherSuiteName(request.TLS.CipherSuite),
+				"alpn", request.TLS.NegotiatedProtocol,
+				"servername", request.TLS.ServerName,
+				"resumed", request.TLS.DidResume,
+			)
+		}
+		log.Logkv(details...)
+		metricProtocolConnections.With(prometheus.Labels{"stream": streamer.name, "proto": request.Proto, "tls": security}).Inc()
 
 		start := time.Now()
 		conn.Serve(streamer.preamble)
@@ -465,7 +1510,7 @@ func (streamer *Streamer) ServeHTTP(writer http.ResponseWriter, request *http.Re
 		for range conn.Queue {
 			// drain any leftovers
 		}
-		logger.Logkv(
+		log.Logkv(
 			"event", eventStreamerClosed,
 			"message", fmt.Sprintf("Connection from %s closed", request.RemoteAddr),
 			"remote", request.RemoteAddr,
@@ -473,7 +1518,7 @@ func (streamer *Streamer) ServeHTTP(writer http.ResponseWriter, request *http.Re
 		)
 
 		// and report
-		streamer.events.NotifyConnect(-1)
+		streamer.events.NotifyConnect(streamer.name, -1)
 		streamer.stats.ConnectionRemoved()
 		metricConnections.With(prometheus.Labels{"stream": streamer.name}).Dec()
 		streamer.stats.StreamDuration(duration)
@@ -482,9 +1527,92 @@ func (streamer *Streamer) ServeHTTP(writer http.ResponseWriter, request *http.Re
 		// also notify the broker
 		streamer.broker.Release(streamer)
 	} else {
-		// Return a suitable error
-		// TODO This should be 503 or 504, but client support seems to be poor
-		// and the standards mandate nothing. Bummer.
-		ServeStreamError(writer, http.StatusNotFound)
+		if command.Duplicate {
+			writer.WriteHeader(http.StatusTooManyRequests)
+		} else if waited {
+			// clients that opted into waiting get a proper answer
+			room := streamer.broker.(WaitingRoom)
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(room.WaitTimeout().Seconds()))))
+			ServeStreamError(writer, http.StatusServiceUnavailable)
+		} else {
+			streamer.refuse(writer, request, log)
+		}
+	}
+}
+
+// setRetryAfter adds the configured Retry-After header to a 503 response.
+func (streamer *Streamer) setRetryAfter(writer http.ResponseWriter, status int) {
+	if status == http.StatusServiceUnavailable {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(streamer.retryAfter.Seconds()))))
+	}
+}
+
+// allowsMethod returns true if a request method is in the list of accepted methods.
+func (streamer *Streamer) allowsMethod(method string) bool {
+	for _, allowed := range streamer.methods {
+		if method == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// refuse answers a connection that was refused because the stream is offline or full.
+func (streamer *Streamer) refuse(writer http.ResponseWriter, request *http.Request, log util.Logger) {
+	if streamer.refusedRedirect != "" {
+		http.Redirect(writer, request, streamer.refusedRedirect, http.StatusFound)
+		return
+	}
+	status := streamer.refusedStatus
+	streamer.setRetryAfter(writer, status)
+	var body []byte
+	if acceptsMediaType(request, "application/json") {
+		body, _ = json.Marshal(map[string]interface{}{
+			"error": strings.ToLower(http.StatusText(status)),
+			"code":  status,
+		})
+		writeStreamHeader(writer, status, map[string]string{"Content-Type": "application/json"})
+	} else if streamer.refusedBody != nil {
+		body = streamer.refusedBody
+		writeStreamHeader(writer, status, map[string]string{"Content-Type": streamer.refusedType})
+	} else {
+		ServeStreamError(writer, status)
+		return
+	}
+	if _, err := writer.Write(body); err != nil {
+		log.Logkv(
+			"event", eventStreamerError,
+			"error", errorStreamerWrite,
+			"remote", request.RemoteAddr,
+			"message", fmt.Sprintf("Error sending refusal to %s: %v", request.RemoteAddr, err),
+		)
 	}
 }
+
+// add sends an add command for a connection to the streaming thread
+// and waits until it was handled.
+// Returns false if the streaming thread didn't take the command within the accept timeout,
+// or if ctx was cancelled before.
+func (streamer *Streamer) add(ctx context.Context, conn *Connection, address string) (*ConnectionRequest, bool) {
+	command := &ConnectionRequest{
+		Command:    StreamerCommandAdd,
+		Address:    address,
+		Connection: conn,
+		Waiter:     &sync.WaitGroup{},
+	}
+	command.Waiter.Add(1)
+	if streamer.acceptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, streamer.acceptTimeout)
+		defer cancel()
+	}
+	select {
+	case streamer.request <- command:
+	case <-ctx.Done():
+		return command, false
+	}
+
+	// wait for the handler, it may already have added the connection
+	command.Waiter.Wait()
+	return command, true
+}
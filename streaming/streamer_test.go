@@ -0,0 +1,1038 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"github.com/onitake/restreamer/auth"
+	"github.com/onitake/restreamer/configuration"
+	"github.com/onitake/restreamer/protocol"
+	"github.com/onitake/restreamer/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamerIdleResponse(t *testing.T) {
+	streamer := NewStreamer("idle", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetResponse(0, map[string]string{"X-Test": "yes", "Content-Type": "video/mp2t"})
+	streamer.SetIdleResponse(true)
+	queue := make(chan protocol.MpegTsPacket)
+	done := make(chan bool)
+	go func() {
+		streamer.Stream(queue)
+		done <- true
+	}()
+	// wait for the streamer to start
+	for !util.LoadBool(&streamer.running) {
+		time.Sleep(time.Millisecond)
+	}
+
+	writer := httptest.NewRecorder()
+	streamer.ServeHTTP(writer, httptest.NewRequest("GET", "/idle.ts", nil))
+	if writer.Code != http.StatusNoContent {
+		t.Errorf("Got status %d on idle stream, expected 204", writer.Code)
+	}
+	if writer.Header().Get("X-Test") != "yes" || writer.Header().Get("Content-Type") != "video/mp2t" {
+		t.Errorf("Configured headers missing: %v", writer.Header())
+	}
+
+	queue <- packetWithPid(0x100)
+	close(queue)
+	<-done
+}
+
+func TestStreamerResponseHeader(t *testing.T) {
+	writer := httptest.NewRecorder()
+	writeStreamHeader(writer, http.StatusAccepted, map[string]string{"Cache-Control": "no-cache"})
+	if writer.Code != http.StatusAccepted {
+		t.Errorf("Got status %d, expected 202", writer.Code)
+	}
+	if writer.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("Default header was not overridden: %s", writer.Header().Get("Cache-Control"))
+	}
+	if writer.Header().Get("Content-Type") != "video/mpeg" {
+		t.Errorf("Default header missing: %s", writer.Header().Get("Content-Type"))
+	}
+}
+
+// countingNotifier counts connection events.
+type countingNotifier struct {
+	lock        sync.Mutex
+	connects    int
+	disconnects int
+}
+
+func (n *countingNotifier) NotifyConnect(stream string, connected int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if connected > 0 {
+		n.connects += connected
+	} else {
+		n.disconnects -= connected
+	}
+}
+
+func (n *countingNotifier) NotifyHeartbeat(when time.Time) {}
+
+func (n *countingNotifier) NotifySource(stream string, url string, connected bool) {}
+
+func (n *countingNotifier) NotifyDead(stream string) {}
+
+func (n *countingNotifier) counts() (int, int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.connects, n.disconnects
+}
+
+// countingBroker counts released connections.
+type countingBroker struct {
+	*AccessController
+	released int32
+}
+
+func (b *countingBroker) Release(streamer *Streamer) {
+	atomic.AddInt32(&b.released, 1)
+	b.AccessController.Release(streamer)
+}
+
+func TestStreamerContextCancel(t *testing.T) {
+	broker := &countingBroker{AccessController: NewAccessController(0)}
+	notifier := &countingNotifier{}
+	streamer := NewStreamer("cancel", 10, broker, auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetNotifier(notifier)
+	queue := make(chan protocol.MpegTsPacket)
+	done := make(chan bool)
+	go func() {
+		streamer.Stream(queue)
+		done <- true
+	}()
+	for !util.LoadBool(&streamer.running) {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan bool)
+	go func() {
+		streamer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/cancel.ts", nil).WithContext(ctx))
+		served <- true
+	}()
+	for connects, _ := notifier.counts(); connects == 0; connects, _ = notifier.counts() {
+		time.Sleep(time.Millisecond)
+	}
+	// simulate a client disconnect
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("Connection was not closed on context cancellation")
+	}
+
+	connects, disconnects := notifier.counts()
+	if connects != 1 || disconnects != 1 {
+		t.Errorf("Got %d connects and %d disconnects, expected 1 each", connects, disconnects)
+	}
+	if atomic.LoadInt32(&broker.released) != 1 {
+		t.Errorf("Connection was released %d times, expected 1", broker.released)
+	}
+
+	close(queue)
+	<-done
+}
+
+// flushCounter is a ResponseWriter that counts flushes.
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int32
+}
+
+func (w *flushCounter) Flush() {
+	atomic.AddInt32(&w.flushes, 1)
+}
+
+func TestConnectionFlushInterval(t *testing.T) {
+	writer := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := NewConnection(writer, 10, "", ctx)
+	conn.flushInterval = time.Millisecond
+	done := make(chan bool)
+	go func() {
+		conn.Serve(nil)
+		done <- true
+	}()
+	// wait for the header flush
+	for atomic.LoadInt32(&writer.flushes) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// no data, no flush
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&writer.flushes) != 1 {
+		t.Errorf("Flushed without data")
+	}
+	conn.Queue <- packetWithPid(0x100)
+	for atomic.LoadInt32(&writer.flushes) == 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+// stallingBroker blocks the streaming thread until it is released.
+type stallingBroker struct {
+	*AccessController
+	stall chan struct{}
+}
+
+func (b *stallingBroker) Accept(remoteaddr string, streamer *Streamer) bool {
+	<-b.stall
+	return false
+}
+
+func TestStreamerAcceptTimeout(t *testing.T) {
+	broker := &stallingBroker{AccessController: NewAccessController(0), stall: make(chan struct{})}
+	streamer := NewStreamer("stall", 10, broker, auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetAcceptTimeout(50 * time.Millisecond)
+	queue := make(chan protocol.MpegTsPacket)
+	done := make(chan bool)
+	go func() {
+		streamer.Stream(queue)
+		done <- true
+	}()
+	for !util.LoadBool(&streamer.running) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the first connection wedges the streaming thread in the broker
+	first := make(chan int)
+	go func() {
+		writer := httptest.NewRecorder()
+		streamer.ServeHTTP(writer, httptest.NewRequest("GET", "/stall.ts", nil))
+		first <- writer.Code
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	writer := httptest.NewRecorder()
+	start := time.Now()
+	streamer.ServeHTTP(writer, httptest.NewRequest("GET", "/stall.ts", nil))
+	if writer.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d on a stalled stream, expected 503", writer.Code)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Accept timeout was not honoured")
+	}
+
+	close(broker.stall)
+	if code := <-first; code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d on a refused connection, expected 503", code)
+	}
+	close(queue)
+	<-done
+}
+
+// gatedBroker holds the streaming thread in Accept until the connection is let through.
+type gatedBroker struct {
+	*countingBroker
+	waiting chan bool
+	gate    chan bool
+}
+
+func (b *gatedBroker) Accept(remoteaddr string, streamer *Streamer) bool {
+	b.waiting <- true
+	return <-b.gate && b.AccessController.Accept(remoteaddr, streamer)
+}
+
+func TestStreamerAbandon(t *testing.T) {
+	broker := &gatedBroker{
+		countingBroker: &countingBroker{AccessController: NewAccessController(0)},
+		waiting:        make(chan bool),
+		gate:           make(chan bool),
+	}
+	notifier := &countingNotifier{}
+	streamer := NewStreamer("abandon", 10, broker, auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetNotifier(notifier)
+	stalled := make(chan protocol.MpegTsPacket)
+	go streamer.Stream(stalled)
+	for !util.LoadBool(&streamer.running) {
+		time.Sleep(time.Millisecond)
+	}
+
+	served := make(chan bool)
+	serve := func(ctx context.Context) {
+		go func() {
+			streamer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/abandon.ts", nil).WithContext(ctx))
+			served <- true
+		}()
+	}
+	// one viewer is connected, the next one wedges the loop in the broker
+	serve(context.Background())
+	<-broker.waiting
+	broker.gate <- true
+	for connects, _ := notifier.counts(); connects == 0; connects, _ = notifier.counts() {
+		time.Sleep(time.Millisecond)
+	}
+	serve(context.Background())
+	<-broker.waiting
+
+	// the watchdog gives up on the loop and the upstream reconnects
+	streamer.abandon()
+	close(stalled)
+	queue := make(chan protocol.MpegTsPacket)
+	result := make(chan error)
+	go func() {
+		result <- streamer.Stream(queue)
+	}()
+	select {
+	case queue <- protocol.MpegTsPacket(make([]byte, protocol.MpegTsPacketSize)):
+	case <-time.After(time.Second):
+		t.Fatal("Upstream was blocked while the new loop was waiting")
+	}
+
+	// the loop wakes up again, disconnects its viewers and hands over
+	broker.gate <- true
+	for i := 0; i < 2; i++ {
+		select {
+		case <-served:
+		case <-time.After(time.Second):
+			t.Fatal("Viewer of the abandoned loop was not disconnected")
+		}
+	}
+	if released := atomic.LoadInt32(&broker.released); released != 2 {
+		t.Errorf("Released %d connections of the abandoned loop, expected 2", released)
+	}
+
+	// the new loop takes over
+	ctx, cancel := context.WithCancel(context.Background())
+	serve(ctx)
+	<-broker.waiting
+	broker.gate <- true
+	for connects, _ := notifier.counts(); connects < 3; connects, _ = notifier.counts() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-served
+	close(queue)
+	if err := <-result; err != nil {
+		t.Errorf("New stream loop failed: %v", err)
+	}
+}
+
+func TestStreamerRefusedResponse(t *testing.T) {
+	// the stream is never started, so all connections are refused
+	streamer := NewStreamer("refused", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetRefusedResponse(0, 1500*time.Millisecond)
+	streamer.SetRefusedContent([]byte("offline"), "text/plain")
+
+	writer := httptest.NewRecorder()
+	streamer.ServeHTTP(writer, httptest.NewRequest("GET", "/refused.ts", nil))
+	if writer.Code != http.StatusServiceUnavailable || writer.Header().Get("Retry-After") != "2" {
+		t.Errorf("Got status %d and Retry-After %s, expected 503 and 2", writer.Code, writer.Header().Get("Retry-After"))
+	}
+	if writer.Body.String() != "offline" || writer.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("Got body %q of type %s, expected the configured content", writer.Body.String(), writer.Header().Get("Content-Type"))
+	}
+
+	request := httptest.NewRequest("GET", "/refused.ts", nil)
+	request.Header.Set("Accept", "application/json")
+	writer = httptest.NewRecorder()
+	streamer.ServeHTTP(writer, request)
+	if body := writer.Body.String(); body != `{"code":503,"error":"service unavailable"}` {
+		t.Errorf("Got body %s, expected a JSON error", body)
+	}
+
+	streamer.SetRefusedRedirect("/poster.jpg")
+	writer = httptest.NewRecorder()
+	streamer.ServeHTTP(writer, httptest.NewRequest("GET", "/refused.ts", nil))
+	if writer.Code != http.StatusFound || writer.Header().Get("Location") != "/poster.jpg" {
+		t.Errorf("Got status %d to %s, expected a redirect to the poster", writer.Code, writer.Header().Get("Location"))
+	}
+}
+
+func TestStreamerMethods(t *testing.T) {
+	streamer := NewStreamer("methods", 10, NewAccessController(1), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	queue := make(chan protocol.MpegTsPacket)
+	done := make(chan bool)
+	go func() {
+		streamer.Stream(queue)
+		done <- true
+	}()
+	for !util.LoadBool(&streamer.running) {
+		time.Sleep(time.Millisecond)
+	}
+
+	writer := httptest.NewRecorder()
+	streamer.ServeHTTP(writer, httptest.NewRequest(http.MethodPost, "/methods.ts", nil))
+	if writer.Code != http.StatusMethodNotAllowed || writer.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("Got status %d and Allow %s for POST, expected 405 and GET, HEAD", writer.Code, writer.Header().Get("Allow"))
+	}
+
+	// HEAD requests must not take the only slot
+	for i := 0; i < 2; i++ {
+		writer = httptest.NewRecorder()
+		streamer.ServeHTTP(writer, httptest.NewRequest(http.MethodHead, "/methods.ts", nil))
+		if writer.Code != http.StatusOK || writer.Header().Get("Content-Type") != "video/mpeg" {
+			t.Errorf("Got status %d for HEAD, expected 200", writer.Code)
+		}
+	}
+	if streamer.broker.(*AccessController).connections != 0 {
+		t.Errorf("HEAD request took a connection slot")
+	}
+
+	// an inhibited stream refuses viewers, so it isn't available
+	streamer.SetInhibit(true)
+	for !util.LoadBool(&streamer.inhibited) {
+		time.Sleep(time.Millisecond)
+	}
+	writer = httptest.NewRecorder()
+	streamer.ServeHTTP(writer, httptest.NewRequest(http.MethodHead, "/methods.ts", nil))
+	if writer.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d for HEAD on an inhibited stream, expected 503", writer.Code)
+	}
+	streamer.SetInhibit(false)
+
+	close(queue)
+	<-done
+	writer = httptest.NewRecorder()
+	streamer.ServeHTTP(writer, httptest.NewRequest(http.MethodHead, "/methods.ts", nil))
+	if writer.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d for HEAD on a stopped stream, expected 503", writer.Code)
+	}
+
+	// an on-demand stream is available while it is stopped, unless it has given up
+	demand := &staticDemand{}
+	streamer.SetDemand(demand, time.Second)
+	writer = httptest.NewRecorder()
+	streamer.ServeHTTP(writer, httptest.NewRequest(http.MethodHead, "/methods.ts", nil))
+	if writer.Code != http.StatusOK {
+		t.Errorf("Got status %d for HEAD on an on-demand stream, expected 200", writer.Code)
+	}
+	demand.dead = true
+	writer = httptest.NewRecorder()
+	streamer.ServeHTTP(writer, httptest.NewRequest(http.MethodHead, "/methods.ts", nil))
+	if writer.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d for HEAD on a dead on-demand stream, expected 503", writer.Code)
+	}
+}
+
+// staticDemand is an on-demand upstream that never connects.
+type staticDemand struct {
+	dead bool
+}
+
+func (d *staticDemand) Wake() {}
+
+func (d *staticDemand) Idle() {}
+
+func (d *staticDemand) Dead() bool {
+	return d.dead
+}
+
+func TestStreamerNoConsumers(t *testing.T) {
+	streamer := NewStreamer("noconsumers", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	counter := metricPacketsNoConsumers.With(prometheus.Labels{"stream": "noconsumers"})
+	before := testutil.ToFloat64(counter)
+	queue := make(chan protocol.MpegTsPacket)
+	done := make(chan bool)
+	go func() {
+		streamer.Stream(queue)
+		done <- true
+	}()
+	for i := 0; i < 3; i++ {
+		queue <- packetWithPid(0x100)
+	}
+	close(queue)
+	<-done
+	if got := testutil.ToFloat64(counter) - before; got != 3 {
+		t.Errorf("Counted %v packets without consumers, expected 3", got)
+	}
+}
+
+func TestConnectionCoalescing(t *testing.T) {
+	writer := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := NewConnection(writer, 10, "", ctx)
+	conn.coalesceSize = 3 * protocol.MpegTsPacketSize
+	conn.coalesceDelay = 20 * time.Millisecond
+	done := make(chan bool)
+	go func() {
+		conn.Serve(nil)
+		done <- true
+	}()
+	// a full buffer is written at once
+	for i := 0; i < 3; i++ {
+		conn.Queue <- packetWithPid(0x100)
+	}
+	for atomic.LoadInt32(&writer.flushes) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	// a partial buffer is written after the delay
+	conn.Queue <- packetWithPid(0x100)
+	start := time.Now()
+	for atomic.LoadInt32(&writer.flushes) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Errorf("Partial buffer was written before the delay")
+	}
+	cancel()
+	<-done
+	if writer.Body.Len() != 4*protocol.MpegTsPacketSize {
+		t.Errorf("Got %d bytes, expected %d", writer.Body.Len(), 4*protocol.MpegTsPacketSize)
+	}
+	if atomic.LoadInt32(&writer.flushes) != 3 {
+		t.Errorf("Got %d flushes, expected 3", writer.flushes)
+	}
+}
+
+func TestStreamerDuplicateConnections(t *testing.T) {
+	notifier := &countingNotifier{}
+	streamer := NewStreamer("duplicates", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetNotifier(notifier)
+	streamer.SetDuplicateLimit(1, true, nil)
+	counter := metricDuplicateConnections.With(prometheus.Labels{"stream": "duplicates"})
+	before := testutil.ToFloat64(counter)
+	queue := make(chan protocol.MpegTsPacket)
+	done := make(chan bool)
+	go func() {
+		streamer.Stream(queue)
+		done <- true
+	}()
+	for !util.LoadBool(&streamer.running) {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan bool)
+	go func() {
+		request := httptest.NewRequest("GET", "/duplicates.ts", nil).WithContext(ctx)
+		request.RemoteAddr = "192.0.2.1:1000"
+		streamer.ServeHTTP(httptest.NewRecorder(), request)
+		served <- true
+	}()
+	for connects, _ := notifier.counts(); connects == 0; connects, _ = notifier.counts() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// same client, different port
+	writer := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/duplicates.ts", nil)
+	request.RemoteAddr = "192.0.2.1:1001"
+	streamer.ServeHTTP(writer, request)
+	if writer.Code != http.StatusTooManyRequests {
+		t.Errorf("Got status %d on a duplicate connection, expected 429", writer.Code)
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("Counted %v duplicate connections, expected 1", got)
+	}
+
+	cancel()
+	<-served
+	close(queue)
+	<-done
+}
+
+func TestDurationQueueSize(t *testing.T) {
+	// 1880 bytes per second = 10 packets per second
+	if got := durationQueueSize(1880, time.Second, 500*time.Millisecond, 1, 100); got != 5 {
+		t.Errorf("Got %d slices for 500ms, expected 5", got)
+	}
+	if got := durationQueueSize(1880, time.Second, 500*time.Millisecond, 2, 100); got != 3 {
+		t.Errorf("Got %d batches for 500ms, expected 3", got)
+	}
+	if got := durationQueueSize(1880, time.Second, time.Minute, 1, 100); got != 100 {
+		t.Errorf("Got %d slices for 1 minute, expected the capacity", got)
+	}
+	if got := durationQueueSize(0, time.Second, time.Second, 1, 100); got != 1 {
+		t.Errorf("Got %d slices without data, expected 1", got)
+	}
+}
+
+// blockingWriter is a ResponseWriter that blocks writes until it is released.
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(data []byte) (int, error) {
+	<-w.release
+	return w.ResponseRecorder.Write(data)
+}
+
+func TestStreamerOverflowDisconnect(t *testing.T) {
+	notifier := &countingNotifier{}
+	streamer := NewStreamer("overflow", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetNotifier(notifier)
+	streamer.SetOutputBuffer(2*protocol.MpegTsPacketSize, 0, OverflowDisconnect)
+	counter := metricSlowDisconnects.With(prometheus.Labels{"stream": "overflow"})
+	before := testutil.ToFloat64(counter)
+	queue := make(chan protocol.MpegTsPacket)
+	done := make(chan bool)
+	go func() {
+		streamer.Stream(queue)
+		done <- true
+	}()
+	for !util.LoadBool(&streamer.running) {
+		time.Sleep(time.Millisecond)
+	}
+
+	writer := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})}
+	served := make(chan bool)
+	go func() {
+		streamer.ServeHTTP(writer, httptest.NewRequest("GET", "/overflow.ts", nil))
+		served <- true
+	}()
+	for connects, _ := notifier.counts(); connects == 0; connects, _ = notifier.counts() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// one packet is stuck in the writer, two fill the queue, the next one overflows
+	for i := 0; i < 4; i++ {
+		queue <- packetWithPid(0x100)
+		time.Sleep(time.Millisecond)
+	}
+	close(writer.release)
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("Slow connection was not closed")
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("Counted %v slow disconnects, expected 1", got)
+	}
+
+	close(queue)
+	<-done
+}
+
+func TestStreamerTableRepeat(t *testing.T) {
+	streamer := NewStreamer("tables", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetTableRepeat(20*time.Millisecond, true)
+	queue := make(chan protocol.MpegTsPacket)
+	done := make(chan bool)
+	go func() {
+		streamer.Stream(queue)
+		done <- true
+	}()
+
+	var buffer bytes.Buffer
+	mux := protocol.NewMpegTsMuxer(&buffer, true, false)
+	if err := mux.WriteVideo([]byte{0, 0, 0, 1, 0x65}, 900, 900, true); err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+	for len(data) >= protocol.MpegTsPacketSize {
+		queue <- protocol.MpegTsPacket(data[:protocol.MpegTsPacketSize])
+		data = data[protocol.MpegTsPacketSize:]
+	}
+
+	conn := NewConnection(httptest.NewRecorder(), 10, "192.0.2.1:1000", context.Background())
+	if command, ok := streamer.add(context.Background(), conn, conn.ClientAddress); !ok || !command.Ok {
+		t.Fatal("Connection was not accepted")
+	}
+	// once on join, and then repeated
+	for i := 0; i < 2; i++ {
+		select {
+		case tables := <-conn.Queue:
+			if len(tables) != 2*protocol.MpegTsPacketSize || protocol.MpegTsPacketPid(tables) != protocol.MpegTsPidPat {
+				t.Errorf("Got %d bytes on PID %d, expected a PAT and a PMT", len(tables), protocol.MpegTsPacketPid(tables))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No tables received")
+		}
+	}
+
+	close(queue)
+	<-done
+}
+
+// recordingObserver remembers all observed values.
+type recordingObserver []float64
+
+func (o *recordingObserver) Observe(value float64) {
+	*o = append(*o, value)
+}
+
+func TestConnectionTimeToFirstByte(t *testing.T) {
+	observer := &recordingObserver{}
+	conn := NewConnection(httptest.NewRecorder(), 10, "192.0.2.1:1000", context.Background())
+	conn.firstByte = observer
+	conn.Queue <- packetWithPid(0x100)
+	conn.Queue <- packetWithPid(0x100)
+	close(conn.Queue)
+	conn.Serve(nil)
+	if len(*observer) != 1 {
+		t.Errorf("Got %d observations, expected exactly one", len(*observer))
+	}
+}
+
+func TestConnectionIdleKeepAlive(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := NewConnection(recorder, 10, "192.0.2.1:1000", ctx)
+	conn.idleKeepAlive = 10 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		conn.Serve(nil)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+	body := recorder.Body.Bytes()
+	if len(body) == 0 || len(body)%protocol.MpegTsPacketSize != 0 {
+		t.Fatalf("Got %d bytes, expected a non-zero number of packets", len(body))
+	}
+	null := protocol.NewMpegTsNullPacket()
+	for i := 0; i < len(body); i += protocol.MpegTsPacketSize {
+		if !bytes.Equal(body[i:i+protocol.MpegTsPacketSize], null) {
+			t.Errorf("Packet %d is not a null packet", i/protocol.MpegTsPacketSize)
+		}
+	}
+}
+
+func TestConnectionIdleKeepAliveEgress(t *testing.T) {
+	// one packet per second, with the burst used up
+	egress := NewEgressLimiter(protocol.MpegTsPacketSize)
+	if err := egress.Wait(context.Background(), egressMinBurst); err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := NewConnection(recorder, 10, "192.0.2.1:1000", ctx)
+	conn.idleKeepAlive = 10 * time.Millisecond
+	conn.egress = egress
+	done := make(chan struct{})
+	go func() {
+		conn.Serve(nil)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+	if packets := recorder.Body.Len() / protocol.MpegTsPacketSize; packets > 1 {
+		t.Errorf("Got %d null packets, the egress limit allows at most 1", packets)
+	}
+}
+
+// accessLines records preformatted access log lines.
+type accessLines struct {
+	util.DummyLogger
+	lines []string
+}
+
+func (l *accessLines) WriteLine(line string) {
+	l.lines = append(l.lines, line)
+}
+
+// plainWriter is a response writer that can't be flushed.
+type plainWriter struct {
+	header http.Header
+	status int
+}
+
+func (writer *plainWriter) Header() http.Header {
+	return writer.header
+}
+
+func (writer *plainWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (writer *plainWriter) WriteHeader(status int) {
+	writer.status = status
+}
+
+func TestConnectionNotFlushable(t *testing.T) {
+	for _, wrapped := range []bool{false, true} {
+		plain := &plainWriter{header: make(http.Header)}
+		var writer http.ResponseWriter = plain
+		if wrapped {
+			// the access log recorder can flush, but the writer it wraps can't
+			writer = &accessRecorder{ResponseWriter: plain}
+		}
+		conn := NewConnection(writer, 10, "", context.Background())
+		done := make(chan bool)
+		go func() {
+			conn.Serve(nil)
+			done <- true
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Streaming to an unflushable writer (wrapped: %v) was not refused", wrapped)
+		}
+		if plain.status != http.StatusInternalServerError {
+			t.Errorf("Got status %d for an unflushable writer (wrapped: %v), expected 500", plain.status, wrapped)
+		}
+	}
+	recorder := &accessRecorder{ResponseWriter: httptest.NewRecorder()}
+	if flusherOf(recorder) != recorder {
+		t.Errorf("Wrapped flushable writer not recognized")
+	}
+}
+
+func TestStreamerAccessLog(t *testing.T) {
+	streamer := NewStreamer("accesslog", 10, NewAccessController(1), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	out := &accessLines{}
+	streamer.SetAccessLog(util.NewAccessLogger(out, util.AccessLogCommon))
+
+	request := httptest.NewRequest(http.MethodGet, "/accesslog.ts?token=secret", nil)
+	request.RemoteAddr = "192.0.2.1:1000"
+	streamer.ServeHTTP(httptest.NewRecorder(), request)
+	if len(out.lines) != 1 {
+		t.Fatalf("Got %d access log lines, expected 1", len(out.lines))
+	}
+	if !strings.HasPrefix(out.lines[0], "192.0.2.1 - - [") || !strings.HasSuffix(out.lines[0], `] "GET /accesslog.ts HTTP/1.1" 503 -`) {
+		t.Errorf("Unexpected access log line for a refused request: %s", out.lines[0])
+	}
+}
+
+func TestStreamerCountries(t *testing.T) {
+	streamer := NewStreamer("countries", 10, NewAccessController(1), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetCountries(nil, []string{"xx"})
+	if !streamer.allowsCountry("DE") || !streamer.allowsCountry("") || streamer.allowsCountry("XX") {
+		t.Errorf("Deny list not applied correctly")
+	}
+	streamer.SetCountries([]string{"de", "CH"}, []string{"CH"})
+	if !streamer.allowsCountry("DE") || streamer.allowsCountry("CH") || streamer.allowsCountry("FR") || streamer.allowsCountry("") {
+		t.Errorf("Allow list not applied correctly")
+	}
+}
+
+func TestStreamerRequiredHeaders(t *testing.T) {
+	streamer := NewStreamer("headers", 10, NewAccessController(1), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetRequiredHeaders([]HeaderRule{
+		{Name: "Referer", Pattern: regexp.MustCompile(`^https://example\.com/`)},
+		{Name: "X-Token", Values: []string{"secret", "other"}},
+	})
+	tests := []struct {
+		referer   string
+		token     string
+		forbidden bool
+	}{
+		{"", "", true},
+		{"https://example.com/player", "", true},
+		{"https://example.com/player", "wrong", true},
+		{"https://example.org/player", "secret", true},
+		{"https://example.com/player", "other", false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodHead, "/headers.ts", nil)
+		if test.referer != "" {
+			request.Header.Set("Referer", test.referer)
+		}
+		if test.token != "" {
+			request.Header.Set("X-Token", test.token)
+		}
+		recorder := httptest.NewRecorder()
+		streamer.ServeHTTP(recorder, request)
+		if forbidden := recorder.Code == http.StatusForbidden; forbidden != test.forbidden {
+			t.Errorf("Referer %q and token %q: got status %d", test.referer, test.token, recorder.Code)
+		}
+	}
+}
+
+func TestTlsVersionName(t *testing.T) {
+	if name := tlsVersionName(nil); name != "none" {
+		t.Errorf("Got %s for an unencrypted connection, expected none", name)
+	}
+	if name := tlsVersionName(&tls.ConnectionState{Version: tls.VersionTLS13}); name != "TLS 1.3" {
+		t.Errorf("Got %s for TLS 1.3", name)
+	}
+}
+
+func TestStreamerConnectionLimits(t *testing.T) {
+	notifier := &countingNotifier{}
+	streamer := NewStreamer("limits", 10, NewAccessController(0), auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetNotifier(notifier)
+	streamer.SetConnectionLimits(2, 1, SoftLimitAdmit)
+	queue := make(chan protocol.MpegTsPacket)
+	done := make(chan bool)
+	go func() {
+		streamer.Stream(queue)
+		done <- true
+	}()
+	for !util.LoadBool(&streamer.running) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the first viewer reaches the soft limit, the second one is still admitted
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func() {
+			streamer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/limits.ts", nil).WithContext(ctx))
+			served <- true
+		}()
+	}
+	for connects, _ := notifier.counts(); connects < 2; connects, _ = notifier.counts() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the third one hits the hard limit
+	writer := httptest.NewRecorder()
+	streamer.ServeHTTP(writer, httptest.NewRequest("GET", "/limits.ts", nil))
+	if writer.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d beyond the hard limit, expected 503", writer.Code)
+	}
+
+	cancel()
+	<-served
+	<-served
+	close(queue)
+	<-done
+
+	streamer.SetConnectionLimits(0, 1, SoftLimitQueue)
+	if !streamer.admits(0) || streamer.admits(1) {
+		t.Errorf("Queue policy doesn't hold viewers at the soft limit")
+	}
+}
+
+func TestStreamerWaitingRoomDeadline(t *testing.T) {
+	notifier := &countingNotifier{}
+	broker := NewAccessController(0)
+	broker.SetWaitingRoom(5, 300*time.Millisecond)
+	streamer := NewStreamer("deadline", 10, broker, auth.NewAuthenticator(configuration.Authentication{}, nil))
+	streamer.SetNotifier(notifier)
+	streamer.SetConnectionLimits(1, 0, SoftLimitAdmit)
+	queue := make(chan protocol.MpegTsPacket)
+	done := make(chan bool)
+	go func() {
+		streamer.Stream(queue)
+		done <- true
+	}()
+	for !util.LoadBool(&streamer.running) {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan bool)
+	go func() {
+		streamer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/deadline.ts", nil).WithContext(ctx))
+		served <- true
+	}()
+	for connects, _ := notifier.counts(); connects < 1; connects, _ = notifier.counts() {
+		time.Sleep(time.Millisecond)
+	}
+	// a viewer of another stream comes and goes
+	broker.Accept("", nil)
+	broker.Release(nil)
+
+	// the stream limit refuses the second viewer, it is held until the deadline
+	start := time.Now()
+	writer := httptest.NewRecorder()
+	streamer.ServeHTTP(writer, httptest.NewRequest("GET", "/deadline.ts", nil))
+	if writer.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d beyond the hard limit, expected 503", writer.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Waiting client was held for %v, beyond its deadline", elapsed)
+	}
+
+	cancel()
+	<-served
+	close(queue)
+	<-done
+}
+
+func TestStreamerWaitingRoomStreams(t *testing.T) {
+	broker := NewAccessController(0)
+	broker.SetWaitingRoom(5, time.Second)
+	var streamers []*Streamer
+	var notifiers []*countingNotifier
+	var queues []chan protocol.MpegTsPacket
+	done := make(chan bool)
+	for _, name := range []string{"first", "second"} {
+		notifier := &countingNotifier{}
+		streamer := NewStreamer(name, 10, broker, auth.NewAuthenticator(configuration.Authentication{}, nil))
+		streamer.SetNotifier(notifier)
+		streamer.SetConnectionLimits(1, 0, SoftLimitAdmit)
+		queue := make(chan protocol.MpegTsPacket)
+		go func() {
+			streamer.Stream(queue)
+			done <- true
+		}()
+		for !util.LoadBool(&streamer.running) {
+			time.Sleep(time.Millisecond)
+		}
+		streamers = append(streamers, streamer)
+		notifiers = append(notifiers, notifier)
+		queues = append(queues, queue)
+	}
+
+	// both streams are full, the viewer of the second one will leave
+	ctx, cancel := context.WithCancel(context.Background())
+	leaving, leave := context.WithCancel(context.Background())
+	served := make(chan bool)
+	for i, viewer := range []context.Context{ctx, leaving} {
+		go func(streamer *Streamer, ctx context.Context) {
+			streamer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+streamer.name+".ts", nil).WithContext(ctx))
+			served <- true
+		}(streamers[i], viewer)
+		for connects, _ := notifiers[i].counts(); connects < 1; connects, _ = notifiers[i].counts() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// a viewer waits for the first stream, then another one for the second stream
+	for i, streamer := range streamers {
+		go func(streamer *Streamer) {
+			streamer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+streamer.name+".ts", nil).WithContext(ctx))
+			served <- true
+		}(streamer)
+		for {
+			broker.lock.Lock()
+			waiting := len(broker.waiters)
+			broker.lock.Unlock()
+			if waiting == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// the slot freed on the second stream goes to the viewer waiting for it
+	leave()
+	<-served
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for connects, _ := notifiers[1].counts(); connects < 2 && time.Now().Before(deadline); connects, _ = notifiers[1].counts() {
+		time.Sleep(time.Millisecond)
+	}
+	if connects, _ := notifiers[1].counts(); connects != 2 {
+		t.Errorf("Waiting viewer of the second stream was not admitted")
+	}
+	if connects, _ := notifiers[0].counts(); connects != 1 {
+		t.Errorf("Viewer was admitted to the full first stream")
+	}
+
+	cancel()
+	for i := 0; i < 3; i++ {
+		<-served
+	}
+	for _, queue := range queues {
+		close(queue)
+		<-done
+	}
+}
@@ -0,0 +1,92 @@
+/* Copyright (c) 2016-2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package streaming
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/url"
+)
+
+// UrlLabelScheme decides how upstream URLs are turned into metric labels.
+//
+// Every distinct label value creates a new time series, so URLs with
+// changing query strings (like access tokens) or many failover upstreams
+// can create a lot of them.
+type UrlLabelScheme int
+
+const (
+	// UrlLabelSanitized strips credentials, the query string and the fragment.
+	UrlLabelSanitized UrlLabelScheme = iota
+	// UrlLabelFull uses the complete URL.
+	UrlLabelFull
+	// UrlLabelHost only keeps the scheme, host and port.
+	UrlLabelHost
+	// UrlLabelHash uses a short hash of the sanitized URL.
+	// The label stays unique per upstream, without revealing it.
+	UrlLabelHash
+	// UrlLabelNone leaves the label empty, so there is only one series per stream.
+	UrlLabelNone
+)
+
+// ParseUrlLabelScheme converts the name of a labeling scheme into its value.
+// Valid names are sanitized (or the empty string), full, host, hash and none.
+func ParseUrlLabelScheme(name string) (UrlLabelScheme, error) {
+	switch name {
+	case "", "sanitized":
+		return UrlLabelSanitized, nil
+	case "full":
+		return UrlLabelFull, nil
+	case "host":
+		return UrlLabelHost, nil
+	case "hash":
+		return UrlLabelHash, nil
+	case "none":
+		return UrlLabelNone, nil
+	default:
+		return UrlLabelSanitized, fmt.Errorf("restreamer: invalid url label scheme %s", name)
+	}
+}
+
+// Label returns the label value for an upstream URL.
+func (scheme UrlLabelScheme) Label(upstream *url.URL) string {
+	switch scheme {
+	case UrlLabelFull:
+		return upstream.String()
+	case UrlLabelHost:
+		return (&url.URL{Scheme: upstream.Scheme, Host: upstream.Host}).String()
+	case UrlLabelHash:
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(sanitizeUrl(upstream)))
+		return fmt.Sprintf("%016x", hash.Sum64())
+	case UrlLabelNone:
+		return ""
+	default:
+		return sanitizeUrl(upstream)
+	}
+}
+
+// sanitizeUrl returns a URL without credentials, query string and fragment.
+func sanitizeUrl(upstream *url.URL) string {
+	sanitized := *upstream
+	sanitized.User = nil
+	sanitized.RawQuery = ""
+	sanitized.ForceQuery = false
+	sanitized.Fragment = ""
+	sanitized.RawFragment = ""
+	return sanitized.String()
+}
@@ -0,0 +1,204 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// clfTimeFormat is the time stamp format of the Common Log Format
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// AccessLogFormat selects the line format of an access log.
+type AccessLogFormat int
+
+const (
+	// AccessLogCombined writes Combined Log Format lines with the duration in seconds appended.
+	AccessLogCombined AccessLogFormat = iota
+	// AccessLogCommon writes Common Log Format lines.
+	AccessLogCommon
+	// AccessLogJson writes JSON lines, like the event log.
+	AccessLogJson
+)
+
+// ParseAccessLogFormat converts an access log format name
+// ("combined", "common" or "json") into an AccessLogFormat.
+// An empty string selects the Combined Log Format.
+func ParseAccessLogFormat(name string) (AccessLogFormat, error) {
+	switch name {
+	case "", "combined":
+		return AccessLogCombined, nil
+	case "common":
+		return AccessLogCommon, nil
+	case "json":
+		return AccessLogJson, nil
+	default:
+		return AccessLogCombined, fmt.Errorf("unknown access log format: %s", name)
+	}
+}
+
+// AccessEntry describes a completed request.
+type AccessEntry struct {
+	// Remote is the client address
+	Remote string
+	// User is the authenticated user name, if any
+	User string
+	// Time is the time when the request was received
+	Time time.Time
+	// Method is the request method
+	Method string
+	// Path is the request path, without the query string
+	Path string
+	// Proto is the request protocol version
+	Proto string
+	// Status is the response status code
+	Status int
+	// Bytes is the size of the response body
+	Bytes uint64
+	// Duration is the time it took to serve the request
+	Duration time.Duration
+	// Referer is the value of the Referer request header
+	Referer string
+	// UserAgent is the value of the User-Agent request header
+	UserAgent string
+}
+
+// LineLogger is a Logger that can also write preformatted lines.
+type LineLogger interface {
+	Logger
+	// WriteLine writes a single line, without any decoration.
+	WriteLine(line string)
+}
+
+// AccessLogger writes one line per completed request.
+type AccessLogger struct {
+	// out is the backing log
+	out LineLogger
+	// format is the line format
+	format AccessLogFormat
+}
+
+// NewAccessLogger creates an access logger that writes lines in format to out.
+func NewAccessLogger(out LineLogger, format AccessLogFormat) *AccessLogger {
+	return &AccessLogger{
+		out:    out,
+		format: format,
+	}
+}
+
+// Log writes an access log line for entry.
+func (logger *AccessLogger) Log(entry *AccessEntry) {
+	switch logger.format {
+	case AccessLogJson:
+		logger.out.Logd(Dict{
+			"remote":    entry.Remote,
+			"user":      entry.User,
+			"time":      entry.Time.Format(timeFormat),
+			"method":    entry.Method,
+			"path":      entry.Path,
+			"proto":     entry.Proto,
+			"status":    entry.Status,
+			"bytes":     entry.Bytes,
+			"duration":  entry.Duration.Seconds(),
+			"referer":   entry.Referer,
+			"useragent": entry.UserAgent,
+		})
+	case AccessLogCommon:
+		logger.out.WriteLine(FormatCommonLog(entry))
+	default:
+		logger.out.WriteLine(FormatCombinedLog(entry))
+	}
+}
+
+// FormatCommonLog formats entry as a Common Log Format line:
+//
+//	remote - user [time] "method path proto" status bytes
+func FormatCommonLog(entry *AccessEntry) string {
+	bytes := "-"
+	if entry.Bytes > 0 {
+		bytes = fmt.Sprint(entry.Bytes)
+	}
+	return fmt.Sprintf(
+		"%s - %s [%s] \"%s %s %s\" %d %s",
+		clfField(entry.Remote),
+		clfField(entry.User),
+		entry.Time.Format(clfTimeFormat),
+		clfEscape(entry.Method),
+		clfEscape(entry.Path),
+		clfEscape(entry.Proto),
+		entry.Status,
+		bytes,
+	)
+}
+
+// FormatCombinedLog formats entry as a Combined Log Format line,
+// followed by the duration of the request in seconds:
+//
+//	remote - user [time] "method path proto" status bytes "referer" "user-agent" duration
+func FormatCombinedLog(entry *AccessEntry) string {
+	return fmt.Sprintf(
+		"%s \"%s\" \"%s\" %.3f",
+		FormatCommonLog(entry),
+		clfQuoted(entry.Referer),
+		clfQuoted(entry.UserAgent),
+		entry.Duration.Seconds(),
+	)
+}
+
+// clfField returns value as an unquoted field, or "-" if it is empty.
+// Whitespace is replaced, so the field can't be split.
+func clfField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// clfQuoted returns the contents of a quoted field, or "-" if value is empty.
+func clfQuoted(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return clfEscape(value)
+}
+
+// clfEscape escapes quotes, backslashes and control characters,
+// so value can be placed between double quotes.
+func clfEscape(value string) string {
+	var escaped strings.Builder
+	for _, r := range value {
+		switch {
+		case r == '"' || r == '\\':
+			escaped.WriteByte('\\')
+			escaped.WriteRune(r)
+		case r < ' ' || r == 0x7f:
+			fmt.Fprintf(&escaped, "\\x%02x", r)
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,86 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+type lineRecorder struct {
+	mockLogger
+	written []string
+}
+
+func (l *lineRecorder) WriteLine(line string) {
+	l.written = append(l.written, line)
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	entry := &AccessEntry{
+		Remote:    "192.0.2.10",
+		Time:      time.Date(2024, time.October, 15, 12, 0, 0, 0, time.UTC),
+		Method:    "GET",
+		Path:      "/stream.ts",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		Bytes:     1880,
+		Duration:  1500 * time.Millisecond,
+		UserAgent: "VLC \"3\"",
+	}
+	common := `192.0.2.10 - - [15/Oct/2024:12:00:00 +0000] "GET /stream.ts HTTP/1.1" 200 1880`
+	if line := FormatCommonLog(entry); line != common {
+		t.Errorf("Got common log line %s, expected %s", line, common)
+	}
+	combined := common + ` "-" "VLC \"3\"" 1.500`
+	if line := FormatCombinedLog(entry); line != combined {
+		t.Errorf("Got combined log line %s, expected %s", line, combined)
+	}
+
+	entry.User = "some user"
+	entry.Bytes = 0
+	entry.Status = 503
+	common = `192.0.2.10 - some_user [15/Oct/2024:12:00:00 +0000] "GET /stream.ts HTTP/1.1" 503 -`
+	if line := FormatCommonLog(entry); line != common {
+		t.Errorf("Got common log line %s, expected %s", line, common)
+	}
+}
+
+func TestAccessLogger(t *testing.T) {
+	entry := &AccessEntry{
+		Remote: "192.0.2.10",
+		Status: 200,
+	}
+	for _, name := range []string{"", "combined", "common", "json"} {
+		format, err := ParseAccessLogFormat(name)
+		if err != nil {
+			t.Fatalf("Cannot parse access log format %s: %v", name, err)
+		}
+		out := &lineRecorder{}
+		NewAccessLogger(out, format).Log(entry)
+		if format == AccessLogJson {
+			if len(out.lines) != 1 || len(out.written) != 0 || out.lines[0]["status"] != 200 {
+				t.Errorf("Format %s did not log a JSON line: %v %v", name, out.lines, out.written)
+			}
+		} else if len(out.lines) != 0 || len(out.written) != 1 {
+			t.Errorf("Format %s did not write a preformatted line: %v %v", name, out.lines, out.written)
+		}
+	}
+	if _, err := ParseAccessLogFormat("apache"); err == nil {
+		t.Errorf("Unknown access log format was accepted")
+	}
+}
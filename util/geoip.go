@@ -0,0 +1,132 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GeoDatabase resolves IP addresses to countries with a MaxMind DB,
+// like GeoLite2-Country or GeoIP2-Country.
+//
+// The database can be reloaded while it is in use, for example after it
+// was replaced by geoipupdate.
+type GeoDatabase struct {
+	// path is the database file name
+	path string
+	// lock protects reader and modified
+	lock sync.RWMutex
+	// reader is the currently loaded database
+	reader *MmdbReader
+	// modified is the modification time of the loaded file
+	modified time.Time
+}
+
+// NewGeoDatabase loads a MaxMind DB from path.
+func NewGeoDatabase(path string) (*GeoDatabase, error) {
+	db := &GeoDatabase{
+		path: path,
+	}
+	if _, err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload loads the database again if the file was modified since it was last loaded.
+// Returns true if a new database was loaded.
+// If the new file can't be loaded, the previous database stays in use.
+func (db *GeoDatabase) Reload() (bool, error) {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return false, err
+	}
+	db.lock.RLock()
+	unchanged := db.reader != nil && info.ModTime().Equal(db.modified)
+	db.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return false, err
+	}
+	reader, err := NewMmdbReader(data)
+	if err != nil {
+		return false, err
+	}
+	db.lock.Lock()
+	db.reader = reader
+	db.modified = info.ModTime()
+	db.lock.Unlock()
+	return true, nil
+}
+
+// Watch checks for database updates every interval until ctx is cancelled.
+// report is called after each reload attempt that loaded a new database or failed.
+func (db *GeoDatabase) Watch(ctx context.Context, interval time.Duration, report func(bool, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if loaded, err := db.Reload(); loaded || err != nil {
+				report(loaded, err)
+			}
+		}
+	}
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country an address belongs to,
+// in upper case. If the country is not known, an empty string is returned.
+// The registered country is used for addresses that have no location.
+func (db *GeoDatabase) Country(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return ""
+		}
+		ip = net.ParseIP(host)
+		if ip == nil {
+			return ""
+		}
+	}
+	db.lock.RLock()
+	reader := db.reader
+	db.lock.RUnlock()
+	value, err := reader.Lookup(ip)
+	if err != nil {
+		return ""
+	}
+	record, _ := value.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := record[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				return strings.ToUpper(code)
+			}
+		}
+	}
+	return ""
+}
@@ -17,11 +17,14 @@
 package util
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -46,6 +49,9 @@ const (
 	KeyModule string = "module"
 	// KeyTime is the standard key for the time stamp when the log entry was generated
 	KeyTime string = "time"
+	//
+	// DefaultLogFlushInterval is the default interval at which compressed logs are flushed
+	DefaultLogFlushInterval = 5 * time.Second
 )
 
 var (
@@ -130,6 +136,17 @@ func NewGlobalModuleLogger(module string, dict Dict) Logger {
 	return logger
 }
 
+// WithDefaults creates a logger that adds the keys in dict to every log line
+// and passes them on to logger.
+//
+// Useful for tagging all log lines that belong to a single request or connection.
+func WithDefaults(logger Logger, dict Dict) Logger {
+	return &ModuleLogger{
+		Logger:   logger,
+		Defaults: dict,
+	}
+}
+
 // SetGlobalStandardLogger assigns a new backing logger to the global standard logger
 //
 // A reference to the old logger is returned.
@@ -187,6 +204,115 @@ func (logger *ModuleLogger) Logkv(keyValues ...interface{}) {
 	logger.Logd(LogFunnel(keyValues))
 }
 
+// SamplingKeys are the keys that identify repetitions of the same log line
+// in a SamplingLogger. Other keys may differ between repetitions.
+var SamplingKeys = []string{KeyModule, "event", "error", "stream", "url"}
+
+// SamplingLogger suppresses repetitive error lines, like the connection errors
+// of an upstream that is down and retried in a loop.
+//
+// Only lines with an "error" key are sampled, all others are passed through unchanged.
+// The first occurrence of an error is logged immediately, further occurrences
+// with the same SamplingKeys are counted, and a summary line is logged at the end
+// of each window in which they were seen.
+type SamplingLogger struct {
+	// Logger is the backing logger to send log lines to.
+	Logger Logger
+	// window is the period over which repetitions are summarized
+	window time.Duration
+	// lock protects seen
+	lock sync.Mutex
+	// seen contains the lines that are being sampled, by sampling key
+	seen map[string]*sampledLine
+}
+
+// sampledLine is an error line that was seen in the current window.
+type sampledLine struct {
+	// line is the first occurrence
+	line Dict
+	// count is the number of suppressed repetitions
+	count uint64
+}
+
+// NewSamplingLogger creates a logger that passes repetitive errors on to logger
+// only once, followed by a summary of the suppressed repetitions after each window.
+func NewSamplingLogger(logger Logger, window time.Duration) *SamplingLogger {
+	return &SamplingLogger{
+		Logger: logger,
+		window: window,
+		seen:   make(map[string]*sampledLine),
+	}
+}
+
+// Logd passes the log lines on, unless they are repetitions of an error.
+func (logger *SamplingLogger) Logd(lines ...Dict) {
+	pass := make([]Dict, 0, len(lines))
+	logger.lock.Lock()
+	for _, line := range lines {
+		if _, ok := line["error"]; !ok {
+			pass = append(pass, line)
+			continue
+		}
+		key := samplingKey(line)
+		if sampled := logger.seen[key]; sampled != nil {
+			sampled.count++
+			continue
+		}
+		logger.seen[key] = &sampledLine{
+			line: line,
+		}
+		time.AfterFunc(logger.window, func() {
+			logger.summarize(key)
+		})
+		pass = append(pass, line)
+	}
+	logger.lock.Unlock()
+	if len(pass) > 0 {
+		logger.Logger.Logd(pass...)
+	}
+}
+
+func (logger *SamplingLogger) Logkv(keyValues ...interface{}) {
+	logger.Logd(LogFunnel(keyValues))
+}
+
+// summarize logs the number of repetitions of a line at the end of a window
+// and starts the next one. If there were none, the line is forgotten.
+func (logger *SamplingLogger) summarize(key string) {
+	logger.lock.Lock()
+	sampled := logger.seen[key]
+	if sampled.count == 0 {
+		delete(logger.seen, key)
+		logger.lock.Unlock()
+		return
+	}
+	summary := make(Dict)
+	for _, k := range SamplingKeys {
+		if value, ok := sampled.line[k]; ok {
+			summary[k] = value
+		}
+	}
+	summary["repeated"] = sampled.count
+	summary["message"] = fmt.Sprintf("Seen %d times in the last %v: %v", sampled.count, logger.window, sampled.line["message"])
+	sampled.count = 0
+	time.AfterFunc(logger.window, func() {
+		logger.summarize(key)
+	})
+	logger.lock.Unlock()
+	logger.Logger.Logd(summary)
+}
+
+// samplingKey assembles the SamplingKeys of a log line into a map key.
+func samplingKey(line Dict) string {
+	values := make([]string, len(SamplingKeys))
+	for i, k := range SamplingKeys {
+		if value, ok := line[k]; ok {
+			values[i] = fmt.Sprint(value)
+		}
+	}
+	return strings.Join(values, "\x00")
+}
+
 // DummyLogger is a logger placeholder that doesn't actually log anything.
 // Just a placeholder for the real big boy loggers.
 type DummyLogger struct{}
@@ -241,6 +367,10 @@ type FileLogger struct {
 	name string
 	// log file handle
 	log io.WriteCloser
+	// compress writes the log with gzip compression
+	compress bool
+	// flushInterval is the interval at which the compressor is flushed
+	flushInterval time.Duration
 	// message queue
 	messages chan interface{}
 	// log line counter
@@ -278,6 +408,54 @@ func NewFileLogger(logfile string, sigusr bool) (*FileLogger, error) {
 	return logger, nil
 }
 
+// NewCompressedFileLogger creates a FileLogger that writes gzip compressed logs.
+//
+// The compressor is flushed every flushInterval, so recent lines are readable
+// with zcat or similar tools, at the expense of a slightly lower compression ratio.
+// If flushInterval is 0, DefaultLogFlushInterval is used.
+// Note that compressed logs can't be followed line by line with tail -f.
+//
+// Each time the log is reopened, a new gzip member is appended to the file.
+// Concatenated gzip members are valid gzip files, so rotated logs can be
+// decompressed as a whole.
+func NewCompressedFileLogger(logfile string, sigusr bool, flushInterval time.Duration) (*FileLogger, error) {
+	if flushInterval <= 0 {
+		flushInterval = DefaultLogFlushInterval
+	}
+	logger := &FileLogger{
+		signals:       make(chan os.Signal, signalQueueLength),
+		name:          logfile,
+		messages:      make(chan interface{}, logQueueLength),
+		compress:      true,
+		flushInterval: flushInterval,
+	}
+
+	err := logger.reopenLog()
+	if err != nil {
+		return nil, err
+	}
+
+	RegisterUserSignalHandler(logger.signals)
+	go logger.handle()
+
+	return logger, nil
+}
+
+// gzipFile is a gzip compressed file.
+type gzipFile struct {
+	*gzip.Writer
+	file *os.File
+}
+
+// Close finishes the compressed stream and closes the file.
+func (f *gzipFile) Close() error {
+	err := f.Writer.Close()
+	if ferr := f.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
 // Logd writes a series of log lines, prefixed by a time stamp in RFC3339 format.
 func (logger *FileLogger) Logd(lines ...Dict) {
 	// send these down the queue
@@ -296,10 +474,30 @@ func (logger *FileLogger) Logkv(keyValues ...interface{}) {
 	logger.Logd(LogFunnel(keyValues))
 }
 
+// rawLine is a preformatted log line that is written without a time stamp.
+type rawLine string
+
+// WriteLine writes a preformatted line to the log, without a time stamp or JSON encoding.
+// This is useful for logs in other formats, like access logs.
+func (logger *FileLogger) WriteLine(line string) {
+	select {
+	case logger.messages <- rawLine(line):
+		// ok
+	default:
+		fmt.Printf("{\"event\":\"error\",\"message\":\"Log queue is full, message dropped\",\"line\":%q}\n", line)
+		logger.drops++
+	}
+}
+
 // Writes a single log line
 func (logger *FileLogger) writeLog(line interface{}) {
 	// only log if the output is open
-	if logger.log != nil {
+	if raw, ok := line.(rawLine); ok && logger.log != nil {
+		if _, err := io.WriteString(logger.log, string(raw)+"\n"); err != nil {
+			fmt.Printf("{\"event\":\"error\",\"message\":\"Cannot write log line to file\",\"line\":%q,\"goerror\":\"%v\"}\n", raw, err)
+		}
+		logger.lines++
+	} else if logger.log != nil {
 		data, err := json.Marshal(line)
 		if err == nil {
 			format := fmt.Sprintf("[%s] %s\n", time.Now().Format(timeFormat), data)
@@ -351,7 +549,15 @@ func (logger *FileLogger) reopenLog() error {
 		logger.log = nil
 	}
 	if err == nil {
-		logger.log, err = os.OpenFile(logger.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0666))
+		var file *os.File
+		file, err = os.OpenFile(logger.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0666))
+		if err == nil {
+			if logger.compress {
+				logger.log = &gzipFile{Writer: gzip.NewWriter(file), file: file}
+			} else {
+				logger.log = file
+			}
+		}
 	}
 
 	return err
@@ -362,8 +568,22 @@ func (logger *FileLogger) reopenLog() error {
 func (logger *FileLogger) handle() {
 	running := true
 
+	// periodically flush the compressor
+	var flush <-chan time.Time
+	if logger.compress {
+		ticker := time.NewTicker(logger.flushInterval)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+
 	for running {
 		select {
+		case <-flush:
+			if compressed, ok := logger.log.(*gzipFile); ok {
+				if err := compressed.Flush(); err != nil {
+					fmt.Printf("{\"event\":\"error\",\"message\":\"Error flushing log\",\"error\":\"flush\",\"errmsg\":\"%s\"}\n", err.Error())
+				}
+			}
 		case sig := <-logger.signals:
 			// check signal type
 			switch sig {
@@ -19,9 +19,14 @@ package util
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestInternalSignal00(t *testing.T) {
@@ -191,3 +196,102 @@ func TestConsoleLogger00(t *testing.T) {
 		t.Errorf("Didn't find test value in log line: %s", m00.lines[0])
 	}
 }
+
+// readCompressedLog decompresses as much of a gzip log file as possible.
+func readCompressedLog(name string) string {
+	file, err := os.Open(name)
+	if err != nil {
+		return ""
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return ""
+	}
+	// an unfinished stream ends with an error, but the flushed data is still returned
+	data, _ := io.ReadAll(reader)
+	return string(data)
+}
+
+// waitForCompressedLog polls a gzip log file until it contains text.
+func waitForCompressedLog(t *testing.T, name string, text string) string {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if data := readCompressedLog(name); strings.Contains(data, text) {
+			return data
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Log line %s was not written", text)
+	return ""
+}
+
+func TestCompressedFileLogger00(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "log.json.gz")
+	l00, err := NewCompressedFileLogger(name, false, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Cannot open log: %v", err)
+	}
+	l00.Logkv("cl00", "first")
+	waitForCompressedLog(t, name, "first")
+	// reopening appends a new gzip member
+	l00.signals <- UserSignal
+	l00.Logkv("cl00", "second")
+	waitForCompressedLog(t, name, "second")
+	l00.Close()
+	data := waitForCompressedLog(t, name, "second")
+	if strings.Count(data, "\n") != 2 || !strings.Contains(data, "first") {
+		t.Errorf("Unexpected log contents: %s", data)
+	}
+}
+
+// syncLogger is a mockLogger that can be used from several goroutines.
+type syncLogger struct {
+	lock sync.Mutex
+	mockLogger
+}
+
+func (l *syncLogger) Logd(lines ...Dict) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.mockLogger.Logd(lines...)
+}
+
+func (l *syncLogger) Logkv(keyValues ...interface{}) {
+	l.Logd(LogFunnel(keyValues))
+}
+
+func (l *syncLogger) get() []Dict {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]Dict{}, l.lines...)
+}
+
+func TestSamplingLogger00(t *testing.T) {
+	m00 := &syncLogger{}
+	l00 := NewSamplingLogger(m00, 20*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		l00.Logkv("event", "connect", "error", "refused", "url", "http://a/")
+	}
+	l00.Logkv("event", "connect", "error", "refused", "url", "http://b/")
+	l00.Logkv("event", "connect", "url", "http://a/")
+	l00.Logkv("event", "connect", "url", "http://a/")
+	if lines := m00.get(); len(lines) != 4 {
+		t.Fatalf("Got %d log lines, expected 4: %v", len(lines), lines)
+	}
+	time.Sleep(50 * time.Millisecond)
+	lines := m00.get()
+	if len(lines) != 5 {
+		t.Fatalf("Got %d log lines, expected 5 with the summary: %v", len(lines), lines)
+	}
+	if lines[4]["repeated"] != uint64(4) || lines[4]["url"] != "http://a/" {
+		t.Errorf("Invalid summary: %v", lines[4])
+	}
+	// after a quiet window, the error is logged immediately again
+	time.Sleep(50 * time.Millisecond)
+	l00.Logkv("event", "connect", "error", "refused", "url", "http://a/")
+	if lines := m00.get(); len(lines) != 6 {
+		t.Errorf("Got %d log lines, expected 6: %v", len(lines), lines)
+	}
+}
@@ -0,0 +1,322 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+const (
+	// mmdbDataSeparator is the size of the zero filled gap between search tree and data section
+	mmdbDataSeparator = 16
+	// mmdbMaxDepth limits the nesting of data structures and pointers
+	mmdbMaxDepth = 32
+)
+
+var (
+	// mmdbMetadataMarker precedes the metadata at the end of the file
+	mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+	// ErrMmdbFormat is returned when a database is malformed
+	ErrMmdbFormat = errors.New("invalid MaxMind database")
+)
+
+// MmdbReader looks up IP addresses in a MaxMind DB file, like the GeoIP2 and GeoLite2 databases.
+//
+// Only reading is supported. The whole database is held in memory.
+// See https://maxmind.github.io/MaxMind-DB/ for the format specification.
+type MmdbReader struct {
+	// data is the database contents
+	data []byte
+	// nodeCount is the number of nodes in the search tree
+	nodeCount uint
+	// recordSize is the size of a search tree record in bits
+	recordSize uint
+	// ipVersion is 4 for IPv4 only databases, 6 for databases that contain IPv6 addresses
+	ipVersion uint
+	// dataStart is the offset of the data section
+	dataStart uint
+	// ipv4Start is the node where IPv4 lookups start in an IPv6 database
+	ipv4Start uint
+	// Metadata contains the database metadata
+	Metadata map[string]interface{}
+}
+
+// NewMmdbReader parses the metadata of a MaxMind DB and prepares it for lookups.
+func NewMmdbReader(data []byte) (*MmdbReader, error) {
+	marker := bytes.LastIndex(data, mmdbMetadataMarker)
+	if marker < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", ErrMmdbFormat)
+	}
+	start := marker + len(mmdbMetadataMarker)
+	value, _, err := mmdbDecode(data[start:], 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrMmdbFormat)
+	}
+	reader := &MmdbReader{
+		data:     data,
+		Metadata: metadata,
+	}
+	reader.nodeCount = mmdbUint(metadata["node_count"])
+	reader.recordSize = mmdbUint(metadata["record_size"])
+	reader.ipVersion = mmdbUint(metadata["ip_version"])
+	if reader.recordSize != 24 && reader.recordSize != 28 && reader.recordSize != 32 {
+		return nil, fmt.Errorf("%w: unsupported record size %d", ErrMmdbFormat, reader.recordSize)
+	}
+	if reader.ipVersion != 4 && reader.ipVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported IP version %d", ErrMmdbFormat, reader.ipVersion)
+	}
+	reader.dataStart = reader.nodeCount*reader.recordSize/4 + mmdbDataSeparator
+	if reader.dataStart > uint(marker) {
+		return nil, fmt.Errorf("%w: search tree exceeds the file size", ErrMmdbFormat)
+	}
+	// IPv4 addresses are stored as ::a.b.c.d in IPv6 databases
+	if reader.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < reader.nodeCount; i++ {
+			node = reader.record(node, 0)
+		}
+		reader.ipv4Start = node
+	}
+	return reader, nil
+}
+
+// Lookup returns the data record for ip, or nil if the address is not in the database.
+func (reader *MmdbReader) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	address := ip.To4()
+	if address != nil {
+		node = reader.ipv4Start
+	} else if reader.ipVersion == 4 {
+		// IPv6 addresses can't be in an IPv4 database
+		return nil, nil
+	} else {
+		address = ip.To16()
+		if address == nil {
+			return nil, fmt.Errorf("invalid IP address: %v", ip)
+		}
+	}
+	for i := 0; i < len(address)*8 && node < reader.nodeCount; i++ {
+		bit := (address[i/8] >> (7 - uint(i%8))) & 1
+		node = reader.record(node, uint(bit))
+	}
+	if node == reader.nodeCount {
+		return nil, nil
+	}
+	if node < reader.nodeCount {
+		return nil, fmt.Errorf("%w: search tree is too deep", ErrMmdbFormat)
+	}
+	offset := node - reader.nodeCount - mmdbDataSeparator
+	section := reader.data[reader.dataStart:]
+	if offset >= uint(len(section)) {
+		return nil, fmt.Errorf("%w: data pointer out of range", ErrMmdbFormat)
+	}
+	value, _, err := mmdbDecode(section, offset, 0)
+	return value, err
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a search tree node.
+func (reader *MmdbReader) record(node uint, bit uint) uint {
+	size := reader.recordSize / 4
+	offset := node * size
+	if offset+size > uint(len(reader.data)) {
+		// point to "not found" on truncated trees
+		return reader.nodeCount
+	}
+	b := reader.data[offset : offset+size]
+	switch reader.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[0:4]))
+		}
+		return uint(binary.BigEndian.Uint32(b[4:8]))
+	}
+}
+
+// mmdbDecode decodes the data field at offset in section.
+// Pointers are resolved relative to the start of section.
+// Returns the decoded value and the offset of the next field.
+func mmdbDecode(section []byte, offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("%w: data nested too deeply", ErrMmdbFormat)
+	}
+	next := func(count uint) ([]byte, error) {
+		if offset+count > uint(len(section)) {
+			return nil, fmt.Errorf("%w: unexpected end of data", ErrMmdbFormat)
+		}
+		b := section[offset : offset+count]
+		offset += count
+		return b, nil
+	}
+	b, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	control := b[0]
+	kind := control >> 5
+	if kind == 1 {
+		// pointer, the size bits are part of the pointer value
+		size := uint(control>>3) & 0x3
+		b, err := next(size + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var pointer uint
+		switch size {
+		case 0:
+			pointer = uint(control&0x7)<<8 | uint(b[0])
+		case 1:
+			pointer = (uint(control&0x7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			pointer = (uint(control&0x7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			pointer = uint(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := mmdbDecode(section, pointer, depth+1)
+		return value, offset, err
+	}
+	if kind == 0 {
+		// extended type
+		b, err := next(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + b[0]
+	}
+	size := uint(control & 0x1f)
+	if size >= 29 {
+		b, err := next(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch size {
+		case 29:
+			size = 29 + uint(b[0])
+		case 30:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+	switch kind {
+	case 2, 4:
+		// UTF-8 string, bytes
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if kind == 2 {
+			return string(b), offset, nil
+		}
+		return append([]byte(nil), b...), offset, nil
+	case 3:
+		// double
+		b, err := next(size)
+		if err != nil || size != 8 {
+			return nil, 0, fmt.Errorf("%w: invalid double", ErrMmdbFormat)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15:
+		// float
+		b, err := next(size)
+		if err != nil || size != 4 {
+			return nil, 0, fmt.Errorf("%w: invalid float", ErrMmdbFormat)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case 5, 6, 8, 9, 10:
+		// unsigned integers and int32, big endian with leading zeros removed
+		b, err := next(size)
+		if err != nil || size > 16 {
+			return nil, 0, fmt.Errorf("%w: invalid integer", ErrMmdbFormat)
+		}
+		if kind == 10 && size > 8 {
+			// 128 bit integers are returned as raw bytes
+			return append([]byte(nil), b...), offset, nil
+		}
+		var value uint64
+		for _, digit := range b {
+			value = value<<8 | uint64(digit)
+		}
+		if kind == 8 {
+			return int32(value), offset, nil
+		}
+		return value, offset, nil
+	case 7:
+		// map
+		values := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, after, err := mmdbDecode(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map key is not a string", ErrMmdbFormat)
+			}
+			value, after, err := mmdbDecode(section, after, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values[name] = value
+			offset = after
+		}
+		return values, offset, nil
+	case 11:
+		// array
+		values := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, after, err := mmdbDecode(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+			offset = after
+		}
+		return values, offset, nil
+	case 14:
+		// boolean, the value is stored in the size
+		return size != 0, offset, nil
+	default:
+		return nil, 0, fmt.Errorf("%w: unsupported data type %d", ErrMmdbFormat, kind)
+	}
+}
+
+// mmdbUint converts an unsigned integer from a decoded record, 0 if it has a different type.
+func mmdbUint(value interface{}) uint {
+	if number, ok := value.(uint64); ok {
+		return uint(number)
+	}
+	return 0
+}
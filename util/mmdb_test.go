@@ -0,0 +1,271 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mmdbNode is a search tree node of a test database.
+// Each record is either nil (not found), a *mmdbNode or a data offset (int).
+type mmdbNode struct {
+	records [2]interface{}
+}
+
+// mmdbBuilder creates small MaxMind DB files for testing.
+type mmdbBuilder struct {
+	root       *mmdbNode
+	data       bytes.Buffer
+	ipVersion  uint64
+	recordSize uint
+}
+
+func newMmdbBuilder(ipVersion uint64, recordSize uint) *mmdbBuilder {
+	return &mmdbBuilder{
+		root:       &mmdbNode{},
+		ipVersion:  ipVersion,
+		recordSize: recordSize,
+	}
+}
+
+// insert adds a network with a data record.
+func (builder *mmdbBuilder) insert(network string, record map[string]interface{}) {
+	_, ipnet, err := net.ParseCIDR(network)
+	if err != nil {
+		panic(err)
+	}
+	address := ipnet.IP.To16()
+	ones, _ := ipnet.Mask.Size()
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		if builder.ipVersion == 4 {
+			address = ip4
+		} else {
+			// IPv4 networks are stored as ::a.b.c.d/96+n
+			address = append(make(net.IP, 12), ip4...)
+			ones += 96
+		}
+	}
+	offset := builder.data.Len()
+	mmdbEncode(&builder.data, record)
+	node := builder.root
+	for i := 0; i < ones; i++ {
+		bit := (address[i/8] >> (7 - uint(i%8))) & 1
+		if i == ones-1 {
+			node.records[bit] = offset
+		} else {
+			next, ok := node.records[bit].(*mmdbNode)
+			if !ok {
+				next = &mmdbNode{}
+				node.records[bit] = next
+			}
+			node = next
+		}
+	}
+}
+
+// build serializes the database.
+func (builder *mmdbBuilder) build() []byte {
+	// number the nodes in breadth-first order, the root must be 0
+	var nodes []*mmdbNode
+	index := make(map[*mmdbNode]int)
+	queue := []*mmdbNode{builder.root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		index[node] = len(nodes)
+		nodes = append(nodes, node)
+		for _, record := range node.records {
+			if child, ok := record.(*mmdbNode); ok {
+				queue = append(queue, child)
+			}
+		}
+	}
+	count := uint32(len(nodes))
+	var out bytes.Buffer
+	for _, node := range nodes {
+		var values [2]uint32
+		for i, record := range node.records {
+			switch value := record.(type) {
+			case *mmdbNode:
+				values[i] = uint32(index[value])
+			case int:
+				values[i] = count + mmdbDataSeparator + uint32(value)
+			default:
+				values[i] = count
+			}
+		}
+		switch builder.recordSize {
+		case 24:
+			out.Write([]byte{byte(values[0] >> 16), byte(values[0] >> 8), byte(values[0]), byte(values[1] >> 16), byte(values[1] >> 8), byte(values[1])})
+		case 28:
+			out.Write([]byte{byte(values[0] >> 16), byte(values[0] >> 8), byte(values[0]), byte(values[0]>>24)<<4 | byte(values[1]>>24), byte(values[1] >> 16), byte(values[1] >> 8), byte(values[1])})
+		default:
+			binary.Write(&out, binary.BigEndian, values)
+		}
+	}
+	out.Write(make([]byte, mmdbDataSeparator))
+	out.Write(builder.data.Bytes())
+	out.Write(mmdbMetadataMarker)
+	mmdbEncode(&out, map[string]interface{}{
+		"node_count":    uint64(count),
+		"record_size":   uint64(builder.recordSize),
+		"ip_version":    builder.ipVersion,
+		"database_type": "Test-Country",
+	})
+	return out.Bytes()
+}
+
+// mmdbEncode writes a value in MaxMind DB data format. Only short values are supported.
+func mmdbEncode(out *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		out.WriteByte(2<<5 | byte(len(v)))
+		out.WriteString(v)
+	case uint64:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], v)
+		digits := bytes.TrimLeft(b[:], "\x00")
+		// uint64 is an extended type
+		out.WriteByte(byte(len(digits)))
+		out.WriteByte(9 - 7)
+		out.Write(digits)
+	case bool:
+		// booleans are an extended type, the value is stored in the size
+		if v {
+			out.WriteByte(1)
+		} else {
+			out.WriteByte(0)
+		}
+		out.WriteByte(14 - 7)
+	case map[string]interface{}:
+		out.WriteByte(7<<5 | byte(len(v)))
+		for key, item := range v {
+			mmdbEncode(out, key)
+			mmdbEncode(out, item)
+		}
+	case []interface{}:
+		out.WriteByte(byte(len(v)))
+		out.WriteByte(11 - 7)
+		for _, item := range v {
+			mmdbEncode(out, item)
+		}
+	}
+}
+
+func country(code string) map[string]interface{} {
+	return map[string]interface{}{"iso_code": code}
+}
+
+func TestMmdbReader(t *testing.T) {
+	for _, size := range []uint{24, 28, 32} {
+		builder := newMmdbBuilder(6, size)
+		builder.insert("192.0.2.0/24", map[string]interface{}{"country": country("de"), "flags": []interface{}{true, uint64(300)}})
+		builder.insert("198.51.100.128/25", map[string]interface{}{"country": country("CH")})
+		builder.insert("2001:db8::/32", map[string]interface{}{"registered_country": country("FR")})
+		reader, err := NewMmdbReader(builder.build())
+		if err != nil {
+			t.Fatalf("Record size %d: cannot open database: %v", size, err)
+		}
+		if reader.Metadata["database_type"] != "Test-Country" {
+			t.Errorf("Record size %d: wrong metadata: %v", size, reader.Metadata)
+		}
+		value, err := reader.Lookup(net.ParseIP("192.0.2.77"))
+		if err != nil {
+			t.Fatalf("Record size %d: lookup failed: %v", size, err)
+		}
+		record, _ := value.(map[string]interface{})
+		flags, _ := record["flags"].([]interface{})
+		if len(flags) != 2 || flags[0] != true || flags[1] != uint64(300) {
+			t.Errorf("Record size %d: wrong record: %v", size, value)
+		}
+		if value, err := reader.Lookup(net.ParseIP("198.51.100.1")); value != nil || err != nil {
+			t.Errorf("Record size %d: expected no record, got %v %v", size, value, err)
+		}
+	}
+
+	builder := newMmdbBuilder(4, 24)
+	builder.insert("203.0.113.0/24", map[string]interface{}{"country": country("JP")})
+	reader, err := NewMmdbReader(builder.build())
+	if err != nil {
+		t.Fatalf("Cannot open IPv4 database: %v", err)
+	}
+	if value, err := reader.Lookup(net.ParseIP("203.0.113.1")); value == nil || err != nil {
+		t.Errorf("Expected a record in the IPv4 database, got %v %v", value, err)
+	}
+	if value, err := reader.Lookup(net.ParseIP("2001:db8::1")); value != nil || err != nil {
+		t.Errorf("Expected no IPv6 record in the IPv4 database, got %v %v", value, err)
+	}
+
+	if _, err := NewMmdbReader([]byte("garbage")); err == nil {
+		t.Errorf("Invalid database was accepted")
+	}
+}
+
+func TestGeoDatabase(t *testing.T) {
+	builder := newMmdbBuilder(6, 28)
+	builder.insert("192.0.2.0/24", map[string]interface{}{"country": country("de")})
+	builder.insert("2001:db8::/32", map[string]interface{}{"registered_country": country("FR")})
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, builder.build(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewGeoDatabase(path)
+	if err != nil {
+		t.Fatalf("Cannot load database: %v", err)
+	}
+	tests := map[string]string{
+		"192.0.2.1":         "DE",
+		"192.0.2.1:1000":    "DE",
+		"[2001:db8::1]:443": "FR",
+		"198.51.100.1":      "",
+		"garbage":           "",
+	}
+	for address, expected := range tests {
+		if country := db.Country(address); country != expected {
+			t.Errorf("Expected country %q for %s, got %q", expected, address, country)
+		}
+	}
+
+	if loaded, err := db.Reload(); loaded || err != nil {
+		t.Errorf("Unchanged database was reloaded: %v", err)
+	}
+	builder = newMmdbBuilder(6, 24)
+	builder.insert("198.51.100.0/24", map[string]interface{}{"country": country("US")})
+	if err := os.WriteFile(path, builder.build(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := db.Reload(); !loaded || err != nil {
+		t.Errorf("Updated database was not reloaded: %v", err)
+	}
+	if country := db.Country("198.51.100.1"); country != "US" {
+		t.Errorf("Expected country US after reload, got %q", country)
+	}
+
+	if _, err := NewGeoDatabase(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Errorf("Missing database was accepted")
+	}
+}
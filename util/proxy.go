@@ -0,0 +1,164 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ProxyList is a list of trusted reverse proxy networks.
+type ProxyList []*net.IPNet
+
+// ParseProxyList parses a list of IP addresses or CIDR networks.
+// Single addresses are treated as host networks.
+func ParseProxyList(list []string) (ProxyList, error) {
+	proxies := make(ProxyList, 0, len(list))
+	for _, entry := range list {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: entry}
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, network)
+		}
+	}
+	return proxies, nil
+}
+
+// Contains tells if an IP address belongs to a trusted proxy.
+func (proxies ProxyList) Contains(ip net.IP) bool {
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddress determines the IP address of the client that sent a request.
+//
+// If the request came from a trusted proxy, the forwarded addresses are
+// evaluated from right to left, and the first address that does not belong to
+// a trusted proxy is returned.
+// The addresses are taken from the Forwarded header (RFC 7239) if it is present,
+// otherwise from X-Forwarded-For, or from X-Real-IP as a last resort.
+// Otherwise, the host part of the remote address is returned.
+func (proxies ProxyList) ClientAddress(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !proxies.Contains(ip) {
+		return host
+	}
+	forwarded := forwardedAddresses(request.Header)
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(forwarded[i])
+		if hop == nil {
+			// garbage in the header, stop at the last valid hop
+			break
+		}
+		host = hop.String()
+		if !proxies.Contains(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// Handler wraps handler and replaces the remote address of requests from trusted
+// proxies with the forwarded client address, so logs, limits and statistics
+// see the real client. The rewritten remote address has no port.
+// Forwarding headers of requests from other peers are ignored.
+// If the list is empty, handler is returned unchanged.
+func (proxies ProxyList) Handler(handler http.Handler) http.Handler {
+	if len(proxies) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		client := proxies.ClientAddress(request)
+		host, _, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			host = request.RemoteAddr
+		}
+		if client != host {
+			request = request.WithContext(request.Context())
+			request.RemoteAddr = client
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// forwardedAddresses returns the chain of forwarded addresses, in the order they were added.
+// Ports and brackets are removed. Obfuscated and unknown addresses are returned as is,
+// so they stop the evaluation.
+func forwardedAddresses(header http.Header) []string {
+	var addresses []string
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, node, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(key, "for") {
+						addresses = append(addresses, forwardedNode(node))
+					}
+				}
+			}
+		}
+		return addresses
+	}
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, address := range strings.Split(value, ",") {
+			addresses = append(addresses, strings.TrimSpace(address))
+		}
+	}
+	if len(addresses) == 0 {
+		if real := strings.TrimSpace(header.Get("X-Real-IP")); real != "" {
+			addresses = append(addresses, real)
+		}
+	}
+	return addresses
+}
+
+// forwardedNode extracts the address from a node in a Forwarded header,
+// like 192.0.2.60, "192.0.2.60:4711" or "[2001:db8::1]:4711".
+func forwardedNode(node string) string {
+	node = strings.Trim(node, "\"")
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
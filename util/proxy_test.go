@@ -0,0 +1,122 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyList(t *testing.T) {
+	proxies, err := ParseProxyList([]string{"10.0.0.0/8", "192.168.1.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseProxyList([]string{"not-an-ip"}); err == nil {
+		t.Error("Invalid address was accepted")
+	}
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		client    string
+	}{
+		// untrusted remote, header must be ignored
+		{"1.2.3.4:1000", "5.6.7.8", "1.2.3.4"},
+		{"192.168.1.1:1000", "5.6.7.8", "5.6.7.8"},
+		{"[::1]:1000", "5.6.7.8", "5.6.7.8"},
+		// chain of trusted proxies, spoofed first entry
+		{"10.1.1.1:1000", "9.9.9.9, 5.6.7.8, 10.2.2.2", "5.6.7.8"},
+		// trusted proxy without header
+		{"10.1.1.1:1000", "", "10.1.1.1"},
+	}
+	for i, test := range tests {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			request.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if client := proxies.ClientAddress(request); client != test.client {
+			t.Errorf("Test %d: expected client %s, got %s", i, test.client, client)
+		}
+	}
+}
+
+func TestProxyListHeaders(t *testing.T) {
+	proxies, err := ParseProxyList([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote  string
+		headers map[string]string
+		client  string
+	}{
+		{"10.1.1.1:1000", map[string]string{"X-Real-IP": "5.6.7.8"}, "5.6.7.8"},
+		{"1.2.3.4:1000", map[string]string{"X-Real-IP": "5.6.7.8"}, "1.2.3.4"},
+		{"10.1.1.1:1000", map[string]string{"Forwarded": "for=5.6.7.8;proto=https"}, "5.6.7.8"},
+		{"10.1.1.1:1000", map[string]string{"Forwarded": `for=9.9.9.9, for="5.6.7.8:4711", for="[2001:db8::1]:80"`}, "5.6.7.8"},
+		{"10.1.1.1:1000", map[string]string{"Forwarded": `For="[2001:db9::1]"`}, "2001:db9::1"},
+		// obfuscated identifiers stop the evaluation at the last valid hop
+		{"10.1.1.1:1000", map[string]string{"Forwarded": "for=5.6.7.8, for=_hidden, for=10.2.2.2"}, "10.2.2.2"},
+		// Forwarded takes precedence
+		{"10.1.1.1:1000", map[string]string{"Forwarded": "for=5.6.7.8", "X-Forwarded-For": "9.9.9.9", "X-Real-IP": "8.8.8.8"}, "5.6.7.8"},
+		{"10.1.1.1:1000", map[string]string{"X-Forwarded-For": "9.9.9.9", "X-Real-IP": "8.8.8.8"}, "9.9.9.9"},
+	}
+	for i, test := range tests {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = test.remote
+		for key, value := range test.headers {
+			request.Header.Set(key, value)
+		}
+		if client := proxies.ClientAddress(request); client != test.client {
+			t.Errorf("Test %d: expected client %s, got %s", i, test.client, client)
+		}
+	}
+}
+
+func TestProxyListHandler(t *testing.T) {
+	proxies, err := ParseProxyList([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remote string
+	handler := proxies.Handler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		remote = request.RemoteAddr
+	}))
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.RemoteAddr = "10.1.1.1:1000"
+	request.Header.Set("X-Forwarded-For", "5.6.7.8")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	if remote != "5.6.7.8" {
+		t.Errorf("Expected forwarded remote address 5.6.7.8, got %s", remote)
+	}
+	if request.RemoteAddr != "10.1.1.1:1000" {
+		t.Errorf("Original request was modified")
+	}
+
+	request = httptest.NewRequest("GET", "/", nil)
+	request.RemoteAddr = "1.2.3.4:1000"
+	request.Header.Set("X-Forwarded-For", "5.6.7.8")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	if remote != "1.2.3.4:1000" {
+		t.Errorf("Expected unchanged remote address 1.2.3.4:1000, got %s", remote)
+	}
+}
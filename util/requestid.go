@@ -0,0 +1,62 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// RequestIdHeader is the HTTP header that carries the request ID.
+	RequestIdHeader = "X-Request-Id"
+	// maxRequestIdLength is the maximum length of request IDs accepted from clients.
+	maxRequestIdLength = 128
+)
+
+// requestCounter makes fallback request IDs unique
+var requestCounter uint64
+
+// NewRequestId generates a random request ID.
+func NewRequestId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// the system random number generator failed, settle for something unique
+		return strconv.FormatInt(time.Now().UnixNano(), 16) + "-" + strconv.FormatUint(atomic.AddUint64(&requestCounter, 1), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// RequestId returns the ID of a request.
+// If the client sent a valid X-Request-Id header, it is used. Otherwise, a new ID is generated.
+func RequestId(request *http.Request) string {
+	id := request.Header.Get(RequestIdHeader)
+	if len(id) == 0 || len(id) > maxRequestIdLength {
+		return NewRequestId()
+	}
+	for i := 0; i < len(id); i++ {
+		// only allow printable ASCII, to keep logs clean
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return NewRequestId()
+		}
+	}
+	return id
+}
@@ -0,0 +1,47 @@
+/* Copyright (c) 2023 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestId(t *testing.T) {
+	request := httptest.NewRequest("GET", "/stream.ts", nil)
+	generated := RequestId(request)
+	if len(generated) != 32 {
+		t.Errorf("Invalid generated request ID: %s", generated)
+	}
+	if RequestId(request) == generated {
+		t.Errorf("Generated request IDs are not unique")
+	}
+
+	request.Header.Set(RequestIdHeader, "client-id-1")
+	if id := RequestId(request); id != "client-id-1" {
+		t.Errorf("Client request ID not honored: %s", id)
+	}
+	request.Header.Set(RequestIdHeader, "bad id")
+	if id := RequestId(request); id == "bad id" {
+		t.Errorf("Invalid client request ID accepted")
+	}
+	request.Header.Set(RequestIdHeader, strings.Repeat("a", maxRequestIdLength+1))
+	if id := RequestId(request); len(id) != 32 {
+		t.Errorf("Overlong client request ID accepted")
+	}
+}
@@ -36,3 +36,9 @@ const (
 func RegisterUserSignalHandler(notify chan os.Signal) {
 	signal.Notify(notify, UserSignal)
 }
+
+// RegisterShutdownSignalHandler registers a process signal handler that
+// notifies on external termination requests, like SIGINT and SIGTERM on Unix.
+func RegisterShutdownSignalHandler(notify chan os.Signal) {
+	signal.Notify(notify, os.Interrupt, syscall.SIGTERM)
+}
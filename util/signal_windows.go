@@ -20,6 +20,7 @@ package util
 
 import (
 	"os"
+	"os/signal"
 )
 
 const (
@@ -34,3 +35,9 @@ const (
 func RegisterUserSignalHandler(notify chan os.Signal) {
 	// Unsupported on MS Windows
 }
+
+// RegisterShutdownSignalHandler registers a process signal handler that
+// notifies on external termination requests, like Ctrl+C on Microsoft Windows.
+func RegisterShutdownSignalHandler(notify chan os.Signal) {
+	signal.Notify(notify, os.Interrupt)
+}